@@ -43,6 +43,9 @@ fn print_rag_config(config: &Config) {
         nucleus_core::config::StorageMode::Grpc { url } => {
             println!("  Storage: Remote gRPC @ {}", url);
         }
+        nucleus_core::config::StorageMode::Memory { max_documents } => {
+            println!("  Storage: In-memory (max {} documents)", max_documents);
+        }
     }
     println!("  Collection: {}", config.storage.vector_db.collection_name);
     println!("  Embedding: {}", config.rag.as_ref().unwrap().embedding_model.name);
@@ -55,9 +58,9 @@ async fn index_example_directory(manager: &ChatManager) {
 
     let path = Path::new("./nucleus-core/src");
     match manager.index_directory(path).await {
-        Ok(count) => {
+        Ok(result) => {
             let total = manager.knowledge_base_count().await;
-            println!("\n✓ Indexed {} files ({} total documents)\n", count, total);
+            println!("\n✓ {} ({} total documents)\n", result, total);
         }
         Err(e) => {
             eprintln!("⚠ Could not index directory: {}", e);
@@ -94,6 +97,12 @@ fn print_summary(config: &Config, doc_count: usize) {
                 config.storage.vector_db.collection_name, url
             );
         }
+        nucleus_core::config::StorageMode::Memory { .. } => {
+            println!(
+                "Collection '{}' in memory (not persisted)",
+                config.storage.vector_db.collection_name
+            );
+        }
     }
     println!("{} documents indexed", doc_count);
     println!("Data persists across restarts");
@@ -1,5 +1,6 @@
 // The initial indexing in this example can take a few minutes
 
+use nucleus::chat::render_tool_log;
 use nucleus::{ChatManagerBuilder, Config};
 use nucleus_plugin::{Permission, PluginRegistry};
 
@@ -68,6 +69,12 @@ async fn main() {
         if input == "exit" || input == "quit" {
             break;
         }
+        // Show the tools the model has called so far
+        if input.trim() == "/tool-log" {
+            println!("{}\n", render_tool_log(&manager.tool_log()));
+            input.clear();
+            continue;
+        }
 
         manager
             .query_stream(None, &input, |chunk| {
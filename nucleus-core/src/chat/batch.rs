@@ -0,0 +1,78 @@
+//! Answering a list of questions in one run.
+//!
+//! Questions are answered one after another, in order, through the same
+//! retrieval and chat path as a single query, so the model stays loaded and
+//! the embedding and retrieval caches are shared across the batch.
+
+use crate::rag::SearchResult;
+use serde::Serialize;
+
+/// The answer to one question of a batch.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct BatchAnswer {
+    pub question: String,
+    pub answer: String,
+    /// Distinct sources of the context used for the answer, best first.
+    pub sources: Vec<String>,
+    /// Why the question couldn't be answered. The rest of the batch still runs.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl BatchAnswer {
+    pub fn answered(question: &str, answer: String, sources: Vec<String>) -> Self {
+        Self {
+            question: question.to_string(),
+            answer,
+            sources,
+            error: None,
+        }
+    }
+
+    pub fn failed(question: &str, sources: Vec<String>, error: impl ToString) -> Self {
+        Self {
+            question: question.to_string(),
+            answer: String::new(),
+            sources,
+            error: Some(error.to_string()),
+        }
+    }
+}
+
+/// Reads one question per line. Blank lines and lines starting with `#` are
+/// skipped.
+pub fn parse_questions(text: &str) -> Vec<String> {
+    text.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(str::to_string)
+        .collect()
+}
+
+/// Distinct `source` metadata of retrieved results, in result order.
+pub(crate) fn context_sources(results: &[SearchResult]) -> Vec<String> {
+    let mut sources: Vec<String> = Vec::new();
+    for source in results
+        .iter()
+        .filter_map(|result| result.document.metadata.get("source"))
+    {
+        if !sources.contains(source) {
+            sources.push(source.clone());
+        }
+    }
+    sources
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_questions_skips_blanks_and_comments() {
+        let text = "# FAQ\nHow do I index a directory?\n\n  What is top_k?  \n# later\nWhy?\n";
+        assert_eq!(
+            parse_questions(text),
+            vec!["How do I index a directory?", "What is top_k?", "Why?"]
+        );
+    }
+}
@@ -0,0 +1,23 @@
+//! Typed events emitted while a chat turn runs.
+//!
+//! Front-ends that want to show tool activity separately from model text can
+//! consume these through [`ChatManager::query_events`](super::ChatManager::query_events).
+
+use serde_json::Value;
+
+/// Something that happened during a chat turn.
+#[derive(Debug, Clone, PartialEq)]
+pub enum ChatEvent {
+    /// A chunk of streamed model text.
+    Token { text: String },
+    /// The model asked for a tool and it is about to run.
+    ToolCallStart { name: String, arguments: Value },
+    /// A tool finished, or was denied before running.
+    ToolResult {
+        name: String,
+        content: String,
+        denied: bool,
+    },
+    /// The turn is complete. `content` is the full final response.
+    Done { content: String },
+}
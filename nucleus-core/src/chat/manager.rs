@@ -27,16 +27,23 @@
 //! while the final `done=true` chunk contains no tool calls. The manager
 //! preserves tool calls from any chunk to ensure they're not lost.
 
+use super::batch::{self, BatchAnswer};
+use super::events::ChatEvent;
+use super::options::QueryOptions;
+use super::plan::{ToolPlan, PLAN_APPROVED, PLAN_INSTRUCTION};
+use super::prompt::{render_messages, trim_conversation, PromptParts};
+use super::thinking::ThinkingFilter;
+use super::tool_log::{ToolLog, ToolLogEntry};
 use crate::config::Config;
 use crate::models::EmbeddingModel;
 use crate::provider::{
     create_provider, ChatRequest, ChatResponse, Message, Provider, ProviderType, StructuredOutput,
     Tool, ToolCall, ToolFunction,
 };
-use crate::rag::RagEngine;
+use crate::rag::{IndexResult, RagEngine};
 use anyhow::{Context, Result};
 use futures::future::join_all;
-use nucleus_plugin::{Permission, PluginRegistry};
+use nucleus_plugin::{ApprovalPolicy, Permission, PluginRegistry, ToolCache};
 use std::path::Path;
 use std::sync::Arc;
 use tracing::{debug, info};
@@ -88,6 +95,10 @@ pub struct ChatManager {
     rag_engine: Option<Arc<RagEngine>>,
     /// Optional JSON schema for forcing a structured JSON output
     pub structured_output: Option<StructuredOutput>,
+    /// Policy consulted before each tool call. `None` runs every call.
+    approval_policy: Option<Arc<ApprovalPolicy>>,
+    /// Tool calls made during this session, oldest first.
+    tool_log: ToolLog,
 }
 
 impl ChatManager {
@@ -176,7 +187,11 @@ impl ChatManager {
     /// # }
     /// ```
     pub async fn with_provider(mut self, provider: Arc<dyn Provider>) -> Result<Self> {
-        self.rag_engine = Some(Arc::new(RagEngine::new(&self.config, provider.clone()).await?));
+        if !self.config.rag_disabled() {
+            self.rag_engine = Some(Arc::new(
+                RagEngine::new(&self.config, provider.clone()).await?,
+            ));
+        }
         self.provider = provider;
         Ok(self)
     }
@@ -247,12 +262,12 @@ impl ChatManager {
     ///
     /// # Returns
     ///
-    /// The number of files successfully indexed.
+    /// A summary of the files indexed, skipped and failed.
     ///
     /// # Errors
     ///
     /// Returns an error if indexing fails.
-    pub async fn index_directory(&self, dir_path: &Path) -> Result<usize> {
+    pub async fn index_directory(&self, dir_path: &Path) -> Result<IndexResult> {
         match self.rag_engine.as_ref() {
             Some(engine) => engine.index_directory(dir_path).await.context("Failed to index directory"),
             None => Err(anyhow::anyhow!("RAG Engine not configured"))
@@ -280,7 +295,9 @@ impl ChatManager {
     /// # Arguments
     ///
     /// * `messages` - Optional custom conversation history. If provided, this replaces
-    ///   the default message preparation and uses the exact messages provided.
+    ///   the default message preparation and uses the exact messages provided,
+    ///   except that only the last `llm.max_history_turns` turns are kept and the
+    ///   oldest non-system messages are dropped to fit `llm.context_length`.
     /// * `user_message` - The user's question or prompt
     ///
     /// # Returns
@@ -324,6 +341,8 @@ impl ChatManager {
     /// 4. If no tool calls, return the response
     ///
     /// The loop ensures the LLM can chain multiple tool calls if needed.
+    /// Repeated calls to cacheable tools such as `read_file` are answered from
+    /// a cache that lasts for the query and is cleared by any mutating tool.
     pub async fn query(
         &self,
         messages: Option<&Vec<Message>>,
@@ -341,7 +360,9 @@ impl ChatManager {
     /// # Arguments
     ///
     /// * `messages` - Optional custom conversation history. If provided, this replaces
-    ///   the default message preparation and uses the exact messages provided.
+    ///   the default message preparation and uses the exact messages provided,
+    ///   except that only the last `llm.max_history_turns` turns are kept and the
+    ///   oldest non-system messages are dropped to fit `llm.context_length`.
     /// * `user_message` - The user's question or prompt
     /// * `on_chunk` - Callback invoked for each chunk of streaming content.
     ///   Receives the incremental content (not accumulated).
@@ -379,16 +400,234 @@ impl ChatManager {
     where
         F: FnMut(&str) + Send,
     {
-        let (context, mut messages) = match messages {
-            Some(messages) => (String::new(), messages.clone()),
-            None => self.prepare_messages(user_message).await,
+        self.query_events(messages, user_message, |event| {
+            if let ChatEvent::Token { text } = event {
+                on_chunk(&text);
+            }
+        })
+        .await
+    }
+
+    /// Send a query to the LLM and report progress as typed [`ChatEvent`]s.
+    ///
+    /// Emits a [`ChatEvent::Token`] for each chunk of streamed text, a
+    /// [`ChatEvent::ToolCallStart`] and [`ChatEvent::ToolResult`] around every
+    /// tool call, and a final [`ChatEvent::Done`]. [`query_stream`](Self::query_stream)
+    /// is this with a handler that only forwards tokens.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// # use nucleus_core::{ChatManager, Config};
+    /// # use nucleus_core::chat::ChatEvent;
+    /// # use nucleus_plugin::{PluginRegistry, Permission};
+    /// # async fn example() -> anyhow::Result<()> {
+    /// # let manager = ChatManager::new(Config::load_or_default(), PluginRegistry::new(Permission::READ_ONLY)).await?;
+    /// manager.query_events(None, "What's in Cargo.toml?", |event| match event {
+    ///     ChatEvent::Token { text } => print!("{}", text),
+    ///     ChatEvent::ToolCallStart { name, .. } => println!("\n[calling {}…]", name),
+    ///     _ => {}
+    /// }).await?;
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn query_events<F>(
+        &self,
+        messages: Option<&Vec<Message>>,
+        user_message: &str,
+        on_event: F,
+    ) -> Result<String>
+    where
+        F: FnMut(ChatEvent) + Send,
+    {
+        self.query_with_options(messages, user_message, &QueryOptions::default(), on_event)
+            .await
+    }
+
+    /// Like [`query_events`](Self::query_events), with per-query [`QueryOptions`]
+    /// taking precedence over the configuration.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// # use nucleus_core::{ChatManager, Config};
+    /// # use nucleus_core::chat::QueryOptions;
+    /// # use nucleus_plugin::{PluginRegistry, Permission};
+    /// # async fn example() -> anyhow::Result<()> {
+    /// # let manager = ChatManager::new(Config::load_or_default(), PluginRegistry::new(Permission::READ_ONLY)).await?;
+    /// let options = QueryOptions::new().with_max_tokens(200);
+    /// let response = manager
+    ///     .query_with_options(None, "Summarize the README", &options, |_| {})
+    ///     .await?;
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn query_with_options<F>(
+        &self,
+        messages: Option<&Vec<Message>>,
+        user_message: &str,
+        options: &QueryOptions,
+        on_event: F,
+    ) -> Result<String>
+    where
+        F: FnMut(ChatEvent) + Send,
+    {
+        let (context, messages) = match messages {
+            Some(messages) => {
+                let mut messages = messages.clone();
+                trim_conversation(
+                    &mut messages,
+                    self.config.llm.max_history_turns,
+                    self.config.llm.context_length,
+                );
+                (String::new(), messages)
+            }
+            None => {
+                let prepared = self
+                    .prepare_messages(user_message, options.rag.unwrap_or(true))
+                    .await;
+                (prepared.context, prepared.messages)
+            }
         };
 
+        self.run_turn(context, messages, options, on_event).await
+    }
+
+    /// Asks the model for a plan of the tool calls it intends to make, and
+    /// only runs the tool loop once `approve` accepts the plan.
+    ///
+    /// The planning request advertises the same tools as [`query`](Self::query)
+    /// but nothing is executed: calls the model makes while planning become
+    /// part of the [`ToolPlan`]. Once approved, the plan is kept in the
+    /// conversation and the turn runs as usual, reporting through `on_event`.
+    ///
+    /// # Returns
+    ///
+    /// The final response, or `None` if the plan was rejected.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// # use nucleus_core::{ChatManager, Config};
+    /// # use nucleus_plugin::{PluginRegistry, Permission};
+    /// # use std::io::{self, Write};
+    /// # async fn example() -> anyhow::Result<()> {
+    /// # let manager = ChatManager::new(Config::load_or_default(), PluginRegistry::new(Permission::ALL)).await?;
+    /// let approve = |plan: &nucleus_core::chat::ToolPlan| {
+    ///     print!("{}\nRun this plan? [y/n] ", plan);
+    ///     io::stdout().flush().unwrap();
+    ///     let mut answer = String::new();
+    ///     io::stdin().read_line(&mut answer).is_ok() && answer.trim() == "y"
+    /// };
+    /// match manager.query_planned("Rename the config module", approve, |_| {}).await? {
+    ///     Some(response) => println!("{}", response),
+    ///     None => println!("Plan rejected, nothing was changed"),
+    /// }
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn query_planned<A, F>(
+        &self,
+        user_message: &str,
+        approve: A,
+        on_event: F,
+    ) -> Result<Option<String>>
+    where
+        A: FnOnce(&ToolPlan) -> bool + Send,
+        F: FnMut(ChatEvent) + Send,
+    {
+        let prepared = self.prepare_messages(user_message, true).await;
+        let mut messages = prepared.messages;
+        messages.push(Message::user(None, PLAN_INSTRUCTION));
+
+        let mut request = ChatRequest::new(&self.config.llm.model, messages.clone())
+            .with_temperature(self.config.llm.temperature);
         let tools = self.build_tools().await;
+        if !tools.is_empty() {
+            request.tools = Some(tools);
+        }
+
+        let reply = self.process_response_stream(request, |_| {}).await?;
+        let plan = ToolPlan::from_message(&reply);
+        if !approve(&plan) {
+            info!("Tool plan rejected, no tools were run");
+            return Ok(None);
+        }
+
+        messages.push(Message::assistant(
+            Some(prepared.context.clone()),
+            plan.to_string(),
+        ));
+        messages.push(Message::user(None, PLAN_APPROVED));
+        self.run_turn(
+            prepared.context,
+            messages,
+            &QueryOptions::default(),
+            on_event,
+        )
+        .await
+        .map(Some)
+    }
+
+    /// Answers each question in order through the same retrieval and chat
+    /// path as [`query`](Self::query).
+    ///
+    /// Questions run one at a time so they share the loaded model and the
+    /// retrieval caches. A failed question is reported in its
+    /// [`BatchAnswer::error`] and the rest still run.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// # use nucleus_core::{ChatManager, Config};
+    /// # use nucleus_core::chat::parse_questions;
+    /// # use nucleus_plugin::{PluginRegistry, Permission};
+    /// # async fn example() -> anyhow::Result<()> {
+    /// # let manager = ChatManager::new(Config::load_or_default(), PluginRegistry::new(Permission::READ_ONLY)).await?;
+    /// let questions = parse_questions(&std::fs::read_to_string("faq.txt")?);
+    /// let answers = manager.query_batch(&questions).await;
+    /// println!("{}", serde_json::to_string_pretty(&answers)?);
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn query_batch(&self, questions: &[String]) -> Vec<BatchAnswer> {
+        let options = QueryOptions::default();
+        let mut answers = Vec::with_capacity(questions.len());
+
+        for question in questions {
+            let prepared = self.prepare_messages(question, true).await;
+            let answer = match self
+                .run_turn(prepared.context, prepared.messages, &options, |_| {})
+                .await
+            {
+                Ok(answer) => BatchAnswer::answered(question, answer, prepared.sources),
+                Err(e) => BatchAnswer::failed(question, prepared.sources, e),
+            };
+            answers.push(answer);
+        }
+
+        answers
+    }
+
+    /// Runs one turn from prepared messages, executing tool calls until the
+    /// model gives a final response.
+    async fn run_turn<F>(
+        &self,
+        context: String,
+        mut messages: Vec<Message>,
+        options: &QueryOptions,
+        mut on_event: F,
+    ) -> Result<String>
+    where
+        F: FnMut(ChatEvent) + Send,
+    {
+        let tools = self.build_tools().await;
+        let mut tool_cache = ToolCache::new();
 
         loop {
             let mut request = ChatRequest::new(&self.config.llm.model, messages.clone())
-                .with_temperature(self.config.llm.temperature);
+                .with_temperature(self.config.llm.temperature)
+                .with_max_tokens(options.max_tokens.or(self.config.llm.max_tokens));
 
             if !tools.is_empty() {
                 request.tools = Some(tools.clone());
@@ -398,7 +637,13 @@ impl ChatManager {
                 request = request.with_structured_output(structured_output.clone());
             }
 
-            let assistant_message = self.process_response_stream(request, &mut on_chunk).await?;
+            let assistant_message = self
+                .process_response_stream(request, |chunk| {
+                    on_event(ChatEvent::Token {
+                        text: chunk.to_string(),
+                    })
+                })
+                .await?;
 
             if let Some(tool_calls) = assistant_message.tool_calls {
                 let mut new_messages = messages.clone();
@@ -408,34 +653,198 @@ impl ChatManager {
                     content: assistant_message.content.clone(),
                     images: None,
                     tool_calls: Some(tool_calls.clone()),
+                    tool_name: None,
+                    tool_call_id: None,
                 });
 
                 for tool_call in tool_calls {
+                    if let Some(correction) = self.tool_call_correction(&tool_call) {
+                        info!(tool_name = %tool_call.function.name, "Tool call not run");
+                        self.log_tool_call(&tool_call, &correction, false);
+                        on_event(ChatEvent::ToolResult {
+                            name: tool_call.function.name.clone(),
+                            content: correction.clone(),
+                            denied: false,
+                        });
+                        new_messages.push(Message::tool_result(
+                            Some(context.clone()),
+                            &tool_call,
+                            correction,
+                        ));
+                        continue;
+                    }
+
+                    if !self.is_tool_call_approved(&tool_call).await {
+                        info!(tool_name = %tool_call.function.name, "Tool call denied");
+                        let denial = format!(
+                            "The call to '{}' was denied by the user.",
+                            tool_call.function.name
+                        );
+                        self.log_tool_call(&tool_call, &denial, true);
+                        on_event(ChatEvent::ToolResult {
+                            name: tool_call.function.name.clone(),
+                            content: denial.clone(),
+                            denied: true,
+                        });
+                        new_messages.push(Message::tool_result(
+                            Some(context.clone()),
+                            &tool_call,
+                            denial,
+                        ));
+                        continue;
+                    }
+
+                    on_event(ChatEvent::ToolCallStart {
+                        name: tool_call.function.name.clone(),
+                        arguments: tool_call.function.arguments.clone(),
+                    });
+
                     let result = self
                         .registry
-                        .execute(
+                        .execute_cached(
+                            &mut tool_cache,
                             &tool_call.function.name,
                             tool_call.function.arguments.clone(),
                         )
-                        .await?;
-
-                    new_messages.push(Message {
-                        role: "tool".to_string(),
-                        context: Some(context.clone()),
-                        content: result.content,
-                        images: None,
-                        tool_calls: None,
+                        .await
+                        .map_err(|e| {
+                            self.log_tool_call(&tool_call, &e.to_string(), false);
+                            e
+                        })?;
+                    self.log_tool_call(&tool_call, &result.content, false);
+
+                    on_event(ChatEvent::ToolResult {
+                        name: tool_call.function.name.clone(),
+                        content: result.content.clone(),
+                        denied: false,
                     });
+
+                    new_messages.push(Message::tool_result(
+                        Some(context.clone()),
+                        &tool_call,
+                        result.content,
+                    ));
                 }
 
                 messages = new_messages;
                 continue;
             }
 
+            on_event(ChatEvent::Done {
+                content: assistant_message.content.clone(),
+            });
             return Ok(assistant_message.content);
         }
     }
 
+    /// Every tool call the model has made through this manager, oldest first,
+    /// with its arguments and a summary of its result.
+    ///
+    /// Unlike an audit log this is only kept in memory, for looking into what
+    /// an agent did during the session. See [`render_tool_log`](super::render_tool_log).
+    pub fn tool_log(&self) -> Vec<ToolLogEntry> {
+        self.tool_log.entries()
+    }
+
+    /// Forgets the tool calls recorded so far.
+    pub fn clear_tool_log(&self) {
+        self.tool_log.clear();
+    }
+
+    fn log_tool_call(&self, tool_call: &ToolCall, result: &str, denied: bool) {
+        self.tool_log.record(ToolLogEntry::new(
+            &tool_call.function.name,
+            &tool_call.function.arguments,
+            result,
+            denied,
+        ));
+    }
+
+    /// Shows the prompt that would be sent for `user_message` without generating.
+    ///
+    /// Runs the same retrieval and prompt assembly as [`query`](Self::query) and
+    /// returns the composed messages rendered as text: the system prompt, the
+    /// retrieved context block and the final user message.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// # use nucleus_core::{ChatManager, Config};
+    /// # use nucleus_plugin::{PluginRegistry, Permission};
+    /// # async fn example() -> anyhow::Result<()> {
+    /// # let manager = ChatManager::new(Config::load_or_default(), PluginRegistry::new(Permission::READ_ONLY)).await?;
+    /// println!("{}", manager.explain("Why is indexing slow?").await);
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn explain(&self, user_message: &str) -> String {
+        let prepared = self.prepare_messages(user_message, true).await;
+        render_messages(&prepared.messages)
+    }
+
+    /// The reply to a call that can't be run, given to the model in place of
+    /// a result: the tool is unknown, or an argument is over the registry's
+    /// size limit.
+    fn tool_call_correction(&self, tool_call: &ToolCall) -> Option<String> {
+        if let Some(correction) = self.unknown_tool_correction(tool_call) {
+            return Some(correction);
+        }
+        let checked = self
+            .registry
+            .check_arguments(&tool_call.function.name, &tool_call.function.arguments);
+        checked.err().map(|e| {
+            format!(
+                "{}. The tool was not run; call it with smaller arguments, \
+                 or answer without it.",
+                e
+            )
+        })
+    }
+
+    /// The reply to a call of a tool that isn't registered or is disabled.
+    ///
+    /// Names the tools that can be called so the model can retry with a valid
+    /// one instead of the query failing with an unknown plugin error.
+    fn unknown_tool_correction(&self, tool_call: &ToolCall) -> Option<String> {
+        if self.registry.get(&tool_call.function.name).is_some() {
+            return None;
+        }
+
+        let available = self.registry.names();
+        let listed = if available.is_empty() {
+            "none".to_string()
+        } else {
+            available.join(", ")
+        };
+        Some(format!(
+            "There is no tool named '{}'. Available tools: {}. \
+             Call one of these instead, or answer without a tool.",
+            tool_call.function.name, listed
+        ))
+    }
+
+    /// Checks a tool call against the approval policy, if one is set.
+    ///
+    /// Unknown tools are let through so the registry can report them.
+    async fn is_tool_call_approved(&self, tool_call: &ToolCall) -> bool {
+        let Some(policy) = &self.approval_policy else {
+            return true;
+        };
+
+        let required = match self.registry.get(&tool_call.function.name) {
+            Some(plugin) => plugin.lock().await.required_permission(),
+            None => return true,
+        };
+
+        policy
+            .approve(
+                &tool_call.function.name,
+                &required,
+                &tool_call.function.arguments,
+            )
+            .await
+    }
+
     /// Converts registered plugins into tool definitions.
     ///
     /// Transforms plugins from the registry into the JSON schema format
@@ -463,64 +872,74 @@ impl ChatManager {
 
     /// Prepare initial messages with RAG context.
     ///
-    /// Retrieves relevant context from the knowledge base and constructs
-    /// the initial user message with enhanced context if available.
+    /// Retrieves relevant context from the knowledge base and assembles the
+    /// system prompt and user message around it. If the result would exceed
+    /// `llm.context_length`, the lowest-scored context chunks are dropped first.
     ///
     /// # Arguments
     ///
     /// * `user_message` - The original user query
+    /// * `use_rag` - Whether to retrieve context at all
     ///
     /// # Returns
     ///
     /// A tuple of (context, messages) where context is the retrieved RAG context
-    /// and messages is a vector containing the initial user message.
-    async fn prepare_messages(&self, user_message: &str) -> (String, Vec<Message>) {
-        let (rag_count, context) = match self.rag_engine.as_ref() {
+    /// and messages is the assembled system and user messages.
+    async fn prepare_messages(&self, user_message: &str, use_rag: bool) -> PreparedPrompt {
+        let results = match self.rag_engine.as_ref() {
+            Some(_) if !use_rag => {
+                debug!("RAG disabled for this query, skipping context retrieval");
+                Vec::new()
+            }
             Some(engine) => {
-                let count = engine.count().await;
-                debug!("RAG knowledge base has {} documents", count);
-                
-                if count > 0 {
-                    debug!("Retrieving RAG context for query: {}", user_message);
-                    let ctx = engine
-                        .retrieve_context(user_message)
-                        .await
-                        .unwrap_or_else(|e| {
-                            debug!("Could not retrieve RAG context: {}", e);
-                            String::new()
-                        });
-                    (count, ctx)
+                let mut results = if engine.is_trivial_query(user_message) {
+                    debug!("Skipping retrieval for trivial query: {}", user_message);
+                    Vec::new()
                 } else {
-                    debug!("RAG knowledge base is empty, skipping context retrieval");
-                    (count, String::new())
-                }
+                    debug!("Retrieving RAG context for query: {}", user_message);
+                    engine.search(user_message).await.unwrap_or_else(|e| {
+                        debug!("Could not retrieve RAG context: {}", e);
+                        Vec::new()
+                    })
+                };
+                engine.limit_context(&mut results);
+                let mut results = engine.with_pinned(results);
+                let allow_commands = self.registry.granted_permissions().execute;
+                engine
+                    .annotate_citations(&mut results, allow_commands)
+                    .await;
+                results
             }
             None => {
                 debug!("RAG engine not configured, skipping context retrieval");
-                (0, String::new())
+                Vec::new()
             }
         };
 
-        let enhanced_message = if !context.is_empty() {
-            debug!(
-                "Enhanced message with {} characters of RAG context",
-                context.len()
-            );
-            format!("{}{}", context, user_message)
-        } else {
-            debug!("No RAG context available, using original message");
-            user_message.to_string()
-        };
+        let mut parts = PromptParts::new(&self.config.system_prompt, user_message)
+            .with_response_language(self.config.response_language.clone())
+            .with_system_suffix(&self.config.system_prompt_suffix)
+            .with_context(results);
+        parts.trim_to_fit(self.config.llm.context_length);
 
-        let messages = vec![Message::user(Some(context.clone()), &enhanced_message)];
+        let context = parts.context_block();
+        debug!(
+            "Prepared prompt with {} characters of RAG context",
+            context.len()
+        );
 
-        (context, messages)
+        PreparedPrompt {
+            context,
+            sources: batch::context_sources(&parts.context),
+            messages: parts.into_messages(),
+        }
     }
 
     /// Process LLM response stream and accumulate content.
     ///
     /// Handles streaming response chunks, accumulates content, and preserves
-    /// tool calls from any chunk in the stream.
+    /// tool calls from any chunk in the stream. Reasoning blocks are filtered
+    /// out of the content when `llm.thinking.strip` is on.
     ///
     /// # Arguments
     ///
@@ -541,14 +960,21 @@ impl ChatManager {
         let mut accumulated_content = String::new();
         let mut final_response: Option<ChatResponse> = None;
         let mut tool_calls: Option<Vec<ToolCall>> = None;
+        let mut thinking = ThinkingFilter::new(&self.config.llm.thinking);
 
         self.provider
             .chat(
                 request,
                 Box::new(|response| {
                     if !response.done && !response.content.is_empty() {
-                        on_chunk(&response.content);
-                        accumulated_content.push_str(&response.content);
+                        let text = match &mut thinking {
+                            Some(filter) => filter.push(&response.content),
+                            None => response.content.clone(),
+                        };
+                        if !text.is_empty() {
+                            on_chunk(&text);
+                            accumulated_content.push_str(&text);
+                        }
                     }
 
                     if let Some(ref calls) = response.message.tool_calls {
@@ -561,6 +987,13 @@ impl ChatManager {
             .await
             .context("Failed to get LLM response")?;
 
+        if let Some(rest) = thinking.map(|mut filter| filter.finish()) {
+            if !rest.is_empty() {
+                on_chunk(&rest);
+                accumulated_content.push_str(&rest);
+            }
+        }
+
         let mut response = final_response.context("No response from LLM")?;
         response.message.content = accumulated_content;
         response.message.tool_calls = tool_calls;
@@ -582,6 +1015,7 @@ impl ChatManager {
     /// The final LLM response after all tool executions are complete.
     async fn handle_tools(&self, messages: Vec<Message>, context: String) -> Result<String> {
         let tools = self.build_tools().await;
+        let mut tool_cache = ToolCache::new();
 
         let mut current_messages = messages;
         loop {
@@ -602,28 +1036,38 @@ impl ChatManager {
                     content: assistant_message.content.clone(),
                     images: None,
                     tool_calls: Some(tool_calls.clone()),
+                    tool_name: None,
+                    tool_call_id: None,
                 });
 
                 // Execute each requested tool
                 for tool_call in tool_calls {
                     let tool_name = &tool_call.function.name;
                     let tool_args = &tool_call.function.arguments;
+                    if let Some(correction) = self.tool_call_correction(tool_call) {
+                        info!(tool_name = %tool_name, "Tool call not run");
+                        current_messages.push(Message::tool_result(
+                            Some(context.to_string()),
+                            tool_call,
+                            correction,
+                        ));
+                        continue;
+                    }
+
                     info!(tool_name = %tool_name, "Executing tool");
 
                     let result = self
                         .registry
-                        .execute(tool_name, tool_args.clone())
+                        .execute_cached(&mut tool_cache, tool_name, tool_args.clone())
                         .await
                         .with_context(|| format!("Failed to execute tool: {}", tool_name))?;
 
                     // Add tool result to conversation
-                    current_messages.push(Message {
-                        role: "tool".to_string(),
-                        context: Some(context.to_string()),
-                        content: result.content,
-                        images: None,
-                        tool_calls: None,
-                    });
+                    current_messages.push(Message::tool_result(
+                        Some(context.to_string()),
+                        &tool_call,
+                        result.content,
+                    ));
                 }
 
                 // Continue loop to get LLM's response using tool results
@@ -635,6 +1079,15 @@ impl ChatManager {
     }
 }
 
+/// Messages ready to send for one query.
+struct PreparedPrompt {
+    /// The rendered context block, attached to assistant and tool messages.
+    context: String,
+    messages: Vec<Message>,
+    /// Sources of the context that made it into the prompt.
+    sources: Vec<String>,
+}
+
 /// Builder for configuring and creating a `ChatManager`.
 ///
 /// This builder provides a fluent API for customizing LLM and embedding models
@@ -683,6 +1136,7 @@ pub struct ChatManagerBuilder {
     embedding_model_override: Option<EmbeddingModel>,
     provider_type_override: Option<ProviderType>,
     structured_output: Option<StructuredOutput>,
+    approval_policy: Option<Arc<ApprovalPolicy>>,
 }
 
 impl ChatManagerBuilder {
@@ -697,6 +1151,8 @@ impl ChatManagerBuilder {
             embedding_model_override: None,
             provider_type_override: None,
             structured_output: None,
+            approval_policy: None,
+            tool_log: ToolLog::default(),
         }
     }
 
@@ -814,6 +1270,26 @@ impl ChatManagerBuilder {
         self
     }
 
+    /// Ask an [`ApprovalPolicy`] before each tool call.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// # use nucleus_core::ChatManagerBuilder;
+    /// # use nucleus_plugin::{ApprovalPolicy, Permission, StdinPrompter};
+    /// # async fn example() -> anyhow::Result<()> {
+    /// let manager = ChatManagerBuilder::new()
+    ///     .with_approval_policy(ApprovalPolicy::interactive(Permission::ALL, StdinPrompter))
+    ///     .build()
+    ///     .await?;
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub fn with_approval_policy(mut self, policy: ApprovalPolicy) -> Self {
+        self.approval_policy = Some(Arc::new(policy));
+        self
+    }
+
     /// Builds the `ChatManager` with the configured settings.
     ///
     /// This initializes the provider with the (possibly overridden) LLM model,
@@ -838,21 +1314,712 @@ impl ChatManagerBuilder {
         let provider = create_provider(&config, Arc::clone(&self.registry)).await?;
         let mut rag_engine = None;
 
-        if self.config.rag.clone().is_some() {
+        if let Some(rag) = config.rag.as_mut().filter(|rag| rag.enabled) {
             if let Some(embedding_model) = self.embedding_model_override {
-                config.rag.clone().unwrap().embedding_model = embedding_model;
+                rag.embedding_model = embedding_model;
             }
 
-            let rag_engine = Arc::new(RagEngine::new(&config, provider.clone()).await?);
+            rag_engine = Some(Arc::new(RagEngine::new(&config, provider.clone()).await?));
         }
 
-
         Ok(ChatManager {
             config,
             provider,
             registry: self.registry,
             rag_engine,
             structured_output: self.structured_output,
+            approval_policy: self.approval_policy,
+            tool_log: ToolLog::default(),
         })
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::provider::testing::{tool_call_message, ScriptedProvider};
+    use crate::rag::testing::{test_engine, MemoryStore};
+    use async_trait::async_trait;
+    use nucleus_plugin::{Plugin, PluginLoader, PluginOutput};
+    use serde_json::{json, Value};
+
+    /// Builds a manager around a fake provider without touching any backend.
+    fn test_manager(provider: Arc<dyn Provider>, registry: PluginRegistry) -> ChatManager {
+        ChatManager {
+            config: Config::default(),
+            provider,
+            registry: Arc::new(registry),
+            rag_engine: None,
+            structured_output: None,
+            approval_policy: None,
+            tool_log: ToolLog::default(),
+        }
+    }
+
+    struct ShoutPlugin;
+
+    #[async_trait]
+    impl Plugin for ShoutPlugin {
+        fn name(&self) -> &str {
+            "shout"
+        }
+
+        fn description(&self) -> &str {
+            "Uppercase the given text"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({
+                "type": "object",
+                "properties": { "text": { "type": "string" } },
+                "required": ["text"]
+            })
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        async fn execute(&self, input: Value) -> nucleus_plugin::Result<PluginOutput> {
+            let text = input["text"].as_str().unwrap_or_default();
+            Ok(PluginOutput::new(text.to_uppercase()))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_loaded_plugin_runs_in_tool_loop() {
+        let mut loader = PluginLoader::new();
+        loader.register_factory("shout", || ShoutPlugin);
+
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        loader
+            .load(&["shout".to_string()], &registry)
+            .await
+            .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            tool_call_message("shout", json!({ "text": "hello" })),
+            Message::assistant(None, "It says HELLO."),
+        ]));
+        let manager = test_manager(provider.clone(), registry);
+
+        let response = manager.query(None, "Shout hello").await.unwrap();
+        assert_eq!(response, "It says HELLO.");
+
+        let requests = provider.requests();
+        assert_eq!(requests.len(), 2);
+
+        let tools = requests[0].tools.as_ref().unwrap();
+        assert!(tools.iter().any(|tool| tool.function.name == "shout"));
+
+        let tool_result = requests[1].messages.last().unwrap();
+        assert_eq!(tool_result.role, "tool");
+        assert_eq!(tool_result.content, "HELLO");
+        assert_eq!(tool_result.tool_name.as_deref(), Some("shout"));
+    }
+
+    struct WhisperPlugin;
+
+    #[async_trait]
+    impl Plugin for WhisperPlugin {
+        fn name(&self) -> &str {
+            "whisper"
+        }
+
+        fn description(&self) -> &str {
+            "Lowercase the given text"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({
+                "type": "object",
+                "properties": { "text": { "type": "string" } },
+                "required": ["text"]
+            })
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        async fn execute(&self, input: Value) -> nucleus_plugin::Result<PluginOutput> {
+            let text = input["text"].as_str().unwrap_or_default();
+            Ok(PluginOutput::new(text.to_lowercase()))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_each_tool_result_names_its_tool() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        assert!(registry.register(ShoutPlugin).await);
+        assert!(registry.register(WhisperPlugin).await);
+
+        let call = |id: &str, name: &str, text: &str| ToolCall {
+            id: Some(id.to_string()),
+            function: crate::provider::ToolCallFunction {
+                name: name.to_string(),
+                arguments: json!({ "text": text }),
+            },
+        };
+        let mut two_calls = Message::assistant(None, "");
+        two_calls.tool_calls = Some(vec![
+            call("call_1", "whisper", "QUIET"),
+            call("call_2", "shout", "loud"),
+        ]);
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            two_calls,
+            Message::assistant(None, "quiet and LOUD"),
+        ]));
+        let manager = test_manager(provider.clone(), registry);
+
+        manager.query(None, "Say it both ways").await.unwrap();
+
+        let requests = provider.requests();
+        let results: Vec<_> = requests[1]
+            .messages
+            .iter()
+            .filter(|message| message.role == "tool")
+            .map(|message| {
+                (
+                    message.tool_name.as_deref().unwrap(),
+                    message.tool_call_id.as_deref().unwrap(),
+                    message.content.as_str(),
+                )
+            })
+            .collect();
+        assert_eq!(
+            results,
+            vec![("whisper", "call_1", "quiet"), ("shout", "call_2", "LOUD")]
+        );
+    }
+
+    /// Counts its executions, to check when tools run.
+    struct CountingPlugin(Arc<std::sync::atomic::AtomicUsize>);
+
+    #[async_trait]
+    impl Plugin for CountingPlugin {
+        fn name(&self) -> &str {
+            "count"
+        }
+
+        fn description(&self) -> &str {
+            "Counts how often it runs"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({ "type": "object", "properties": {} })
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        async fn execute(&self, _input: Value) -> nucleus_plugin::Result<PluginOutput> {
+            let runs = self.0.fetch_add(1, std::sync::atomic::Ordering::SeqCst) + 1;
+            Ok(PluginOutput::new(runs.to_string()))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_plan_mode_runs_no_tools_until_approved() {
+        use std::sync::atomic::{AtomicUsize, Ordering};
+
+        for approved in [false, true] {
+            let runs = Arc::new(AtomicUsize::new(0));
+            let registry = PluginRegistry::new(Permission::READ_ONLY);
+            assert!(registry.register(CountingPlugin(runs.clone())).await);
+            let provider = Arc::new(ScriptedProvider::new(vec![
+                tool_call_message("count", json!({})),
+                tool_call_message("count", json!({})),
+                Message::assistant(None, "Counted once"),
+            ]));
+            let manager = test_manager(provider.clone(), registry);
+
+            let mut shown = None;
+            let response = manager
+                .query_planned(
+                    "Count",
+                    |plan| {
+                        shown = Some(plan.to_string());
+                        runs.load(Ordering::SeqCst) == 0 && approved
+                    },
+                    |_| {},
+                )
+                .await
+                .unwrap();
+
+            assert_eq!(shown.as_deref(), Some("1. count {}"));
+            let planning = &provider.requests()[0];
+            assert!(planning.tools.is_some());
+            assert_eq!(planning.messages.last().unwrap().content, PLAN_INSTRUCTION);
+            if approved {
+                assert_eq!(response.as_deref(), Some("Counted once"));
+                assert_eq!(runs.load(Ordering::SeqCst), 1);
+            } else {
+                assert_eq!(response, None);
+                assert_eq!(runs.load(Ordering::SeqCst), 0);
+                assert_eq!(provider.requests().len(), 1);
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_unknown_tool_call_is_answered_with_available_tools() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        assert!(registry.register(ShoutPlugin).await);
+        assert!(registry.register(WhisperPlugin).await);
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            tool_call_message("yell", json!({ "text": "hi" })),
+            tool_call_message("shout", json!({ "text": "hi" })),
+            Message::assistant(None, "HI"),
+        ]));
+        let manager = test_manager(provider.clone(), registry);
+
+        let reply = manager.query(None, "Say hi loudly").await.unwrap();
+
+        assert_eq!(reply, "HI");
+        let requests = provider.requests();
+        let correction = requests[1].messages.last().unwrap();
+        assert_eq!(correction.role, "tool");
+        assert_eq!(correction.tool_name.as_deref(), Some("yell"));
+        assert!(correction.content.contains("no tool named 'yell'"));
+        assert!(correction
+            .content
+            .contains("Available tools: shout, whisper."));
+    }
+
+    #[tokio::test]
+    async fn test_oversized_tool_argument_is_answered_with_size_error() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY).with_max_argument_bytes(8);
+        registry.register(ShoutPlugin).await;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            tool_call_message("shout", json!({ "text": "a very long message" })),
+            Message::assistant(None, "Too long"),
+        ]));
+        let manager = test_manager(provider.clone(), registry);
+
+        let reply = manager.query(None, "Shout this").await.unwrap();
+
+        assert_eq!(reply, "Too long");
+        let result = provider.requests()[1].messages.last().unwrap().clone();
+        assert_eq!(result.role, "tool");
+        assert!(result
+            .content
+            .starts_with("Argument too large: 'text' of shout is 19 bytes, the limit is 8 bytes."));
+        assert!(!result.content.contains("A VERY LONG MESSAGE"));
+    }
+
+    #[tokio::test]
+    async fn test_explain_shows_assembled_prompt_without_generating() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine
+            .add_knowledge(
+                "The indexer splits files into 512 byte chunks",
+                "indexer.md",
+            )
+            .await
+            .unwrap();
+
+        let mut manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE))
+            .with_rag(Arc::new(engine));
+        manager.config.system_prompt = "You are a test assistant.".to_string();
+
+        let explained = manager.explain("How big are chunks?").await;
+
+        assert!(explained.contains("--- system ---\nYou are a test assistant."));
+        assert!(explained.contains("Relevant context from your knowledge base"));
+        assert!(explained.contains("512 byte chunks"));
+        assert!(explained.trim_end().ends_with("How big are chunks?"));
+        assert!(provider.requests().is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_pinned_file_accompanies_unrelated_queries() {
+        let dir = tempfile::tempdir().unwrap();
+        let conventions = dir.path().join("CONVENTIONS.md");
+        std::fs::write(&conventions, "Errors are thiserror enums.").unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine.pin(&conventions).await.unwrap();
+        let manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE))
+            .with_rag(Arc::new(engine));
+
+        let explained = manager.explain("What's the weather like?").await;
+
+        assert!(explained.contains("Relevant context from your knowledge base"));
+        assert!(explained.contains("Errors are thiserror enums."));
+    }
+
+    #[tokio::test]
+    async fn test_rag_can_be_turned_off_per_query() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine
+            .add_knowledge("Channels in this codebase wrap tokio mpsc", "notes.md")
+            .await
+            .unwrap();
+        let manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE))
+            .with_rag(Arc::new(engine));
+
+        let question = "What is the syntax for a channel?";
+        let without = QueryOptions::new().with_rag(false);
+        manager
+            .query_with_options(None, question, &without, |_| {})
+            .await
+            .unwrap();
+        manager
+            .query_with_options(None, question, &QueryOptions::new(), |_| {})
+            .await
+            .unwrap();
+
+        let requests = provider.requests();
+        let general = requests[0].messages.last().unwrap();
+        assert_eq!(general.content, question);
+        assert_eq!(general.context, None);
+        let grounded = requests[1].messages.last().unwrap();
+        assert!(grounded.content.contains("wrap tokio mpsc"));
+    }
+
+    #[tokio::test]
+    async fn test_trivial_query_skips_retrieval() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine
+            .add_knowledge("Channels in this codebase wrap tokio mpsc", "notes.md")
+            .await
+            .unwrap();
+        let manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE))
+            .with_rag(Arc::new(engine));
+        let embeds = provider.embed_calls();
+
+        manager
+            .query_with_options(None, "Thanks!", &QueryOptions::new(), |_| {})
+            .await
+            .unwrap();
+
+        assert_eq!(provider.embed_calls(), embeds);
+        let sent = provider.requests()[0].messages.last().unwrap().clone();
+        assert_eq!(sent.content, "Thanks!");
+    }
+
+    #[tokio::test]
+    async fn test_history_is_trimmed_to_context_length() {
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None, "Done",
+        )]));
+        let mut manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE));
+        manager.config.llm.context_length = 40;
+        let conversation = vec![
+            Message::user(None, "a".repeat(200)),
+            Message::assistant(None, "b".repeat(200)),
+            Message::user(None, "What changed?"),
+            Message::assistant(None, "The parser."),
+            Message::user(None, "Why?"),
+        ];
+
+        manager.query(Some(&conversation), "Why?").await.unwrap();
+
+        let sent: Vec<String> = provider.requests()[0]
+            .messages
+            .iter()
+            .map(|message| message.content.clone())
+            .collect();
+        assert_eq!(sent, vec!["What changed?", "The parser.", "Why?"]);
+    }
+
+    #[tokio::test]
+    async fn test_history_keeps_last_turns() {
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None, "Done",
+        )]));
+        let mut manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE));
+        manager.config.llm.max_history_turns = 1;
+        let conversation = vec![
+            Message::user(None, "Open the parser"),
+            Message::assistant(None, "Opened."),
+            Message::user(None, "What changed?"),
+            Message::assistant(None, "The lexer."),
+            Message::user(None, "Why?"),
+        ];
+
+        manager.query(Some(&conversation), "Why?").await.unwrap();
+
+        let sent: Vec<String> = provider.requests()[0]
+            .messages
+            .iter()
+            .map(|message| message.content.clone())
+            .collect();
+        assert_eq!(sent, vec!["What changed?", "The lexer.", "Why?"]);
+    }
+
+    #[tokio::test]
+    async fn test_given_messages_are_sent_as_given() {
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None, "Done",
+        )]));
+        let manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE));
+        let conversation = vec![
+            Message::system(None, "Answer tersely."),
+            Message::user(None, "What changed?"),
+        ];
+
+        manager
+            .query(Some(&conversation), "What changed?")
+            .await
+            .unwrap();
+
+        let sent = &provider.requests()[0].messages;
+        assert_eq!(
+            render_messages(sent),
+            render_messages(&conversation),
+            "no system prompt, context or second user message is added"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_response_language_reaches_system_message() {
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None, "Hallo",
+        )]));
+        let mut manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE));
+        manager.config.response_language = Some("German".to_string());
+
+        manager.query(None, "Say hello").await.unwrap();
+
+        let system = &provider.requests()[0].messages[0];
+        assert_eq!(system.role, "system");
+        assert!(system.content.contains("Always answer in German"));
+    }
+
+    #[tokio::test]
+    async fn test_system_prompt_suffix_follows_language_in_tool_chats() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        registry.register(ShoutPlugin).await;
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            tool_call_message("shout", json!({ "text": "hi" })),
+            Message::assistant(None, "HI"),
+        ]));
+        let mut manager = test_manager(provider.clone(), registry);
+        manager.config.response_language = Some("German".to_string());
+        manager.config.system_prompt_suffix = "Never reveal secrets.".to_string();
+
+        manager.query(None, "Shout hi").await.unwrap();
+
+        let requests = provider.requests();
+        assert_eq!(requests.len(), 2);
+        for request in requests {
+            let system = &request.messages[0];
+            assert_eq!(system.role, "system");
+            assert!(system.content.contains("Always answer in German"));
+            assert!(system.content.ends_with("\n\nNever reveal secrets."));
+        }
+    }
+
+    #[tokio::test]
+    async fn test_query_events_sequence_for_tool_turn() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        registry.register(ShoutPlugin).await;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            tool_call_message("shout", json!({ "text": "hi" })),
+            Message::assistant(None, "Done: HI"),
+        ]));
+        let manager = test_manager(provider, registry);
+
+        let mut events = Vec::new();
+        manager
+            .query_events(None, "Shout hi", |event| events.push(event))
+            .await
+            .unwrap();
+
+        assert_eq!(
+            events,
+            vec![
+                ChatEvent::ToolCallStart {
+                    name: "shout".to_string(),
+                    arguments: json!({ "text": "hi" }),
+                },
+                ChatEvent::ToolResult {
+                    name: "shout".to_string(),
+                    content: "HI".to_string(),
+                    denied: false,
+                },
+                ChatEvent::Token {
+                    text: "Done: HI".to_string(),
+                },
+                ChatEvent::Done {
+                    content: "Done: HI".to_string(),
+                },
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_tool_log_records_calls_in_order() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        registry.register(ShoutPlugin).await;
+        registry.register(WhisperPlugin).await;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            tool_call_message("shout", json!({ "text": "hi" })),
+            tool_call_message("whisper", json!({ "text": "HI" })),
+            Message::assistant(None, "Done"),
+        ]));
+        let manager = test_manager(provider, registry);
+        assert!(manager.tool_log().is_empty());
+
+        manager.query(None, "Shout, then whisper").await.unwrap();
+
+        assert_eq!(
+            manager.tool_log(),
+            vec![
+                ToolLogEntry::new("shout", &json!({ "text": "hi" }), "HI", false),
+                ToolLogEntry::new("whisper", &json!({ "text": "HI" }), "hi", false),
+            ]
+        );
+        assert_eq!(
+            crate::chat::render_tool_log(&manager.tool_log()),
+            "1. shout {\"text\":\"hi\"} -> HI\n2. whisper {\"text\":\"HI\"} -> hi"
+        );
+
+        manager.clear_tool_log();
+        assert!(manager.tool_log().is_empty());
+    }
+
+    struct BrokenPlugin;
+
+    #[async_trait]
+    impl Plugin for BrokenPlugin {
+        fn name(&self) -> &str {
+            "broken"
+        }
+
+        fn description(&self) -> &str {
+            "Always fails"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({ "type": "object" })
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        async fn execute(&self, _input: Value) -> nucleus_plugin::Result<PluginOutput> {
+            Err(nucleus_plugin::PluginError::Other(
+                "disk on fire".to_string(),
+            ))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_tool_log_records_failed_call() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        registry.register(BrokenPlugin).await;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![tool_call_message(
+            "broken",
+            json!({}),
+        )]));
+        let manager = test_manager(provider, registry);
+
+        assert!(manager.query(None, "Break something").await.is_err());
+
+        let log = manager.tool_log();
+        assert_eq!(log.len(), 1);
+        assert_eq!(log[0].name, "broken");
+        assert!(
+            log[0].summary.contains("disk on fire"),
+            "{}",
+            log[0].summary
+        );
+    }
+
+    #[tokio::test]
+    async fn test_max_tokens_override_takes_precedence() {
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            Message::assistant(None, "short"),
+            Message::assistant(None, "longer"),
+        ]));
+        let mut manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE));
+        manager.config.llm.max_tokens = Some(500);
+
+        let options = QueryOptions::new().with_max_tokens(200);
+        manager
+            .query_with_options(None, "Be short", &options, |_| {})
+            .await
+            .unwrap();
+        manager.query(None, "Default length").await.unwrap();
+
+        let requests = provider.requests();
+        assert_eq!(requests[0].max_tokens, Some(200));
+        assert_eq!(requests[1].max_tokens, Some(500));
+    }
+
+    #[tokio::test]
+    async fn test_thinking_block_stripped_from_streamed_and_final_response() {
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None,
+            "<think>The config sets port 8080.</think>\n\nThe server listens on port 8080.",
+        )]));
+        let mut manager = test_manager(provider, PluginRegistry::new(Permission::NONE));
+        manager.config.llm.thinking.strip = true;
+
+        let mut streamed = String::new();
+        let response = manager
+            .query_stream(None, "Which port?", |chunk| streamed.push_str(chunk))
+            .await
+            .unwrap();
+
+        assert_eq!(response, "The server listens on port 8080.");
+        assert_eq!(streamed, response);
+    }
+
+    #[tokio::test]
+    async fn test_batch_answers_each_question_in_order() {
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            Message::assistant(None, "Run the index request."),
+            Message::assistant(None, "Five by default."),
+            Message::assistant(None, "Through the plugin registry."),
+        ]));
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine
+            .add_knowledge("storage.top_k defaults to five results", "docs/config.md")
+            .await
+            .unwrap();
+        let manager = test_manager(provider.clone(), PluginRegistry::new(Permission::NONE))
+            .with_rag(Arc::new(engine));
+
+        let questions = crate::chat::parse_questions(
+            "How do I index a directory?\nWhat is top_k?\n\nHow are tools run?\n",
+        );
+        let answers = manager.query_batch(&questions).await;
+
+        let asked: Vec<_> = answers.iter().map(|a| a.question.as_str()).collect();
+        assert_eq!(
+            asked,
+            vec![
+                "How do I index a directory?",
+                "What is top_k?",
+                "How are tools run?"
+            ]
+        );
+        let answered: Vec<_> = answers.iter().map(|a| a.answer.as_str()).collect();
+        assert_eq!(
+            answered,
+            vec![
+                "Run the index request.",
+                "Five by default.",
+                "Through the plugin registry."
+            ]
+        );
+        assert_eq!(answers[1].sources, vec!["docs/config.md".to_string()]);
+        assert!(answers.iter().all(|a| a.error.is_none()));
+        assert_eq!(provider.requests().len(), 3);
+    }
+}
@@ -1,3 +1,22 @@
+mod batch;
+mod events;
 mod manager;
+mod options;
+mod plan;
+mod prompt;
+mod template;
+mod thinking;
+mod tool_log;
+mod transcript;
 
+pub(crate) use batch::context_sources;
+pub use batch::{parse_questions, BatchAnswer};
+pub use events::ChatEvent;
 pub use manager::{ChatManager, ChatManagerBuilder};
+pub use options::QueryOptions;
+pub use plan::ToolPlan;
+pub use prompt::{estimate_tokens, render_messages, PromptParts, Trimmed};
+pub use template::{load_template, load_templates, PromptTemplate, TemplateError};
+pub use thinking::ThinkingFilter;
+pub use tool_log::{render_tool_log, ToolLogEntry};
+pub use transcript::render_markdown;
@@ -0,0 +1,35 @@
+/// Settings for a single query that override the configuration.
+///
+/// # Examples
+///
+/// ```no_run
+/// # use nucleus_core::chat::QueryOptions;
+/// let options = QueryOptions::new().with_max_tokens(200);
+///
+/// // A general question that codebase context would only distract from
+/// let general = QueryOptions::new().with_rag(false);
+/// ```
+#[derive(Debug, Clone, Default)]
+pub struct QueryOptions {
+    /// Maximum tokens to generate. Overrides `llm.max_tokens`.
+    pub max_tokens: Option<usize>,
+    /// Whether to add retrieved knowledge-base context. Unset uses the RAG
+    /// engine when one is configured.
+    pub rag: Option<bool>,
+}
+
+impl QueryOptions {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn with_max_tokens(mut self, max_tokens: usize) -> Self {
+        self.max_tokens = Some(max_tokens);
+        self
+    }
+
+    pub fn with_rag(mut self, rag: bool) -> Self {
+        self.rag = Some(rag);
+        self
+    }
+}
@@ -0,0 +1,84 @@
+//! Planning tool use before any tool runs.
+//!
+//! In plan mode the model is first shown the tools and asked to list the calls
+//! it intends to make without making them. The plan is handed to the caller
+//! for approval, and only an approved plan is carried out through the normal
+//! tool loop.
+
+use crate::provider::{Message, ToolCall};
+use std::fmt;
+
+/// Appended to the user's message for the planning request.
+pub(crate) const PLAN_INSTRUCTION: &str = "Before doing anything, list the tool calls you \
+     intend to make to answer this, in order, one per line as `tool_name: what it is for`. \
+     Do not run any tools yet; the list will be reviewed first.";
+
+/// Sent once the plan is approved.
+pub(crate) const PLAN_APPROVED: &str =
+    "The plan is approved. Carry it out now, calling the tools as needed.";
+
+/// The tool calls a model intends to make, returned by
+/// [`ChatManager::query_planned`](super::ChatManager::query_planned) for approval.
+#[derive(Debug, Clone, Default)]
+pub struct ToolPlan {
+    /// The plan as the model wrote it.
+    pub text: String,
+    /// Calls the model asked for while planning. They are never executed;
+    /// the model is asked to make them again once the plan is approved.
+    pub calls: Vec<ToolCall>,
+}
+
+impl ToolPlan {
+    pub(crate) fn from_message(message: &Message) -> Self {
+        Self {
+            text: message.content.trim().to_string(),
+            calls: message.tool_calls.clone().unwrap_or_default(),
+        }
+    }
+
+    /// Whether the model intends to use no tools at all.
+    pub fn is_empty(&self) -> bool {
+        self.text.is_empty() && self.calls.is_empty()
+    }
+}
+
+/// The model's text, followed by one numbered line per requested call with
+/// its arguments.
+impl fmt::Display for ToolPlan {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut lines = Vec::new();
+        if !self.text.is_empty() {
+            lines.push(self.text.clone());
+        }
+        for (i, call) in self.calls.iter().enumerate() {
+            lines.push(format!(
+                "{}. {} {}",
+                i + 1,
+                call.function.name,
+                call.function.arguments
+            ));
+        }
+        write!(f, "{}", lines.join("\n"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::provider::testing::tool_call_message;
+    use serde_json::json;
+
+    #[test]
+    fn test_plan_lists_text_then_requested_calls() {
+        let mut message = tool_call_message("write_file", json!({ "path": "a.txt" }));
+        message.content = "Write the file.\n".to_string();
+
+        let plan = ToolPlan::from_message(&message);
+
+        assert_eq!(
+            plan.to_string(),
+            "Write the file.\n1. write_file {\"path\":\"a.txt\"}"
+        );
+        assert!(ToolPlan::from_message(&Message::assistant(None, " ")).is_empty());
+    }
+}
@@ -0,0 +1,439 @@
+//! Prompt assembly for chat requests.
+//!
+//! A request is built from a system prompt, earlier conversation turns,
+//! retrieved knowledge-base context, and the user's message. These are kept
+//! apart until the request is sent so the least important pieces can be trimmed
+//! when the whole prompt would not fit in the model's context window.
+
+use crate::provider::Message;
+use crate::rag::{format_context, is_pinned, SearchResult};
+use tracing::info;
+
+/// Rough token estimate used for context budgeting.
+///
+/// Assumes about four bytes per token, which is close enough for English text
+/// and code with common tokenizers.
+pub fn estimate_tokens(text: &str) -> usize {
+    text.len().div_ceil(4)
+}
+
+/// A piece of the prompt that was dropped to fit the context length.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Trimmed {
+    /// A history message, by its position in the original history.
+    History(usize),
+    /// A retrieved context chunk.
+    Context { source: String, score: f32 },
+}
+
+/// The parts of a chat request before they are flattened into messages.
+#[derive(Debug, Clone, Default)]
+pub struct PromptParts {
+    pub system_prompt: String,
+    /// Language every answer should be written in, if configured.
+    pub response_language: Option<String>,
+    /// Instructions that always close the system message, after the
+    /// language instruction.
+    pub system_suffix: String,
+    pub history: Vec<Message>,
+    pub context: Vec<SearchResult>,
+    pub user_message: String,
+}
+
+impl PromptParts {
+    pub fn new(system_prompt: impl Into<String>, user_message: impl Into<String>) -> Self {
+        Self {
+            system_prompt: system_prompt.into(),
+            user_message: user_message.into(),
+            ..Default::default()
+        }
+    }
+
+    pub fn with_history(mut self, history: Vec<Message>) -> Self {
+        self.history = history;
+        self
+    }
+
+    /// Keeps only the last `turns` turns of the history, where each turn
+    /// starts at a user message. `0` keeps the whole history.
+    pub fn keep_last_turns(&mut self, turns: usize) {
+        if turns == 0 {
+            return;
+        }
+        let starts: Vec<usize> = self
+            .history
+            .iter()
+            .enumerate()
+            .filter(|(_, message)| message.role == "user")
+            .map(|(index, _)| index)
+            .collect();
+        if starts.len() > turns {
+            self.history.drain(..starts[starts.len() - turns]);
+        }
+    }
+
+    pub fn with_context(mut self, context: Vec<SearchResult>) -> Self {
+        self.context = context;
+        self
+    }
+
+    pub fn with_response_language(mut self, language: Option<String>) -> Self {
+        self.response_language = language.filter(|l| !l.trim().is_empty());
+        self
+    }
+
+    pub fn with_system_suffix(mut self, suffix: impl Into<String>) -> Self {
+        self.system_suffix = suffix.into();
+        self
+    }
+
+    /// The system message content, including any language instruction and
+    /// the suffix.
+    pub fn system_message(&self) -> String {
+        let message = match &self.response_language {
+            Some(language) if self.system_prompt.is_empty() => language_instruction(language),
+            Some(language) => format!(
+                "{}\n\n{}",
+                self.system_prompt.trim_end(),
+                language_instruction(language)
+            ),
+            None => self.system_prompt.clone(),
+        };
+
+        let suffix = self.system_suffix.trim();
+        match (message.is_empty(), suffix.is_empty()) {
+            (_, true) => message,
+            (true, false) => suffix.to_string(),
+            (false, false) => format!("{}\n\n{}", message.trim_end(), suffix),
+        }
+    }
+
+    /// The formatted context block that is prepended to the user message.
+    pub fn context_block(&self) -> String {
+        format_context(&self.context)
+    }
+
+    /// Estimated token count of the assembled prompt.
+    pub fn estimate_tokens(&self) -> usize {
+        estimate_tokens(&self.system_message())
+            + self
+                .history
+                .iter()
+                .map(|m| estimate_tokens(&m.content))
+                .sum::<usize>()
+            + estimate_tokens(&self.context_block())
+            + estimate_tokens(&self.user_message)
+    }
+
+    /// Drops content until the prompt fits in `max_tokens`.
+    ///
+    /// The oldest history messages go first, then the lowest-scored context
+    /// chunks, then pinned documents, last pinned first. The system prompt and
+    /// user message are never dropped, so the result can still exceed
+    /// `max_tokens` if those alone are too large.
+    ///
+    /// Returns what was dropped, in drop order.
+    pub fn trim_to_fit(&mut self, max_tokens: usize) -> Vec<Trimmed> {
+        let mut trimmed = Vec::new();
+        let mut history_dropped = 0;
+
+        while self.estimate_tokens() > max_tokens {
+            if !self.history.is_empty() {
+                self.history.remove(0);
+                trimmed.push(Trimmed::History(history_dropped));
+                history_dropped += 1;
+            } else if let Some(index) = lowest_scored(&self.context) {
+                let result = self.context.remove(index);
+                trimmed.push(Trimmed::Context {
+                    source: result
+                        .document
+                        .metadata
+                        .get("source")
+                        .cloned()
+                        .unwrap_or_default(),
+                    score: result.score,
+                });
+            } else {
+                break;
+            }
+        }
+
+        for item in &trimmed {
+            info!(?item, max_tokens, "Trimmed prompt to fit context length");
+        }
+
+        trimmed
+    }
+
+    /// Flattens the parts into the messages sent to the provider.
+    pub fn into_messages(self) -> Vec<Message> {
+        let context = self.context_block();
+        let system = self.system_message();
+        let mut messages = Vec::with_capacity(self.history.len() + 2);
+
+        if !system.is_empty() {
+            messages.push(Message::system(None, system));
+        }
+
+        messages.extend(self.history);
+
+        let content = format!("{}{}", context, self.user_message);
+        let context = if context.is_empty() {
+            None
+        } else {
+            Some(context)
+        };
+        messages.push(Message::user(context, content));
+
+        messages
+    }
+}
+
+fn language_instruction(language: &str) -> String {
+    format!(
+        "Always answer in {}, even when the question or the provided context is in another language.",
+        language.trim()
+    )
+}
+
+/// Trims a conversation that is sent as given, in place.
+///
+/// Only the last `turns` turns before the final message are kept, where each
+/// turn starts at a user message and `0` keeps them all. Then the oldest
+/// messages go until the estimate fits in `max_tokens`. System messages and
+/// the final message are never dropped.
+pub(crate) fn trim_conversation(messages: &mut Vec<Message>, turns: usize, max_tokens: usize) {
+    let Some(last) = messages.pop() else {
+        return;
+    };
+
+    let starts: Vec<usize> = messages
+        .iter()
+        .enumerate()
+        .filter(|(_, message)| message.role == "user")
+        .map(|(index, _)| index)
+        .collect();
+    if turns > 0 && starts.len() > turns {
+        let cut = starts[starts.len() - turns];
+        let mut index = 0;
+        messages.retain(|message| {
+            index += 1;
+            index > cut || message.role == "system"
+        });
+    }
+
+    let mut tokens: usize = messages
+        .iter()
+        .chain([&last])
+        .map(|message| estimate_tokens(&message.content))
+        .sum();
+    while tokens > max_tokens {
+        let Some(oldest) = messages.iter().position(|message| message.role != "system") else {
+            break;
+        };
+        let dropped = messages.remove(oldest);
+        tokens -= estimate_tokens(&dropped.content);
+        info!(
+            max_tokens,
+            "Trimmed conversation message to fit context length"
+        );
+    }
+
+    messages.push(last);
+}
+
+/// Renders messages as plain text for inspection.
+///
+/// Each message is preceded by a `--- role ---` header. Used to show exactly
+/// what would be sent to the model.
+pub fn render_messages(messages: &[Message]) -> String {
+    messages
+        .iter()
+        .map(|message| format!("--- {} ---\n{}\n", message.role, message.content.trim()))
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+/// The next context entry to drop: the lowest-scored retrieved chunk, or the
+/// last pinned document once no retrieved chunks are left.
+fn lowest_scored(results: &[SearchResult]) -> Option<usize> {
+    if results.iter().all(is_pinned) {
+        return results.len().checked_sub(1);
+    }
+
+    results
+        .iter()
+        .enumerate()
+        .filter(|(_, result)| !is_pinned(result))
+        .min_by(|(_, a), (_, b)| {
+            a.score
+                .partial_cmp(&b.score)
+                .unwrap_or(std::cmp::Ordering::Equal)
+        })
+        .map(|(index, _)| index)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rag::Document;
+
+    fn chunk(source: &str, content: &str, score: f32) -> SearchResult {
+        SearchResult {
+            document: Document::new(source, content, vec![]).with_metadata("source", source),
+            score,
+        }
+    }
+
+    fn pinned(source: &str, content: &str) -> SearchResult {
+        let mut result = chunk(source, content, 1.0);
+        result.document = result.document.with_metadata("pinned", "true");
+        result
+    }
+
+    #[test]
+    fn test_pinned_documents_trimmed_after_retrieved_chunks() {
+        let filler = "x".repeat(400);
+        let mut parts = PromptParts::new("system", "question").with_context(vec![
+            pinned("conventions.md", &filler),
+            chunk("high.rs", &filler, 0.9),
+            pinned("glossary.md", &filler),
+            chunk("low.rs", &filler, 0.2),
+        ]);
+
+        // Room for the system prompt, user message and a single entry.
+        let trimmed = parts.trim_to_fit(150);
+
+        let sources: Vec<_> = trimmed
+            .iter()
+            .map(|item| match item {
+                Trimmed::Context { source, .. } => source.as_str(),
+                Trimmed::History(_) => "history",
+            })
+            .collect();
+        assert_eq!(sources, vec!["low.rs", "high.rs", "glossary.md"]);
+        assert_eq!(parts.context.len(), 1);
+        assert_eq!(
+            parts.context[0].document.metadata["source"],
+            "conventions.md"
+        );
+    }
+
+    #[test]
+    fn test_estimate_tokens() {
+        assert_eq!(estimate_tokens(""), 0);
+        assert_eq!(estimate_tokens("abcd"), 1);
+        assert_eq!(estimate_tokens("abcde"), 2);
+    }
+
+    #[test]
+    fn test_within_budget_is_untouched() {
+        let mut parts = PromptParts::new("system", "question")
+            .with_history(vec![Message::user(None, "earlier")])
+            .with_context(vec![chunk("a.rs", "fn a() {}", 0.9)]);
+
+        assert!(parts.trim_to_fit(10_000).is_empty());
+        assert_eq!(parts.history.len(), 1);
+        assert_eq!(parts.context.len(), 1);
+    }
+
+    #[test]
+    fn test_trims_history_then_lowest_scored_context() {
+        let filler = "x".repeat(400);
+        let mut parts = PromptParts::new("system", "question")
+            .with_history(vec![
+                Message::user(None, &filler),
+                Message::assistant(None, &filler),
+            ])
+            .with_context(vec![
+                chunk("high.rs", &filler, 0.9),
+                chunk("low.rs", &filler, 0.2),
+                chunk("mid.rs", &filler, 0.5),
+            ]);
+
+        // Room for the system prompt, user message and a single chunk.
+        let budget = 150;
+        let trimmed = parts.trim_to_fit(budget);
+
+        assert_eq!(
+            trimmed,
+            vec![
+                Trimmed::History(0),
+                Trimmed::History(1),
+                Trimmed::Context {
+                    source: "low.rs".to_string(),
+                    score: 0.2
+                },
+                Trimmed::Context {
+                    source: "mid.rs".to_string(),
+                    score: 0.5
+                },
+            ]
+        );
+        assert!(parts.estimate_tokens() <= budget);
+        assert_eq!(parts.context.len(), 1);
+        assert_eq!(parts.context[0].document.id, "high.rs");
+    }
+
+    #[test]
+    fn test_into_messages_order() {
+        let messages = PromptParts::new("system", "question")
+            .with_history(vec![Message::assistant(None, "earlier")])
+            .with_context(vec![chunk("a.rs", "fn a() {}", 0.9)])
+            .into_messages();
+
+        assert_eq!(messages.len(), 3);
+        assert_eq!(messages[0].role, "system");
+        assert_eq!(messages[1].content, "earlier");
+        assert_eq!(messages[2].role, "user");
+        assert!(messages[2].content.contains("fn a() {}"));
+        assert!(messages[2].content.ends_with("question"));
+    }
+
+    #[test]
+    fn test_response_language_instruction() {
+        let messages = PromptParts::new("Be brief.", "question")
+            .with_response_language(Some("German".to_string()))
+            .into_messages();
+        assert!(messages[0].content.starts_with("Be brief."));
+        assert!(messages[0].content.contains("Always answer in German"));
+
+        let messages = PromptParts::new("Be brief.", "question").into_messages();
+        assert_eq!(messages[0].content, "Be brief.");
+        assert!(!messages[0].content.contains("Always answer in"));
+    }
+
+    #[test]
+    fn test_trim_conversation_keeps_system_and_final_message() {
+        let filler = "x".repeat(400);
+        let mut messages = vec![
+            Message::system(None, "system"),
+            Message::user(None, &filler),
+            Message::assistant(None, &filler),
+            Message::user(None, "earlier"),
+            Message::assistant(None, "answer"),
+            Message::user(None, &filler),
+        ];
+
+        trim_conversation(&mut messages, 0, 110);
+
+        let kept: Vec<&str> = messages.iter().map(|m| m.content.as_str()).collect();
+        assert_eq!(kept, vec!["system", "earlier", "answer", filler.as_str()]);
+
+        trim_conversation(&mut messages, 1, 10_000);
+        assert_eq!(messages.len(), 4);
+        trim_conversation(&mut messages, 0, 0);
+        let roles: Vec<&str> = messages.iter().map(|m| m.role.as_str()).collect();
+        assert_eq!(roles, vec!["system", "user"]);
+    }
+
+    #[test]
+    fn test_render_messages() {
+        let rendered = render_messages(&[
+            Message::system(None, "Be brief."),
+            Message::user(None, "Hi\n"),
+        ]);
+
+        assert_eq!(rendered, "--- system ---\nBe brief.\n\n--- user ---\nHi\n");
+    }
+}
@@ -0,0 +1,305 @@
+//! Reusable prompt templates.
+//!
+//! Each file in the templates directory is one template, named after the file
+//! without its extension. Templates contain `{{name}}` placeholders that are
+//! filled from leading `name=value` arguments when the template is used; the
+//! rest of the arguments fill `{{input}}` as written.
+//!
+//! ```text
+//! # templates/review.md
+//! Review this {{language}} code for bugs and unclear naming:
+//!
+//! {{input}}
+//! ```
+//!
+//! `review language=Rust fn main() {}` then fills both placeholders.
+
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use thiserror::Error;
+
+/// Placeholder that receives the free-form part of the arguments.
+pub const INPUT_PLACEHOLDER: &str = "input";
+
+#[derive(Debug, Error)]
+pub enum TemplateError {
+    #[error("Failed to read templates from {path}: {source}")]
+    Io {
+        path: PathBuf,
+        source: std::io::Error,
+    },
+
+    #[error("No template named '{0}'")]
+    NotFound(String),
+
+    #[error("Template '{template}' needs a value for {{{{{placeholder}}}}}")]
+    MissingArgument {
+        template: String,
+        placeholder: String,
+    },
+}
+
+pub type Result<T> = std::result::Result<T, TemplateError>;
+
+/// A named prompt with `{{placeholder}}` slots.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PromptTemplate {
+    pub name: String,
+    pub body: String,
+}
+
+impl PromptTemplate {
+    pub fn new(name: impl Into<String>, body: impl Into<String>) -> Self {
+        Self {
+            name: name.into(),
+            body: body.into(),
+        }
+    }
+
+    /// Placeholder names in order of first appearance, without duplicates.
+    pub fn placeholders(&self) -> Vec<String> {
+        let mut names: Vec<String> = Vec::new();
+        let mut rest = self.body.as_str();
+
+        while let Some((_, name, end)) = next_placeholder(rest) {
+            if !names.iter().any(|n| n == name) {
+                names.push(name.to_string());
+            }
+            rest = &rest[end..];
+        }
+
+        names
+    }
+
+    /// Fills the template from an argument string.
+    ///
+    /// Leading words of the form `name=value`, where `name` is one of the
+    /// template's placeholders, set that placeholder (use quotes for values
+    /// with spaces: `tone="very formal"`). Everything after them fills
+    /// `{{input}}` verbatim, so code or prose containing `=` or quotes is left
+    /// alone. Every placeholder must receive a value.
+    pub fn fill(&self, args: &str) -> Result<String> {
+        let (mut values, input) = parse_args(args, &self.placeholders());
+        if !input.is_empty() {
+            values.insert(INPUT_PLACEHOLDER.to_string(), input.to_string());
+        }
+
+        let mut filled = String::with_capacity(self.body.len());
+        let mut rest = self.body.as_str();
+
+        while let Some((start, name, end)) = next_placeholder(rest) {
+            let value = values
+                .get(name)
+                .ok_or_else(|| TemplateError::MissingArgument {
+                    template: self.name.clone(),
+                    placeholder: name.to_string(),
+                })?;
+            filled.push_str(&rest[..start]);
+            filled.push_str(value);
+            rest = &rest[end..];
+        }
+
+        filled.push_str(rest);
+        Ok(filled)
+    }
+}
+
+/// Finds the next `{{name}}` in `text`, returning where it starts, the
+/// trimmed name, and where it ends.
+fn next_placeholder(text: &str) -> Option<(usize, &str, usize)> {
+    let mut offset = 0;
+    loop {
+        let start = offset + text[offset..].find("{{")?;
+        let end = start + 2 + text[start + 2..].find("}}")?;
+        let name = text[start + 2..end].trim();
+        if is_name(name) {
+            return Some((start, name, end + 2));
+        }
+        offset = start + 2;
+    }
+}
+
+/// Takes the leading `name=value` arguments whose name is one of `names`,
+/// returning their values and the rest of `args` untouched.
+fn parse_args<'a>(args: &'a str, names: &[String]) -> (HashMap<String, String>, &'a str) {
+    let mut values = HashMap::new();
+    let mut rest = args.trim_start();
+
+    while let Some((name, value, after)) = leading_pair(rest) {
+        if name == INPUT_PLACEHOLDER || !names.iter().any(|n| n == name) {
+            break;
+        }
+        values.insert(name.to_string(), value.to_string());
+        rest = after.trim_start();
+    }
+
+    (values, rest)
+}
+
+/// Splits a `name=value` word off the front of `text`, returning the name,
+/// the value and what follows. A value starting with `"` runs to the next
+/// `"`; any other value runs to the next whitespace.
+fn leading_pair(text: &str) -> Option<(&str, &str, &str)> {
+    let (name, after) = text.split_once('=')?;
+    if !is_name(name) {
+        return None;
+    }
+
+    if let Some(quoted) = after.strip_prefix('"') {
+        let end = quoted.find('"')?;
+        let rest = &quoted[end + 1..];
+        if rest.starts_with(|c: char| !c.is_whitespace()) {
+            return None;
+        }
+        return Some((name, &quoted[..end], rest));
+    }
+
+    let end = after.find(char::is_whitespace).unwrap_or(after.len());
+    Some((name, &after[..end], &after[end..]))
+}
+
+fn is_name(name: &str) -> bool {
+    !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_alphanumeric() || c == '_' || c == '-')
+}
+
+/// Loads every template in `dir`, sorted by name.
+///
+/// Hidden files and subdirectories are skipped. A missing directory has no
+/// templates.
+pub fn load_templates(dir: &Path) -> Result<Vec<PromptTemplate>> {
+    let io_error = |source| TemplateError::Io {
+        path: dir.to_path_buf(),
+        source,
+    };
+
+    let entries = match std::fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(io_error(e)),
+    };
+
+    let mut templates = Vec::new();
+    for entry in entries {
+        let path = entry.map_err(io_error)?.path();
+        let Some(name) = template_name(&path) else {
+            continue;
+        };
+        if !path.is_file() {
+            continue;
+        }
+        let body = std::fs::read_to_string(&path).map_err(|source| TemplateError::Io {
+            path: path.clone(),
+            source,
+        })?;
+        templates.push(PromptTemplate::new(name, body));
+    }
+
+    templates.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(templates)
+}
+
+/// Loads the template called `name` from `dir`.
+pub fn load_template(dir: &Path, name: &str) -> Result<PromptTemplate> {
+    load_templates(dir)?
+        .into_iter()
+        .find(|template| template.name == name)
+        .ok_or_else(|| TemplateError::NotFound(name.to_string()))
+}
+
+fn template_name(path: &Path) -> Option<String> {
+    let name = path.file_stem()?.to_string_lossy();
+    if name.starts_with('.') {
+        return None;
+    }
+    Some(name.into_owned())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_fill_named_and_input_placeholders() {
+        let template = PromptTemplate::new(
+            "review",
+            "Review this {{language}} code in a {{ tone }} tone:\n\n{{input}}\n\n({{language}})",
+        );
+
+        assert_eq!(template.placeholders(), vec!["language", "tone", "input"]);
+        assert_eq!(
+            template
+                .fill(r#"language=Rust tone="friendly but direct" fn main() {}"#)
+                .unwrap(),
+            "Review this Rust code in a friendly but direct tone:\n\nfn main() {}\n\n(Rust)"
+        );
+    }
+
+    #[test]
+    fn test_fill_passes_input_through_verbatim() {
+        let template = PromptTemplate::new("review", "Review this {{language}}:\n{{input}}");
+
+        let code = r#"let tone = "x";  language=Go  print("a = b")"#;
+        assert_eq!(
+            template.fill(&format!("language=Rust {}", code)).unwrap(),
+            format!("Review this Rust:\n{}", code)
+        );
+
+        // Only names of placeholders are taken as arguments.
+        let err = template.fill("size=10 language=Rust").unwrap_err();
+        assert!(matches!(
+            err,
+            TemplateError::MissingArgument { ref placeholder, .. } if placeholder == "language"
+        ));
+    }
+
+    #[test]
+    fn test_fill_reports_missing_argument() {
+        let template = PromptTemplate::new("explain", "Explain {{topic}} simply. {{input}}");
+
+        let err = template.fill("borrowing").unwrap_err();
+        assert!(matches!(
+            err,
+            TemplateError::MissingArgument { ref placeholder, .. } if placeholder == "topic"
+        ));
+        assert_eq!(
+            err.to_string(),
+            "Template 'explain' needs a value for {{topic}}"
+        );
+
+        // Braces that aren't a placeholder are left alone.
+        let literal = PromptTemplate::new("json", "Format as {{ }} or {\"a\": {{input}}}");
+        assert_eq!(literal.fill("1").unwrap(), "Format as {{ }} or {\"a\": 1}");
+    }
+
+    #[test]
+    fn test_load_templates_from_directory() {
+        let dir = tempdir().unwrap();
+        std::fs::write(dir.path().join("refactor.md"), "Refactor:\n{{input}}").unwrap();
+        std::fs::write(dir.path().join("explain.txt"), "Explain {{input}}").unwrap();
+        std::fs::write(dir.path().join(".hidden"), "ignored").unwrap();
+        std::fs::create_dir(dir.path().join("drafts")).unwrap();
+
+        let names: Vec<_> = load_templates(dir.path())
+            .unwrap()
+            .into_iter()
+            .map(|t| t.name)
+            .collect();
+        assert_eq!(names, vec!["explain", "refactor"]);
+
+        let template = load_template(dir.path(), "refactor").unwrap();
+        assert_eq!(
+            template.fill("let x = 1;").unwrap(),
+            "Refactor:\nlet x = 1;"
+        );
+
+        assert!(matches!(
+            load_template(dir.path(), "missing"),
+            Err(TemplateError::NotFound(_))
+        ));
+        assert!(load_templates(&dir.path().join("nope")).unwrap().is_empty());
+    }
+}
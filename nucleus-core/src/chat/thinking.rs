@@ -0,0 +1,222 @@
+//! Removing reasoning blocks such as `<think>...</think>` from responses.
+//!
+//! With `llm.thinking.strip` on, each block is cut from the response before it
+//! is printed, returned or saved, along with the whitespace after it. Streamed
+//! text is held back while a block may be open, so no part of one is sent.
+//! A block the model never closes is dropped to the end of the response.
+
+use crate::config::{ThinkingBlock, ThinkingConfig};
+use regex::Regex;
+
+/// Built-in blocks as `(start, end)` patterns, matched case-insensitively.
+const BUILTIN_BLOCKS: &[(&str, &str)] = &[
+    (r"(?i)<think>", r"(?i)</think>"),
+    (r"(?i)<thinking>", r"(?i)</thinking>"),
+    (r"(?i)<reasoning>", r"(?i)</reasoning>"),
+];
+
+/// Bytes of streamed text held back in case they begin a block. Start
+/// patterns are expected to match less than this.
+const HOLD_BACK: usize = 32;
+
+/// Strips reasoning blocks from a response as it streams in.
+#[derive(Debug, Clone)]
+pub struct ThinkingFilter {
+    blocks: Vec<(Regex, Regex)>,
+    /// Text received but not yet given out.
+    pending: String,
+    /// Index of the block being skipped, if inside one.
+    inside: Option<usize>,
+    /// Whether whitespace is being dropped after a block.
+    after_block: bool,
+}
+
+impl ThinkingFilter {
+    /// Builds a filter from the built-in blocks plus `config.blocks`, or
+    /// `None` when `config.strip` is off.
+    ///
+    /// User blocks whose patterns aren't valid regular expressions are skipped
+    /// with a warning rather than failing the response.
+    pub fn new(config: &ThinkingConfig) -> Option<Self> {
+        if !config.strip {
+            return None;
+        }
+
+        let builtin = BUILTIN_BLOCKS.iter().map(|(start, end)| {
+            let start = Regex::new(start).expect("built-in thinking pattern");
+            let end = Regex::new(end).expect("built-in thinking pattern");
+            (start, end)
+        });
+
+        let custom = config
+            .blocks
+            .iter()
+            .filter_map(|block| match compile(block) {
+                Ok(patterns) => Some(patterns),
+                Err(e) => {
+                    tracing::warn!(
+                        "Skipping invalid thinking block {:?}..{:?}: {}",
+                        block.start,
+                        block.end,
+                        e
+                    );
+                    None
+                }
+            });
+
+        Some(Self {
+            blocks: builtin.chain(custom).collect(),
+            pending: String::new(),
+            inside: None,
+            after_block: false,
+        })
+    }
+
+    /// Takes the next streamed chunk and returns the text that can be given
+    /// out now, which may be empty.
+    pub fn push(&mut self, chunk: &str) -> String {
+        self.pending.push_str(chunk);
+        let mut output = self.take_blocks();
+        if self.inside.is_some() {
+            return output;
+        }
+
+        let mut keep = self.pending.len().saturating_sub(HOLD_BACK);
+        while !self.pending.is_char_boundary(keep) {
+            keep -= 1;
+        }
+        output.extend(self.pending.drain(..keep));
+        output
+    }
+
+    /// Returns the text still held back once the response has ended.
+    pub fn finish(&mut self) -> String {
+        let mut output = self.take_blocks();
+        if self.inside.take().is_some() {
+            tracing::debug!("Dropping a thinking block that was never closed");
+            self.pending.clear();
+        }
+        output.push_str(&std::mem::take(&mut self.pending));
+        output
+    }
+
+    /// Strips every block from a whole response.
+    pub fn strip(&mut self, text: &str) -> String {
+        let mut output = self.push(text);
+        output.push_str(&self.finish());
+        output
+    }
+
+    /// Removes the blocks that start or end in the pending text, returning
+    /// the text before them. Text that may still begin a block, and the
+    /// inside of a block that hasn't ended, stay pending.
+    fn take_blocks(&mut self) -> String {
+        let mut output = String::new();
+        loop {
+            if self.after_block {
+                let trimmed = self.pending.trim_start();
+                if trimmed.is_empty() {
+                    self.pending.clear();
+                    return output;
+                }
+                self.pending = trimmed.to_string();
+                self.after_block = false;
+            }
+
+            match self.inside {
+                Some(index) => {
+                    let Some(end) = self.blocks[index].1.find(&self.pending) else {
+                        return output;
+                    };
+                    self.pending.drain(..end.end());
+                    self.inside = None;
+                    self.after_block = true;
+                }
+                None => {
+                    let start = self
+                        .blocks
+                        .iter()
+                        .enumerate()
+                        .filter_map(|(index, (start, _))| {
+                            start.find(&self.pending).map(|found| (index, found))
+                        })
+                        .min_by_key(|(_, found)| found.start());
+                    let Some((index, found)) = start else {
+                        return output;
+                    };
+                    output.push_str(&self.pending[..found.start()]);
+                    self.pending.drain(..found.end());
+                    self.inside = Some(index);
+                }
+            }
+        }
+    }
+}
+
+fn compile(block: &ThinkingBlock) -> Result<(Regex, Regex), regex::Error> {
+    Ok((Regex::new(&block.start)?, Regex::new(&block.end)?))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn filter(blocks: Vec<ThinkingBlock>) -> ThinkingFilter {
+        ThinkingFilter::new(&ThinkingConfig {
+            strip: true,
+            blocks,
+        })
+        .unwrap()
+    }
+
+    #[test]
+    fn test_thinking_block_removed_and_answer_kept() {
+        let response = "<think>\nThe user wants the port. Config says 8080.\n</think>\n\n\
+                        The server listens on port 8080.";
+
+        assert_eq!(
+            filter(Vec::new()).strip(response),
+            "The server listens on port 8080."
+        );
+        assert_eq!(
+            filter(Vec::new()).strip("Before <THINKING>hmm</THINKING> after"),
+            "Before after"
+        );
+        assert!(ThinkingFilter::new(&ThinkingConfig::default()).is_none());
+    }
+
+    #[test]
+    fn test_streamed_block_split_across_chunks_never_leaks() {
+        let mut filter = filter(vec![ThinkingBlock {
+            start: r"\[scratch\]".to_string(),
+            end: r"\[/scratch\]".to_string(),
+        }]);
+        let chunks = [
+            "Answer: ",
+            "<thi",
+            "nk>secret ",
+            "plan</th",
+            "ink> 42",
+            " [scr",
+            "atch]x[/scratch]!",
+        ];
+
+        let mut streamed = String::new();
+        for chunk in chunks {
+            let out = filter.push(chunk);
+            assert!(!out.contains("secret") && !out.contains('<'), "{:?}", out);
+            streamed.push_str(&out);
+        }
+        streamed.push_str(&filter.finish());
+
+        assert_eq!(streamed, "Answer: 42 !");
+    }
+
+    #[test]
+    fn test_unclosed_block_dropped_at_end() {
+        assert_eq!(
+            filter(Vec::new()).strip("Sure. <think>still going"),
+            "Sure. "
+        );
+    }
+}
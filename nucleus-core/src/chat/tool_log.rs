@@ -0,0 +1,118 @@
+//! The tool calls a chat session has made, for debugging agent behaviour.
+//!
+//! Every call the model asks for is recorded in order as the tool loop runs,
+//! whether it ran, was denied or named an unknown tool. The log lives as long
+//! as the [`ChatManager`](super::ChatManager) and is never written to disk.
+
+use serde_json::Value;
+use std::fmt;
+use std::sync::Mutex;
+
+/// Longest result summary kept for a call, in characters.
+const SUMMARY_CHARS: usize = 80;
+
+/// One tool call of the session, returned by
+/// [`ChatManager::tool_log`](super::ChatManager::tool_log).
+#[derive(Debug, Clone, PartialEq)]
+pub struct ToolLogEntry {
+    pub name: String,
+    pub arguments: Value,
+    /// The first line of the result, shortened to fit on one line.
+    pub summary: String,
+    /// Whether the call was denied instead of run.
+    pub denied: bool,
+}
+
+impl ToolLogEntry {
+    pub(crate) fn new(name: &str, arguments: &Value, result: &str, denied: bool) -> Self {
+        Self {
+            name: name.to_string(),
+            arguments: arguments.clone(),
+            summary: summarize(result),
+            denied,
+        }
+    }
+}
+
+/// `read_file {"path":"Cargo.toml"} -> [package] (12 lines)`.
+impl fmt::Display for ToolLogEntry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} {} -> ", self.name, self.arguments)?;
+        if self.denied {
+            write!(f, "denied: ")?;
+        }
+        write!(f, "{}", self.summary)
+    }
+}
+
+/// Renders the log one numbered call per line, oldest first.
+pub fn render_tool_log(entries: &[ToolLogEntry]) -> String {
+    if entries.is_empty() {
+        return "No tools have been called in this session".to_string();
+    }
+    entries
+        .iter()
+        .enumerate()
+        .map(|(i, entry)| format!("{}. {}", i + 1, entry))
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+/// The calls recorded so far.
+#[derive(Debug, Default)]
+pub(crate) struct ToolLog {
+    entries: Mutex<Vec<ToolLogEntry>>,
+}
+
+impl ToolLog {
+    pub fn record(&self, entry: ToolLogEntry) {
+        self.entries.lock().unwrap().push(entry);
+    }
+
+    pub fn entries(&self) -> Vec<ToolLogEntry> {
+        self.entries.lock().unwrap().clone()
+    }
+
+    pub fn clear(&self) {
+        self.entries.lock().unwrap().clear();
+    }
+}
+
+fn summarize(result: &str) -> String {
+    let result = result.trim();
+    let first = result.lines().next().unwrap_or_default();
+    let mut summary: String = first.chars().take(SUMMARY_CHARS).collect();
+    if summary.len() < first.len() {
+        summary.push('…');
+    }
+    let lines = result.lines().count();
+    if lines > 1 {
+        summary.push_str(&format!(" ({} lines)", lines));
+    }
+    summary
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_results_summarized_to_their_first_line() {
+        let entry = ToolLogEntry::new(
+            "read_file",
+            &json!({ "path": "Cargo.toml" }),
+            "[package]\nname = \"nucleus\"\n",
+            false,
+        );
+        assert_eq!(
+            entry.to_string(),
+            "read_file {\"path\":\"Cargo.toml\"} -> [package] (2 lines)"
+        );
+
+        let long = "x".repeat(100);
+        let entry = ToolLogEntry::new("shout", &json!({}), &long, true);
+        assert_eq!(entry.summary.chars().count(), SUMMARY_CHARS + 1);
+        assert!(entry.to_string().starts_with("shout {} -> denied: xxx"));
+    }
+}
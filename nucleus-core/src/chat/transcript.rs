@@ -0,0 +1,76 @@
+//! Rendering a conversation as a Markdown document.
+
+use crate::provider::Message;
+
+/// Renders a conversation as Markdown, one `## <Role>` section per message.
+///
+/// Message content is copied as-is, so fenced code blocks keep their language
+/// tags. A fence the model left open is closed at the end of its message so
+/// the following headings aren't swallowed by it.
+pub fn render_markdown(messages: &[Message]) -> String {
+    let mut markdown = String::from("# Conversation\n");
+
+    for message in messages {
+        let heading = match (message.role.as_str(), &message.tool_name) {
+            ("tool", Some(name)) => format!("Tool: {}", name),
+            (role, _) => capitalize(role),
+        };
+        markdown.push_str(&format!("\n## {}\n\n", heading));
+
+        let content = message.content.trim();
+        markdown.push_str(content);
+        markdown.push('\n');
+        if has_open_fence(content) {
+            markdown.push_str("```\n");
+        }
+    }
+
+    markdown
+}
+
+fn capitalize(role: &str) -> String {
+    let mut chars = role.chars();
+    match chars.next() {
+        Some(first) => first.to_uppercase().chain(chars).collect(),
+        None => String::new(),
+    }
+}
+
+fn has_open_fence(content: &str) -> bool {
+    content
+        .lines()
+        .filter(|line| line.trim_start().starts_with("```"))
+        .count()
+        % 2
+        == 1
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_two_turns_render_with_headings_and_code_blocks() {
+        let markdown = render_markdown(&[
+            Message::user(
+                None,
+                "Why does this panic?\n\n```rust\nlet v: Vec<u8> = vec![];\nv[0];\n```",
+            ),
+            Message::assistant(
+                None,
+                "Indexing an empty vector panics. Use `get`:\n\n```rust\nv.get(0);\n```\n",
+            ),
+            Message::user(None, "Thanks"),
+            Message::assistant(None, "Unfinished:\n```sh\ncargo test"),
+        ]);
+
+        assert_eq!(
+            markdown,
+            "# Conversation\n\
+             \n## User\n\nWhy does this panic?\n\n```rust\nlet v: Vec<u8> = vec![];\nv[0];\n```\n\
+             \n## Assistant\n\nIndexing an empty vector panics. Use `get`:\n\n```rust\nv.get(0);\n```\n\
+             \n## User\n\nThanks\n\
+             \n## Assistant\n\nUnfinished:\n```sh\ncargo test\n```\n"
+        );
+    }
+}
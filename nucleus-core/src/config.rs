@@ -1,9 +1,12 @@
 use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
 use std::fs;
-use std::path::Path;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
 use thiserror::Error;
 
 use crate::models::EmbeddingModel;
+use crate::provenance::{self, Origin, Provenance, RETRIEVAL_SETTINGS};
 
 #[derive(Debug, Error)]
 pub enum ConfigError {
@@ -12,8 +15,20 @@ pub enum ConfigError {
 
     #[error("Failed to parse config: {0}")]
     Parse(#[from] serde_yaml::Error),
+
+    #[error("Failed to fetch config from {url}: {message}")]
+    Fetch { url: String, message: String },
+
+    #[error("Config environment variable {0} is not set")]
+    MissingEnv(String),
+
+    #[error("Unknown environment '{0}' selected by NUCLEUS_ENV")]
+    UnknownEnvironment(String),
 }
 
+/// Environment variable naming the entry of `environments:` to apply.
+pub const ENV_VAR: &str = "NUCLEUS_ENV";
+
 pub type Result<T> = std::result::Result<T, ConfigError>;
 
 /// Configuration for the entire chat/agent
@@ -22,20 +37,56 @@ pub type Result<T> = std::result::Result<T, ConfigError>;
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Config {
     pub system_prompt: String,
+    /// Appended to the system prompt in every chat, after the response
+    /// language instruction, for instructions that should hold whatever the
+    /// prompt, such as output format or safety rules.
+    #[serde(default)]
+    pub system_prompt_suffix: String,
+    /// Language the assistant should answer in, e.g. `"German"`.
+    ///
+    /// When set, an instruction is added to the system prompt so answers use
+    /// this language regardless of the language of the question or documents.
+    #[serde(default)]
+    pub response_language: Option<String>,
     pub llm: LlmConfig,
     pub rag: Option<RagConfig>,
     pub storage: StorageConfig,
     pub personalization: PersonalizationConfig,
+    #[serde(default)]
+    pub server: ServerConfig,
 
-    #[serde(skip)]
+    /// Names of plugins to load at startup, in addition to the built-in tools.
+    ///
+    /// Each name must match a factory registered with the `PluginLoader`
+    /// passed to `nucleus_std::registry_from_config`.
+    #[serde(default)]
+    pub plugins: Vec<String>,
+
+    /// Directory of prompt templates, one file per template.
+    ///
+    /// Relative paths are resolved against the request's working directory.
+    #[serde(default = "default_templates_dir")]
+    pub templates_dir: String,
+
+    #[serde(default)]
     pub permission: Permission,
+
+    /// Where each retrieval setting came from, recorded when the config is
+    /// loaded. See [`explain_retrieval`](Self::explain_retrieval).
+    #[serde(skip)]
+    pub provenance: Provenance,
+}
+
+fn default_templates_dir() -> String {
+    "templates".to_string()
 }
 
 /// Permissions granted to the AI.
 ///
 /// **Note**: A permission granted here does not mean it will automatically perform the actions.
 /// However, if false, the functionality will not exist to begin with.
-#[derive(Debug, Clone, Copy, Serialize, Deserialize)]
+#[derive(Debug, Clone, Serialize, Deserialize)]
+#[serde(default)]
 pub struct Permission {
     /// Read directories and files
     pub read: bool,
@@ -43,6 +94,26 @@ pub struct Permission {
     pub write: bool,
     /// Run system commands
     pub command: bool,
+    /// Directories writes are confined to, such as the indexed project.
+    /// Reads are not affected. Empty allows writes anywhere `write` does.
+    ///
+    /// Passed to the file tools by `nucleus_std::registry_from_config`.
+    pub write_roots: Vec<String>,
+    /// Directory file writes are staged in for review instead of changing the
+    /// target, at the target's path relative to the working directory. Unset
+    /// writes files in place.
+    ///
+    /// Passed to the file tools by `nucleus_std::registry_from_config`.
+    pub write_staging_dir: Option<String>,
+    /// Largest tool call argument, in bytes, that a tool is run with. Unset
+    /// allows any size.
+    pub max_argument_bytes: Option<usize>,
+    /// Per-tool argument limits in bytes, by tool name, used instead of
+    /// `max_argument_bytes`.
+    pub tool_argument_limits: HashMap<String, usize>,
+    /// Tools that stay registered but are switched off: not offered to the
+    /// model or run, and listed as disabled.
+    pub disabled_tools: Vec<String>,
 }
 
 impl Default for Permission {
@@ -51,6 +122,22 @@ impl Default for Permission {
             read: true,
             write: true,
             command: true,
+            write_roots: Vec::new(),
+            write_staging_dir: None,
+            max_argument_bytes: None,
+            tool_argument_limits: HashMap::new(),
+            disabled_tools: Vec::new(),
+        }
+    }
+}
+
+impl Permission {
+    /// The permissions to create a tool registry with.
+    pub fn granted(&self) -> nucleus_plugin::Permission {
+        nucleus_plugin::Permission {
+            read: self.read,
+            write: self.write,
+            execute: self.command,
         }
     }
 }
@@ -65,6 +152,32 @@ pub struct LlmConfig {
     pub base_url: String,
     pub temperature: f64,
     pub context_length: usize,
+    /// Default cap on generated tokens per response. Unset means no cap.
+    #[serde(default)]
+    pub max_tokens: Option<usize>,
+    /// Seconds before a chat or embedding call is abandoned with a timeout
+    /// error. Unset waits indefinitely.
+    #[serde(default)]
+    pub request_timeout: Option<u64>,
+    /// Most recent conversation turns sent with each request. Older turns are
+    /// dropped from the prompt. `0` keeps the whole history.
+    #[serde(default)]
+    pub max_history_turns: usize,
+    /// Model to retry a chat with when `model` is missing or fails to load
+    #[serde(default)]
+    pub fallback_model: Option<String>,
+    /// Environment variable holding an API key for the model server, sent
+    /// as `Authorization: Bearer <key>`. Only the variable name is stored.
+    #[serde(default)]
+    pub api_key_env: Option<String>,
+    /// Extra HTTP headers sent with every request to the model server.
+    /// A value of `env:NAME` is read from the `NAME` environment variable,
+    /// which keeps secrets out of the config file.
+    #[serde(default)]
+    pub headers: HashMap<String, String>,
+    /// Reasoning blocks to cut from responses. See [`ThinkingConfig`].
+    #[serde(default)]
+    pub thinking: ThinkingConfig,
     /// CoreML-specific: input feature name
     #[serde(default = "default_input_name")]
     pub coreml_input_name: String,
@@ -73,6 +186,65 @@ pub struct LlmConfig {
     pub coreml_output_name: String,
 }
 
+/// Settings for removing reasoning blocks from responses.
+///
+/// When `strip` is on, `<think>`, `<thinking>` and `<reasoning>` blocks,
+/// plus any in `blocks`, are removed from each response before it is
+/// streamed, returned or saved.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ThinkingConfig {
+    #[serde(default)]
+    pub strip: bool,
+    /// Extra blocks to remove
+    #[serde(default)]
+    pub blocks: Vec<ThinkingBlock>,
+}
+
+/// A block running from a match of `start` to the next match of `end`, both
+/// regular expressions.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ThinkingBlock {
+    pub start: String,
+    pub end: String,
+}
+
+/// Shown in place of secret values in [`Config::redacted`].
+pub const REDACTED: &str = "<redacted>";
+
+impl LlmConfig {
+    /// HTTP headers for model server requests, with `env:` values and
+    /// [`api_key_env`](Self::api_key_env) read from the environment.
+    ///
+    /// # Errors
+    ///
+    /// Returns [`ConfigError::MissingEnv`] if a referenced variable isn't set.
+    pub fn request_headers(&self) -> Result<Vec<(String, String)>> {
+        let env =
+            |name: &str| std::env::var(name).map_err(|_| ConfigError::MissingEnv(name.to_string()));
+
+        let mut headers = Vec::new();
+        if let Some(name) = &self.api_key_env {
+            headers.push((
+                "Authorization".to_string(),
+                format!("Bearer {}", env(name)?),
+            ));
+        }
+
+        let mut names: Vec<_> = self.headers.keys().collect();
+        names.sort();
+        for name in names {
+            let value = &self.headers[name];
+            let value = match value.strip_prefix("env:") {
+                Some(var) => env(var)?,
+                None => value.clone(),
+            };
+            headers.push((name.clone(), value));
+        }
+
+        Ok(headers)
+    }
+}
+
 fn default_provider() -> String {
     "mistralrs".to_string()
 }
@@ -90,9 +262,285 @@ fn default_output_name() -> String {
 /// This covers embedding settings and text processing behavior (chunking, indexing).
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct RagConfig {
+    /// Use the knowledge base at all. When off, no vector store or
+    /// collection is created and nothing is embedded or retrieved, so chats
+    /// go straight to the model.
+    #[serde(default = "default_rag_enabled")]
+    pub enabled: bool,
     pub embedding_model: EmbeddingModel,
     #[serde(default)]
     pub indexer: IndexerConfig,
+    /// Number of chunk embeddings kept in memory so re-embedding the same text is free.
+    /// `0` disables the cache.
+    #[serde(default = "default_embedding_cache_size")]
+    pub embedding_cache_size: usize,
+    /// Retrieved chunks scoring below this are dropped. Unset keeps everything.
+    #[serde(default)]
+    pub min_score: Option<f32>,
+    /// Extra detail attached to the source of each retrieved chunk
+    #[serde(default)]
+    pub citations: CitationConfig,
+    /// Head each entry of the context block with where it came from, such as
+    /// `[src/auth/token.rs:40-72]`, so the model can reason about where code
+    /// lives. Uses the line range recorded when the chunk was indexed.
+    #[serde(default)]
+    pub inline_metadata: bool,
+    /// How many candidates to fetch per final result (`storage.top_k`), so
+    /// filtering and dedup still leave enough to fill the result. `1` fetches
+    /// exactly `top_k`.
+    #[serde(default = "default_candidate_multiplier")]
+    pub candidate_multiplier: usize,
+    /// Re-order retrieved candidates by how many of the query's words they
+    /// contain, blended with their vector score, before `top_k` is applied
+    #[serde(default)]
+    pub rerank: bool,
+    /// Most retrieved chunks that reach the prompt, applied after filtering
+    /// and ranking. `storage.top_k` still sets how many are retrieved; unset
+    /// keeps all of them.
+    #[serde(default)]
+    pub max_context_docs: Option<usize>,
+    /// Whether to tell the user, on their first retrieval, that the knowledge
+    /// base is empty and needs indexing
+    #[serde(default)]
+    pub empty_notice: EmptyNotice,
+    /// Files whose whole content goes ahead of the retrieved context in every
+    /// prompt, such as project conventions or a glossary
+    #[serde(default)]
+    pub pinned: Vec<String>,
+    /// Embed each chunk with the nearest function signature or heading above
+    /// it prepended, so narrow chunks keep their surroundings. Only the
+    /// embedding changes; the stored chunk is the plain content.
+    #[serde(default)]
+    pub contextual_chunks: bool,
+    /// Embed code chunks with their comments removed, so they match on what
+    /// the code does. The stored chunk keeps its comments for the prompt.
+    #[serde(default)]
+    pub embed_without_comments: bool,
+    /// Embed each chunk under a header line naming its file, such as
+    /// `// file: src/auth/token.rs`, so questions that mention a path find
+    /// its chunks. The stored chunk is left without the header.
+    #[serde(default)]
+    pub prepend_source_path: bool,
+    /// Also index each file's path and name as a small document of its own,
+    /// so questions such as "where is the token refresh code" can find a
+    /// file by its name when its content doesn't match.
+    #[serde(default)]
+    pub index_paths: bool,
+    /// Skipping retrieval for greetings and acknowledgements
+    #[serde(default)]
+    pub trivial_queries: TrivialQueryConfig,
+    /// Retrieval of earlier conversation turns that no longer fit in the prompt
+    #[serde(default)]
+    pub conversation_recall: ConversationRecallConfig,
+    /// Embed an LLM-written summary of each indexed chunk instead of its text
+    #[serde(default)]
+    pub summary_index: SummaryIndexConfig,
+    /// Prepended to indexed content before embedding, e.g. `search_document: `
+    /// for models trained with task prefixes
+    #[serde(default)]
+    pub document_prefix: String,
+    /// Prepended to queries before embedding, e.g. `search_query: `
+    #[serde(default)]
+    pub query_prefix: String,
+    /// Scale every embedding to unit length before it is stored or searched,
+    /// so dot-product scores behave like cosine similarity
+    #[serde(default)]
+    pub normalize_embeddings: bool,
+    /// Embed a single word at startup so the embedding model is loaded before
+    /// the first index or query
+    #[serde(default)]
+    pub warmup_embedding_model: bool,
+    /// How long the model server keeps the embedding model loaded after a
+    /// request, e.g. `30m`. Sent as `keep_alive` on every embed request; unset
+    /// uses the server's default.
+    #[serde(default)]
+    pub embedding_keep_alive: Option<String>,
+    /// Named collections, each stored separately and embedded with its own
+    /// model, e.g. a code model for source and a prose model for docs
+    #[serde(default)]
+    pub collections: HashMap<String, CollectionConfig>,
+}
+
+/// A named collection alongside the default knowledge base.
+///
+/// Its documents are kept in a vector database collection of the same name
+/// and embedded with `embedding_model`, for both indexing and queries.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CollectionConfig {
+    pub embedding_model: EmbeddingModel,
+}
+
+fn default_candidate_multiplier() -> usize {
+    3
+}
+
+/// What to include in citations for retrieved chunks.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct CitationConfig {
+    /// Include the source file's last-modified time
+    #[serde(default)]
+    pub modified_time: bool,
+    /// Include the last commit and author for the cited lines from `git blame`.
+    /// Only used when the registry grants execute permission.
+    #[serde(default)]
+    pub git_blame: bool,
+    /// How the cited lines are written: `path:10-24` by default, or as a
+    /// `path:10` anchor or link an editor can jump to
+    #[serde(default)]
+    pub anchor: CitationAnchor,
+}
+
+impl CitationConfig {
+    /// Whether citations carry anything beyond the source path.
+    pub fn is_enabled(&self) -> bool {
+        self.modified_time || self.git_blame || self.anchor != CitationAnchor::Range
+    }
+}
+
+/// Format of the location in a citation.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CitationAnchor {
+    /// `src/main.rs:10-24`
+    #[default]
+    Range,
+    /// `src/main.rs:10`, the first cited line
+    Line,
+    /// `file:///home/me/project/src/main.rs#L10`
+    FileUri,
+    /// `vscode://file/home/me/project/src/main.rs:10`, opened by VS Code
+    Vscode,
+}
+
+/// Settings for retrieving earlier turns of a conversation.
+///
+/// When enabled, every chat turn of a request that names its `session` is
+/// embedded into an in-memory index for that session, and the turns most
+/// relevant to a new question in the same session are added to its context
+/// even after they've been trimmed from the history. Requests without a
+/// session are neither remembered nor recalled.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ConversationRecallConfig {
+    #[serde(default)]
+    pub enabled: bool,
+    /// Most earlier turns added to a prompt
+    #[serde(default = "default_recall_top_k")]
+    pub top_k: usize,
+    /// Most turns kept per session; the oldest are dropped first
+    #[serde(default = "default_recall_max_turns")]
+    pub max_turns: usize,
+}
+
+fn default_recall_top_k() -> usize {
+    3
+}
+
+fn default_recall_max_turns() -> usize {
+    200
+}
+
+impl Default for ConversationRecallConfig {
+    fn default() -> Self {
+        Self {
+            enabled: false,
+            top_k: default_recall_top_k(),
+            max_turns: default_recall_max_turns(),
+        }
+    }
+}
+
+/// Settings for recognizing queries not worth retrieving context for.
+///
+/// A query is trivial when it is shorter than `min_length` characters or
+/// every word in it is one of `words`, e.g. `hi` or `thanks!`. Chat turns
+/// with a trivial query are answered without embedding it or searching the
+/// knowledge base; explicit searches still run.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TrivialQueryConfig {
+    #[serde(default = "default_trivial_enabled")]
+    pub enabled: bool,
+    /// Queries with fewer characters, not counting surrounding whitespace
+    #[serde(default = "default_trivial_min_length")]
+    pub min_length: usize,
+    /// Words that carry no question on their own, compared case-insensitively
+    #[serde(default = "default_trivial_words")]
+    pub words: Vec<String>,
+}
+
+impl TrivialQueryConfig {
+    /// Whether retrieval should be skipped for `query`.
+    pub fn is_trivial(&self, query: &str) -> bool {
+        if !self.enabled {
+            return false;
+        }
+
+        let query = query.trim();
+        if query.chars().count() < self.min_length {
+            return true;
+        }
+
+        query
+            .split(|c: char| !c.is_alphanumeric() && c != '\'')
+            .filter(|word| !word.is_empty())
+            .all(|word| {
+                self.words
+                    .iter()
+                    .any(|trivial| trivial.eq_ignore_ascii_case(word))
+            })
+    }
+}
+
+impl Default for TrivialQueryConfig {
+    fn default() -> Self {
+        Self {
+            enabled: true,
+            min_length: default_trivial_min_length(),
+            words: default_trivial_words(),
+        }
+    }
+}
+
+fn default_rag_enabled() -> bool {
+    true
+}
+
+fn default_trivial_enabled() -> bool {
+    true
+}
+
+fn default_trivial_min_length() -> usize {
+    3
+}
+
+fn default_trivial_words() -> Vec<String> {
+    [
+        "hi", "hello", "hey", "thanks", "thank", "you", "thx", "ty", "ok", "okay", "yes", "no",
+        "yep", "nope", "sure", "cool", "great", "nice", "bye", "goodbye", "good", "morning",
+        "evening", "cheers", "lol",
+    ]
+    .into_iter()
+    .map(String::from)
+    .collect()
+}
+
+/// Settings for summary indexing.
+///
+/// When enabled, indexing asks the chat model for a one or two sentence
+/// summary of every chunk and embeds that summary, while the raw chunk is
+/// still what gets stored and added to prompts. This helps conceptual
+/// questions match code, at the cost of one chat call per chunk. Content added
+/// with `add` is embedded as is.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SummaryIndexConfig {
+    #[serde(default)]
+    pub enabled: bool,
+    /// Chat model used for summaries; defaults to `llm.model`
+    #[serde(default)]
+    pub model: Option<String>,
+}
+
+fn default_embedding_cache_size() -> usize {
+    10_000
 }
 
 /// Configuration for file indexing behavior.
@@ -113,6 +561,98 @@ pub struct IndexerConfig {
 
     /// Overlap between consecutive chunks in bytes
     pub chunk_overlap: usize,
+
+    /// How chunk document IDs are derived
+    #[serde(default)]
+    pub id_scheme: IdScheme,
+
+    /// Chunking strategy by file extension, e.g. `{ json: text }` or
+    /// `{ py: lines }` to only break chunks between lines.
+    /// Extends the defaults; see [`ChunkerRegistry`](crate::rag::ChunkerRegistry).
+    #[serde(default)]
+    pub chunkers: HashMap<String, String>,
+
+    /// Indexing a directory with more matching files than this fails with the
+    /// count unless forced, to catch accidental runs on huge trees. `0`
+    /// disables the check.
+    #[serde(default = "default_max_files")]
+    pub max_files: usize,
+
+    /// Scrubbing of secrets from file content before it is chunked and embedded
+    #[serde(default)]
+    pub redaction: RedactionConfig,
+
+    /// Walk into symlinked directories, as indexing always has. Each
+    /// directory is visited once by its resolved path, so symlink cycles are
+    /// skipped. Symlinked files are indexed either way.
+    #[serde(default = "default_follow_symlinks")]
+    pub follow_symlinks: bool,
+
+    /// End chunks of `.md`, `.markdown` and `.txt` files at the last sentence
+    /// end or line break in the window instead of at exactly `chunk_size`
+    /// bytes. Entries in `chunkers` for those extensions take precedence.
+    #[serde(default)]
+    pub sentence_aware: bool,
+
+    /// Leave out chunks with nothing to embed once preprocessed: those that
+    /// are only whitespace, or only comments when `rag.embed_without_comments`
+    /// is set. Files left with no chunks are skipped.
+    #[serde(default = "default_skip_blank")]
+    pub skip_blank: bool,
+}
+
+fn default_skip_blank() -> bool {
+    true
+}
+
+fn default_max_files() -> usize {
+    10_000
+}
+
+fn default_follow_symlinks() -> bool {
+    true
+}
+
+/// Settings for redacting indexed files.
+///
+/// When enabled, API keys, tokens, private keys and email addresses are
+/// replaced with placeholders such as `[REDACTED_EMAIL]` before a file is
+/// chunked, so they are never embedded or stored. Content added with `add`
+/// is stored as given.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct RedactionConfig {
+    #[serde(default)]
+    pub enabled: bool,
+    /// Extra regular expressions to redact, replaced with `[REDACTED]`
+    #[serde(default)]
+    pub patterns: Vec<String>,
+}
+
+/// What to do when retrieval runs against an empty knowledge base.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum EmptyNotice {
+    /// Suggest indexing the first time it happens
+    #[default]
+    WarnOnce,
+    /// Say nothing
+    Silent,
+}
+
+/// Scheme used to build document IDs for indexed chunks.
+///
+/// `relpath` and `hash` don't depend on where the files live, so exported
+/// collections stay valid when moved to another machine.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum IdScheme {
+    /// `<path>_chunk_<n>` using the path as indexed
+    #[default]
+    Path,
+    /// `<path relative to the indexed root>_chunk_<n>`
+    RelPath,
+    /// SHA-256 of the relative path, chunk number and chunk content
+    Hash,
 }
 
 fn default_exclude_patterns() -> Vec<String> {
@@ -130,6 +670,13 @@ impl Default for IndexerConfig {
             exclude_patterns: default_exclude_patterns(),
             chunk_size: 512,
             chunk_overlap: 50,
+            id_scheme: IdScheme::default(),
+            chunkers: HashMap::new(),
+            max_files: default_max_files(),
+            redaction: RedactionConfig::default(),
+            follow_symlinks: default_follow_symlinks(),
+            sentence_aware: false,
+            skip_blank: default_skip_blank(),
         }
     }
 }
@@ -142,6 +689,18 @@ pub enum StorageMode {
     Embedded { path: String },
     /// gRPC storage - connect to external vector database server
     Grpc { url: String },
+    /// In-memory storage - nothing is persisted, for experiments and tests
+    Memory {
+        /// Most documents the collection may hold. Indexing past it fails
+        /// rather than growing until the process runs out of memory. `0`
+        /// disables the cap.
+        #[serde(default = "default_max_memory_documents")]
+        max_documents: usize,
+    },
+}
+
+fn default_max_memory_documents() -> usize {
+    100_000
 }
 
 impl Default for StorageMode {
@@ -161,11 +720,41 @@ impl Default for RagConfig {
             exclude_patterns: default_exclude_patterns(),
             chunk_size: embedding_model.embedding_dim,
             chunk_overlap: 50,
+            id_scheme: IdScheme::default(),
+            chunkers: HashMap::new(),
+            max_files: default_max_files(),
+            redaction: RedactionConfig::default(),
+            follow_symlinks: default_follow_symlinks(),
+            sentence_aware: false,
+            skip_blank: default_skip_blank(),
         };
 
         Self {
+            enabled: true,
             embedding_model,
             indexer,
+            embedding_cache_size: default_embedding_cache_size(),
+            min_score: None,
+            citations: CitationConfig::default(),
+            inline_metadata: false,
+            candidate_multiplier: default_candidate_multiplier(),
+            rerank: false,
+            max_context_docs: None,
+            empty_notice: EmptyNotice::default(),
+            pinned: Vec::new(),
+            contextual_chunks: false,
+            embed_without_comments: false,
+            prepend_source_path: false,
+            index_paths: false,
+            trivial_queries: TrivialQueryConfig::default(),
+            conversation_recall: ConversationRecallConfig::default(),
+            summary_index: SummaryIndexConfig::default(),
+            document_prefix: String::new(),
+            query_prefix: String::new(),
+            normalize_embeddings: false,
+            warmup_embedding_model: false,
+            embedding_keep_alive: None,
+            collections: HashMap::new(),
         }
     }
 }
@@ -196,6 +785,66 @@ pub struct StorageConfig {
 pub struct VectorDbConfig {
     /// Collection/index name for storing vectors
     pub collection_name: String,
+    /// How query and stored vectors are compared
+    #[serde(default)]
+    pub similarity: SimilarityMetric,
+}
+
+/// Similarity used to score stored vectors against a query.
+///
+/// For Qdrant this is fixed when the collection is created; changing it for
+/// an existing collection has no effect until the collection is recreated.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SimilarityMetric {
+    /// Cosine of the angle between vectors, in `[-1, 1]`
+    #[default]
+    Cosine,
+    /// Raw dot product; equals cosine for unit-length vectors
+    Dot,
+}
+
+/// Settings for server mode.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ServerConfig {
+    /// Maximum number of chat requests handled at once. `0` means unlimited.
+    #[serde(default = "default_max_concurrent_chats")]
+    pub max_concurrent_chats: usize,
+    /// Reject chat requests beyond the limit instead of queuing them.
+    #[serde(default)]
+    pub reject_when_busy: bool,
+    /// Send the text streamed so far with the error when a chat fails midway,
+    /// instead of only the error.
+    #[serde(default)]
+    pub partial_on_error: bool,
+    /// Maximum number of embedding calls sent to the model server at once,
+    /// so indexing can't queue up ahead of chats. `0` means unlimited.
+    #[serde(default = "default_max_concurrent_embeddings")]
+    pub max_concurrent_embeddings: usize,
+    /// Hold back new embedding calls while a chat is retrieving context or
+    /// generating, so chats go ahead of background indexing.
+    #[serde(default)]
+    pub prioritize_chats: bool,
+}
+
+fn default_max_concurrent_chats() -> usize {
+    4
+}
+
+fn default_max_concurrent_embeddings() -> usize {
+    2
+}
+
+impl Default for ServerConfig {
+    fn default() -> Self {
+        Self {
+            max_concurrent_chats: default_max_concurrent_chats(),
+            reject_when_busy: false,
+            partial_on_error: false,
+            max_concurrent_embeddings: default_max_concurrent_embeddings(),
+            prioritize_chats: false,
+        }
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -218,6 +867,7 @@ impl Default for VectorDbConfig {
     fn default() -> Self {
         Self {
             collection_name: "nucleus_kb".to_string(),
+            similarity: SimilarityMetric::default(),
         }
     }
 }
@@ -242,6 +892,13 @@ impl Default for LlmConfig {
             base_url: "http://localhost:11434".to_string(),
             temperature: 0.6,
             context_length: 32768,
+            max_tokens: None,
+            request_timeout: None,
+            max_history_turns: 0,
+            fallback_model: None,
+            api_key_env: None,
+            headers: HashMap::new(),
+            thinking: ThinkingConfig::default(),
             coreml_input_name: default_input_name(),
             coreml_output_name: default_output_name(),
         }
@@ -255,10 +912,16 @@ impl Default for Config {
             system_prompt:
                 "You are a helpful AI assistant specializing in programming and development tasks."
                     .to_string(),
+            system_prompt_suffix: String::new(),
+            response_language: None,
             rag: None,
             storage: StorageConfig::default(),
             personalization: PersonalizationConfig::default(),
+            server: ServerConfig::default(),
+            plugins: Vec::new(),
+            templates_dir: default_templates_dir(),
             permission: Permission::default(),
+            provenance: Provenance::default(),
         }
     }
 }
@@ -267,13 +930,96 @@ impl Config {
     /// Load configuration from a YAML file.
     pub fn load<P: AsRef<Path>>(path: P) -> Result<Self> {
         let contents = fs::read_to_string(path)?;
-        let mut config: Config = serde_yaml::from_str(&contents)?;
+        Self::from_yaml(&contents)
+    }
+
+    /// Parse configuration from YAML text.
+    ///
+    /// When [`ENV_VAR`] names an entry of the top-level `environments:`
+    /// section, that entry is laid over the rest of the file, as with
+    /// [`from_yaml_for_env`](Self::from_yaml_for_env). Then the
+    /// [retrieval settings](crate::provenance::RETRIEVAL_SETTINGS) set by
+    /// `NUCLEUS_<SETTING>` variables, such as `NUCLEUS_STORAGE_TOP_K=12`, are
+    /// taken from the environment.
+    pub fn from_yaml(yaml: &str) -> Result<Self> {
+        Self::resolve(yaml, &|name| {
+            std::env::var(name).ok().filter(|value| !value.is_empty())
+        })
+    }
+
+    /// Parse configuration from YAML text for the environment `env`.
+    ///
+    /// The `environments:` section maps names such as `dev` and `prod` to
+    /// partial configs. The one for `env` is merged over the base config key
+    /// by key, so `prod: { storage: { top_k: 10 } }` changes `top_k` and
+    /// keeps the rest of `storage`; lists and other values are replaced
+    /// whole. Any setting can be overlaid, from the model to storage paths
+    /// and server limits.
+    ///
+    /// With no `env`, the file is used as is. Naming an environment the file
+    /// doesn't define, including in a file without `environments:`, is an
+    /// error, so a typo can't silently run with the base settings. No other
+    /// environment variables are read.
+    pub fn from_yaml_for_env(yaml: &str, env: Option<&str>) -> Result<Self> {
+        Self::resolve(yaml, &|name| {
+            if name == ENV_VAR {
+                env.map(str::to_string)
+            } else {
+                None
+            }
+        })
+    }
+
+    /// Parses `yaml`, reading environment variables through `vars`, and
+    /// records where each retrieval setting came from.
+    fn resolve(yaml: &str, vars: &dyn Fn(&str) -> Option<String>) -> Result<Self> {
+        let mut value: serde_yaml::Value = serde_yaml::from_str(yaml)?;
+        let environments = value
+            .as_mapping_mut()
+            .and_then(|root| root.remove("environments"));
 
-        config.permission = Permission::default();
+        let mut provenance = Provenance::default();
+        provenance.record_present(&value, &Origin::File);
+        if let Some(name) = vars(ENV_VAR) {
+            let overlay = environments
+                .as_ref()
+                .and_then(|environments| environments.get(&name))
+                .cloned()
+                .ok_or_else(|| ConfigError::UnknownEnvironment(name.clone()))?;
+            provenance.record_present(&overlay, &Origin::Profile(name));
+            merge_yaml(&mut value, overlay);
+        }
+        provenance.apply_env(&mut value, vars)?;
+
+        let mut config: Config = serde_yaml::from_value(value)?;
+        config.provenance = provenance;
 
         Ok(config)
     }
 
+    /// Load configuration from a file path, URL, or environment variable.
+    ///
+    /// - `http://…` and `https://…` are fetched, giving up after 10 seconds
+    /// - `env:NAME` reads the YAML from the `NAME` environment variable
+    /// - anything else is a file path, as with [`load`](Self::load)
+    pub async fn load_from(source: &str) -> Result<Self> {
+        if let Some(name) = source.strip_prefix("env:") {
+            let yaml =
+                std::env::var(name).map_err(|_| ConfigError::MissingEnv(name.to_string()))?;
+            return Self::from_yaml(&yaml);
+        }
+
+        if source.starts_with("http://") || source.starts_with("https://") {
+            let yaml = fetch(source).await.map_err(|e| ConfigError::Fetch {
+                url: source.to_string(),
+                message: e.to_string(),
+            })?;
+            return Self::from_yaml(&yaml);
+        }
+
+        Self::load(source)
+    }
+
     /// Load configuration from `config.yaml` if it exists, otherwise use defaults.
     pub fn load_or_default() -> Self {
         Self::load("config.yaml").unwrap_or_default()
@@ -302,6 +1048,12 @@ impl Config {
         self
     }
 
+    /// Set the language responses should be written in.
+    pub fn with_response_language(mut self, language: impl Into<String>) -> Self {
+        self.response_language = Some(language.into());
+        self
+    }
+
     /// Set the base URL for the LLM provider.
     pub fn with_base_url(mut self, url: impl Into<String>) -> Self {
         self.llm.base_url = url.into();
@@ -314,6 +1066,19 @@ impl Config {
         self
     }
 
+    /// Set the default maximum number of tokens per response.
+    pub fn with_max_tokens(mut self, max_tokens: usize) -> Self {
+        self.llm.max_tokens = Some(max_tokens);
+        self
+    }
+
+    /// Set how many of the most recent conversation turns are sent with each
+    /// request. `0` keeps the whole history.
+    pub fn with_max_history_turns(mut self, turns: usize) -> Self {
+        self.llm.max_history_turns = turns;
+        self
+    }
+
     /// Set the LLM provider type.
     pub fn with_provider(mut self, provider: impl Into<String>) -> Self {
         self.llm.provider = provider.into();
@@ -340,6 +1105,106 @@ impl Config {
         self.personalization = personalization_config;
         self
     }
+
+    /// Configure server mode settings.
+    pub fn with_server_config(mut self, server_config: ServerConfig) -> Self {
+        self.server = server_config;
+        self
+    }
+
+    /// Set the plugins to load at startup.
+    pub fn with_plugins(mut self, plugins: Vec<String>) -> Self {
+        self.plugins = plugins;
+        self
+    }
+
+    /// Whether the knowledge base is turned off with `rag.enabled: false`.
+    pub fn rag_disabled(&self) -> bool {
+        self.rag.as_ref().is_some_and(|rag| !rag.enabled)
+    }
+
+    /// Every [retrieval setting](crate::provenance::RETRIEVAL_SETTINGS) with
+    /// its effective value and where that came from, one per line, e.g.
+    /// `storage.top_k = 12 (env NUCLEUS_STORAGE_TOP_K)`.
+    pub fn explain_retrieval(&self) -> String {
+        let value = serde_yaml::to_value(self).unwrap_or_default();
+        RETRIEVAL_SETTINGS
+            .iter()
+            .map(|path| {
+                let setting = match provenance::lookup(&value, path) {
+                    None | Some(serde_yaml::Value::Null) => "unset".to_string(),
+                    Some(serde_yaml::Value::String(text)) => text.clone(),
+                    Some(other) => serde_yaml::to_string(other)
+                        .map(|text| text.trim_end().to_string())
+                        .unwrap_or_default(),
+                };
+                format!("{} = {} ({})", path, setting, self.provenance.origin(path))
+            })
+            .collect::<Vec<_>>()
+            .join("\n")
+    }
+
+    /// A copy safe to print or log: literal header values are replaced with
+    /// [`REDACTED`]. `env:` references and `api_key_env` are kept, since they
+    /// only name the variable.
+    pub fn redacted(&self) -> Self {
+        let mut config = self.clone();
+        for value in config.llm.headers.values_mut() {
+            if !value.starts_with("env:") {
+                *value = REDACTED.to_string();
+            }
+        }
+        config
+    }
+
+    /// Files and directories nucleus writes its own state to: the embedded
+    /// vector database, chat history, tool state and user preferences.
+    ///
+    /// Indexing never walks into these.
+    pub fn data_paths(&self) -> Vec<PathBuf> {
+        let mut paths = vec![
+            PathBuf::from(&self.storage.chat_history_path),
+            PathBuf::from(&self.storage.tool_state_path),
+            PathBuf::from(&self.personalization.user_preferences_path),
+        ];
+        if let StorageMode::Embedded { path } = &self.storage.storage_mode {
+            paths.insert(0, PathBuf::from(path));
+        }
+        paths
+    }
+}
+
+/// Merges `overlay` into `base`: mappings key by key, anything else by
+/// replacing it.
+fn merge_yaml(base: &mut serde_yaml::Value, overlay: serde_yaml::Value) {
+    match (base, overlay) {
+        (serde_yaml::Value::Mapping(base), serde_yaml::Value::Mapping(overlay)) => {
+            for (key, value) in overlay {
+                match base.get_mut(&key) {
+                    Some(existing) => merge_yaml(existing, value),
+                    None => {
+                        base.insert(key, value);
+                    }
+                }
+            }
+        }
+        (base, overlay) => *base = overlay,
+    }
+}
+
+/// How long [`Config::load_from`] waits for a remote config.
+const FETCH_TIMEOUT: Duration = Duration::from_secs(10);
+
+async fn fetch(url: &str) -> std::result::Result<String, reqwest::Error> {
+    reqwest::Client::builder()
+        .timeout(FETCH_TIMEOUT)
+        .build()?
+        .get(url)
+        .send()
+        .await?
+        .error_for_status()?
+        .text()
+        .await
 }
 
 #[cfg(test)]
@@ -354,6 +1219,24 @@ mod tests {
         assert!(perm.command);
     }
 
+    #[test]
+    fn test_permission_read_from_file() {
+        let mut value = serde_yaml::to_value(Config::default()).unwrap();
+        value.as_mapping_mut().unwrap().insert(
+            "permission".into(),
+            serde_yaml::from_str("{ command: false, write_roots: [/home/me/project] }").unwrap(),
+        );
+        let config = Config::from_yaml(&serde_yaml::to_string(&value).unwrap()).unwrap();
+
+        assert!(config.permission.write);
+        assert!(!config.permission.command);
+        assert_eq!(config.permission.write_roots, vec!["/home/me/project"]);
+        assert_eq!(
+            config.permission.granted(),
+            nucleus_plugin::Permission::READ_WRITE
+        );
+    }
+
     #[test]
     fn test_vector_db_config_default() {
         let config = VectorDbConfig::default();
@@ -374,4 +1257,234 @@ mod tests {
         let config = RagConfig::default();
         assert_eq!(config.embedding_model.name, EmbeddingModel::default().name);
     }
+
+    #[test]
+    fn test_trivial_queries_are_short_or_only_pleasantries() {
+        let trivial = TrivialQueryConfig::default();
+        assert!(trivial.is_trivial("hi"));
+        assert!(trivial.is_trivial("Thanks!"));
+        assert!(trivial.is_trivial("ok, thank you"));
+        assert!(trivial.is_trivial(" ? "));
+        assert!(!trivial.is_trivial("thanks, where is the config parsed?"));
+
+        let disabled = TrivialQueryConfig {
+            enabled: false,
+            ..TrivialQueryConfig::default()
+        };
+        assert!(!disabled.is_trivial("hi"));
+    }
+
+    #[test]
+    fn test_data_paths_cover_storage_and_preferences() {
+        let paths = Config::default().data_paths();
+        assert_eq!(
+            paths,
+            vec![
+                PathBuf::from("./data/nucleus_vectordb"),
+                PathBuf::from("./data/history"),
+                PathBuf::from("./data/tool_state"),
+                PathBuf::from("./data/preferences.json"),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_plugins_default_to_empty() {
+        let mut value =
+            serde_yaml::to_value(Config::default().with_plugins(vec!["jira".into()])).unwrap();
+        let parsed: Config = serde_yaml::from_value(value.clone()).unwrap();
+        assert_eq!(parsed.plugins, vec!["jira".to_string()]);
+
+        value.as_mapping_mut().unwrap().remove("plugins");
+        let parsed: Config = serde_yaml::from_value(value).unwrap();
+        assert!(parsed.plugins.is_empty());
+    }
+
+    /// Serves `response` to the first connection and returns the URL.
+    async fn serve_once(response: String) -> String {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let url = format!("http://{}/config.yaml", listener.local_addr().unwrap());
+        tokio::spawn(async move {
+            let (mut socket, _) = listener.accept().await.unwrap();
+            let mut request = [0; 1024];
+            let _ = socket.read(&mut request).await;
+            socket.write_all(response.as_bytes()).await.unwrap();
+        });
+        url
+    }
+
+    fn remote_yaml() -> String {
+        serde_yaml::to_string(
+            &Config::default()
+                .with_system_prompt("remote")
+                .with_model("qwen3:8b"),
+        )
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_load_from_url() {
+        let yaml = remote_yaml();
+        let url = serve_once(format!(
+            "HTTP/1.1 200 OK\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+            yaml.len(),
+            yaml
+        ))
+        .await;
+
+        let config = Config::load_from(&url).await.unwrap();
+
+        assert_eq!(config.system_prompt, "remote");
+        assert_eq!(config.llm.model, "qwen3:8b");
+    }
+
+    #[tokio::test]
+    async fn test_load_from_url_reports_http_errors() {
+        let url = serve_once(
+            "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n".to_string(),
+        )
+        .await;
+
+        let err = Config::load_from(&url).await.unwrap_err();
+
+        assert!(matches!(err, ConfigError::Fetch { .. }));
+        assert!(err.to_string().contains("404"));
+    }
+
+    #[tokio::test]
+    async fn test_load_from_env_var() {
+        std::env::set_var("NUCLEUS_TEST_INLINE_CONFIG", remote_yaml());
+
+        let config = Config::load_from("env:NUCLEUS_TEST_INLINE_CONFIG")
+            .await
+            .unwrap();
+        assert_eq!(config.system_prompt, "remote");
+
+        let missing = Config::load_from("env:NUCLEUS_TEST_UNSET_CONFIG").await;
+        assert!(
+            matches!(missing, Err(ConfigError::MissingEnv(name)) if name == "NUCLEUS_TEST_UNSET_CONFIG")
+        );
+    }
+
+    #[test]
+    fn test_nucleus_env_applies_environment_overlay() {
+        let yaml = format!(
+            "{}environments:
+  prod:
+    llm:
+      model: qwen3:32b
+    storage:
+      chat_history_path: /var/lib/nucleus/history
+    server:
+      max_concurrent_chats: 16
+  dev:
+    llm:
+      model: qwen3:0.6b
+",
+            serde_yaml::to_string(&Config::default()).unwrap()
+        );
+
+        // Not through NUCLEUS_ENV, which would make every other test's
+        // `from_yaml` ask for `prod` too.
+        let prod = Config::from_yaml_for_env(&yaml, Some("prod")).unwrap();
+        let base = Config::default();
+        assert_eq!(prod.llm.model, "qwen3:32b");
+        assert_eq!(prod.storage.chat_history_path, "/var/lib/nucleus/history");
+        assert_eq!(prod.server.max_concurrent_chats, 16);
+        // Keys the overlay leaves out keep their base values.
+        assert_eq!(prod.llm.base_url, base.llm.base_url);
+        assert_eq!(prod.storage.tool_state_path, base.storage.tool_state_path);
+
+        let unselected = Config::from_yaml_for_env(&yaml, None).unwrap();
+        assert_eq!(unselected.llm.model, base.llm.model);
+        assert!(matches!(
+            Config::from_yaml_for_env(&yaml, Some("staging")),
+            Err(ConfigError::UnknownEnvironment(name)) if name == "staging"
+        ));
+    }
+
+    #[test]
+    fn test_nucleus_env_without_environments_section_is_rejected() {
+        let yaml = serde_yaml::to_string(&Config::default()).unwrap();
+
+        assert!(Config::from_yaml_for_env(&yaml, None).is_ok());
+        assert!(matches!(
+            Config::from_yaml_for_env(&yaml, Some("prod")),
+            Err(ConfigError::UnknownEnvironment(name)) if name == "prod"
+        ));
+    }
+
+    #[test]
+    fn test_provenance_attributes_env_over_file() {
+        let mut file = Config::default().with_rag_config(RagConfig::default());
+        file.storage.top_k = 8;
+        let mut value = serde_yaml::to_value(&file).unwrap();
+        value["rag"].as_mapping_mut().unwrap().remove("rerank");
+        let yaml = format!(
+            "{}environments:\n  prod:\n    rag:\n      min_score: 0.5\n",
+            serde_yaml::to_string(&value).unwrap()
+        );
+
+        let vars = |name: &str| match name {
+            "NUCLEUS_ENV" => Some("prod".to_string()),
+            "NUCLEUS_STORAGE_TOP_K" => Some("12".to_string()),
+            _ => None,
+        };
+        let config = Config::resolve(&yaml, &vars).unwrap();
+
+        assert_eq!(config.storage.top_k, 12);
+        let origin = |path: &str| config.provenance.origin(path);
+        assert_eq!(
+            origin("storage.top_k"),
+            Origin::Env("NUCLEUS_STORAGE_TOP_K".to_string())
+        );
+        assert_eq!(origin("rag.min_score"), Origin::Profile("prod".to_string()));
+        assert_eq!(origin("rag.candidate_multiplier"), Origin::File);
+        assert_eq!(origin("rag.rerank"), Origin::Default);
+
+        let explained = config.explain_retrieval();
+        assert!(explained.contains("storage.top_k = 12 (env NUCLEUS_STORAGE_TOP_K)"));
+        assert!(explained.contains("rag.min_score = 0.5 (profile prod)"));
+        assert!(explained.contains("rag.rerank = false (default)"));
+        assert!(explained.contains("rag.max_context_docs = unset (file)"));
+
+        // No variables are read when the environment is passed in.
+        let config = Config::from_yaml_for_env(&yaml, None).unwrap();
+        assert_eq!(config.storage.top_k, 8);
+        assert_eq!(config.provenance.origin("storage.top_k"), Origin::File);
+    }
+
+    #[test]
+    fn test_headers_resolve_env_and_redact_literals() {
+        std::env::set_var("NUCLEUS_TEST_API_KEY", "key-123");
+        let mut config = Config::default();
+        config.llm.api_key_env = Some("NUCLEUS_TEST_API_KEY".to_string());
+        config.llm.headers = HashMap::from([
+            ("X-Org".to_string(), "env:NUCLEUS_TEST_API_KEY".to_string()),
+            ("X-Secret".to_string(), "literal-secret".to_string()),
+        ]);
+
+        assert_eq!(
+            config.llm.request_headers().unwrap(),
+            vec![
+                ("Authorization".to_string(), "Bearer key-123".to_string()),
+                ("X-Org".to_string(), "key-123".to_string()),
+                ("X-Secret".to_string(), "literal-secret".to_string()),
+            ]
+        );
+
+        let dump = serde_yaml::to_string(&config.redacted()).unwrap();
+        assert!(!dump.contains("literal-secret"));
+        assert!(!dump.contains("key-123"));
+        assert!(dump.contains(REDACTED));
+        assert!(dump.contains("env:NUCLEUS_TEST_API_KEY"));
+
+        config.llm.api_key_env = Some("NUCLEUS_TEST_UNSET_API_KEY".to_string());
+        assert!(matches!(
+            config.llm.request_headers(),
+            Err(ConfigError::MissingEnv(name)) if name == "NUCLEUS_TEST_UNSET_API_KEY"
+        ));
+    }
 }
@@ -0,0 +1,541 @@
+//! Setup checks for diagnosing a broken installation.
+//!
+//! [`run`] checks, in order, that the config parses and is valid, that Ollama
+//! is reachable and has the chat and embedding models, and that the vector
+//! database storage is writable and opens. Each failure comes with a hint on
+//! how to fix it.
+//!
+//! # Example
+//!
+//! ```no_run
+//! use nucleus_core::doctor::{self, SystemEnvironment};
+//!
+//! # async fn example() {
+//! let report = doctor::run(None, &SystemEnvironment).await;
+//! println!("{}", report);
+//! std::process::exit(report.exit_code());
+//! # }
+//! ```
+
+use crate::config::{Config, StorageMode};
+use async_trait::async_trait;
+use std::fmt;
+use std::path::Path;
+use std::time::Duration;
+
+/// Outcome of a single check.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum CheckStatus {
+    Pass,
+    Fail,
+    /// Not applicable to this config, or blocked by an earlier failure.
+    Skip,
+}
+
+/// Result of one doctor check.
+#[derive(Debug, Clone, PartialEq)]
+pub struct CheckResult {
+    pub name: &'static str,
+    pub status: CheckStatus,
+    pub detail: String,
+    /// How to fix a failure.
+    pub hint: Option<String>,
+}
+
+impl CheckResult {
+    fn pass(name: &'static str, detail: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: CheckStatus::Pass,
+            detail: detail.into(),
+            hint: None,
+        }
+    }
+
+    fn fail(name: &'static str, detail: impl Into<String>, hint: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: CheckStatus::Fail,
+            detail: detail.into(),
+            hint: Some(hint.into()),
+        }
+    }
+
+    fn skip(name: &'static str, detail: impl Into<String>) -> Self {
+        Self {
+            name,
+            status: CheckStatus::Skip,
+            detail: detail.into(),
+            hint: None,
+        }
+    }
+}
+
+/// Every check that was run, in order.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct DoctorReport {
+    pub checks: Vec<CheckResult>,
+}
+
+impl DoctorReport {
+    /// Whether no check failed.
+    pub fn passed(&self) -> bool {
+        self.checks.iter().all(|c| c.status != CheckStatus::Fail)
+    }
+
+    /// Process exit code: `0` if every check passed or was skipped, `1` otherwise.
+    pub fn exit_code(&self) -> i32 {
+        if self.passed() {
+            0
+        } else {
+            1
+        }
+    }
+
+    /// The result of the check with the given name.
+    pub fn check(&self, name: &str) -> Option<&CheckResult> {
+        self.checks.iter().find(|c| c.name == name)
+    }
+}
+
+impl fmt::Display for DoctorReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for check in &self.checks {
+            let mark = match check.status {
+                CheckStatus::Pass => "✓",
+                CheckStatus::Fail => "✗",
+                CheckStatus::Skip => "-",
+            };
+            writeln!(f, "{} {}: {}", mark, check.name, check.detail)?;
+            if let Some(hint) = &check.hint {
+                writeln!(f, "    → {}", hint)?;
+            }
+        }
+
+        let failed = self
+            .checks
+            .iter()
+            .filter(|c| c.status == CheckStatus::Fail)
+            .count();
+        match failed {
+            0 => write!(f, "\nAll checks passed"),
+            n => write!(f, "\n{} check(s) failed", n),
+        }
+    }
+}
+
+/// The outside world the checks talk to, so they can be faked in tests.
+#[async_trait]
+pub trait Environment: Send + Sync {
+    /// Names of the models served by the Ollama server at `base_url`.
+    async fn ollama_models(&self, base_url: &str) -> std::result::Result<Vec<String>, String>;
+
+    /// Opens the vector store described by `config`.
+    async fn open_store(&self, config: &Config) -> std::result::Result<(), String>;
+}
+
+/// The real environment: Ollama over HTTP and the configured vector store.
+pub struct SystemEnvironment;
+
+#[async_trait]
+impl Environment for SystemEnvironment {
+    async fn ollama_models(&self, base_url: &str) -> std::result::Result<Vec<String>, String> {
+        #[derive(serde::Deserialize)]
+        struct Tags {
+            models: Vec<Tag>,
+        }
+        #[derive(serde::Deserialize)]
+        struct Tag {
+            name: String,
+        }
+
+        let client = reqwest::Client::builder()
+            .timeout(Duration::from_secs(5))
+            .build()
+            .map_err(|e| e.to_string())?;
+        let tags: Tags = client
+            .get(format!("{}/api/tags", base_url.trim_end_matches('/')))
+            .send()
+            .await
+            .and_then(|response| response.error_for_status())
+            .map_err(|e| e.to_string())?
+            .json()
+            .await
+            .map_err(|e| e.to_string())?;
+
+        Ok(tags.models.into_iter().map(|tag| tag.name).collect())
+    }
+
+    async fn open_store(&self, config: &Config) -> std::result::Result<(), String> {
+        let dim = config
+            .rag
+            .as_ref()
+            .map(|rag| rag.embedding_model.embedding_dim)
+            .unwrap_or_default();
+        crate::rag::create_vector_store(config.storage.clone(), dim as u64)
+            .await
+            .map(|_| ())
+            .map_err(|e| e.to_string())
+    }
+}
+
+/// Runs every check.
+///
+/// `config_path` is the config file to check. Without one, `config.yaml` is
+/// used if it exists and the defaults otherwise.
+pub async fn run(config_path: Option<&Path>, env: &dyn Environment) -> DoctorReport {
+    let path = config_path.unwrap_or_else(|| Path::new("config.yaml"));
+    let config = if config_path.is_none() && !path.exists() {
+        Ok((
+            Config::default(),
+            "no config.yaml, using defaults".to_string(),
+        ))
+    } else {
+        Config::load(path)
+            .map(|config| (config, format!("loaded {}", path.display())))
+            .map_err(|e| format!("{}: {}", path.display(), e))
+    };
+
+    run_checks(config, env).await
+}
+
+/// Runs every check against an already loaded (or failed) config.
+pub async fn run_checks(
+    config: std::result::Result<(Config, String), String>,
+    env: &dyn Environment,
+) -> DoctorReport {
+    let mut report = DoctorReport::default();
+
+    let config = match config {
+        Ok((config, source)) => {
+            let problems = validate(&config);
+            if problems.is_empty() {
+                report.checks.push(CheckResult::pass("config", source));
+            } else {
+                report.checks.push(CheckResult::fail(
+                    "config",
+                    problems.join("; "),
+                    "Fix the listed values in your config file",
+                ));
+            }
+            config
+        }
+        Err(e) => {
+            report.checks.push(CheckResult::fail(
+                "config",
+                e,
+                "Check the file exists and is valid YAML matching the documented config format",
+            ));
+            for name in [
+                "ollama",
+                "chat model",
+                "embedding model",
+                "storage",
+                "database",
+            ] {
+                report
+                    .checks
+                    .push(CheckResult::skip(name, "config could not be loaded"));
+            }
+            return report;
+        }
+    };
+
+    check_ollama(&config, env, &mut report).await;
+
+    let writable = check_storage(&config);
+    let storage_ok = writable.status != CheckStatus::Fail;
+    report.checks.push(writable);
+
+    report.checks.push(if storage_ok {
+        match env.open_store(&config).await {
+            Ok(()) => CheckResult::pass("database", "vector store opened"),
+            Err(e) => CheckResult::fail(
+                "database",
+                format!("could not open vector store: {}", e),
+                match config.storage.storage_mode {
+                    StorageMode::Grpc { .. } => "Make sure the Qdrant server is running and reachable",
+                    StorageMode::Memory { .. } => "Check the storage configuration",
+                    StorageMode::Embedded { .. } => {
+                        "The database files may be corrupt or from an incompatible version; move them aside and re-index"
+                    }
+                },
+            ),
+        }
+    } else {
+        CheckResult::skip("database", "storage is not writable")
+    });
+
+    report
+}
+
+/// Problems with config values that parse but can't work.
+fn validate(config: &Config) -> Vec<String> {
+    let mut problems = Vec::new();
+
+    if config.llm.model.trim().is_empty() {
+        problems.push("llm.model is empty".to_string());
+    }
+    if !(0.0..=2.0).contains(&config.llm.temperature) {
+        problems.push(format!(
+            "llm.temperature {} is outside 0.0-2.0",
+            config.llm.temperature
+        ));
+    }
+    if config.llm.context_length == 0 {
+        problems.push("llm.context_length must be greater than 0".to_string());
+    }
+    if config.storage.top_k == 0 {
+        problems.push("storage.top_k must be greater than 0".to_string());
+    }
+    if let Some(rag) = &config.rag {
+        if rag.indexer.chunk_size == 0 {
+            problems.push("rag.indexer.chunk_size must be greater than 0".to_string());
+        } else if rag.indexer.chunk_overlap >= rag.indexer.chunk_size {
+            problems.push(format!(
+                "rag.indexer.chunk_overlap ({}) must be smaller than chunk_size ({})",
+                rag.indexer.chunk_overlap, rag.indexer.chunk_size
+            ));
+        }
+    }
+
+    problems
+}
+
+async fn check_ollama(config: &Config, env: &dyn Environment, report: &mut DoctorReport) {
+    if config.llm.provider != "ollama" {
+        let detail = format!("provider is {}", config.llm.provider);
+        for name in ["ollama", "chat model", "embedding model"] {
+            report.checks.push(CheckResult::skip(name, detail.clone()));
+        }
+        return;
+    }
+
+    let models = match env.ollama_models(&config.llm.base_url).await {
+        Ok(models) => {
+            report.checks.push(CheckResult::pass(
+                "ollama",
+                format!("reachable at {}", config.llm.base_url),
+            ));
+            models
+        }
+        Err(e) => {
+            report.checks.push(CheckResult::fail(
+                "ollama",
+                format!("not reachable at {}: {}", config.llm.base_url, e),
+                "Start Ollama with `ollama serve`, or fix llm.base_url",
+            ));
+            for name in ["chat model", "embedding model"] {
+                report
+                    .checks
+                    .push(CheckResult::skip(name, "Ollama is not reachable"));
+            }
+            return;
+        }
+    };
+
+    report
+        .checks
+        .push(check_model("chat model", &config.llm.model, &models));
+
+    report.checks.push(match &config.rag {
+        Some(rag) => check_model("embedding model", &rag.embedding_model.name, &models),
+        None => CheckResult::skip("embedding model", "RAG is not configured"),
+    });
+}
+
+fn check_model(name: &'static str, model: &str, available: &[String]) -> CheckResult {
+    let present = available
+        .iter()
+        .any(|m| m == model || m.strip_suffix(":latest") == Some(model));
+
+    if present {
+        CheckResult::pass(name, format!("{} is available", model))
+    } else {
+        CheckResult::fail(
+            name,
+            format!("{} is not pulled", model),
+            format!("Run `ollama pull {}`", model),
+        )
+    }
+}
+
+fn check_storage(config: &Config) -> CheckResult {
+    let StorageMode::Embedded { path } = &config.storage.storage_mode else {
+        return CheckResult::skip("storage", "using a remote vector database");
+    };
+
+    let dir = Path::new(path);
+    let probe = dir.join(".nucleus-doctor");
+    let written = std::fs::create_dir_all(dir)
+        .and_then(|_| std::fs::write(&probe, b"ok"))
+        .and_then(|_| std::fs::remove_file(&probe));
+
+    match written {
+        Ok(()) => CheckResult::pass("storage", format!("{} is writable", path)),
+        Err(e) => CheckResult::fail(
+            "storage",
+            format!("{} is not writable: {}", path, e),
+            "Point storage.storage_mode.path at a directory you can write to",
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::RagConfig;
+    use tempfile::tempdir;
+
+    struct FakeEnvironment {
+        models: std::result::Result<Vec<String>, String>,
+        store: std::result::Result<(), String>,
+    }
+
+    impl FakeEnvironment {
+        fn healthy() -> Self {
+            Self {
+                models: Ok(vec![
+                    "qwen3:8b".to_string(),
+                    "nomic-embed-text:latest".to_string(),
+                ]),
+                store: Ok(()),
+            }
+        }
+    }
+
+    #[async_trait]
+    impl Environment for FakeEnvironment {
+        async fn ollama_models(&self, _base_url: &str) -> std::result::Result<Vec<String>, String> {
+            self.models.clone()
+        }
+
+        async fn open_store(&self, _config: &Config) -> std::result::Result<(), String> {
+            self.store.clone()
+        }
+    }
+
+    fn config(storage: &Path) -> Config {
+        let mut rag = RagConfig::default();
+        rag.embedding_model.name = "nomic-embed-text".to_string();
+
+        let mut config = Config::default()
+            .with_provider("ollama")
+            .with_model("qwen3:8b")
+            .with_rag_config(rag);
+        config.storage.storage_mode = StorageMode::Embedded {
+            path: storage.to_string_lossy().to_string(),
+        };
+        config
+    }
+
+    async fn run_with(config: Config, env: FakeEnvironment) -> DoctorReport {
+        run_checks(Ok((config, "test config".to_string())), &env).await
+    }
+
+    fn status(report: &DoctorReport, name: &str) -> CheckStatus {
+        report.check(name).unwrap().status
+    }
+
+    #[tokio::test]
+    async fn test_all_checks_pass() {
+        let dir = tempdir().unwrap();
+        let report = run_with(config(&dir.path().join("db")), FakeEnvironment::healthy()).await;
+
+        assert!(report.passed(), "{}", report);
+        assert_eq!(report.exit_code(), 0);
+        assert_eq!(report.checks.len(), 6);
+    }
+
+    #[tokio::test]
+    async fn test_unparseable_config_fails_and_skips_the_rest() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("config.yaml");
+        std::fs::write(&path, "llm: [not, a, mapping").unwrap();
+
+        let report = run(Some(&path), &FakeEnvironment::healthy()).await;
+
+        assert_eq!(status(&report, "config"), CheckStatus::Fail);
+        assert_eq!(status(&report, "database"), CheckStatus::Skip);
+        assert_eq!(report.exit_code(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_invalid_config_values_fail() {
+        let dir = tempdir().unwrap();
+        let mut config = config(&dir.path().join("db"));
+        config.llm.temperature = 5.0;
+
+        let report = run_with(config, FakeEnvironment::healthy()).await;
+
+        let check = report.check("config").unwrap();
+        assert_eq!(check.status, CheckStatus::Fail);
+        assert!(check.detail.contains("llm.temperature"));
+    }
+
+    #[tokio::test]
+    async fn test_ollama_down() {
+        let dir = tempdir().unwrap();
+        let env = FakeEnvironment {
+            models: Err("connection refused".to_string()),
+            ..FakeEnvironment::healthy()
+        };
+
+        let report = run_with(config(&dir.path().join("db")), env).await;
+
+        assert_eq!(status(&report, "ollama"), CheckStatus::Fail);
+        assert!(report
+            .check("ollama")
+            .unwrap()
+            .hint
+            .as_deref()
+            .unwrap()
+            .contains("ollama serve"));
+        assert_eq!(status(&report, "chat model"), CheckStatus::Skip);
+        assert_eq!(report.exit_code(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_missing_models() {
+        let dir = tempdir().unwrap();
+        let env = FakeEnvironment {
+            models: Ok(vec!["llama3.2:3b".to_string()]),
+            ..FakeEnvironment::healthy()
+        };
+
+        let report = run_with(config(&dir.path().join("db")), env).await;
+
+        let chat = report.check("chat model").unwrap();
+        assert_eq!(chat.status, CheckStatus::Fail);
+        assert_eq!(chat.hint.as_deref(), Some("Run `ollama pull qwen3:8b`"));
+        assert_eq!(status(&report, "embedding model"), CheckStatus::Fail);
+    }
+
+    #[tokio::test]
+    async fn test_unwritable_storage_skips_database() {
+        let dir = tempdir().unwrap();
+        let file = dir.path().join("not-a-dir");
+        std::fs::write(&file, "").unwrap();
+
+        let report = run_with(config(&file.join("db")), FakeEnvironment::healthy()).await;
+
+        assert_eq!(status(&report, "storage"), CheckStatus::Fail);
+        assert_eq!(status(&report, "database"), CheckStatus::Skip);
+    }
+
+    #[tokio::test]
+    async fn test_database_fails_to_open() {
+        let dir = tempdir().unwrap();
+        let env = FakeEnvironment {
+            store: Err("corrupt manifest".to_string()),
+            ..FakeEnvironment::healthy()
+        };
+
+        let report = run_with(config(&dir.path().join("db")), env).await;
+
+        assert_eq!(status(&report, "storage"), CheckStatus::Pass);
+        let database = report.check("database").unwrap();
+        assert_eq!(database.status, CheckStatus::Fail);
+        assert!(database.detail.contains("corrupt manifest"));
+    }
+}
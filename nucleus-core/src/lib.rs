@@ -16,8 +16,10 @@
 pub mod chat;
 pub mod config;
 pub mod detection;
+pub mod doctor;
 pub mod models;
 pub mod patterns;
+pub mod provenance;
 pub mod provider;
 pub mod qdrant_helper;
 pub mod rag;
@@ -0,0 +1,126 @@
+//! Where each effective retrieval setting came from.
+//!
+//! A setting is resolved from, in increasing precedence: its default, the
+//! config file, the entry of `environments:` selected by `NUCLEUS_ENV`, and a
+//! `NUCLEUS_<SETTING>` environment variable such as `NUCLEUS_STORAGE_TOP_K`.
+//! [`Config::from_yaml`](crate::config::Config::from_yaml) records which one
+//! won for each of the [`RETRIEVAL_SETTINGS`], and
+//! [`Config::explain_retrieval`](crate::config::Config::explain_retrieval)
+//! lists them.
+
+use serde_yaml::Value;
+use std::collections::BTreeMap;
+use std::fmt;
+
+/// Settings that shape retrieval, by dotted path. Each can be overridden by
+/// the environment variable [`env_var`] names for it.
+pub const RETRIEVAL_SETTINGS: &[&str] = &[
+    "storage.top_k",
+    "storage.vector_db.similarity",
+    "rag.min_score",
+    "rag.candidate_multiplier",
+    "rag.rerank",
+    "rag.max_context_docs",
+    "rag.inline_metadata",
+    "rag.normalize_embeddings",
+];
+
+/// Where a setting's value came from.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub enum Origin {
+    /// Not set anywhere, or set in code rather than loaded.
+    #[default]
+    Default,
+    /// The config file, URL or `env:` variable the config was loaded from.
+    File,
+    /// The named entry of the config's `environments:` section.
+    Profile(String),
+    /// The named environment variable.
+    Env(String),
+}
+
+impl fmt::Display for Origin {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::Default => write!(f, "default"),
+            Self::File => write!(f, "file"),
+            Self::Profile(name) => write!(f, "profile {}", name),
+            Self::Env(name) => write!(f, "env {}", name),
+        }
+    }
+}
+
+/// The origin of each retrieval setting of a loaded config.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Provenance {
+    origins: BTreeMap<String, Origin>,
+}
+
+impl Provenance {
+    /// Where the setting at `path` came from.
+    pub fn origin(&self, path: &str) -> Origin {
+        self.origins.get(path).cloned().unwrap_or_default()
+    }
+
+    /// Attributes every retrieval setting present in `value` to `origin`.
+    pub(crate) fn record_present(&mut self, value: &Value, origin: &Origin) {
+        for path in RETRIEVAL_SETTINGS {
+            if lookup(value, path).is_some() {
+                self.origins.insert(path.to_string(), origin.clone());
+            }
+        }
+    }
+
+    /// Applies the environment variable overrides `vars` has to `config`.
+    ///
+    /// A value is parsed as YAML, so `12`, `true` and `cosine` take their
+    /// natural types. Overrides of `rag.*` settings are ignored when the
+    /// config has no `rag` section.
+    pub(crate) fn apply_env(
+        &mut self,
+        config: &mut Value,
+        vars: &dyn Fn(&str) -> Option<String>,
+    ) -> Result<(), serde_yaml::Error> {
+        for path in RETRIEVAL_SETTINGS {
+            let name = env_var(path);
+            let Some(raw) = vars(&name) else {
+                continue;
+            };
+            let value: Value = serde_yaml::from_str(&raw)?;
+            if set(config, path, value) {
+                self.origins.insert(path.to_string(), Origin::Env(name));
+            } else {
+                tracing::warn!("Ignoring {}: the config has no section for {}", name, path);
+            }
+        }
+        Ok(())
+    }
+}
+
+/// The environment variable overriding the setting at `path`, e.g.
+/// `NUCLEUS_STORAGE_TOP_K` for `storage.top_k`.
+pub fn env_var(path: &str) -> String {
+    format!("NUCLEUS_{}", path.replace('.', "_").to_uppercase())
+}
+
+/// The value at dotted `path`, if every part of the path exists.
+pub(crate) fn lookup<'a>(value: &'a Value, path: &str) -> Option<&'a Value> {
+    path.split('.').try_fold(value, |value, key| value.get(key))
+}
+
+/// Sets the value at dotted `path` when its parent mapping exists.
+fn set(config: &mut Value, path: &str, value: Value) -> bool {
+    let Some((parent, key)) = path.rsplit_once('.') else {
+        return false;
+    };
+    let parent = parent
+        .split('.')
+        .try_fold(config, |value, key| value.get_mut(key));
+    match parent.and_then(Value::as_mapping_mut) {
+        Some(mapping) => {
+            mapping.insert(Value::String(key.to_string()), value);
+            true
+        }
+        None => false,
+    }
+}
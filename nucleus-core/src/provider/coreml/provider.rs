@@ -535,7 +535,7 @@ impl Provider for CoreMLProvider {
     ) -> Result<()> {
         let (_prompt_text, mut input_ids) = self.format_chat_prompt(&request.messages)?;
 
-        let max_tokens = 512;
+        let max_tokens = request.max_tokens.unwrap_or(512);
 
         info!(
             "Starting chat generation with {} input tokens, max {} new tokens",
@@ -3,10 +3,11 @@
 use super::types::*;
 #[cfg(any(target_os = "macos", feature = "coreml"))]
 use super::CoreMLProvider;
-use super::{MistralRsProvider, OllamaProvider};
+use super::{FallbackProvider, MistralRsProvider, OllamaProvider, TimeoutProvider};
 use crate::Config;
 use nucleus_plugin::PluginRegistry;
 use std::sync::Arc;
+use std::time::Duration;
 use tracing::info;
 
 /// Creates a provider instance based on configuration.
@@ -15,9 +16,39 @@ use tracing::info;
 /// - `"ollama"` - Ollama API provider
 /// - `"mistralrs"` - mistral.rs in-process provider
 /// - `"coreml"` - CoreML inference (macOS only, requires `coreml` feature)
+///
+/// With `llm.request_timeout` set, the provider is wrapped in a
+/// [`TimeoutProvider`], and with `llm.fallback_model` set, in a
+/// [`FallbackProvider`].
 pub async fn create_provider(
     config: &Config,
     registry: Arc<PluginRegistry>,
+) -> Result<Arc<dyn Provider>> {
+    let provider = create_backend(config, registry).await?;
+
+    let provider: Arc<dyn Provider> = match config.llm.request_timeout {
+        Some(seconds) => {
+            info!("Provider calls time out after {}s", seconds);
+            Arc::new(TimeoutProvider::new(provider, Duration::from_secs(seconds)))
+        }
+        None => provider,
+    };
+
+    Ok(match &config.llm.fallback_model {
+        Some(model) => {
+            info!(
+                "Chats fall back to {} when {} is unavailable",
+                model, config.llm.model
+            );
+            Arc::new(FallbackProvider::new(provider, model))
+        }
+        None => provider,
+    })
+}
+
+async fn create_backend(
+    config: &Config,
+    registry: Arc<PluginRegistry>,
 ) -> Result<Arc<dyn Provider>> {
     let provider_type = config.llm.provider.to_lowercase();
 
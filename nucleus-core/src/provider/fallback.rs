@@ -0,0 +1,177 @@
+//! Retrying chats with a second model when the first can't be used.
+
+use super::types::*;
+use crate::models::EmbeddingModel;
+use async_trait::async_trait;
+use std::sync::Arc;
+use tracing::warn;
+
+/// Wraps a provider so a chat whose model is missing or fails to load is
+/// retried with `llm.fallback_model`.
+///
+/// A chat that already streamed part of its answer is not retried, since the
+/// caller has seen output from the first model. Embeddings are passed through.
+pub struct FallbackProvider {
+    inner: Arc<dyn Provider>,
+    fallback_model: String,
+}
+
+impl FallbackProvider {
+    pub fn new(inner: Arc<dyn Provider>, fallback_model: impl Into<String>) -> Self {
+        Self {
+            inner,
+            fallback_model: fallback_model.into(),
+        }
+    }
+}
+
+/// Whether `error` means the requested model can't be used, rather than the
+/// server or the request being at fault.
+fn is_model_unavailable(error: &ProviderError) -> bool {
+    match error {
+        ProviderError::ModelNotFound(_) => true,
+        ProviderError::Api(body) => {
+            let body = body.to_lowercase();
+            body.contains("model")
+                && ["load", "not found", "unavailable"]
+                    .iter()
+                    .any(|reason| body.contains(reason))
+        }
+        _ => false,
+    }
+}
+
+#[async_trait]
+impl Provider for FallbackProvider {
+    async fn chat<'a>(
+        &'a self,
+        request: ChatRequest,
+        mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+    ) -> Result<()> {
+        let mut streamed = false;
+        let error = match self
+            .inner
+            .chat(
+                request.clone(),
+                Box::new(|response| {
+                    streamed |= !response.content.is_empty();
+                    callback(response)
+                }),
+            )
+            .await
+        {
+            Ok(()) => return Ok(()),
+            Err(error) => error,
+        };
+
+        if streamed || request.model == self.fallback_model || !is_model_unavailable(&error) {
+            return Err(error);
+        }
+
+        warn!(
+            "Model '{}' failed ({}), falling back to '{}'",
+            request.model, error, self.fallback_model
+        );
+        let fallback = ChatRequest {
+            model: self.fallback_model.clone(),
+            ..request
+        };
+        self.inner.chat(fallback, callback).await
+    }
+
+    async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        self.inner.embed(text, model).await
+    }
+
+    async fn embed_batch(&self, texts: &[&str], model: &EmbeddingModel) -> Result<Vec<Vec<f32>>> {
+        self.inner.embed_batch(texts, model).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+
+    /// Fails chats for `primary` with `error`, answers any other model with
+    /// `answer from <model>`, and records the models asked.
+    struct PrimaryDownProvider {
+        error: fn() -> ProviderError,
+        models: Mutex<Vec<String>>,
+    }
+
+    impl PrimaryDownProvider {
+        fn new(error: fn() -> ProviderError) -> Self {
+            Self {
+                error,
+                models: Mutex::new(Vec::new()),
+            }
+        }
+    }
+
+    #[async_trait]
+    impl Provider for PrimaryDownProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> Result<()> {
+            self.models.lock().unwrap().push(request.model.clone());
+            if request.model == "primary" {
+                return Err((self.error)());
+            }
+
+            let answer = format!("answer from {}", request.model);
+            callback(ChatResponse {
+                model: request.model,
+                content: answer.clone(),
+                done: true,
+                message: Message::assistant(None, answer),
+            });
+            Ok(())
+        }
+
+        async fn embed(&self, _text: &str, _model: &EmbeddingModel) -> Result<Vec<f32>> {
+            Ok(vec![0.0; 4])
+        }
+    }
+
+    async fn ask(provider: &FallbackProvider) -> Result<String> {
+        let mut answer = String::new();
+        provider
+            .chat(
+                ChatRequest::new("primary", vec![Message::user(None, "hi")]),
+                Box::new(|response| answer.push_str(&response.content)),
+            )
+            .await?;
+        Ok(answer)
+    }
+
+    #[tokio::test]
+    async fn test_unavailable_primary_falls_back() {
+        let inner = Arc::new(PrimaryDownProvider::new(|| {
+            ProviderError::ModelNotFound("primary".to_string())
+        }));
+        let provider = FallbackProvider::new(inner.clone(), "backup");
+
+        assert_eq!(ask(&provider).await.unwrap(), "answer from backup");
+        assert_eq!(*inner.models.lock().unwrap(), vec!["primary", "backup"]);
+
+        let inner = Arc::new(PrimaryDownProvider::new(|| {
+            ProviderError::Api("failed to load model: out of memory".to_string())
+        }));
+        let provider = FallbackProvider::new(inner, "backup");
+        assert_eq!(ask(&provider).await.unwrap(), "answer from backup");
+    }
+
+    #[tokio::test]
+    async fn test_other_errors_are_not_retried() {
+        let inner = Arc::new(PrimaryDownProvider::new(|| {
+            ProviderError::Api("invalid request: messages is empty".to_string())
+        }));
+        let provider = FallbackProvider::new(inner.clone(), "backup");
+
+        assert!(matches!(ask(&provider).await, Err(ProviderError::Api(_))));
+        assert_eq!(*inner.models.lock().unwrap(), vec!["primary"]);
+    }
+}
@@ -16,9 +16,10 @@ use nucleus_plugin::PluginRegistry;
 use tracing::{debug, info, warn};
 
 use futures::future::join_all;
+use std::collections::HashMap;
 use std::path::Path;
 use std::sync::Arc;
-use tokio::sync::OnceCell;
+use tokio::sync::Mutex;
 
 /// mistral.rs in-process provider.
 ///
@@ -31,8 +32,8 @@ pub struct MistralRsProvider {
     model: Arc<Model>,
     model_name: String,
     registry: Arc<PluginRegistry>,
-    config: Config,
-    embedding_model: OnceCell<Arc<Model>>,
+    /// Embedding models loaded so far, by model ID.
+    embedding_models: Mutex<HashMap<String, Arc<Model>>>,
 }
 
 impl MistralRsProvider {
@@ -77,8 +78,7 @@ impl MistralRsProvider {
             model: Arc::new(model),
             model_name,
             registry,
-            config: config.clone(),
-            embedding_model: OnceCell::new(),
+            embedding_models: Mutex::new(HashMap::new()),
         })
     }
 
@@ -158,6 +158,44 @@ impl MistralRsProvider {
 
         Ok(model)
     }
+
+    /// Loads `model` on first use, keeping one instance per model ID so
+    /// collections with their own embedding model don't share vectors.
+    async fn embedding_model(&self, model: &EmbeddingModel) -> Result<Arc<Model>> {
+        // Held while loading so concurrent first calls load the model once.
+        let mut models = self.embedding_models.lock().await;
+        if let Some(loaded) = models.get(&model.id) {
+            return Ok(Arc::clone(loaded));
+        }
+
+        let model_path: String = match &model.path {
+            Some(path) => path.to_string_lossy().into(),
+            None => model
+                .hf_repo
+                .clone()
+                .unwrap_or("Nucleus Registry".to_string()),
+        };
+
+        info!("Loading embedding model from: {}", model_path);
+
+        let loaded = EmbeddingModelBuilder::new(model_path.clone())
+            .with_logging()
+            .with_throughput_logging()
+            .with_token_source(mistralrs::TokenSource::None)
+            .build()
+            .await
+            .map_err(|e| {
+                ProviderError::Other(format!(
+                    "Failed to load embedding model from '{}': {:?}\n\n\
+                        Make sure the model exists at that path.",
+                    model_path, e
+                ))
+            })?;
+
+        let loaded = Arc::new(loaded);
+        models.insert(model.id.clone(), Arc::clone(&loaded));
+        Ok(loaded)
+    }
 }
 
 #[async_trait]
@@ -290,6 +328,10 @@ impl Provider for MistralRsProvider {
                 .set_tool_choice(ToolChoice::Auto);
         }
 
+        if let Some(max_tokens) = request.max_tokens {
+            builder = builder.set_sampler_max_len(max_tokens);
+        }
+
         // Stream request
         let timeout_duration = std::time::Duration::from_secs(60);
         let mut stream =
@@ -351,6 +393,8 @@ impl Provider for MistralRsProvider {
                                     context: None,
                                     images: None,
                                     tool_calls: None,
+                                    tool_name: None,
+                                    tool_call_id: None,
                                 },
                             });
                         }
@@ -360,6 +404,7 @@ impl Provider for MistralRsProvider {
                             final_tool_calls = Some(
                                 tcs.iter()
                                     .map(|tc| super::types::ToolCall {
+                                        id: Some(tc.id.clone()),
                                         function: super::types::ToolCallFunction {
                                             name: tc.function.name.clone(),
                                             arguments: serde_json::from_str(&tc.function.arguments)
@@ -389,47 +434,16 @@ impl Provider for MistralRsProvider {
                 context: None,
                 images: None,
                 tool_calls: final_tool_calls,
+                tool_name: None,
+                tool_call_id: None,
             },
         });
 
         Ok(())
     }
 
-    async fn embed(&self, text: &str, _model: &EmbeddingModel) -> Result<Vec<f32>> {     
-        let rag = &self.config.rag.clone().unwrap();
-       
-        let embedding_model = self
-            .embedding_model
-            .get_or_try_init(|| async {
-                let model_path: String = match &rag.embedding_model.path {
-                    Some(path) => path.to_string_lossy().into(),
-                    None => 
-                        rag
-                        .embedding_model
-                        .hf_repo
-                        .clone()
-                        .unwrap_or("Nucleus Registry".to_string()),
-                };
-
-                info!("Loading embedding model from: {}", model_path);
-
-                let model = EmbeddingModelBuilder::new(model_path.clone())
-                    .with_logging()
-                    .with_throughput_logging()
-                    .with_token_source(mistralrs::TokenSource::None)
-                    .build()
-                    .await
-                    .map_err(|e| {
-                        ProviderError::Other(format!(
-                            "Failed to load embedding model from '{}': {:?}\n\n\
-                                Make sure the model exists at that path.",
-                            model_path, e
-                        ))
-                    })?;
-
-                Ok::<Arc<Model>, ProviderError>(Arc::new(model))
-            })
-            .await?;
+    async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        let embedding_model = self.embedding_model(model).await?;
 
         // Generate embedding
         let embedding = embedding_model
@@ -4,10 +4,15 @@
 //! (Ollama, mistral.rs, etc.) to provide chat completions and embeddings.
 
 mod factory;
+mod fallback;
 pub mod mistralrs;
 pub mod ollama;
+mod timeout;
 mod types;
 
+#[cfg(test)]
+pub(crate) mod testing;
+
 #[cfg(any(target_os = "macos", feature = "coreml"))]
 pub mod coreml;
 
@@ -19,8 +24,10 @@ pub use types::{
 
 // Re-export provider implementations
 pub use factory::create_provider;
+pub use fallback::FallbackProvider;
 pub use mistralrs::MistralRsProvider;
 pub use ollama::OllamaProvider;
+pub use timeout::TimeoutProvider;
 
 #[cfg(any(target_os = "macos", feature = "coreml"))]
 pub use coreml::CoreMLProvider;
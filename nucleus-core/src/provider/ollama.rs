@@ -7,6 +7,7 @@ use crate::models::EmbeddingModel;
 use async_trait::async_trait;
 
 use futures::StreamExt;
+use reqwest::header::{HeaderMap, HeaderName, HeaderValue};
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
 
@@ -20,15 +21,50 @@ pub struct OllamaProvider {
 
 impl OllamaProvider {
     /// Creates a new Ollama provider with the specified config.
+    ///
+    /// `llm.api_key_env` and `llm.headers` are sent with every request.
+    /// Headers that can't be resolved are skipped with a warning.
     pub fn new(config: &crate::Config) -> Self {
+        let http_client = reqwest::Client::builder()
+            .default_headers(default_headers(&config.llm))
+            .build()
+            .unwrap_or_default();
+
         Self {
             base_url: config.llm.base_url.clone(),
-            http_client: reqwest::Client::new(),
+            http_client,
             config: config.clone(),
         }
     }
 }
 
+fn default_headers(llm: &crate::config::LlmConfig) -> HeaderMap {
+    let mut headers = HeaderMap::new();
+
+    let resolved = match llm.request_headers() {
+        Ok(resolved) => resolved,
+        Err(e) => {
+            tracing::warn!("Sending requests without llm headers: {}", e);
+            return headers;
+        }
+    };
+
+    for (name, value) in resolved {
+        match (
+            HeaderName::from_bytes(name.as_bytes()),
+            HeaderValue::from_str(&value),
+        ) {
+            (Ok(name), Ok(mut value)) => {
+                value.set_sensitive(true);
+                headers.insert(name, value);
+            }
+            _ => tracing::warn!("Skipping invalid llm header: {}", name),
+        }
+    }
+
+    headers
+}
+
 impl Default for OllamaProvider {
     fn default() -> Self {
         let config = crate::Config::default();
@@ -48,31 +84,16 @@ impl Provider for OllamaProvider {
         // Convert to Ollama-specific request format
         let ollama_request = OllamaChatRequest {
             model: request.model.clone(),
-            messages: request
-                .messages
-                .iter()
-                .map(|m| OllamaMessage {
-                    role: m.role.clone(),
-                    content: m.content.clone(),
-                    images: m.images.clone(),
-                    tool_calls: m.tool_calls.as_ref().map(|tcs| {
-                        tcs.iter()
-                            .map(|tc| OllamaToolCall {
-                                function: OllamaToolCallFunction {
-                                    name: tc.function.name.clone(),
-                                    arguments: tc.function.arguments.clone(),
-                                },
-                            })
-                            .collect()
-                    }),
-                })
-                .collect(),
+            messages: request.messages.iter().map(OllamaMessage::from).collect(),
             options: {
                 let mut opts = HashMap::new();
                 opts.insert(
                     "temperature".to_string(),
                     serde_json::json!(request.temperature),
                 );
+                if let Some(max_tokens) = request.max_tokens {
+                    opts.insert("num_predict".to_string(), serde_json::json!(max_tokens));
+                }
                 Some(opts)
             },
             stream: true,
@@ -96,11 +117,13 @@ impl Provider for OllamaProvider {
             .post(&url)
             .json(&ollama_request)
             .send()
-            .await?;
+            .await
+            .map_err(|e| send_error(&url, e))?;
 
         if !response.status().is_success() {
+            let status = response.status();
             let error_text = response.text().await?;
-            return Err(ProviderError::Api(error_text));
+            return Err(api_error(status, error_text, &request.model));
         }
 
         let mut stream = response.bytes_stream();
@@ -133,6 +156,7 @@ impl Provider for OllamaProvider {
                             tool_calls: ollama_response.message.tool_calls.as_ref().map(|tcs| {
                                 tcs.iter()
                                     .map(|tc| ToolCall {
+                                        id: tc.id.clone(),
                                         function: ToolCallFunction {
                                             name: tc.function.name.clone(),
                                             arguments: tc.function.arguments.clone(),
@@ -140,6 +164,8 @@ impl Provider for OllamaProvider {
                                     })
                                     .collect()
                             }),
+                            tool_name: None,
+                            tool_call_id: None,
                         },
                     });
                 }
@@ -149,12 +175,17 @@ impl Provider for OllamaProvider {
         Ok(())
     }
 
-    async fn embed(&self, text: &str, _model: &EmbeddingModel) -> Result<Vec<f32>> {
+    async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
         let url = format!("{}/api/embed", self.base_url);
 
         let embed_request = EmbedRequest {
-            model: self.config.rag.clone().unwrap().embedding_model.name.clone(),
+            model: model.name.clone(),
             input: text.to_string(),
+            keep_alive: self
+                .config
+                .rag
+                .as_ref()
+                .and_then(|rag| rag.embedding_keep_alive.clone()),
         };
 
         let response = self
@@ -162,11 +193,13 @@ impl Provider for OllamaProvider {
             .post(&url)
             .json(&embed_request)
             .send()
-            .await?;
+            .await
+            .map_err(|e| send_error(&url, e))?;
 
         if !response.status().is_success() {
+            let status = response.status();
             let error_text = response.text().await?;
-            return Err(ProviderError::Api(error_text));
+            return Err(api_error(status, error_text, &embed_request.model));
         }
 
         let embed_response = response.json::<EmbedResponse>().await?;
@@ -179,6 +212,29 @@ impl Provider for OllamaProvider {
     }
 }
 
+/// Reports connection failures as [`ProviderError::Unreachable`], since they
+/// almost always mean Ollama isn't running.
+fn send_error(url: &str, error: reqwest::Error) -> ProviderError {
+    if error.is_connect() {
+        ProviderError::Unreachable {
+            url: url.to_string(),
+            source: error,
+        }
+    } else {
+        ProviderError::Request(error)
+    }
+}
+
+/// Ollama answers requests for a model it doesn't have with a 404 and a
+/// body like `model "qwen3:8b" not found, try pulling it first`.
+fn api_error(status: reqwest::StatusCode, body: String, model: &str) -> ProviderError {
+    if status == reqwest::StatusCode::NOT_FOUND && body.contains("not found") {
+        ProviderError::ModelNotFound(model.to_string())
+    } else {
+        ProviderError::Api(body)
+    }
+}
+
 // Ollama-specific request/response types (internal)
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -205,6 +261,34 @@ struct OllamaMessage {
     images: Option<Vec<String>>,
     #[serde(skip_serializing_if = "Option::is_none")]
     tool_calls: Option<Vec<OllamaToolCall>>,
+    /// On tool results, the tool that produced them
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    tool_name: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    tool_call_id: Option<String>,
+}
+
+impl From<&Message> for OllamaMessage {
+    fn from(m: &Message) -> Self {
+        Self {
+            role: m.role.clone(),
+            content: m.content.clone(),
+            images: m.images.clone(),
+            tool_calls: m.tool_calls.as_ref().map(|tcs| {
+                tcs.iter()
+                    .map(|tc| OllamaToolCall {
+                        id: tc.id.clone(),
+                        function: OllamaToolCallFunction {
+                            name: tc.function.name.clone(),
+                            arguments: tc.function.arguments.clone(),
+                        },
+                    })
+                    .collect()
+            }),
+            tool_name: m.tool_name.clone(),
+            tool_call_id: m.tool_call_id.clone(),
+        }
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -235,6 +319,8 @@ struct OllamaToolFunction {
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 struct OllamaToolCall {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    id: Option<String>,
     function: OllamaToolCallFunction,
 }
 
@@ -243,3 +329,163 @@ struct OllamaToolCallFunction {
     name: String,
     arguments: serde_json::Value,
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_missing_model_is_model_not_found() {
+        let err = api_error(
+            reqwest::StatusCode::NOT_FOUND,
+            r#"{"error":"model \"qwen3:8b\" not found, try pulling it first"}"#.to_string(),
+            "qwen3:8b",
+        );
+        assert!(matches!(err, ProviderError::ModelNotFound(ref model) if model == "qwen3:8b"));
+
+        let err = api_error(
+            reqwest::StatusCode::INTERNAL_SERVER_ERROR,
+            "out of memory".to_string(),
+            "qwen3:8b",
+        );
+        assert!(matches!(err, ProviderError::Api(_)));
+    }
+
+    #[test]
+    fn test_tool_results_carry_tool_name() {
+        let call = ToolCall {
+            id: Some("call_1".to_string()),
+            function: ToolCallFunction {
+                name: "read_file".to_string(),
+                arguments: serde_json::json!({ "path": "a.rs" }),
+            },
+        };
+
+        let json = serde_json::to_value(OllamaMessage::from(&Message::tool_result(
+            None,
+            &call,
+            "fn main() {}",
+        )))
+        .unwrap();
+        assert_eq!(
+            json,
+            serde_json::json!({
+                "role": "tool",
+                "content": "fn main() {}",
+                "tool_name": "read_file",
+                "tool_call_id": "call_1",
+            })
+        );
+
+        let json = serde_json::to_value(OllamaMessage::from(&Message::user(None, "hi"))).unwrap();
+        assert!(json.get("tool_name").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_configured_headers_are_sent() {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+        std::env::set_var("NUCLEUS_TEST_OLLAMA_KEY", "s3cret");
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let mut config = crate::Config::default();
+        config.llm.base_url = format!("http://{}", listener.local_addr().unwrap());
+        config.llm.api_key_env = Some("NUCLEUS_TEST_OLLAMA_KEY".to_string());
+        config
+            .llm
+            .headers
+            .insert("X-Team".to_string(), "docs".to_string());
+
+        let server = tokio::spawn(async move {
+            let (mut socket, _) = listener.accept().await.unwrap();
+            let mut request = vec![0; 4096];
+            let read = socket.read(&mut request).await.unwrap();
+            let body = r#"{"model":"m","message":{"role":"assistant","content":""},"done":true}"#;
+            let response = format!(
+                "HTTP/1.1 200 OK\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}\n",
+                body.len() + 1,
+                body
+            );
+            socket.write_all(response.as_bytes()).await.unwrap();
+            String::from_utf8_lossy(&request[..read]).to_lowercase()
+        });
+
+        let provider = OllamaProvider::new(&config);
+        provider
+            .chat(
+                ChatRequest::new("m", vec![Message::user(None, "hi")]),
+                Box::new(|_| {}),
+            )
+            .await
+            .unwrap();
+
+        let request = server.await.unwrap();
+        assert!(request.contains("authorization: bearer s3cret"));
+        assert!(request.contains("x-team: docs"));
+    }
+
+    #[tokio::test]
+    async fn test_embed_forwards_model_and_keep_alive() {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let mut config = crate::Config::default();
+        config.llm.base_url = format!("http://{}", listener.local_addr().unwrap());
+        let mut rag = crate::config::RagConfig::default();
+        rag.embedding_keep_alive = Some("30m".to_string());
+        config.rag = Some(rag);
+
+        let server = tokio::spawn(async move {
+            let (mut socket, _) = listener.accept().await.unwrap();
+            // The body may arrive after the headers, so read up to the end of the JSON.
+            let mut request = Vec::new();
+            let mut buf = vec![0; 4096];
+            while !request.ends_with(b"}") {
+                let read = socket.read(&mut buf).await.unwrap();
+                if read == 0 {
+                    break;
+                }
+                request.extend_from_slice(&buf[..read]);
+            }
+            let body = r#"{"model":"m","embeddings":[[0.5,0.5]]}"#;
+            let response = format!(
+                "HTTP/1.1 200 OK\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                body.len(),
+                body
+            );
+            socket.write_all(response.as_bytes()).await.unwrap();
+            String::from_utf8_lossy(&request).to_string()
+        });
+
+        let provider = OllamaProvider::new(&config);
+        let model = EmbeddingModel {
+            name: "nomic-embed-text".to_string(),
+            ..EmbeddingModel::default()
+        };
+        let embedding = provider.embed("hello", &model).await.unwrap();
+        assert_eq!(embedding, vec![0.5, 0.5]);
+
+        let request = server.await.unwrap();
+        assert!(request.contains(r#""model":"nomic-embed-text""#));
+        assert!(request.contains(r#""keep_alive":"30m""#));
+    }
+
+    #[tokio::test]
+    async fn test_refused_connection_is_unreachable() {
+        let mut config = crate::Config::default();
+        // Nothing listens on port 1.
+        config.llm.base_url = "http://127.0.0.1:1".to_string();
+        let provider = OllamaProvider::new(&config);
+
+        let result = provider
+            .chat(
+                ChatRequest::new("qwen3:8b", vec![Message::user(None, "hi")]),
+                Box::new(|_| {}),
+            )
+            .await;
+
+        assert!(matches!(
+            result,
+            Err(ProviderError::Unreachable { ref url, .. }) if url == "http://127.0.0.1:1/api/chat"
+        ));
+    }
+}
@@ -0,0 +1,157 @@
+//! Test doubles for exercising code that talks to a [`Provider`].
+
+use super::{ChatRequest, ChatResponse, Message, Provider, Result, ToolCall, ToolCallFunction};
+use crate::models::EmbeddingModel;
+use async_trait::async_trait;
+use std::collections::hash_map::DefaultHasher;
+use std::collections::VecDeque;
+use std::hash::{Hash, Hasher};
+use std::sync::Mutex;
+
+/// Dimension of the vectors returned by [`fake_embedding`].
+pub(crate) const FAKE_EMBEDDING_DIM: usize = 64;
+
+/// A provider that replays scripted assistant messages and records requests.
+///
+/// Once the script runs out it answers with an empty assistant message.
+/// Embeddings come from [`fake_embedding`].
+#[derive(Default)]
+pub(crate) struct ScriptedProvider {
+    replies: Mutex<VecDeque<Message>>,
+    requests: Mutex<Vec<ChatRequest>>,
+    embedded: Mutex<Vec<String>>,
+    embedding_models: Mutex<Vec<String>>,
+}
+
+impl ScriptedProvider {
+    pub(crate) fn new(replies: Vec<Message>) -> Self {
+        Self {
+            replies: Mutex::new(replies.into()),
+            requests: Mutex::new(Vec::new()),
+            embedded: Mutex::new(Vec::new()),
+            embedding_models: Mutex::new(Vec::new()),
+        }
+    }
+
+    /// Every chat request received so far, in order.
+    pub(crate) fn requests(&self) -> Vec<ChatRequest> {
+        self.requests.lock().unwrap().clone()
+    }
+
+    /// Number of texts embedded so far.
+    pub(crate) fn embed_calls(&self) -> usize {
+        self.embedded.lock().unwrap().len()
+    }
+
+    /// Every text embedded so far, in order.
+    pub(crate) fn embedded_texts(&self) -> Vec<String> {
+        self.embedded.lock().unwrap().clone()
+    }
+
+    /// ID of the model asked for by each embedding so far, in order.
+    pub(crate) fn embedding_models(&self) -> Vec<String> {
+        self.embedding_models.lock().unwrap().clone()
+    }
+}
+
+#[async_trait]
+impl Provider for ScriptedProvider {
+    async fn chat<'a>(
+        &'a self,
+        request: ChatRequest,
+        mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+    ) -> Result<()> {
+        self.requests.lock().unwrap().push(request.clone());
+
+        let reply = self
+            .replies
+            .lock()
+            .unwrap()
+            .pop_front()
+            .unwrap_or_else(|| Message::assistant(None, ""));
+
+        if !reply.content.is_empty() {
+            callback(ChatResponse {
+                model: request.model.clone(),
+                content: reply.content.clone(),
+                done: false,
+                message: reply.clone(),
+            });
+        }
+
+        callback(ChatResponse {
+            model: request.model,
+            content: String::new(),
+            done: true,
+            message: reply,
+        });
+
+        Ok(())
+    }
+
+    async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        self.embedded.lock().unwrap().push(text.to_string());
+        self.embedding_models.lock().unwrap().push(model.id.clone());
+        Ok(fake_embedding(text))
+    }
+}
+
+/// A provider whose embeddings are [`fake_embedding`] scaled by the length of
+/// the text, so they are not unit length. Chat is not supported.
+#[derive(Default)]
+pub(crate) struct ScaledProvider;
+
+#[async_trait]
+impl Provider for ScaledProvider {
+    async fn chat<'a>(
+        &'a self,
+        _request: ChatRequest,
+        _callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+    ) -> Result<()> {
+        Ok(())
+    }
+
+    async fn embed(&self, text: &str, _model: &EmbeddingModel) -> Result<Vec<f32>> {
+        let scale = 1.0 + text.len() as f32;
+        Ok(fake_embedding(text)
+            .into_iter()
+            .map(|x| x * scale)
+            .collect())
+    }
+}
+
+/// An assistant message that asks for a single tool call.
+pub(crate) fn tool_call_message(name: &str, arguments: serde_json::Value) -> Message {
+    let mut message = Message::assistant(None, "");
+    message.tool_calls = Some(vec![ToolCall {
+        id: None,
+        function: ToolCallFunction {
+            name: name.to_string(),
+            arguments,
+        },
+    }]);
+    message
+}
+
+/// Deterministic bag-of-words embedding.
+///
+/// Texts that share words get similar vectors, which is enough to make
+/// retrieval tests meaningful without a real model.
+pub(crate) fn fake_embedding(text: &str) -> Vec<f32> {
+    let mut vector = vec![0.0; FAKE_EMBEDDING_DIM];
+
+    for word in text
+        .split(|c: char| !c.is_alphanumeric())
+        .filter(|w| !w.is_empty())
+    {
+        let mut hasher = DefaultHasher::new();
+        word.to_lowercase().hash(&mut hasher);
+        vector[(hasher.finish() as usize) % FAKE_EMBEDDING_DIM] += 1.0;
+    }
+
+    let norm = vector.iter().map(|v| v * v).sum::<f32>().sqrt();
+    if norm > 0.0 {
+        vector.iter_mut().for_each(|v| *v /= norm);
+    }
+    vector
+}
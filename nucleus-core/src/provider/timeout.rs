@@ -0,0 +1,128 @@
+//! Deadline enforcement for provider calls.
+
+use super::types::*;
+use crate::models::EmbeddingModel;
+use async_trait::async_trait;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::time::timeout;
+
+/// Wraps a provider so every chat and embedding call fails with
+/// [`ProviderError::Timeout`] once it runs longer than the deadline.
+///
+/// A timed-out call's future is dropped, which cancels the underlying
+/// request; a streaming chat gets no further callbacks after the deadline.
+pub struct TimeoutProvider {
+    inner: Arc<dyn Provider>,
+    timeout: Duration,
+}
+
+impl TimeoutProvider {
+    pub fn new(inner: Arc<dyn Provider>, timeout: Duration) -> Self {
+        Self { inner, timeout }
+    }
+}
+
+#[async_trait]
+impl Provider for TimeoutProvider {
+    async fn chat<'a>(
+        &'a self,
+        request: ChatRequest,
+        callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+    ) -> Result<()> {
+        timeout(self.timeout, self.inner.chat(request, callback))
+            .await
+            .map_err(|_| ProviderError::Timeout(self.timeout))?
+    }
+
+    async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        timeout(self.timeout, self.inner.embed(text, model))
+            .await
+            .map_err(|_| ProviderError::Timeout(self.timeout))?
+    }
+
+    async fn embed_batch(&self, texts: &[&str], model: &EmbeddingModel) -> Result<Vec<Vec<f32>>> {
+        timeout(self.timeout, self.inner.embed_batch(texts, model))
+            .await
+            .map_err(|_| ProviderError::Timeout(self.timeout))?
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::time::Instant;
+
+    /// Sends one chunk, then never finishes. Records when its call is dropped.
+    #[derive(Default)]
+    struct StallingProvider {
+        dropped: Arc<AtomicBool>,
+    }
+
+    struct DropFlag(Arc<AtomicBool>);
+
+    impl Drop for DropFlag {
+        fn drop(&mut self) {
+            self.0.store(true, Ordering::SeqCst);
+        }
+    }
+
+    #[async_trait]
+    impl Provider for StallingProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> Result<()> {
+            let _flag = DropFlag(self.dropped.clone());
+            callback(ChatResponse {
+                model: request.model,
+                content: "partial".to_string(),
+                done: false,
+                message: Message::assistant(None, "partial"),
+            });
+            std::future::pending().await
+        }
+
+        async fn embed(&self, _text: &str, _model: &EmbeddingModel) -> Result<Vec<f32>> {
+            let _flag = DropFlag(self.dropped.clone());
+            std::future::pending().await
+        }
+    }
+
+    const DEADLINE: Duration = Duration::from_millis(50);
+
+    #[tokio::test]
+    async fn test_stalled_chat_times_out_and_is_cancelled() {
+        let inner = Arc::new(StallingProvider::default());
+        let provider = TimeoutProvider::new(inner.clone(), DEADLINE);
+        let mut chunks = Vec::new();
+
+        let started = Instant::now();
+        let result = provider
+            .chat(
+                ChatRequest::new("model", vec![Message::user(None, "hi")]),
+                Box::new(|response| chunks.push(response.content)),
+            )
+            .await;
+
+        assert!(matches!(result, Err(ProviderError::Timeout(d)) if d == DEADLINE));
+        assert!(started.elapsed() < Duration::from_secs(1));
+        assert_eq!(chunks, vec!["partial"]);
+        assert!(inner.dropped.load(Ordering::SeqCst));
+    }
+
+    #[tokio::test]
+    async fn test_stalled_embed_times_out() {
+        let inner = Arc::new(StallingProvider::default());
+        let provider = TimeoutProvider::new(inner.clone(), DEADLINE);
+
+        let started = Instant::now();
+        let result = provider.embed("text", &EmbeddingModel::default()).await;
+
+        assert!(matches!(result, Err(ProviderError::Timeout(_))));
+        assert!(started.elapsed() < Duration::from_secs(1));
+        assert!(inner.dropped.load(Ordering::SeqCst));
+    }
+}
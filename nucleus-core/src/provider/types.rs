@@ -34,9 +34,22 @@ pub enum ProviderError {
     #[error("JSON parsing failed: {0}")]
     Json(#[from] serde_json::Error),
 
+    #[error("Could not reach the model server at {url}: {source}")]
+    Unreachable {
+        url: String,
+        #[source]
+        source: reqwest::Error,
+    },
+
+    #[error("Model '{0}' not found, pull it first (e.g. `ollama pull {0}`)")]
+    ModelNotFound(String),
+
     #[error("API error: {0}")]
     Api(String),
 
+    #[error("Request timed out after {}s", .0.as_secs_f64())]
+    Timeout(std::time::Duration),
+
     #[error("Provider error: {0}")]
     Other(String),
 }
@@ -61,6 +74,13 @@ pub trait Provider: Send + Sync {
     /// Generate an embedding vector for the given text.
     async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>>;
 
+    /// Generate an embedding for a search query that someone is waiting on.
+    /// Providers that queue embedding calls can serve it first; the default
+    /// calls embed().
+    async fn embed_query(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        self.embed(text, model).await
+    }
+
     /// Generate embeddings for multiple texts in batch.
     /// Default implementation calls embed() sequentially.
     async fn embed_batch(&self, texts: &[&str], model: &EmbeddingModel) -> Result<Vec<Vec<f32>>> {
@@ -78,6 +98,9 @@ pub struct ChatRequest {
     pub model: String,
     pub messages: Vec<Message>,
     pub temperature: f64,
+    /// Maximum number of tokens to generate. `None` leaves it to the backend.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_tokens: Option<usize>,
     pub tools: Option<Vec<Tool>>,
     pub structured_output: Option<StructuredOutput>,
 }
@@ -88,6 +111,7 @@ impl ChatRequest {
             model: model.into(),
             messages,
             temperature: 0.7,
+            max_tokens: None,
             tools: None,
             structured_output: None,
         }
@@ -103,6 +127,11 @@ impl ChatRequest {
         self
     }
 
+    pub fn with_max_tokens(mut self, max_tokens: Option<usize>) -> Self {
+        self.max_tokens = max_tokens;
+        self
+    }
+
     pub fn with_tools(mut self, tools: Vec<Tool>) -> Self {
         self.tools = Some(tools);
         self
@@ -132,6 +161,14 @@ pub struct Message {
 
     #[serde(skip_serializing_if = "Option::is_none")]
     pub tool_calls: Option<Vec<ToolCall>>,
+
+    /// For tool results: the name of the tool that produced it
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tool_name: Option<String>,
+
+    /// For tool results: the ID of the call it answers, if the model gave one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub tool_call_id: Option<String>,
 }
 
 impl Message {
@@ -142,6 +179,8 @@ impl Message {
             content: content.into(),
             images: None,
             tool_calls: None,
+            tool_name: None,
+            tool_call_id: None,
         }
     }
 
@@ -152,6 +191,8 @@ impl Message {
             content: content.into(),
             images: None,
             tool_calls: None,
+            tool_name: None,
+            tool_call_id: None,
         }
     }
 
@@ -162,6 +203,8 @@ impl Message {
             content: content.into(),
             images: None,
             tool_calls: None,
+            tool_name: None,
+            tool_call_id: None,
         }
     }
 
@@ -172,6 +215,22 @@ impl Message {
             content: content.into(),
             images: None,
             tool_calls: None,
+            tool_name: None,
+            tool_call_id: None,
+        }
+    }
+
+    /// The result of `call`, attributed to its tool so models can match
+    /// results to calls when a turn makes several.
+    pub fn tool_result(
+        context: Option<String>,
+        call: &ToolCall,
+        content: impl Into<String>,
+    ) -> Self {
+        Self {
+            tool_name: Some(call.function.name.clone()),
+            tool_call_id: call.id.clone(),
+            ..Self::tool(context, content)
         }
     }
 }
@@ -195,6 +254,9 @@ pub struct ToolFunction {
 /// Tool call requested by the LLM.
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct ToolCall {
+    /// Call ID, for providers that assign one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub id: Option<String>,
     pub function: ToolCallFunction,
 }
 
@@ -210,6 +272,9 @@ pub struct ToolCallFunction {
 pub struct EmbedRequest {
     pub model: String,
     pub input: String,
+    /// How long the server keeps the model loaded afterwards, e.g. `30m`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub keep_alive: Option<String>,
 }
 
 /// Response containing embeddings.
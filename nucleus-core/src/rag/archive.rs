@@ -0,0 +1,180 @@
+//! Reading `.zip`, `.tar`, `.tar.gz` and `.tgz` archives for indexing.
+//!
+//! Entries are read one at a time straight from the archive, without
+//! unpacking it to disk. Each entry is known by its path inside the archive,
+//! which is what it is filtered on and what its chunks record as their source.
+//! Entries whose path leads outside the archive are skipped.
+
+use super::indexer::{CollectedFiles, IndexedFile};
+use super::report::FileError;
+use flate2::read::GzDecoder;
+use std::fs::File;
+use std::io::{self, Read};
+use std::path::{Component, Path, PathBuf};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Format {
+    Zip,
+    Tar,
+    TarGz,
+}
+
+impl Format {
+    fn of(path: &Path) -> Option<Self> {
+        let name = path.file_name()?.to_str()?.to_ascii_lowercase();
+        if name.ends_with(".zip") {
+            Some(Format::Zip)
+        } else if name.ends_with(".tar.gz") || name.ends_with(".tgz") {
+            Some(Format::TarGz)
+        } else if name.ends_with(".tar") {
+            Some(Format::Tar)
+        } else {
+            None
+        }
+    }
+}
+
+/// Reads the entries of the archive at `path` that `accept` lets through.
+///
+/// Entries that aren't valid UTF-8 are counted as binary, and entries that
+/// can't be read are reported as failed, as for files on disk.
+pub(crate) fn read_entries(
+    path: &Path,
+    accept: impl Fn(&Path) -> bool,
+) -> io::Result<CollectedFiles> {
+    let format = Format::of(path).ok_or_else(|| {
+        io::Error::new(
+            io::ErrorKind::InvalidInput,
+            format!(
+                "{} is not a .zip, .tar, .tar.gz or .tgz archive",
+                path.display()
+            ),
+        )
+    })?;
+    let file = File::open(path)?;
+
+    let mut collected = CollectedFiles::default();
+    match format {
+        Format::Zip => read_zip(file, &accept, &mut collected)?,
+        Format::Tar => read_tar(file, &accept, &mut collected)?,
+        Format::TarGz => read_tar(GzDecoder::new(file), &accept, &mut collected)?,
+    }
+    Ok(collected)
+}
+
+fn read_zip(
+    file: File,
+    accept: &impl Fn(&Path) -> bool,
+    collected: &mut CollectedFiles,
+) -> io::Result<()> {
+    let mut archive = zip::ZipArchive::new(file).map_err(io::Error::other)?;
+    for index in 0..archive.len() {
+        let mut entry = archive.by_index(index).map_err(io::Error::other)?;
+        if entry.is_dir() {
+            continue;
+        }
+        let Some(path) = entry.enclosed_name().and_then(|name| entry_path(&name)) else {
+            tracing::debug!(
+                "Skipping archive entry outside the archive: {}",
+                entry.name()
+            );
+            continue;
+        };
+        if accept(&path) {
+            let mut bytes = Vec::new();
+            let read = entry.read_to_end(&mut bytes).map(|_| bytes);
+            push_entry(collected, path, read);
+        }
+    }
+    Ok(())
+}
+
+fn read_tar(
+    reader: impl Read,
+    accept: &impl Fn(&Path) -> bool,
+    collected: &mut CollectedFiles,
+) -> io::Result<()> {
+    let mut archive = tar::Archive::new(reader);
+    for entry in archive.entries()? {
+        let mut entry = entry?;
+        if !entry.header().entry_type().is_file() {
+            continue;
+        }
+        let Some(path) = entry_path(&entry.path()?) else {
+            tracing::debug!(
+                "Skipping archive entry outside the archive: {}",
+                entry.path()?.display()
+            );
+            continue;
+        };
+        if accept(&path) {
+            let mut bytes = Vec::new();
+            let read = entry.read_to_end(&mut bytes).map(|_| bytes);
+            push_entry(collected, path, read);
+        }
+    }
+    Ok(())
+}
+
+fn push_entry(collected: &mut CollectedFiles, path: PathBuf, read: io::Result<Vec<u8>>) {
+    match read.map(String::from_utf8) {
+        Ok(Ok(content)) => collected.files.push(IndexedFile { path, content }),
+        Ok(Err(_)) => collected.binary += 1,
+        Err(e) => collected.failed.push(FileError {
+            path,
+            error: e.to_string(),
+        }),
+    }
+}
+
+/// An entry's path without a leading `./` or `/` and with `..` resolved, so
+/// `./src/lib.rs`, `/src/lib.rs` and `docs/../src/lib.rs` name the same
+/// source. `None` when `..` climbs out of the archive or nothing is left.
+fn entry_path(path: &Path) -> Option<PathBuf> {
+    let mut normalized = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::Normal(part) => normalized.push(part),
+            Component::ParentDir => {
+                if !normalized.pop() {
+                    return None;
+                }
+            }
+            Component::CurDir | Component::RootDir | Component::Prefix(_) => {}
+        }
+    }
+    Some(normalized).filter(|path| !path.as_os_str().is_empty())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_archive_format_from_file_name() {
+        assert_eq!(Format::of(Path::new("docs.zip")), Some(Format::Zip));
+        assert_eq!(Format::of(Path::new("src.TAR.GZ")), Some(Format::TarGz));
+        assert_eq!(Format::of(Path::new("src.tgz")), Some(Format::TarGz));
+        assert_eq!(Format::of(Path::new("src.tar")), Some(Format::Tar));
+        assert_eq!(Format::of(Path::new("src.gz")), None);
+    }
+
+    #[test]
+    fn test_entry_paths_stay_inside_the_archive() {
+        for (path, expected) in [
+            ("./src/lib.rs", Some("src/lib.rs")),
+            ("/src/lib.rs", Some("src/lib.rs")),
+            ("docs/../src/lib.rs", Some("src/lib.rs")),
+            ("src/../../etc/passwd", None),
+            ("../secrets.md", None),
+            ("./", None),
+        ] {
+            assert_eq!(
+                entry_path(Path::new(path)),
+                expected.map(PathBuf::from),
+                "{}",
+                path
+            );
+        }
+    }
+}
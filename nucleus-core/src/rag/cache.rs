@@ -0,0 +1,158 @@
+//! Cache of retrieval results keyed by query embedding and candidate count.
+//!
+//! Related questions in a session often retrieve the same chunks. Caching the
+//! search result for each query embedding skips the repeated vector search. The
+//! cache must be invalidated whenever the collection changes.
+//!
+//! Entries hold the raw candidates of a search, before `min_score`, `top_k`
+//! or metadata filters are applied, so only the number of candidates fetched
+//! needs to be part of the key.
+
+use super::types::SearchResult;
+use std::collections::{HashMap, VecDeque};
+use std::sync::Mutex;
+
+/// Number of query results kept before the oldest is evicted.
+pub const DEFAULT_CAPACITY: usize = 128;
+
+/// Embedding components are rounded to this many steps per unit before
+/// comparing, so tiny floating point differences still map to the same entry.
+const QUANTIZATION_SCALE: f32 = 1000.0;
+
+/// A search as cached: the quantized query embedding and the number of
+/// candidates fetched. Compared in full, so distinct searches never share an
+/// entry.
+#[derive(Debug, Clone, PartialEq, Eq, Hash)]
+struct CacheKey {
+    embedding: Vec<i32>,
+    limit: usize,
+}
+
+impl CacheKey {
+    fn new(embedding: &[f32], limit: usize) -> Self {
+        Self {
+            embedding: embedding
+                .iter()
+                .map(|value| (value * QUANTIZATION_SCALE).round() as i32)
+                .collect(),
+            limit,
+        }
+    }
+}
+
+#[derive(Default)]
+struct CacheState {
+    entries: HashMap<CacheKey, Vec<SearchResult>>,
+    order: VecDeque<CacheKey>,
+}
+
+/// Bounded FIFO cache from query embedding and candidate count to search
+/// results.
+pub struct RetrievalCache {
+    capacity: usize,
+    state: Mutex<CacheState>,
+}
+
+impl RetrievalCache {
+    pub fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            state: Mutex::new(CacheState::default()),
+        }
+    }
+
+    /// Cached results of fetching `limit` candidates for `embedding`, if any.
+    pub fn get(&self, embedding: &[f32], limit: usize) -> Option<Vec<SearchResult>> {
+        self.state
+            .lock()
+            .unwrap()
+            .entries
+            .get(&CacheKey::new(embedding, limit))
+            .cloned()
+    }
+
+    /// Stores the results of fetching `limit` candidates for `embedding`,
+    /// evicting the oldest entry when full.
+    pub fn insert(&self, embedding: &[f32], limit: usize, results: Vec<SearchResult>) {
+        if self.capacity == 0 {
+            return;
+        }
+
+        let key = CacheKey::new(embedding, limit);
+        let mut state = self.state.lock().unwrap();
+
+        if state.entries.insert(key.clone(), results).is_none() {
+            state.order.push_back(key);
+        }
+
+        while state.order.len() > self.capacity {
+            if let Some(oldest) = state.order.pop_front() {
+                state.entries.remove(&oldest);
+            }
+        }
+    }
+
+    /// Drops every cached result. Call after any change to the collection.
+    pub fn invalidate(&self) {
+        let mut state = self.state.lock().unwrap();
+        state.entries.clear();
+        state.order.clear();
+    }
+
+    pub fn len(&self) -> usize {
+        self.state.lock().unwrap().entries.len()
+    }
+}
+
+impl Default for RetrievalCache {
+    fn default() -> Self {
+        Self::new(DEFAULT_CAPACITY)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rag::Document;
+
+    fn result(id: &str) -> Vec<SearchResult> {
+        vec![SearchResult {
+            document: Document::new(id, id, vec![]),
+            score: 1.0,
+        }]
+    }
+
+    #[test]
+    fn test_nearly_equal_embeddings_share_an_entry() {
+        let cache = RetrievalCache::default();
+        cache.insert(&[0.1, 0.2, 0.3], 5, result("a"));
+
+        assert!(cache.get(&[0.1, 0.2, 0.3], 5).is_some());
+        assert!(cache.get(&[0.10001, 0.2, 0.3], 5).is_some());
+        assert!(cache.get(&[0.2, 0.2, 0.3], 5).is_none());
+    }
+
+    #[test]
+    fn test_searches_for_other_candidate_counts_miss() {
+        let cache = RetrievalCache::default();
+        cache.insert(&[0.1, 0.2, 0.3], 5, result("a"));
+
+        assert!(cache.get(&[0.1, 0.2, 0.3], 10).is_none());
+        assert!(cache.get(&[0.1, 0.2, 0.3, 0.0], 5).is_none());
+    }
+
+    #[test]
+    fn test_evicts_oldest_entry() {
+        let cache = RetrievalCache::new(2);
+        cache.insert(&[1.0], 5, result("a"));
+        cache.insert(&[2.0], 5, result("b"));
+        cache.insert(&[3.0], 5, result("c"));
+
+        assert_eq!(cache.len(), 2);
+        assert!(cache.get(&[1.0], 5).is_none());
+        assert!(cache.get(&[3.0], 5).is_some());
+
+        cache.invalidate();
+        assert_eq!(cache.len(), 0);
+    }
+}
@@ -0,0 +1,498 @@
+//! Pluggable chunking strategies.
+//!
+//! A [`Chunker`] splits one file's content into chunks. The [`ChunkerRegistry`]
+//! holds the available strategies by name and picks one per file by
+//! extension, falling back to [`TextChunker`] for unmapped extensions and for
+//! strategies that decline a file.
+//!
+//! Built-in strategies:
+//! - `text`: fixed-size overlapping character windows
+//! - `structured`: JSON and YAML split by key, used for `.json`, `.yaml` and `.yml`
+//! - `lines`: windows that only break between lines, for whitespace-sensitive
+//!   code such as Python; not used for any extension by default
+//! - `sentences`: windows that end at the last sentence end or line break that
+//!   fits, for prose; used for `.md`, `.markdown` and `.txt` when
+//!   `rag.indexer.sentence_aware` is set
+//!
+//! `rag.indexer.chunkers` maps further extensions to a strategy by name, for
+//! example `{ json: text }` to chunk JSON as plain text or `{ py: lines }` to
+//! keep Python lines and their indentation whole.
+
+use super::indexer::{chunk_text, FileChunk};
+use super::structured::{chunk_structured, Format};
+use std::collections::HashMap;
+use std::fmt;
+use std::path::Path;
+use std::sync::Arc;
+
+/// What a chunker is told about the file it is splitting.
+#[derive(Debug, Clone, Copy)]
+pub struct FileMeta<'a> {
+    pub path: &'a Path,
+    /// Target chunk size in bytes (`rag.indexer.chunk_size`).
+    pub chunk_size: usize,
+    /// Bytes shared between consecutive chunks (`rag.indexer.chunk_overlap`).
+    pub chunk_overlap: usize,
+}
+
+/// A strategy for splitting a file into chunks.
+pub trait Chunker: Send + Sync {
+    /// Splits `content`, or returns `None` to leave the file to plain text
+    /// chunking, e.g. when it doesn't parse as the expected format.
+    fn chunk(&self, content: &str, meta: &FileMeta) -> Option<Vec<FileChunk>>;
+}
+
+/// Fixed-size overlapping windows; the default for every file.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct TextChunker;
+
+impl Chunker for TextChunker {
+    fn chunk(&self, content: &str, meta: &FileMeta) -> Option<Vec<FileChunk>> {
+        Some(
+            chunk_text(content, meta.chunk_size, meta.chunk_overlap)
+                .into_iter()
+                .map(|content| FileChunk {
+                    content,
+                    key_path: None,
+                })
+                .collect(),
+        )
+    }
+}
+
+/// JSON and YAML split by key, with the key path recorded on each chunk.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct StructuredChunker;
+
+impl Chunker for StructuredChunker {
+    fn chunk(&self, content: &str, meta: &FileMeta) -> Option<Vec<FileChunk>> {
+        let format = Format::from_path(meta.path)?;
+        let chunks = chunk_structured(format, content, meta.chunk_size, meta.chunk_overlap)?;
+        Some(
+            chunks
+                .into_iter()
+                .map(|chunk| FileChunk {
+                    content: chunk.content,
+                    key_path: Some(chunk.key_path),
+                })
+                .collect(),
+        )
+    }
+}
+
+/// Windows of whole lines, keeping the original bytes of each line.
+///
+/// Lines are added to a chunk until the next one would pass `chunk_size`;
+/// the overlap is made of the last whole lines that fit in `chunk_overlap`.
+/// A single line longer than `chunk_size` becomes a chunk of its own rather
+/// than being split.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct LineChunker;
+
+impl Chunker for LineChunker {
+    fn chunk(&self, content: &str, meta: &FileMeta) -> Option<Vec<FileChunk>> {
+        Some(
+            chunk_lines(content, meta.chunk_size, meta.chunk_overlap)
+                .into_iter()
+                .map(|content| FileChunk {
+                    content,
+                    key_path: None,
+                })
+                .collect(),
+        )
+    }
+}
+
+fn chunk_lines(text: &str, chunk_size: usize, overlap: usize) -> Vec<String> {
+    let lines: Vec<&str> = text.split_inclusive('\n').collect();
+    let mut chunks = Vec::new();
+    let mut next = 0;
+
+    while next < lines.len() {
+        let start = next;
+        let mut size = 0;
+        while next < lines.len() && (next == start || size + lines[next].len() <= chunk_size) {
+            size += lines[next].len();
+            next += 1;
+        }
+        chunks.push(lines[start..next].concat());
+
+        if next == lines.len() {
+            break;
+        }
+
+        // Step back over whole lines for the overlap, always moving forward
+        // at least one line.
+        let mut shared = 0;
+        while next > start + 1 && shared + lines[next - 1].len() <= overlap {
+            shared += lines[next - 1].len();
+            next -= 1;
+        }
+    }
+
+    chunks
+}
+
+/// Extensions chunked with `sentences` when `rag.indexer.sentence_aware` is set.
+pub(crate) const PROSE_EXTENSIONS: &[&str] = &["md", "markdown", "txt"];
+
+/// Windows that end at a sentence boundary, keeping ideas in prose whole.
+///
+/// Each chunk ends after the last `.`, `!` or `?` followed by whitespace, or
+/// the last line break, within `chunk_size` bytes, along with the whitespace
+/// after it. A window with no such boundary past the overlap is cut at
+/// `chunk_size` as with [`TextChunker`].
+#[derive(Debug, Clone, Copy, Default)]
+pub struct SentenceChunker;
+
+impl Chunker for SentenceChunker {
+    fn chunk(&self, content: &str, meta: &FileMeta) -> Option<Vec<FileChunk>> {
+        Some(
+            chunk_sentences(content, meta.chunk_size, meta.chunk_overlap)
+                .into_iter()
+                .map(|content| FileChunk {
+                    content,
+                    key_path: None,
+                })
+                .collect(),
+        )
+    }
+}
+
+fn chunk_sentences(text: &str, chunk_size: usize, overlap: usize) -> Vec<String> {
+    let mut chunks = Vec::new();
+    let mut start = 0;
+
+    while start < text.len() {
+        let mut end = (start + chunk_size).min(text.len());
+        while end > start && !text.is_char_boundary(end) {
+            end -= 1;
+        }
+        if end < text.len() {
+            // Only back off to a boundary that still moves past the overlap,
+            // so the next chunk starts further on.
+            if let Some(boundary) = sentence_end(text, start, end) {
+                if boundary > overlap {
+                    end = start + boundary;
+                }
+            }
+        }
+        if end == start {
+            // A chunk size smaller than one character.
+            end += text[start..].chars().next().map_or(1, char::len_utf8);
+        }
+
+        chunks.push(text[start..end].to_string());
+        if end == text.len() {
+            break;
+        }
+
+        let mut next = end.saturating_sub(overlap).max(start + 1);
+        while !text.is_char_boundary(next) {
+            next += 1;
+        }
+        start = next;
+    }
+
+    chunks
+}
+
+/// Where the last sentence of `text[start..end]` ends, counted from
+/// `start` and including the whitespace after it that fits in the window.
+fn sentence_end(text: &str, start: usize, end: usize) -> Option<usize> {
+    let window = end - start;
+    let mut last = None;
+    let mut chars = text[start..].char_indices().peekable();
+    while let Some((index, c)) = chars.next() {
+        if index >= window {
+            break;
+        }
+        let ends = c == '\n'
+            || (matches!(c, '.' | '!' | '?')
+                && chars.peek().map_or(true, |(_, next)| next.is_whitespace()));
+        if !ends {
+            continue;
+        }
+        let mut boundary = index + c.len_utf8();
+        while let Some(&(index, next)) = chars.peek() {
+            if !next.is_whitespace() || index + next.len_utf8() > window {
+                break;
+            }
+            boundary = index + next.len_utf8();
+            chars.next();
+        }
+        last = Some(boundary);
+    }
+    last
+}
+
+/// Chunking strategies by name, and which one each extension uses.
+#[derive(Clone)]
+pub struct ChunkerRegistry {
+    strategies: HashMap<String, Arc<dyn Chunker>>,
+    extensions: HashMap<String, String>,
+}
+
+impl Default for ChunkerRegistry {
+    fn default() -> Self {
+        let mut registry = Self {
+            strategies: HashMap::new(),
+            extensions: HashMap::new(),
+        };
+        registry.register("text", TextChunker, &[]);
+        registry.register("structured", StructuredChunker, &["json", "yaml", "yml"]);
+        registry.register("lines", LineChunker, &[]);
+        registry.register("sentences", SentenceChunker, &[]);
+        registry
+    }
+}
+
+impl ChunkerRegistry {
+    /// The built-in strategies with `overrides` (extension to strategy name)
+    /// applied on top. Overrides naming an unknown strategy are ignored.
+    pub fn with_overrides(overrides: &HashMap<String, String>) -> Self {
+        let mut registry = Self::default();
+        registry.apply_overrides(overrides);
+        registry
+    }
+
+    /// Applies `overrides` (extension to strategy name) on top of the current
+    /// mapping. Overrides naming an unknown strategy are ignored.
+    pub fn apply_overrides(&mut self, overrides: &HashMap<String, String>) {
+        for (extension, strategy) in overrides {
+            if !self.use_for(extension, strategy) {
+                tracing::warn!(
+                    "Unknown chunker '{}' for .{} files, using default",
+                    strategy,
+                    extension
+                );
+            }
+        }
+    }
+
+    /// Adds a strategy under `name` and uses it for `extensions`.
+    ///
+    /// Replaces any strategy already registered under `name`.
+    pub fn register(
+        &mut self,
+        name: impl Into<String>,
+        chunker: impl Chunker + 'static,
+        extensions: &[&str],
+    ) {
+        let name = name.into();
+        self.strategies.insert(name.clone(), Arc::new(chunker));
+        for extension in extensions {
+            self.extensions.insert(normalize(extension), name.clone());
+        }
+    }
+
+    /// Uses the strategy called `name` for files with `extension`.
+    ///
+    /// Returns `false` if no strategy has that name.
+    pub fn use_for(&mut self, extension: &str, name: &str) -> bool {
+        if !self.strategies.contains_key(name) {
+            return false;
+        }
+        self.extensions
+            .insert(normalize(extension), name.to_string());
+        true
+    }
+
+    /// Chunks a file with the strategy for its extension.
+    pub fn chunk(&self, content: &str, meta: &FileMeta) -> Vec<FileChunk> {
+        let chosen = meta
+            .path
+            .extension()
+            .and_then(|extension| {
+                self.extensions
+                    .get(&normalize(&extension.to_string_lossy()))
+            })
+            .and_then(|name| self.strategies.get(name))
+            .and_then(|chunker| chunker.chunk(content, meta));
+
+        chosen
+            .or_else(|| TextChunker.chunk(content, meta))
+            .unwrap_or_default()
+    }
+}
+
+impl fmt::Debug for ChunkerRegistry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut names: Vec<_> = self.strategies.keys().collect();
+        names.sort();
+        f.debug_struct("ChunkerRegistry")
+            .field("strategies", &names)
+            .field("extensions", &self.extensions)
+            .finish()
+    }
+}
+
+fn normalize(extension: &str) -> String {
+    extension.trim_start_matches('.').to_lowercase()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    /// Splits on `|` and counts its calls.
+    #[derive(Clone, Default)]
+    struct PipeChunker {
+        calls: Arc<AtomicUsize>,
+    }
+
+    impl Chunker for PipeChunker {
+        fn chunk(&self, content: &str, _meta: &FileMeta) -> Option<Vec<FileChunk>> {
+            self.calls.fetch_add(1, Ordering::SeqCst);
+            Some(
+                content
+                    .split('|')
+                    .map(|part| FileChunk {
+                        content: part.to_string(),
+                        key_path: None,
+                    })
+                    .collect(),
+            )
+        }
+    }
+
+    fn meta(path: &str) -> FileMeta<'_> {
+        FileMeta {
+            path: Path::new(path),
+            chunk_size: 512,
+            chunk_overlap: 50,
+        }
+    }
+
+    fn contents(chunks: Vec<FileChunk>) -> Vec<String> {
+        chunks.into_iter().map(|chunk| chunk.content).collect()
+    }
+
+    #[test]
+    fn test_custom_chunker_handles_its_extension_only() {
+        let pipe = PipeChunker::default();
+        let mut registry = ChunkerRegistry::default();
+        registry.register("pipe", pipe.clone(), &[".ZZZ"]);
+
+        assert_eq!(
+            contents(registry.chunk("a|b|c", &meta("notes.zzz"))),
+            vec!["a", "b", "c"]
+        );
+        assert_eq!(
+            contents(registry.chunk("a|b|c", &meta("notes.txt"))),
+            vec!["a|b|c"]
+        );
+        assert_eq!(pipe.calls.load(Ordering::SeqCst), 1);
+    }
+
+    #[test]
+    fn test_defaults_match_previous_dispatch() {
+        let registry = ChunkerRegistry::default();
+
+        let yaml = registry.chunk("a: 1\nb: 2\n", &meta("config.yml"));
+        let keys: Vec<_> = yaml.iter().map(|c| c.key_path.as_deref()).collect();
+        assert_eq!(keys, vec![Some("a"), Some("b")]);
+
+        // Invalid JSON falls back to plain text.
+        let broken = registry.chunk("{ not json", &meta("data.json"));
+        assert_eq!(contents(broken), vec!["{ not json"]);
+    }
+
+    #[test]
+    fn test_line_chunks_never_split_python_lines() {
+        let source = "\
+def retry(request, attempts=3):
+    for attempt in range(attempts):
+        try:
+            return send(request)
+        except TimeoutError:
+            if attempt == attempts - 1:
+                raise
+            time.sleep(2 ** attempt)
+";
+        let mut registry = ChunkerRegistry::default();
+        assert!(registry.use_for("py", "lines"));
+        let meta = FileMeta {
+            path: Path::new("retry.py"),
+            chunk_size: 70,
+            chunk_overlap: 40,
+        };
+
+        let chunks = contents(registry.chunk(source, &meta));
+        assert!(chunks.len() > 1);
+        for chunk in &chunks {
+            assert!(chunk.ends_with('\n'));
+            for line in chunk.lines() {
+                assert!(source.lines().any(|l| l == line), "split line: {:?}", line);
+            }
+        }
+        // Overlap is whole lines, indentation included.
+        assert!(chunks[1].starts_with("    for attempt in range(attempts):\n"));
+        assert!(chunks.iter().any(
+            |c| c.contains("            if attempt == attempts - 1:\n                raise\n")
+        ));
+
+        // Without the overlap, the chunks are the file byte for byte.
+        let meta = FileMeta {
+            chunk_overlap: 0,
+            ..meta
+        };
+        assert_eq!(contents(registry.chunk(source, &meta)).concat(), source);
+    }
+
+    #[test]
+    fn test_overrides_select_strategy_by_name() {
+        let overrides = HashMap::from([
+            ("json".to_string(), "text".to_string()),
+            ("toml".to_string(), "missing".to_string()),
+        ]);
+        let registry = ChunkerRegistry::with_overrides(&overrides);
+
+        let chunks = registry.chunk("{\"a\": 1, \"b\": 2}", &meta("data.json"));
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].key_path, None);
+    }
+
+    #[test]
+    fn test_sentence_aware_chunks_end_at_sentence_boundaries() {
+        use crate::config::IndexerConfig;
+        use crate::rag::indexer::Indexer;
+
+        let prose = "Chunks are embedded one at a time. Each one should hold a whole idea! \
+Cutting a sentence in half splits its meaning across two vectors. Does that hurt recall? \
+It does, so prose is cut at sentence ends.\nA line break counts as a boundary too";
+        let indexer = Indexer::new(IndexerConfig {
+            chunk_size: 80,
+            chunk_overlap: 10,
+            sentence_aware: true,
+            ..IndexerConfig::default()
+        });
+
+        let chunks = contents(indexer.chunk_file(Path::new("notes.md"), prose));
+        assert!(chunks.len() > 2);
+        for chunk in &chunks[..chunks.len() - 1] {
+            assert!(chunk.len() <= 80);
+            let end = chunk.trim_end();
+            assert!(
+                chunk.ends_with('\n') || end.ends_with(['.', '!', '?']),
+                "chunk ends mid-sentence: {:?}",
+                chunk
+            );
+        }
+        assert_eq!(
+            chunks[0],
+            "Chunks are embedded one at a time. Each one should hold a whole idea! "
+        );
+        assert!(chunks.last().unwrap().ends_with("boundary too"));
+
+        // Code is still cut at exactly chunk_size.
+        let code = contents(indexer.chunk_file(Path::new("notes.rs"), prose));
+        assert_eq!(code[0].len(), 80);
+
+        // A window without any boundary falls back to the hard cut.
+        let run_on = "word ".repeat(40);
+        let chunks = chunk_sentences(&run_on, 80, 10);
+        assert_eq!(chunks[0].len(), 80);
+    }
+}
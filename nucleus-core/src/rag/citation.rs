@@ -0,0 +1,384 @@
+//! Source citations for retrieved chunks.
+//!
+//! A citation names the file a chunk came from and, when enabled, how stale it
+//! is: the file's last-modified time and the most recent commit touching the
+//! chunk's lines according to `git blame`.
+//!
+//! Indexed chunks record the lines they span as `start_line` and `end_line`
+//! metadata, so a citation can point an editor at them without rereading the
+//! file.
+
+use super::types::SearchResult;
+use crate::config::{CitationAnchor, CitationConfig};
+use std::path::Path;
+use std::time::{Duration, SystemTime};
+use tokio::process::Command;
+
+/// The last commit to touch a cited line range.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BlameInfo {
+    /// Abbreviated commit hash.
+    pub commit: String,
+    pub author: String,
+}
+
+/// Where a retrieved chunk came from.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Citation {
+    pub source: String,
+    /// First and last line of the chunk in the source file, 1-based.
+    pub lines: Option<(usize, usize)>,
+    pub modified: Option<SystemTime>,
+    pub blame: Option<BlameInfo>,
+}
+
+impl Citation {
+    /// Short human-readable form, e.g.
+    /// `src/main.rs:10-24, modified 3d ago, last commit 1a2b3c4 by Alice`.
+    ///
+    /// The location is written as `anchor` describes.
+    pub fn label(&self, anchor: CitationAnchor, now: SystemTime) -> String {
+        let mut label = self.location(anchor);
+
+        if let Some(modified) = self.modified {
+            let age = now.duration_since(modified).unwrap_or_default();
+            label.push_str(&format!(", modified {}", format_age(age)));
+        }
+
+        if let Some(blame) = &self.blame {
+            label.push_str(&format!(
+                ", last commit {} by {}",
+                blame.commit, blame.author
+            ));
+        }
+
+        label
+    }
+
+    /// The source and first line in the form `anchor` describes. Links use
+    /// the absolute path of the source.
+    pub fn location(&self, anchor: CitationAnchor) -> String {
+        let absolute = || {
+            std::path::absolute(&self.source)
+                .map(|path| path.to_string_lossy().into_owned())
+                .unwrap_or_else(|_| self.source.clone())
+        };
+
+        match (anchor, self.lines) {
+            (CitationAnchor::Range, Some((start, end))) => {
+                format!("{}:{}-{}", self.source, start, end)
+            }
+            (CitationAnchor::Line, Some((start, _))) => format!("{}:{}", self.source, start),
+            (CitationAnchor::FileUri, lines) => {
+                let uri = format!("file://{}", absolute());
+                match lines {
+                    Some((start, _)) => format!("{}#L{}", uri, start),
+                    None => uri,
+                }
+            }
+            (CitationAnchor::Vscode, lines) => {
+                let uri = format!("vscode://file{}", absolute());
+                match lines {
+                    Some((start, _)) => format!("{}:{}", uri, start),
+                    None => uri,
+                }
+            }
+            (_, None) => self.source.clone(),
+        }
+    }
+}
+
+/// Builds the citation for a search result.
+///
+/// Returns `None` for results without a `source`. Blame info is only looked
+/// up when `allow_commands` is set, since it runs `git`; it is left out when
+/// the file isn't in a repository or git isn't available.
+pub async fn cite(
+    result: &SearchResult,
+    config: &CitationConfig,
+    allow_commands: bool,
+) -> Option<Citation> {
+    let source = result.document.metadata.get("source")?.clone();
+    let path = Path::new(&source);
+
+    let mut citation = Citation {
+        source: source.clone(),
+        lines: indexed_lines(result),
+        modified: None,
+        blame: None,
+    };
+
+    if config.modified_time {
+        citation.modified = tokio::fs::metadata(path)
+            .await
+            .and_then(|m| m.modified())
+            .ok();
+    }
+
+    if config.git_blame && allow_commands {
+        if citation.lines.is_none() {
+            if let Ok(content) = tokio::fs::read_to_string(path).await {
+                citation.lines = line_range(&content, &result.document.content);
+            }
+        }
+        if let Some((start, end)) = citation.lines {
+            citation.blame = git_blame(path, start, end).await;
+        }
+    }
+
+    Some(citation)
+}
+
+/// The line range recorded on a chunk when it was indexed.
+fn indexed_lines(result: &SearchResult) -> Option<(usize, usize)> {
+    let metadata = &result.document.metadata;
+    let start = metadata.get("start_line")?.parse().ok()?;
+    let end = metadata.get("end_line")?.parse().ok()?;
+    Some((start, end))
+}
+
+/// 1-based line ranges of consecutive chunks of `content`, each `None` when
+/// the chunk doesn't appear verbatim, as with structured chunks.
+///
+/// Every chunk is searched for from where the previous one started, so
+/// overlapping chunks and repeated text map to the right lines.
+pub(crate) fn chunk_line_ranges<'a>(
+    content: &str,
+    chunks: impl IntoIterator<Item = &'a str>,
+) -> Vec<Option<(usize, usize)>> {
+    let mut cursor = 0;
+    let mut line_at_cursor = 1;
+
+    chunks
+        .into_iter()
+        .map(|chunk| {
+            let first_char = chunk.chars().next()?;
+            let start = cursor + content[cursor..].find(chunk)?;
+            let first = line_at_cursor + content[cursor..start].matches('\n').count();
+            let last = first + chunk.trim_end_matches('\n').matches('\n').count();
+
+            cursor = start + first_char.len_utf8();
+            line_at_cursor = first + usize::from(first_char == '\n');
+            Some((first, last))
+        })
+        .collect()
+}
+
+/// 1-based line range of `chunk` within `content`, if it appears verbatim.
+fn line_range(content: &str, chunk: &str) -> Option<(usize, usize)> {
+    if chunk.is_empty() {
+        return None;
+    }
+
+    let start = content.find(chunk)?;
+    let first = content[..start].matches('\n').count() + 1;
+    let last = first + chunk.trim_end_matches('\n').matches('\n').count();
+    Some((first, last))
+}
+
+/// Runs `git blame` over the line range and returns its most recent commit.
+async fn git_blame(path: &Path, start: usize, end: usize) -> Option<BlameInfo> {
+    let dir = path.parent().filter(|p| !p.as_os_str().is_empty())?;
+    let file = path.file_name()?;
+
+    let output = Command::new("git")
+        .arg("-C")
+        .arg(dir)
+        .args(["blame", "--porcelain", "-L"])
+        .arg(format!("{},{}", start, end))
+        .arg("--")
+        .arg(file)
+        .output()
+        .await
+        .ok()?;
+
+    if !output.status.success() {
+        return None;
+    }
+
+    latest_commit(&String::from_utf8_lossy(&output.stdout))
+}
+
+/// Picks the commit with the newest author time from porcelain blame output.
+///
+/// Lines that aren't committed yet are ignored.
+fn latest_commit(porcelain: &str) -> Option<BlameInfo> {
+    let mut latest: Option<(u64, BlameInfo)> = None;
+    let mut commit: Option<String> = None;
+    let mut author = String::new();
+
+    for line in porcelain.lines() {
+        if let Some(value) = line.strip_prefix("author ") {
+            author = value.to_string();
+        } else if let Some(value) = line.strip_prefix("author-time ") {
+            let (Some(hash), Ok(time)) = (&commit, value.parse::<u64>()) else {
+                continue;
+            };
+            if hash.chars().all(|c| c == '0') {
+                continue;
+            }
+            if latest.as_ref().map_or(true, |(newest, _)| time > *newest) {
+                latest = Some((
+                    time,
+                    BlameInfo {
+                        commit: hash.chars().take(7).collect(),
+                        author: author.clone(),
+                    },
+                ));
+            }
+        } else if is_header(line) {
+            commit = line.split(' ').next().map(str::to_string);
+        }
+    }
+
+    latest.map(|(_, blame)| blame)
+}
+
+/// Whether a porcelain line starts a new entry (a 40-character commit hash).
+fn is_header(line: &str) -> bool {
+    line.split(' ')
+        .next()
+        .is_some_and(|hash| hash.len() == 40 && hash.chars().all(|c| c.is_ascii_hexdigit()))
+}
+
+fn format_age(age: Duration) -> String {
+    let seconds = age.as_secs();
+    match seconds {
+        0..=59 => "just now".to_string(),
+        60..=3_599 => format!("{}m ago", seconds / 60),
+        3_600..=86_399 => format!("{}h ago", seconds / 3_600),
+        _ => format!("{}d ago", seconds / 86_400),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rag::Document;
+    use std::process::Command as StdCommand;
+    use tempfile::tempdir;
+
+    const FILE: &str = "fn one() {}\n\nfn two() {}\nfn three() {}\n";
+
+    fn result(path: &Path, chunk: &str) -> SearchResult {
+        SearchResult {
+            document: Document::new("id", chunk, vec![])
+                .with_metadata("source", path.to_string_lossy()),
+            score: 1.0,
+        }
+    }
+
+    fn git(dir: &Path, args: &[&str]) {
+        let status = StdCommand::new("git")
+            .arg("-C")
+            .arg(dir)
+            .args(["-c", "user.name=Ada", "-c", "user.email=ada@example.com"])
+            .args(args)
+            .output()
+            .unwrap()
+            .status;
+        assert!(status.success(), "git {:?} failed", args);
+    }
+
+    fn enabled() -> CitationConfig {
+        CitationConfig {
+            modified_time: true,
+            git_blame: true,
+            ..CitationConfig::default()
+        }
+    }
+
+    #[test]
+    fn test_line_range() {
+        assert_eq!(line_range(FILE, "fn one() {}"), Some((1, 1)));
+        assert_eq!(
+            line_range(FILE, "fn two() {}\nfn three() {}\n"),
+            Some((3, 4))
+        );
+        assert_eq!(line_range(FILE, "fn four() {}"), None);
+    }
+
+    #[test]
+    fn test_chunk_line_ranges_follow_overlapping_chunks() {
+        let content = "a\nb\nc\na\nb\n";
+        let ranges = chunk_line_ranges(content, ["a\nb\n", "b\nc\na\n", "a\nb\n", "{\"k\": 1}"]);
+        assert_eq!(ranges, vec![Some((1, 2)), Some((2, 4)), Some((4, 5)), None]);
+    }
+
+    #[tokio::test]
+    async fn test_anchor_uses_indexed_lines() {
+        let mut result = result(Path::new("src/lib.rs"), "fn two() {}");
+        result.document.metadata.extend([
+            ("start_line".to_string(), "42".to_string()),
+            ("end_line".to_string(), "45".to_string()),
+        ]);
+        let line = CitationConfig {
+            anchor: CitationAnchor::Line,
+            ..CitationConfig::default()
+        };
+
+        let citation = cite(&result, &line, false).await.unwrap();
+
+        assert_eq!(citation.lines, Some((42, 45)));
+        let now = SystemTime::now();
+        assert_eq!(citation.label(CitationAnchor::Line, now), "src/lib.rs:42");
+        assert_eq!(
+            citation.label(CitationAnchor::Range, now),
+            "src/lib.rs:42-45"
+        );
+        let uri = citation.location(CitationAnchor::FileUri);
+        assert!(uri.starts_with("file:///"));
+        assert!(uri.ends_with("/src/lib.rs#L42"));
+        let vscode = citation.location(CitationAnchor::Vscode);
+        assert!(vscode.starts_with("vscode://file/"));
+        assert!(vscode.ends_with("/src/lib.rs:42"));
+    }
+
+    #[tokio::test]
+    async fn test_blame_attached_for_committed_lines() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("lib.rs");
+        std::fs::write(&path, FILE).unwrap();
+        git(dir.path(), &["init", "-q"]);
+        git(dir.path(), &["add", "lib.rs"]);
+        git(dir.path(), &["commit", "-q", "-m", "Add lib"]);
+
+        let chunk = "fn two() {}\nfn three() {}\n";
+        let citation = cite(&result(&path, chunk), &enabled(), true).await.unwrap();
+
+        assert_eq!(citation.lines, Some((3, 4)));
+        assert!(citation.modified.is_some());
+        let blame = citation.blame.unwrap();
+        assert_eq!(blame.author, "Ada");
+        assert_eq!(blame.commit.len(), 7);
+
+        let label = cite(&result(&path, chunk), &enabled(), true)
+            .await
+            .unwrap()
+            .label(CitationAnchor::Range, SystemTime::now());
+        assert!(label.contains(":3-4, modified just now, last commit"));
+        assert!(label.ends_with("by Ada"));
+    }
+
+    #[tokio::test]
+    async fn test_blame_omitted_outside_repo_or_without_permission() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("lib.rs");
+        std::fs::write(&path, FILE).unwrap();
+
+        let citation = cite(&result(&path, "fn one() {}"), &enabled(), true)
+            .await
+            .unwrap();
+        assert!(citation.modified.is_some());
+        assert_eq!(citation.blame, None);
+
+        git(dir.path(), &["init", "-q"]);
+        git(dir.path(), &["add", "lib.rs"]);
+        git(dir.path(), &["commit", "-q", "-m", "Add lib"]);
+
+        let citation = cite(&result(&path, "fn one() {}"), &enabled(), false)
+            .await
+            .unwrap();
+        assert_eq!(citation.blame, None);
+    }
+}
@@ -0,0 +1,203 @@
+//! Comment handling for the text that is embedded, used with
+//! `rag.embed_without_comments`, `rag.prepend_source_path` and
+//! `rag.indexer.skip_blank`.
+//!
+//! Comments describe code in prose, which can pull a chunk towards queries
+//! about what it says rather than what it does. With the option on, chunks
+//! are embedded without their comments while the stored content, which is
+//! what the prompt shows, keeps them. The source path header is written as a
+//! comment of the file's language, so it reads like part of the code.
+
+use super::indexer::relative_path;
+use std::path::Path;
+
+/// How comments are written in a language.
+struct Syntax {
+    line: &'static [&'static str],
+    block: Option<(&'static str, &'static str)>,
+    /// Characters that open a string literal, inside which nothing is a comment.
+    quotes: &'static [char],
+}
+
+const C_LIKE: Syntax = Syntax {
+    line: &["//"],
+    block: Some(("/*", "*/")),
+    quotes: &['"', '\'', '`'],
+};
+
+/// Like [`C_LIKE`], but `'` also starts lifetimes, so only `"` opens a string.
+const RUST: Syntax = Syntax {
+    line: &["//"],
+    block: Some(("/*", "*/")),
+    quotes: &['"'],
+};
+
+const HASH: Syntax = Syntax {
+    line: &["#"],
+    block: None,
+    quotes: &['"', '\''],
+};
+
+const DASH: Syntax = Syntax {
+    line: &["--"],
+    block: None,
+    quotes: &['"', '\''],
+};
+
+fn syntax_for(path: &Path) -> Option<&'static Syntax> {
+    let extension = path.extension()?.to_str()?;
+    match extension {
+        "rs" => Some(&RUST),
+        "c" | "h" | "cc" | "cpp" | "hpp" | "cs" | "go" | "java" | "kt" | "scala" | "swift"
+        | "js" | "jsx" | "ts" | "tsx" | "php" => Some(&C_LIKE),
+        "py" | "rb" | "sh" | "bash" | "zsh" | "pl" | "r" => Some(&HASH),
+        "sql" | "lua" | "hs" => Some(&DASH),
+        _ => None,
+    }
+}
+
+/// `text` without the comments of the language of `path`, dropping lines
+/// that held nothing but a comment.
+///
+/// Files of unknown languages, and chunks that are entirely comments, are
+/// returned unchanged so there is still something to embed.
+pub(crate) fn strip_comments(path: &Path, text: &str) -> String {
+    let Some(syntax) = syntax_for(path) else {
+        return text.to_string();
+    };
+
+    let stripped = remove_comments(syntax, text);
+    let code: Vec<&str> = stripped
+        .lines()
+        .map(str::trim_end)
+        .filter(|line| !line.trim().is_empty())
+        .collect();
+    if code.is_empty() {
+        return text.to_string();
+    }
+    code.join("\n")
+}
+
+/// Whether `text` holds nothing but comments and whitespace in the language
+/// of `path`. Always false for unknown languages.
+pub(crate) fn is_only_comments(path: &Path, text: &str) -> bool {
+    syntax_for(path).is_some_and(|syntax| remove_comments(syntax, text).trim().is_empty())
+}
+
+/// The header naming `path`, relative to `root`, for its embedded chunks:
+/// `// file: src/lib.rs`, or `file: notes.txt` for files without a known
+/// comment syntax.
+pub(crate) fn path_header(path: &Path, root: Option<&Path>) -> String {
+    let name = relative_path(path, root);
+    match syntax_for(path) {
+        Some(syntax) => format!("{} file: {}", syntax.line[0], name),
+        None => format!("file: {}", name),
+    }
+}
+
+fn remove_comments(syntax: &Syntax, text: &str) -> String {
+    let mut out = String::with_capacity(text.len());
+    let mut rest = text;
+
+    while let Some(c) = rest.chars().next() {
+        if syntax.quotes.contains(&c) {
+            let end = string_end(rest, c);
+            out.push_str(&rest[..end]);
+            rest = &rest[end..];
+        } else if let Some(end) = char_literal_end(rest) {
+            out.push_str(&rest[..end]);
+            rest = &rest[end..];
+        } else if syntax.line.iter().any(|opener| rest.starts_with(opener)) {
+            let end = rest.find('\n').unwrap_or(rest.len());
+            rest = &rest[end..];
+        } else if let Some((open, close)) = syntax.block.filter(|(open, _)| rest.starts_with(open))
+        {
+            match rest[open.len()..].find(close) {
+                Some(end) => {
+                    let comment = &rest[..open.len() + end + close.len()];
+                    // Keep the line breaks so line-oriented cleanup still works.
+                    out.extend(comment.chars().filter(|&c| c == '\n'));
+                    rest = &rest[comment.len()..];
+                }
+                None => rest = "",
+            }
+        } else {
+            out.push(c);
+            rest = &rest[c.len_utf8()..];
+        }
+    }
+
+    out
+}
+
+/// Byte length of a Rust-style character literal such as `'"'` or `'\n'` at
+/// the start of `text`, which would otherwise be read as opening a string.
+fn char_literal_end(text: &str) -> Option<usize> {
+    let mut chars = text.char_indices();
+    chars.next().filter(|&(_, c)| c == '\'')?;
+    let (_, first) = chars.next()?;
+    if first == '\\' {
+        chars.next()?;
+    }
+    chars
+        .next()
+        .filter(|&(_, c)| c == '\'')
+        .map(|(i, c)| i + c.len_utf8())
+}
+
+/// Byte length of the string literal at the start of `text`, including its
+/// quotes. An unterminated literal runs to the end of the line.
+fn string_end(text: &str, quote: char) -> usize {
+    let mut escaped = false;
+    for (i, c) in text.char_indices().skip(1) {
+        match c {
+            _ if escaped => escaped = false,
+            '\\' => escaped = true,
+            '\n' => return i,
+            c if c == quote => return i + c.len_utf8(),
+            _ => {}
+        }
+    }
+    text.len()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_comments_removed_outside_strings() {
+        let code = "/// Loads the config.\nfn load<'a>() {\n    // read it\n    let url = \"http://x\"; /* inline */\n    let q = '\"'; // quote\n}\n";
+        assert_eq!(
+            strip_comments(Path::new("src/config.rs"), code),
+            "fn load<'a>() {\n    let url = \"http://x\";\n    let q = '\"';\n}"
+        );
+
+        let script = "# setup\nname = 'a # b'  # trailing\n";
+        assert_eq!(
+            strip_comments(Path::new("setup.py"), script),
+            "name = 'a # b'"
+        );
+
+        let lua = "-- greet\nprint(\"-- not a comment\") -- trailing\n";
+        assert_eq!(
+            strip_comments(Path::new("init.lua"), lua),
+            "print(\"-- not a comment\")"
+        );
+
+        let notes = "# Heading\nText";
+        assert_eq!(strip_comments(Path::new("README.md"), notes), notes);
+        assert_eq!(
+            strip_comments(Path::new("lib.rs"), "// only a comment\n"),
+            "// only a comment\n"
+        );
+    }
+
+    #[test]
+    fn test_is_only_comments() {
+        assert!(is_only_comments(Path::new("lib.rs"), "// a\n/* b */\n\n"));
+        assert!(is_only_comments(Path::new("run.sh"), "# setup\n"));
+        assert!(!is_only_comments(Path::new("lib.rs"), "fn main() {}\n"));
+        assert!(!is_only_comments(Path::new("notes.txt"), "# Heading\n"));
+    }
+}
@@ -0,0 +1,262 @@
+//! Side-by-side retrieval with two sets of settings.
+//!
+//! Used when tuning retrieval: the same query is run with two
+//! [`RetrievalSettings`] and the returned chunks are diffed, so it's easy to
+//! see what a larger `top_k` or a stricter `min_score` adds or removes.
+//! Settings that only take effect at index time, such as the chunking
+//! strategy, need a re-index and can't be compared this way.
+
+use super::types::SearchResult;
+use std::fmt;
+
+/// Query-time retrieval settings.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct RetrievalSettings {
+    /// Results returned per query (`storage.top_k`).
+    pub top_k: usize,
+    /// Minimum score a result must reach (`rag.min_score`).
+    pub min_score: Option<f32>,
+    /// Candidates fetched per result (`rag.candidate_multiplier`).
+    pub candidate_multiplier: usize,
+    /// Re-order candidates by query term coverage (`rag.rerank`); see
+    /// [`rerank`](super::rerank::rerank).
+    pub rerank: bool,
+}
+
+impl RetrievalSettings {
+    pub fn with_top_k(mut self, top_k: usize) -> Self {
+        self.top_k = top_k;
+        self
+    }
+
+    pub fn with_min_score(mut self, min_score: Option<f32>) -> Self {
+        self.min_score = min_score;
+        self
+    }
+
+    pub fn with_candidate_multiplier(mut self, candidate_multiplier: usize) -> Self {
+        self.candidate_multiplier = candidate_multiplier;
+        self
+    }
+
+    pub fn with_rerank(mut self, rerank: bool) -> Self {
+        self.rerank = rerank;
+        self
+    }
+
+    /// Sets one setting by its config name, e.g. `("top_k", "8")`.
+    ///
+    /// `min_score=none` clears the threshold.
+    pub fn set(&mut self, key: &str, value: &str) -> Result<(), String> {
+        let invalid = || format!("Invalid value for {}: {}", key, value);
+        match key {
+            "top_k" => self.top_k = value.parse().map_err(|_| invalid())?,
+            "min_score" if value == "none" => self.min_score = None,
+            "min_score" => self.min_score = Some(value.parse().map_err(|_| invalid())?),
+            "candidate_multiplier" => {
+                self.candidate_multiplier = value.parse().map_err(|_| invalid())?
+            }
+            "rerank" => self.rerank = value.parse().map_err(|_| invalid())?,
+            _ => return Err(format!("Unknown retrieval setting: {}", key)),
+        }
+        Ok(())
+    }
+
+    /// Number of candidates fetched from the store.
+    pub(crate) fn candidate_limit(&self) -> usize {
+        self.top_k * self.candidate_multiplier.max(1)
+    }
+}
+
+impl fmt::Display for RetrievalSettings {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "top_k={}", self.top_k)?;
+        match self.min_score {
+            Some(min_score) => write!(f, " min_score={}", min_score)?,
+            None => write!(f, " min_score=none")?,
+        }
+        write!(f, " candidate_multiplier={}", self.candidate_multiplier)?;
+        if self.rerank {
+            write!(f, " rerank")?;
+        }
+        Ok(())
+    }
+}
+
+/// A chunk returned by one side of a comparison.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ComparedHit {
+    pub id: String,
+    pub source: String,
+    pub score: f32,
+}
+
+impl From<&SearchResult> for ComparedHit {
+    fn from(result: &SearchResult) -> Self {
+        Self {
+            id: result.document.id.clone(),
+            source: result
+                .document
+                .metadata
+                .get("source")
+                .cloned()
+                .unwrap_or_default(),
+            score: result.score,
+        }
+    }
+}
+
+/// Results of one query under two settings.
+#[derive(Debug, Clone, PartialEq)]
+pub struct RetrievalComparison {
+    pub query: String,
+    pub settings: (RetrievalSettings, RetrievalSettings),
+    /// Hits with the first settings, best first.
+    pub first: Vec<ComparedHit>,
+    /// Hits with the second settings, best first.
+    pub second: Vec<ComparedHit>,
+}
+
+impl RetrievalComparison {
+    /// Hits only returned with the first settings.
+    pub fn only_in_first(&self) -> Vec<&ComparedHit> {
+        missing_from(&self.first, &self.second)
+    }
+
+    /// Hits only returned with the second settings.
+    pub fn only_in_second(&self) -> Vec<&ComparedHit> {
+        missing_from(&self.second, &self.first)
+    }
+
+    /// Whether both settings returned the same chunks in the same order.
+    pub fn is_same(&self) -> bool {
+        self.first.len() == self.second.len()
+            && self
+                .first
+                .iter()
+                .zip(&self.second)
+                .all(|(a, b)| a.id == b.id)
+    }
+}
+
+fn missing_from<'a>(hits: &'a [ComparedHit], other: &[ComparedHit]) -> Vec<&'a ComparedHit> {
+    hits.iter()
+        .filter(|hit| !other.iter().any(|o| o.id == hit.id))
+        .collect()
+}
+
+/// Lists every hit from either side with its rank and score under each
+/// settings, marking hits unique to one side with `-` (first) or `+` (second).
+impl fmt::Display for RetrievalComparison {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "Query: {}", self.query)?;
+        writeln!(f, "- {}", self.settings.0)?;
+        writeln!(f, "+ {}", self.settings.1)?;
+
+        let mut ids: Vec<&str> = self.first.iter().map(|hit| hit.id.as_str()).collect();
+        for hit in &self.second {
+            if !ids.contains(&hit.id.as_str()) {
+                ids.push(&hit.id);
+            }
+        }
+
+        for id in ids {
+            let first = position(&self.first, id);
+            let second = position(&self.second, id);
+            let marker = match (first, second) {
+                (Some(_), None) => '-',
+                (None, Some(_)) => '+',
+                _ => ' ',
+            };
+            let hit = first
+                .or(second)
+                .map(|(_, hit)| hit)
+                .expect("id from a side");
+            writeln!(
+                f,
+                "{} {:>12} | {:>12}  {} ({})",
+                marker,
+                rank_and_score(first),
+                rank_and_score(second),
+                hit.source,
+                hit.id
+            )?;
+        }
+
+        write!(
+            f,
+            "{} only in first, {} only in second",
+            self.only_in_first().len(),
+            self.only_in_second().len()
+        )
+    }
+}
+
+fn position<'a>(hits: &'a [ComparedHit], id: &str) -> Option<(usize, &'a ComparedHit)> {
+    hits.iter().enumerate().find(|(_, hit)| hit.id == id)
+}
+
+fn rank_and_score(hit: Option<(usize, &ComparedHit)>) -> String {
+    match hit {
+        Some((index, hit)) => format!("#{} {:.3}", index + 1, hit.score),
+        None => "-".to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn hit(id: &str, score: f32) -> ComparedHit {
+        ComparedHit {
+            id: id.to_string(),
+            source: format!("{}.md", id),
+            score,
+        }
+    }
+
+    #[test]
+    fn test_set_by_name() {
+        let mut settings = RetrievalSettings {
+            top_k: 5,
+            min_score: Some(0.2),
+            candidate_multiplier: 3,
+            rerank: false,
+        };
+
+        settings.set("top_k", "8").unwrap();
+        settings.set("min_score", "none").unwrap();
+        assert_eq!(settings.top_k, 8);
+        assert_eq!(settings.min_score, None);
+        assert_eq!(settings.candidate_limit(), 24);
+
+        assert!(settings.set("top_k", "many").is_err());
+        assert!(settings.set("chunk_size", "10").is_err());
+    }
+
+    #[test]
+    fn test_display_marks_hits_unique_to_a_side() {
+        let settings = RetrievalSettings {
+            top_k: 2,
+            min_score: None,
+            candidate_multiplier: 1,
+            rerank: false,
+        };
+        let comparison = RetrievalComparison {
+            query: "q".to_string(),
+            settings: (settings, settings.with_top_k(3)),
+            first: vec![hit("a", 0.9), hit("b", 0.5)],
+            second: vec![hit("a", 0.9), hit("c", 0.7), hit("b", 0.5)],
+        };
+
+        let text = comparison.to_string();
+        let lines: Vec<&str> = text.lines().collect();
+        assert_eq!(lines[1], "- top_k=2 min_score=none candidate_multiplier=1");
+        assert!(lines[3].starts_with("  "));
+        assert!(lines[5].starts_with('+'));
+        assert!(lines[5].contains("#2 0.700"));
+        assert!(lines[5].ends_with("c.md (c)"));
+        assert_eq!(lines[6], "0 only in first, 1 only in second");
+        assert!(!comparison.is_same());
+    }
+}
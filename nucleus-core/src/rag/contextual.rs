@@ -0,0 +1,102 @@
+//! Situational cues for chunks, used with `rag.contextual_chunks`.
+//!
+//! A chunk cut from the middle of a function or section loses the line that
+//! says what it belongs to. With contextual chunks on, the nearest signature
+//! or heading above a chunk is prepended to the text that is embedded, while
+//! the stored content, which is what the prompt shows, stays unchanged.
+
+use regex::Regex;
+use std::path::Path;
+use std::sync::LazyLock;
+
+/// Declarations that open a scope in common languages.
+static SIGNATURE: LazyLock<Regex> = LazyLock::new(|| {
+    Regex::new(
+        r"^\s*(?:(?:pub(?:\([^)]*\))?|export|default|async|unsafe|const|static|public|private|protected|abstract)\s+)*(?:fn|impl|struct|enum|trait|mod|def|class|func|function|interface|type)\b",
+    )
+    .expect("built-in signature pattern")
+});
+
+/// The signatures or headings of a file, by line, to look up which one a
+/// chunk falls under.
+pub(crate) struct ContextLines {
+    /// 1-based line number and trimmed text, in file order.
+    lines: Vec<(usize, String)>,
+}
+
+impl ContextLines {
+    /// Collects the headings of a Markdown file, or the signatures of any
+    /// other file.
+    pub fn new(path: &Path, content: &str) -> Self {
+        let markdown = path
+            .extension()
+            .and_then(|extension| extension.to_str())
+            .is_some_and(|extension| matches!(extension, "md" | "markdown"));
+
+        let lines = content
+            .lines()
+            .enumerate()
+            .filter(|(_, line)| {
+                if markdown {
+                    is_heading(line)
+                } else {
+                    SIGNATURE.is_match(line)
+                }
+            })
+            .map(|(index, line)| (index + 1, line.trim().to_string()))
+            .collect();
+        Self { lines }
+    }
+
+    /// The nearest signature or heading at or above `line`, if there is one.
+    pub fn before(&self, line: usize) -> Option<&str> {
+        let index = self.lines.partition_point(|(number, _)| *number <= line);
+        index
+            .checked_sub(1)
+            .map(|index| self.lines[index].1.as_str())
+    }
+
+    /// The text to embed for a chunk starting at `line`: the chunk with its
+    /// context line prepended, or the chunk alone when it has none or already
+    /// starts with it.
+    pub fn situate(&self, line: Option<usize>, chunk: &str) -> String {
+        match line.and_then(|line| self.before(line)) {
+            Some(context) if !chunk.trim_start().starts_with(context) => {
+                format!("{}\n{}", context, chunk)
+            }
+            _ => chunk.to_string(),
+        }
+    }
+}
+
+fn is_heading(line: &str) -> bool {
+    let hashes = line.len() - line.trim_start_matches('#').len();
+    (1..=6).contains(&hashes) && line[hashes..].starts_with(' ')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_nearest_signature_or_heading_above_a_line() {
+        let code = "use std::fmt;\n\npub async fn load(path: &Path) -> Result<()> {\n    let a = 1;\n    let b = 2;\n}\n";
+        let lines = ContextLines::new(Path::new("src/load.rs"), code);
+        assert_eq!(lines.before(2), None);
+        assert_eq!(
+            lines.before(5),
+            Some("pub async fn load(path: &Path) -> Result<()> {")
+        );
+
+        let doc = "# Guide\n\nIntro\n\n## Install\n\nRun the script.\n#hashtag\n";
+        let lines = ContextLines::new(Path::new("README.md"), doc);
+        assert_eq!(lines.before(4), Some("# Guide"));
+        assert_eq!(lines.before(8), Some("## Install"));
+        assert_eq!(
+            lines.situate(Some(7), "Run the script."),
+            "## Install\nRun the script."
+        );
+        assert_eq!(lines.situate(None, "Run the script."), "Run the script.");
+        assert_eq!(lines.situate(Some(5), "## Install\n"), "## Install\n");
+    }
+}
@@ -0,0 +1,96 @@
+//! Earlier chat turns, kept apart per conversation.
+//!
+//! Every conversation has its own in-memory index, so a turn is only ever
+//! recalled into the conversation it was said in. An index keeps the last
+//! `rag.conversation_recall.max_turns` turns, dropping the oldest first, and
+//! once [`MAX_CONVERSATIONS`] conversations are kept the one used least
+//! recently is forgotten to make room for a new one.
+
+use super::memory_store::MemoryStore;
+use super::types::Document;
+use crate::config::SimilarityMetric;
+use std::collections::VecDeque;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+
+/// Most conversations whose turns are kept at once.
+const MAX_CONVERSATIONS: usize = 256;
+
+/// The conversation indexes of an engine, shared between its clones.
+pub(crate) struct Conversations {
+    /// Conversations by ID, least recently used first.
+    indexes: Mutex<VecDeque<(String, Arc<Conversation>)>>,
+    similarity: SimilarityMetric,
+    max_turns: usize,
+}
+
+/// The remembered turns of one conversation.
+pub(crate) struct Conversation {
+    turns: MemoryStore,
+    next_turn: AtomicUsize,
+    max_turns: usize,
+}
+
+impl Conversations {
+    pub fn new(similarity: SimilarityMetric, max_turns: usize) -> Self {
+        Self {
+            indexes: Mutex::default(),
+            similarity,
+            max_turns,
+        }
+    }
+
+    /// The index of conversation `id`, created if it has none yet.
+    pub fn get_or_create(&self, id: &str) -> Arc<Conversation> {
+        let mut indexes = self.indexes.lock().unwrap();
+        let conversation = match indexes.iter().position(|(key, _)| key == id) {
+            Some(position) => indexes.remove(position).unwrap().1,
+            None => {
+                if indexes.len() >= MAX_CONVERSATIONS {
+                    indexes.pop_front();
+                }
+                Arc::new(Conversation {
+                    turns: MemoryStore::new().with_similarity(self.similarity),
+                    next_turn: AtomicUsize::new(0),
+                    max_turns: self.max_turns,
+                })
+            }
+        };
+        indexes.push_back((id.to_string(), conversation.clone()));
+        conversation
+    }
+
+    /// The index of conversation `id`, if anything was remembered in it.
+    pub fn get(&self, id: &str) -> Option<Arc<Conversation>> {
+        self.indexes
+            .lock()
+            .unwrap()
+            .iter()
+            .find(|(key, _)| key == id)
+            .map(|(_, conversation)| conversation.clone())
+    }
+}
+
+impl Conversation {
+    /// The store holding the turns, oldest first.
+    pub fn turns(&self) -> &MemoryStore {
+        &self.turns
+    }
+
+    /// A turn document for `content`, numbered after every turn before it.
+    ///
+    /// Numbers are taken atomically, so turns remembered at the same time
+    /// never share an ID.
+    pub fn turn(&self, role: &str, content: &str, embedding: Vec<f32>) -> Document {
+        let turn = self.next_turn.fetch_add(1, Ordering::SeqCst);
+        Document::new(format!("turn:{}", turn), content, embedding)
+            .with_metadata("source", "conversation")
+            .with_metadata("role", role)
+            .with_metadata("turn", turn.to_string())
+    }
+
+    /// Drops the oldest turns beyond `max_turns`.
+    pub fn evict(&self) {
+        self.turns.keep_latest(self.max_turns);
+    }
+}
@@ -7,7 +7,9 @@ use crate::{
     models::EmbeddingModel,
     provider::{Provider, ProviderError},
 };
-use std::sync::Arc;
+use sha2::{Digest, Sha256};
+use std::collections::{HashMap, VecDeque};
+use std::sync::{Arc, Mutex};
 use thiserror::Error;
 
 /// Errors that can occur during embedding generation.
@@ -39,10 +41,30 @@ pub type Result<T> = std::result::Result<T, EmbedderError>;
 /// - `nomic-embed-text` - 768-dimensional embeddings, good general purpose
 /// - `mxbai-embed-large` - 1024-dimensional embeddings, higher quality
 ///
+/// Embeddings are cached by text, so embedding the same chunk twice (for
+/// example when pre-warming before an index) only calls the provider once.
+///
+/// # Prefixes
+///
+/// Instruction-tuned models such as `nomic-embed-text` expect a task prefix,
+/// e.g. `search_document: ` for indexed content and `search_query: ` for
+/// queries. [`embed_document`](Self::embed_document) and
+/// [`embed_query`](Self::embed_query) prepend the prefixes set with
+/// [`with_prefixes`](Self::with_prefixes); [`embed`](Self::embed) never does.
+///
+/// # Normalization
+///
+/// With [`with_normalization`](Self::with_normalization) every embedding is
+/// scaled to unit length, which makes dot-product scores equal to cosine
+/// similarity for models that don't normalize their output.
 #[derive(Clone)]
 pub struct Embedder {
     provider: Arc<dyn Provider>,
     model: EmbeddingModel,
+    cache: Arc<EmbeddingCache>,
+    document_prefix: String,
+    query_prefix: String,
+    normalize: bool,
 }
 
 impl Embedder {
@@ -50,9 +72,56 @@ impl Embedder {
         Self {
             provider,
             model: model.into(),
+            cache: Arc::new(EmbeddingCache::new(DEFAULT_CACHE_CAPACITY)),
+            document_prefix: String::new(),
+            query_prefix: String::new(),
+            normalize: false,
         }
     }
 
+    /// Sets the prefixes prepended to indexed content and to queries.
+    pub fn with_prefixes(
+        mut self,
+        document_prefix: impl Into<String>,
+        query_prefix: impl Into<String>,
+    ) -> Self {
+        self.document_prefix = document_prefix.into();
+        self.query_prefix = query_prefix.into();
+        self
+    }
+
+    /// Scales every embedding to unit length when `normalize` is set.
+    pub fn with_normalization(mut self, normalize: bool) -> Self {
+        self.normalize = normalize;
+        self
+    }
+
+    /// Sets how many embeddings are cached. `0` disables the cache.
+    pub fn with_cache_capacity(mut self, capacity: usize) -> Self {
+        self.cache = Arc::new(EmbeddingCache::new(capacity));
+        self
+    }
+
+    /// ID of the configured model.
+    pub fn model_id(&self) -> &str {
+        &self.model.id
+    }
+
+    /// Length of the vectors produced by the configured model.
+    pub fn dimension(&self) -> usize {
+        self.model.embedding_dim
+    }
+
+    /// Whether an embedding for `text` is already cached.
+    pub fn is_cached(&self, text: &str) -> bool {
+        self.cache.get(text).is_some()
+    }
+
+    /// Number of cached embeddings.
+    pub fn cached_count(&self) -> usize {
+        self.cache.len()
+    }
+
     /// Generates a vector embedding for the given text.
     ///
     /// The embedding is a high-dimensional vector (typically 768 or 1024 dimensions)
@@ -76,10 +145,76 @@ impl Embedder {
     /// - The API returns no embeddings
     ///
     pub async fn embed(&self, text: &str) -> Result<Vec<f32>> {
+        self.embed_cached(text, false).await
+    }
+
+    /// Looks `text` up in the cache, and embeds and caches it when missing.
+    async fn embed_cached(&self, text: &str, query: bool) -> Result<Vec<f32>> {
+        if let Some(embedding) = self.cache.get(text) {
+            return Ok(embedding);
+        }
+
+        let embedding = self.embed_uncached(text, query).await?;
+        self.cache.insert(text, embedding.clone());
+        Ok(embedding)
+    }
+
+    /// Asks the provider for an embedding of `text`, skipping the cache.
+    /// Queries go through [`Provider::embed_query`] so they can be served
+    /// ahead of indexing.
+    async fn embed_uncached(&self, text: &str, query: bool) -> Result<Vec<f32>> {
+        let embedding = if query {
+            self.provider.embed_query(text, &self.model).await
+        } else {
+            self.provider.embed(text, &self.model).await
+        };
+        let mut embedding = embedding.map_err(EmbedderError::Provider)?;
+        if self.normalize {
+            normalize(&mut embedding);
+        }
+        Ok(embedding)
+    }
+
+    /// Sends a one-word embed request so the provider loads the model.
+    ///
+    /// Bypasses the cache, since a cached embedding wouldn't reach the provider.
+    pub async fn load_model(&self) -> Result<()> {
         self.provider
-            .embed(text, &self.model)
+            .embed("warmup", &self.model)
+            .await
+            .map_err(EmbedderError::Provider)?;
+        Ok(())
+    }
+
+    /// Embeds content being added to the knowledge base, with the document prefix.
+    pub async fn embed_document(&self, text: &str) -> Result<Vec<f32>> {
+        self.embed(&prefixed(&self.document_prefix, text)).await
+    }
+
+    /// Embeds a search query, with the query prefix.
+    pub async fn embed_query(&self, text: &str) -> Result<Vec<f32>> {
+        self.embed_cached(&prefixed(&self.query_prefix, text), true)
+            .await
+    }
+
+    /// Embeds a search query like [`embed_query`](Self::embed_query), but
+    /// always asks the provider and leaves the cache untouched.
+    ///
+    /// Used to time embedding, which a cached query would hide.
+    pub async fn embed_query_uncached(&self, text: &str) -> Result<Vec<f32>> {
+        self.embed_uncached(&prefixed(&self.query_prefix, text), true)
             .await
-            .map_err(EmbedderError::Provider)
+    }
+
+    /// Embeds content being added to the knowledge base in batch, with the
+    /// document prefix.
+    pub async fn embed_documents(&self, texts: &[&str]) -> Result<Vec<Vec<f32>>> {
+        let texts: Vec<String> = texts
+            .iter()
+            .map(|text| prefixed(&self.document_prefix, text))
+            .collect();
+        let refs: Vec<&str> = texts.iter().map(|text| text.as_str()).collect();
+        self.embed_batch(&refs).await
     }
 
     /// Generates embeddings for multiple texts in batch.
@@ -93,7 +228,8 @@ impl Embedder {
     ///
     /// # Returns
     ///
-    /// A vector of embeddings, one for each input text.
+    /// A vector of embeddings, one for each input text. Only texts missing from
+    /// the cache are sent to the provider.
     ///
     /// # Errors
     ///
@@ -102,16 +238,197 @@ impl Embedder {
         use tracing::info;
 
         info!("Embedder::embed_batch called with {} texts", texts.len());
-        let result = self
-            .provider
-            .embed_batch(texts, &self.model)
-            .await
-            .map_err(EmbedderError::Provider)?;
+        let mut embeddings: Vec<Option<Vec<f32>>> =
+            texts.iter().map(|text| self.cache.get(text)).collect();
+
+        let missing: Vec<&str> = texts
+            .iter()
+            .zip(&embeddings)
+            .filter(|(_, cached)| cached.is_none())
+            .map(|(text, _)| *text)
+            .collect();
+
+        if !missing.is_empty() {
+            let mut fresh = self
+                .provider
+                .embed_batch(&missing, &self.model)
+                .await
+                .map_err(EmbedderError::Provider)?
+                .into_iter();
+
+            for (text, slot) in texts.iter().zip(embeddings.iter_mut()) {
+                if slot.is_none() {
+                    let mut embedding = fresh.next().ok_or(EmbedderError::NoEmbeddings)?;
+                    if self.normalize {
+                        normalize(&mut embedding);
+                    }
+                    self.cache.insert(text, embedding.clone());
+                    *slot = Some(embedding);
+                }
+            }
+        }
+
         info!(
-            "Embedder::embed_batch completed, got {} embeddings",
-            result.len()
+            "Embedder::embed_batch completed, {} of {} from cache",
+            texts.len() - missing.len(),
+            texts.len()
+        );
+
+        Ok(embeddings.into_iter().flatten().collect())
+    }
+}
+
+fn prefixed(prefix: &str, text: &str) -> String {
+    format!("{}{}", prefix, text)
+}
+
+/// Scales `vector` to unit length. Zero vectors are left as they are.
+pub(crate) fn normalize(vector: &mut [f32]) {
+    let norm = vector.iter().map(|x| x * x).sum::<f32>().sqrt();
+    if norm > 0.0 {
+        vector.iter_mut().for_each(|x| *x /= norm);
+    }
+}
+
+/// Number of embeddings cached when no capacity is configured.
+const DEFAULT_CACHE_CAPACITY: usize = 10_000;
+
+#[derive(Default)]
+struct CacheState {
+    entries: HashMap<[u8; 32], Vec<f32>>,
+    order: VecDeque<[u8; 32]>,
+}
+
+/// Bounded FIFO cache of embeddings keyed by a hash of the embedded text.
+struct EmbeddingCache {
+    capacity: usize,
+    state: Mutex<CacheState>,
+}
+
+impl EmbeddingCache {
+    fn new(capacity: usize) -> Self {
+        Self {
+            capacity,
+            state: Mutex::new(CacheState::default()),
+        }
+    }
+
+    fn key(text: &str) -> [u8; 32] {
+        Sha256::digest(text.as_bytes()).into()
+    }
+
+    fn get(&self, text: &str) -> Option<Vec<f32>> {
+        self.state
+            .lock()
+            .unwrap()
+            .entries
+            .get(&Self::key(text))
+            .cloned()
+    }
+
+    fn insert(&self, text: &str, embedding: Vec<f32>) {
+        if self.capacity == 0 {
+            return;
+        }
+
+        let key = Self::key(text);
+        let mut state = self.state.lock().unwrap();
+        if state.entries.insert(key, embedding).is_none() {
+            state.order.push_back(key);
+        }
+
+        while state.order.len() > self.capacity {
+            if let Some(oldest) = state.order.pop_front() {
+                state.entries.remove(&oldest);
+            }
+        }
+    }
+
+    fn len(&self) -> usize {
+        self.state.lock().unwrap().entries.len()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::provider::testing::{ScaledProvider, ScriptedProvider};
+
+    #[tokio::test]
+    async fn test_prefixes_applied_per_path() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let embedder = Embedder::new(provider.clone(), EmbeddingModel::default())
+            .with_prefixes("search_document: ", "search_query: ");
+
+        embedder.embed_document("fn main() {}").await.unwrap();
+        embedder.embed_documents(&["a", "b"]).await.unwrap();
+        embedder.embed_query("where is main?").await.unwrap();
+
+        assert_eq!(
+            provider.embedded_texts(),
+            vec![
+                "search_document: fn main() {}",
+                "search_document: a",
+                "search_document: b",
+                "search_query: where is main?",
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_normalization_yields_unit_vectors() {
+        let provider = Arc::new(ScaledProvider);
+        let raw = Embedder::new(provider.clone(), EmbeddingModel::default());
+        let normalized = Embedder::new(provider, EmbeddingModel::default())
+            .with_normalization(true)
+            .with_cache_capacity(0);
+
+        let length = |v: &[f32]| v.iter().map(|x| x * x).sum::<f32>().sqrt();
+        let text = "the quick brown fox jumps over the quick dog";
+        assert!((length(&raw.embed(text).await.unwrap()) - 1.0).abs() > 1e-3);
+
+        for embedding in normalized
+            .embed_batch(&[text, "fox", "the the the"])
+            .await
+            .unwrap()
+            .into_iter()
+            .chain([normalized.embed(text).await.unwrap()])
+        {
+            assert!((length(&embedding) - 1.0).abs() < 1e-5);
+        }
+
+        let mut zero = vec![0.0; 4];
+        normalize(&mut zero);
+        assert_eq!(zero, vec![0.0; 4]);
+    }
+
+    #[tokio::test]
+    async fn test_empty_prefixes_leave_input_unchanged() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let embedder = Embedder::new(provider.clone(), EmbeddingModel::default());
+
+        embedder.embed_document("fn main() {}").await.unwrap();
+        embedder.embed_query("where is main?").await.unwrap();
+
+        assert_eq!(
+            provider.embedded_texts(),
+            vec!["fn main() {}", "where is main?"]
         );
+    }
+
+    #[tokio::test]
+    async fn test_uncached_query_always_reaches_provider() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let embedder = Embedder::new(provider.clone(), EmbeddingModel::default())
+            .with_prefixes("", "search_query: ");
+
+        let query = "where is main?";
+        let cached = embedder.embed_query(query).await.unwrap();
+        let uncached = embedder.embed_query_uncached(query).await.unwrap();
+        embedder.embed_query_uncached(query).await.unwrap();
 
-        Ok(result)
+        assert_eq!(cached, uncached);
+        assert_eq!(provider.embedded_texts().len(), 3);
+        assert_eq!(embedder.cached_count(), 1);
     }
 }
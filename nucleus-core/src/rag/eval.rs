@@ -0,0 +1,233 @@
+//! Retrieval quality measurement against a labeled query set.
+//!
+//! A labeled set maps each query to the source files that should be retrieved
+//! for it. Running it through [`RagEngine::evaluate`](super::RagEngine::evaluate)
+//! reports recall@k and mean reciprocal rank (MRR) for the current settings.
+
+use std::collections::BTreeMap;
+use std::fmt;
+use std::path::Path;
+
+/// Queries and the sources expected for each.
+///
+/// Loaded from a JSON object whose keys are queries and whose values are an
+/// expected source path or a list of them:
+///
+/// ```json
+/// {
+///   "how are files split into chunks?": "src/rag/indexer.rs",
+///   "where is the config loaded?": ["src/config.rs", "README.md"]
+/// }
+/// ```
+///
+/// Expected paths match a retrieved source that ends with them, so they can
+/// be given relative to the indexed directory.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct LabeledSet {
+    pub queries: Vec<LabeledQuery>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct LabeledQuery {
+    pub query: String,
+    pub expected: Vec<String>,
+}
+
+#[derive(serde::Deserialize)]
+#[serde(untagged)]
+enum Expected {
+    One(String),
+    Many(Vec<String>),
+}
+
+impl LabeledSet {
+    /// Parses a labeled set from JSON. Queries are kept in sorted order.
+    pub fn from_json(json: &str) -> Result<Self, String> {
+        let labels: BTreeMap<String, Expected> =
+            serde_json::from_str(json).map_err(|e| e.to_string())?;
+
+        let queries = labels
+            .into_iter()
+            .map(|(query, expected)| LabeledQuery {
+                query,
+                expected: match expected {
+                    Expected::One(source) => vec![source],
+                    Expected::Many(sources) => sources,
+                },
+            })
+            .collect();
+
+        Ok(Self { queries })
+    }
+
+    /// Reads and parses a labeled set file.
+    pub fn load(path: &Path) -> Result<Self, String> {
+        let json = std::fs::read_to_string(path)
+            .map_err(|e| format!("Failed to read {}: {}", path.display(), e))?;
+        Self::from_json(&json).map_err(|e| format!("Invalid labeled set {}: {}", path.display(), e))
+    }
+}
+
+/// How retrieval did for one query.
+#[derive(Debug, Clone, PartialEq)]
+pub struct QueryEval {
+    pub query: String,
+    pub expected: Vec<String>,
+    /// Distinct sources retrieved, best first.
+    pub retrieved: Vec<String>,
+    /// Fraction of the expected sources that were retrieved.
+    pub recall: f64,
+    /// 1-based position of the first expected source, if any was retrieved.
+    pub first_hit: Option<usize>,
+}
+
+impl QueryEval {
+    /// Scores a ranked list of retrieved sources against the expected ones.
+    ///
+    /// Sources retrieved more than once (several chunks of one file) count at
+    /// the position of their first chunk.
+    pub fn score(query: &str, expected: &[String], retrieved: &[String]) -> Self {
+        let mut distinct: Vec<String> = Vec::new();
+        for source in retrieved {
+            if !distinct.contains(source) {
+                distinct.push(source.clone());
+            }
+        }
+
+        let found = expected
+            .iter()
+            .filter(|e| distinct.iter().any(|source| matches(source, e)))
+            .count();
+        let recall = if expected.is_empty() {
+            0.0
+        } else {
+            found as f64 / expected.len() as f64
+        };
+        let first_hit = distinct
+            .iter()
+            .position(|source| expected.iter().any(|e| matches(source, e)))
+            .map(|index| index + 1);
+
+        Self {
+            query: query.to_string(),
+            expected: expected.to_vec(),
+            retrieved: distinct,
+            recall,
+            first_hit,
+        }
+    }
+
+    /// `1 / first_hit`, or `0` if nothing expected was retrieved.
+    pub fn reciprocal_rank(&self) -> f64 {
+        self.first_hit.map_or(0.0, |rank| 1.0 / rank as f64)
+    }
+}
+
+fn matches(source: &str, expected: &str) -> bool {
+    source == expected || Path::new(source).ends_with(expected)
+}
+
+/// Aggregate results of a labeled set.
+#[derive(Debug, Clone, PartialEq)]
+pub struct EvalReport {
+    /// Results retrieved per query (`storage.top_k`).
+    pub k: usize,
+    pub queries: Vec<QueryEval>,
+}
+
+impl EvalReport {
+    /// Mean recall@k over all queries.
+    pub fn recall_at_k(&self) -> f64 {
+        mean(self.queries.iter().map(|q| q.recall))
+    }
+
+    /// Mean reciprocal rank over all queries.
+    pub fn mrr(&self) -> f64 {
+        mean(self.queries.iter().map(QueryEval::reciprocal_rank))
+    }
+}
+
+fn mean(values: impl ExactSizeIterator<Item = f64>) -> f64 {
+    let count = values.len();
+    if count == 0 {
+        return 0.0;
+    }
+    values.sum::<f64>() / count as f64
+}
+
+impl fmt::Display for EvalReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        for query in &self.queries {
+            let rank = match query.first_hit {
+                Some(rank) => format!("first hit at {}", rank),
+                None => "no hit".to_string(),
+            };
+            writeln!(f, "{:.2} recall, {}: {}", query.recall, rank, query.query)?;
+        }
+        write!(
+            f,
+            "\n{} queries, recall@{} {:.3}, MRR {:.3}",
+            self.queries.len(),
+            self.k,
+            self.recall_at_k(),
+            self.mrr()
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn strings(values: &[&str]) -> Vec<String> {
+        values.iter().map(|v| v.to_string()).collect()
+    }
+
+    #[test]
+    fn test_labeled_set_accepts_one_or_many_sources() {
+        let set = LabeledSet::from_json(r#"{"b": "x.rs", "a": ["y.rs", "z.rs"]}"#).unwrap();
+
+        assert_eq!(
+            set.queries,
+            vec![
+                LabeledQuery {
+                    query: "a".to_string(),
+                    expected: strings(&["y.rs", "z.rs"]),
+                },
+                LabeledQuery {
+                    query: "b".to_string(),
+                    expected: strings(&["x.rs"]),
+                },
+            ]
+        );
+        assert!(LabeledSet::from_json("[1, 2]").is_err());
+    }
+
+    #[test]
+    fn test_recall_and_mrr_match_hand_calculation() {
+        let report = EvalReport {
+            k: 3,
+            queries: vec![
+                // Hit at 1, both expected found: recall 1, RR 1
+                QueryEval::score(
+                    "q1",
+                    &strings(&["src/a.rs", "b.rs"]),
+                    &strings(&["/repo/src/a.rs", "/repo/src/a.rs", "/repo/b.rs"]),
+                ),
+                // Hit at 3, one of two found: recall 0.5, RR 1/3
+                QueryEval::score(
+                    "q2",
+                    &strings(&["c.rs", "d.rs"]),
+                    &strings(&["/repo/a.rs", "/repo/b.rs", "/repo/c.rs"]),
+                ),
+                // Nothing found: recall 0, RR 0. `bc.rs` must not match `c.rs`.
+                QueryEval::score("q3", &strings(&["c.rs"]), &strings(&["/repo/bc.rs"])),
+            ],
+        };
+
+        assert_eq!(report.queries[0].retrieved.len(), 2);
+        assert_eq!(report.queries[1].first_hit, Some(3));
+        assert!((report.recall_at_k() - 0.5).abs() < 1e-9);
+        assert!((report.mrr() - 4.0 / 9.0).abs() < 1e-9);
+    }
+}
@@ -4,9 +4,18 @@
 //! - Recursively collect code files from directories
 //! - Split large text into overlapping chunks
 //! - Filter files by extension and exclude patterns
-
-use crate::config::IndexerConfig;
+//! - Pick a chunking strategy per file (see [`chunker`](super::chunker))
+
+use super::archive;
+use super::chunker::{Chunker, ChunkerRegistry, FileMeta, PROSE_EXTENSIONS};
+use super::redact::Redactor;
+use super::report::FileError;
+use crate::config::{IdScheme, IndexerConfig};
+use sha2::{Digest, Sha256};
+use std::borrow::Cow;
+use std::collections::HashSet;
 use std::path::{Path, PathBuf};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 use thiserror::Error;
 use tokio::fs;
 
@@ -28,22 +37,132 @@ pub type Result<T> = std::result::Result<T, IndexerError>;
 /// - Recursive directory traversal
 /// - File extension filtering
 /// - Exclude pattern matching
+/// - Choosing a chunker for each file
+/// - Redacting secrets before chunking, when `redaction.enabled` is set
+/// - Skipping nucleus's own storage (see [`with_protected_paths`](Self::with_protected_paths))
 #[derive(Debug, Clone)]
 pub struct Indexer {
     config: IndexerConfig,
+    chunkers: ChunkerRegistry,
+    redactor: Option<Redactor>,
+    protected: Vec<PathBuf>,
 }
 
 impl Indexer {
     /// Creates a new Indexer with the given configuration.
     pub fn new(config: IndexerConfig) -> Self {
-        Self { config }
+        let mut chunkers = ChunkerRegistry::default();
+        if config.sentence_aware {
+            for extension in PROSE_EXTENSIONS {
+                chunkers.use_for(extension, "sentences");
+            }
+        }
+        chunkers.apply_overrides(&config.chunkers);
+        let redactor = config
+            .redaction
+            .enabled
+            .then(|| Redactor::new(&config.redaction));
+        Self {
+            config,
+            chunkers,
+            redactor,
+            protected: Vec::new(),
+        }
+    }
+
+    /// Never walks into these files or directories, e.g. the vector database
+    /// and chat history, even when they sit inside the indexed tree.
+    ///
+    /// Paths are compared after resolving them, so relative paths and
+    /// symlinks match. Paths that don't exist are ignored.
+    pub fn with_protected_paths(mut self, paths: Vec<PathBuf>) -> Self {
+        self.protected = paths;
+        self
+    }
+
+    /// Registers a chunking strategy under `name` and uses it for files with
+    /// the given extensions.
+    pub fn with_chunker(
+        mut self,
+        name: impl Into<String>,
+        chunker: impl Chunker + 'static,
+        extensions: &[&str],
+    ) -> Self {
+        self.chunkers.register(name, chunker, extensions);
+        self
     }
 
     /// Collects all indexable files from the specified directory.
     ///
     /// Walks the directory tree recursively, applying extension and exclude filters.
     pub async fn collect_files(&self, dir_path: impl AsRef<Path>) -> Result<Vec<IndexedFile>> {
-        collect_files(dir_path, &self.config).await
+        let collected = collect_files(dir_path, &self.config, None, &self.protected).await?;
+        Ok(collected.files)
+    }
+
+    /// Like [`collect_files`](Self::collect_files), but also reports the files
+    /// that were left out because they are binary or couldn't be read.
+    /// `since` skips files last modified before it.
+    pub(crate) async fn collect_files_reporting(
+        &self,
+        dir_path: impl AsRef<Path>,
+        since: Option<SystemTime>,
+    ) -> Result<CollectedFiles> {
+        collect_files(dir_path, &self.config, since, &self.protected).await
+    }
+
+    /// Reads the entries of a `.zip`, `.tar`, `.tar.gz` or `.tgz` archive
+    /// that pass the extension and exclude filters, with their paths inside
+    /// the archive.
+    pub(crate) async fn collect_archive(&self, archive_path: &Path) -> Result<CollectedFiles> {
+        let archive_path = archive_path.to_path_buf();
+        let config = self.config.clone();
+        let collected = tokio::task::spawn_blocking(move || {
+            archive::read_entries(&archive_path, |path| {
+                !should_exclude(path, &config.exclude_patterns)
+                    && is_indexable(path, &config.extensions)
+            })
+        })
+        .await
+        .map_err(std::io::Error::other)??;
+        Ok(collected)
+    }
+
+    /// Like [`collect_files`](Self::collect_files), but skips files last
+    /// modified before `since`.
+    pub async fn collect_files_since(
+        &self,
+        dir_path: impl AsRef<Path>,
+        since: SystemTime,
+    ) -> Result<Vec<IndexedFile>> {
+        let collected = collect_files(dir_path, &self.config, Some(since), &self.protected).await?;
+        Ok(collected.files)
+    }
+
+    /// Counts the files [`collect_files`](Self::collect_files) would return,
+    /// without reading them.
+    ///
+    /// Unreadable and binary files are counted too, so this is an upper bound.
+    pub async fn count_files(&self, dir_path: impl AsRef<Path>) -> Result<usize> {
+        let paths = walk_files(dir_path.as_ref(), &self.config, &self.protected).await?;
+        Ok(paths.len())
+    }
+
+    /// Bytes shared by consecutive text chunks (`rag.indexer.chunk_overlap`).
+    pub fn chunk_overlap(&self) -> usize {
+        self.config.chunk_overlap
+    }
+
+    /// Most files a directory may contain before indexing it needs
+    /// confirmation (`rag.indexer.max_files`). `None` means no limit.
+    pub fn max_files(&self) -> Option<usize> {
+        Some(self.config.max_files).filter(|&max| max > 0)
+    }
+
+    /// Whether chunks with nothing to embed are left out
+    /// (`rag.indexer.skip_blank`).
+    pub fn skip_blank(&self) -> bool {
+        self.config.skip_blank
     }
 
     /// Chunks text according to the indexer's configuration.
@@ -52,6 +171,111 @@ impl Indexer {
     pub fn chunk_text(&self, text: &str) -> Vec<String> {
         chunk_text(text, self.config.chunk_size, self.config.chunk_overlap)
     }
+
+    /// Chunks a file's content with the strategy registered for its extension.
+    ///
+    /// By default JSON and YAML files are split by key, with the key path
+    /// recorded on each chunk. Everything else, and structured files that
+    /// fail to parse, is chunked as plain text.
+    ///
+    /// With redaction enabled the content is redacted first.
+    pub fn chunk_file(&self, path: &Path, content: &str) -> Vec<FileChunk> {
+        let meta = FileMeta {
+            path,
+            chunk_size: self.config.chunk_size,
+            chunk_overlap: self.config.chunk_overlap,
+        };
+        self.chunkers.chunk(&self.redact(content), &meta)
+    }
+
+    /// The content as [`chunk_file`](Self::chunk_file) chunks it: redacted
+    /// when redaction is enabled, unchanged otherwise.
+    pub fn redact<'a>(&self, content: &'a str) -> Cow<'a, str> {
+        match &self.redactor {
+            Some(redactor) => redactor.redact(content),
+            None => Cow::Borrowed(content),
+        }
+    }
+
+    /// Builds the document ID for a chunk using the configured [`IdScheme`].
+    pub fn chunk_id(
+        &self,
+        path: &Path,
+        root: Option<&Path>,
+        index: usize,
+        content: &str,
+    ) -> String {
+        chunk_id(self.config.id_scheme, path, root, index, content)
+    }
+}
+
+/// Builds the document ID for chunk `index` of the file at `path`.
+///
+/// `root` is the directory being indexed. Relative schemes fall back to `path`
+/// as given when there is no root or `path` is outside it. Relative paths always
+/// use `/` so IDs match across platforms.
+pub fn chunk_id(
+    scheme: IdScheme,
+    path: &Path,
+    root: Option<&Path>,
+    index: usize,
+    content: &str,
+) -> String {
+    let relative = || relative_path(path, root);
+
+    match scheme {
+        IdScheme::Path => format!("{}_chunk_{}", path.display(), index),
+        IdScheme::RelPath => format!("{}_chunk_{}", relative(), index),
+        IdScheme::Hash => {
+            let mut hasher = Sha256::new();
+            // The index keeps repeated chunks of one file, such as license
+            // headers, from sharing an ID and overwriting each other.
+            hasher.update(relative().as_bytes());
+            hasher.update([0]);
+            hasher.update(index.to_string().as_bytes());
+            hasher.update([0]);
+            hasher.update(content.as_bytes());
+            hasher
+                .finalize()
+                .iter()
+                .map(|byte| format!("{:02x}", byte))
+                .collect()
+        }
+    }
+}
+
+/// `path` relative to `root`, joined with `/`. Falls back to `path` as given
+/// when there is no root or `path` is outside it.
+pub(crate) fn relative_path(path: &Path, root: Option<&Path>) -> String {
+    let relative = root
+        .and_then(|root| path.strip_prefix(root).ok())
+        .unwrap_or(path);
+    relative
+        .components()
+        .map(|c| c.as_os_str().to_string_lossy())
+        .collect::<Vec<_>>()
+        .join("/")
+}
+
+/// The text of the document standing for the file at `path` itself, used
+/// with `rag.index_paths`: its path relative to `root`, then its file name
+/// with `_`, `-` and `.` read as spaces so the words in it match queries.
+pub(crate) fn path_document(path: &Path, root: Option<&Path>) -> String {
+    let name = path
+        .file_name()
+        .map(|name| name.to_string_lossy().to_string())
+        .unwrap_or_default();
+    let words = name.replace(['_', '-', '.'], " ");
+    format!("{}\n{}\n{}", relative_path(path, root), name, words.trim())
+}
+
+/// SHA-256 of a file's content as hex, stored on its chunks as
+/// `content_hash` so changes on disk can be detected.
+pub(crate) fn content_hash(content: &str) -> String {
+    Sha256::digest(content.as_bytes())
+        .iter()
+        .map(|byte| format!("{:02x}", byte))
+        .collect()
 }
 
 /// Splits text into overlapping chunks for better context preservation.
@@ -113,6 +337,14 @@ pub fn chunk_text(text: &str, chunk_size: usize, overlap: usize) -> Vec<String>
     chunks
 }
 
+/// A chunk of a file, ready to embed.
+#[derive(Debug, Clone, PartialEq)]
+pub struct FileChunk {
+    pub content: String,
+    /// Dotted key path for chunks of structured files.
+    pub key_path: Option<String>,
+}
+
 /// A file that has been collected and read for indexing.
 #[derive(Debug, Clone)]
 pub struct IndexedFile {
@@ -120,10 +352,21 @@ pub struct IndexedFile {
     pub content: String,
 }
 
+/// Files read for indexing, plus those that were left out.
+#[derive(Debug, Default)]
+pub(crate) struct CollectedFiles {
+    pub files: Vec<IndexedFile>,
+    /// Files that aren't valid UTF-8, such as images and executables.
+    pub binary: usize,
+    /// Files that couldn't be read, e.g. for lack of permission.
+    pub failed: Vec<FileError>,
+}
+
 /// Recursively collects all indexable files from a directory.
 ///
 /// Walks the directory tree starting from `dir_path`, filtering files based on
-/// the provided configuration. Binary files and unreadable files are silently skipped.
+/// the provided configuration. Binary and unreadable files are left out and
+/// reported in the result.
 ///
 /// # Filtering
 ///
@@ -132,22 +375,76 @@ pub struct IndexedFile {
 ///   If empty, all readable text files are indexed.
 /// - **Exclude patterns**: Directories or files matching patterns in `config.exclude_patterns`
 ///   are skipped (e.g., "node_modules", ".git").
+/// - **Modification time**: When `since` is set, files modified before it are skipped.
+/// - **Protected paths**: Anything inside `protected` is skipped.
 ///
 /// This function is internal to the RAG system. Use [`Rag::index_directory`](crate::rag::Rag::index_directory)
 /// for public-facing directory indexing.
 pub(crate) async fn collect_files(
     dir_path: impl AsRef<Path>,
     config: &IndexerConfig,
-) -> Result<Vec<IndexedFile>> {
-    let mut files = Vec::new();
-    collect_files_recursive(dir_path.as_ref(), &mut files, config).await?;
-    Ok(files)
+    since: Option<SystemTime>,
+    protected: &[PathBuf],
+) -> Result<CollectedFiles> {
+    let mut collected = CollectedFiles::default();
+
+    for path in walk_files(dir_path.as_ref(), config, protected).await? {
+        if let Some(since) = since {
+            let modified = fs::metadata(&path).await.and_then(|m| m.modified());
+            if modified.is_ok_and(|modified| modified < since) {
+                continue;
+            }
+        }
+
+        match fs::read_to_string(&path).await {
+            Ok(content) => collected.files.push(IndexedFile { path, content }),
+            Err(e) if e.kind() == std::io::ErrorKind::InvalidData => collected.binary += 1,
+            Err(e) => collected.failed.push(FileError {
+                path,
+                error: e.to_string(),
+            }),
+        }
+    }
+
+    Ok(collected)
+}
+
+/// Paths of every file under `dir_path` that passes the extension, exclude
+/// and protected-path filters, without reading them.
+async fn walk_files(
+    dir_path: &Path,
+    config: &IndexerConfig,
+    protected: &[PathBuf],
+) -> Result<Vec<PathBuf>> {
+    let mut protected_resolved = Vec::new();
+    for path in protected {
+        if let Ok(resolved) = fs::canonicalize(path).await {
+            protected_resolved.push(resolved);
+        }
+    }
+
+    let mut paths = Vec::new();
+    let mut visited = HashSet::new();
+    visited.insert(fs::canonicalize(dir_path).await?);
+    walk_files_recursive(
+        dir_path,
+        &mut paths,
+        &mut visited,
+        config,
+        &protected_resolved,
+    )
+    .await?;
+    Ok(paths)
 }
 
-fn collect_files_recursive<'a>(
+/// `visited` holds the resolved path of every directory walked so far, so a
+/// directory reached again through a symlink is skipped instead of looping.
+fn walk_files_recursive<'a>(
     dir: &'a Path,
-    files: &'a mut Vec<IndexedFile>,
+    paths: &'a mut Vec<PathBuf>,
+    visited: &'a mut HashSet<PathBuf>,
     config: &'a IndexerConfig,
+    protected: &'a [PathBuf],
 ) -> std::pin::Pin<Box<dyn std::future::Future<Output = Result<()>> + Send + 'a>> {
     Box::pin(async move {
         let mut entries = fs::read_dir(dir).await?;
@@ -159,15 +456,27 @@ fn collect_files_recursive<'a>(
                 continue;
             }
 
+            if is_protected(&path, protected).await {
+                tracing::debug!("Skipping nucleus storage: {}", path.display());
+                continue;
+            }
+
+            let is_symlink = entry.file_type().await?.is_symlink();
             if path.is_dir() {
-                collect_files_recursive(&path, files, config).await?;
-            } else if is_indexable(&path, &config.extensions) {
-                if let Ok(content) = fs::read_to_string(&path).await {
-                    files.push(IndexedFile {
-                        path: path.clone(),
-                        content,
-                    });
+                if is_symlink && !config.follow_symlinks {
+                    tracing::debug!("Not following symlinked directory: {}", path.display());
+                    continue;
+                }
+                let Ok(resolved) = fs::canonicalize(&path).await else {
+                    continue;
+                };
+                if !visited.insert(resolved) {
+                    tracing::debug!("Skipping already visited directory: {}", path.display());
+                    continue;
                 }
+                walk_files_recursive(&path, paths, visited, config, protected).await?;
+            } else if is_indexable(&path, &config.extensions) {
+                paths.push(path);
             }
         }
 
@@ -175,6 +484,30 @@ fn collect_files_recursive<'a>(
     })
 }
 
+/// Parses a `--since` cutoff.
+///
+/// Accepts a duration before `now` such as `90s`, `30m`, `24h`, `7d` or `2w`,
+/// or an absolute Unix timestamp in seconds.
+pub fn parse_since(value: &str, now: SystemTime) -> Option<SystemTime> {
+    let value = value.trim();
+    if let Ok(seconds) = value.parse::<u64>() {
+        return UNIX_EPOCH.checked_add(Duration::from_secs(seconds));
+    }
+
+    let unit_at = value.find(|c: char| !c.is_ascii_digit())?;
+    let (amount, unit) = value.split_at(unit_at);
+    let amount: u64 = amount.parse().ok()?;
+    let seconds = match unit {
+        "s" => 1,
+        "m" => 60,
+        "h" => 60 * 60,
+        "d" => 24 * 60 * 60,
+        "w" => 7 * 24 * 60 * 60,
+        _ => return None,
+    };
+    now.checked_sub(Duration::from_secs(amount.checked_mul(seconds)?))
+}
+
 /// Checks if a file should be indexed based on its extension.
 ///
 /// If `extensions` is empty, all files are considered indexable (useful for
@@ -193,6 +526,17 @@ fn is_indexable(path: &Path, extensions: &[String]) -> bool {
     false
 }
 
+/// Whether `path` resolves to somewhere inside one of the (already resolved)
+/// protected paths.
+async fn is_protected(path: &Path, protected: &[PathBuf]) -> bool {
+    if protected.is_empty() {
+        return false;
+    }
+    fs::canonicalize(path)
+        .await
+        .is_ok_and(|resolved| protected.iter().any(|p| resolved.starts_with(p)))
+}
+
 /// Checks if a path should be excluded based on exclude patterns.
 ///
 /// A path is excluded if any component of its path matches an exclude pattern.
@@ -228,6 +572,65 @@ mod tests {
         assert_eq!(chunks[1], "89ABCDEF");
     }
 
+    #[test]
+    fn test_chunk_id_schemes() {
+        let root = Path::new("/home/alice/project");
+        let path = Path::new("/home/alice/project/src/main.rs");
+
+        assert_eq!(
+            chunk_id(IdScheme::Path, path, Some(root), 2, "fn main() {}"),
+            "/home/alice/project/src/main.rs_chunk_2"
+        );
+        assert_eq!(
+            chunk_id(IdScheme::RelPath, path, Some(root), 2, "fn main() {}"),
+            "src/main.rs_chunk_2"
+        );
+
+        let hash = chunk_id(IdScheme::Hash, path, Some(root), 2, "fn main() {}");
+        assert_eq!(hash.len(), 64);
+        assert!(hash.chars().all(|c| c.is_ascii_hexdigit()));
+        assert_ne!(
+            hash,
+            chunk_id(IdScheme::Hash, path, Some(root), 2, "fn other() {}")
+        );
+        assert_ne!(
+            hash,
+            chunk_id(IdScheme::Hash, path, Some(root), 3, "fn main() {}")
+        );
+    }
+
+    #[test]
+    fn test_relative_ids_are_stable_across_roots() {
+        for scheme in [IdScheme::RelPath, IdScheme::Hash] {
+            let here = chunk_id(
+                scheme,
+                Path::new("/home/alice/project/src/lib.rs"),
+                Some(Path::new("/home/alice/project")),
+                0,
+                "pub mod rag;",
+            );
+            let there = chunk_id(
+                scheme,
+                Path::new("/srv/checkout/src/lib.rs"),
+                Some(Path::new("/srv/checkout")),
+                0,
+                "pub mod rag;",
+            );
+            assert_eq!(here, there);
+        }
+    }
+
+    #[test]
+    fn test_path_document_names_file_relative_to_root() {
+        assert_eq!(
+            path_document(
+                Path::new("/home/alice/project/src/auth/token_refresh.rs"),
+                Some(Path::new("/home/alice/project"))
+            ),
+            "src/auth/token_refresh.rs\ntoken_refresh.rs\ntoken refresh rs"
+        );
+    }
+
     #[test]
     fn test_is_indexable() {
         let extensions = vec!["rs".to_string(), "md".to_string()];
@@ -263,4 +666,163 @@ mod tests {
         assert!(should_exclude(Path::new("target/debug/main"), &patterns));
         assert!(!should_exclude(Path::new("src/main.rs"), &patterns));
     }
+
+    #[test]
+    fn test_chunk_file_dispatches_on_extension() {
+        let indexer = Indexer::new(IndexerConfig::default());
+        let yaml = "llm:\n  model: qwen3:8b\nstorage:\n  mode: embedded\n";
+
+        let chunks = indexer.chunk_file(Path::new("config.yaml"), yaml);
+        assert_eq!(chunks.len(), 2);
+        assert_eq!(chunks[0].key_path.as_deref(), Some("llm"));
+        assert_eq!(chunks[1].key_path.as_deref(), Some("storage"));
+
+        let chunks = indexer.chunk_file(Path::new("notes.txt"), yaml);
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].key_path, None);
+        assert_eq!(chunks[0].content, yaml);
+    }
+
+    #[test]
+    fn test_parse_since() {
+        let now = UNIX_EPOCH + Duration::from_secs(1_000_000);
+
+        assert_eq!(
+            parse_since("24h", now),
+            Some(now - Duration::from_secs(86_400))
+        );
+        assert_eq!(
+            parse_since("30m", now),
+            Some(now - Duration::from_secs(1_800))
+        );
+        assert_eq!(
+            parse_since("1700000000", now),
+            Some(UNIX_EPOCH + Duration::from_secs(1_700_000_000))
+        );
+        assert_eq!(parse_since("3 days", now), None);
+        assert_eq!(parse_since("h", now), None);
+    }
+
+    #[tokio::test]
+    async fn test_collect_files_since_skips_older_files() {
+        let dir = tempfile::tempdir().unwrap();
+        let now = SystemTime::now();
+
+        for (name, age) in [("old.rs", 48 * 3600), ("new.rs", 3600)] {
+            let path = dir.path().join(name);
+            std::fs::write(&path, name).unwrap();
+            std::fs::File::options()
+                .write(true)
+                .open(&path)
+                .unwrap()
+                .set_modified(now - Duration::from_secs(age))
+                .unwrap();
+        }
+
+        let config = IndexerConfig {
+            exclude_patterns: Vec::new(),
+            ..IndexerConfig::default()
+        };
+        let indexer = Indexer::new(config);
+
+        let files = indexer
+            .collect_files_since(dir.path(), parse_since("24h", now).unwrap())
+            .await
+            .unwrap();
+        let names: Vec<_> = files
+            .iter()
+            .map(|f| f.path.file_name().unwrap().to_string_lossy().to_string())
+            .collect();
+        assert_eq!(names, vec!["new.rs".to_string()]);
+
+        assert_eq!(indexer.collect_files(dir.path()).await.unwrap().len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_storage_directories_are_never_walked() {
+        let dir = tempfile::tempdir().unwrap();
+        let root = dir.path();
+        for (path, content) in [
+            ("src/main.rs", "fn main() {}"),
+            ("data/nucleus_vectordb/kb.lance/data.txt", "binary-ish"),
+            ("data/history/session.json", "{\"role\": \"user\"}"),
+            ("data/preferences.json", "{}"),
+            ("data/notes.md", "kept"),
+        ] {
+            std::fs::create_dir_all(root.join(path).parent().unwrap()).unwrap();
+            std::fs::write(root.join(path), content).unwrap();
+        }
+
+        let config = IndexerConfig {
+            exclude_patterns: Vec::new(),
+            ..IndexerConfig::default()
+        };
+        let indexer = Indexer::new(config).with_protected_paths(vec![
+            root.join("data/nucleus_vectordb"),
+            root.join("data/./history"),
+            root.join("data/preferences.json"),
+            root.join("data/does-not-exist"),
+        ]);
+
+        let mut names: Vec<_> = indexer
+            .collect_files(root)
+            .await
+            .unwrap()
+            .iter()
+            .map(|f| {
+                f.path
+                    .strip_prefix(root)
+                    .unwrap()
+                    .to_string_lossy()
+                    .to_string()
+            })
+            .collect();
+        names.sort();
+        assert_eq!(names, vec!["data/notes.md", "src/main.rs"]);
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_symlink_cycles_are_walked_once() {
+        use std::os::unix::fs::symlink;
+
+        let dir = tempfile::tempdir().unwrap();
+        let shared = tempfile::tempdir().unwrap();
+        let root = dir.path();
+        std::fs::create_dir(root.join("src")).unwrap();
+        std::fs::write(root.join("src/main.rs"), "fn main() {}").unwrap();
+        std::fs::write(shared.path().join("util.rs"), "pub fn util() {}").unwrap();
+        // src/loop points back at the root, and shared is outside the tree.
+        symlink(root, root.join("src/loop")).unwrap();
+        symlink(shared.path(), root.join("shared")).unwrap();
+
+        let mut config = IndexerConfig {
+            exclude_patterns: Vec::new(),
+            ..IndexerConfig::default()
+        };
+        let relative = |files: Vec<IndexedFile>| {
+            let mut paths: Vec<PathBuf> = files
+                .into_iter()
+                .map(|file| file.path.strip_prefix(root).unwrap().to_path_buf())
+                .collect();
+            paths.sort();
+            paths
+        };
+
+        let files = Indexer::new(config.clone())
+            .collect_files(root)
+            .await
+            .unwrap();
+        assert_eq!(
+            relative(files),
+            vec![
+                PathBuf::from("shared/util.rs"),
+                PathBuf::from("src/main.rs")
+            ]
+        );
+
+        config.follow_symlinks = false;
+        let files = Indexer::new(config).collect_files(root).await.unwrap();
+        assert_eq!(relative(files), vec![PathBuf::from("src/main.rs")]);
+    }
 }
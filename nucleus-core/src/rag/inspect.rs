@@ -0,0 +1,69 @@
+//! A look at a single embedding, for debugging dimension and normalization
+//! problems.
+
+use std::fmt;
+
+/// Components shown in [`EmbeddingInfo::head`].
+const HEAD_COMPONENTS: usize = 8;
+
+/// Summary of the vector embedded for a piece of text.
+#[derive(Debug, Clone, PartialEq)]
+pub struct EmbeddingInfo {
+    pub model: String,
+    /// Length of the vector the model returned.
+    pub dimension: usize,
+    /// Length the configured model is expected to return.
+    pub expected_dimension: usize,
+    /// Euclidean length. About 1.0 for normalized embeddings.
+    pub norm: f32,
+    /// The first few components.
+    pub head: Vec<f32>,
+}
+
+impl EmbeddingInfo {
+    pub(crate) fn new(model: &str, expected_dimension: usize, embedding: &[f32]) -> Self {
+        Self {
+            model: model.to_string(),
+            dimension: embedding.len(),
+            expected_dimension,
+            norm: embedding.iter().map(|x| x * x).sum::<f32>().sqrt(),
+            head: embedding.iter().take(HEAD_COMPONENTS).copied().collect(),
+        }
+    }
+
+    /// Whether the vector is not as long as the configured model's.
+    pub fn is_mismatched(&self) -> bool {
+        self.dimension != self.expected_dimension
+    }
+}
+
+impl fmt::Display for EmbeddingInfo {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "Model: {}", self.model)?;
+        write!(f, "Dimension: {}", self.dimension)?;
+        if self.is_mismatched() {
+            write!(f, " (expected {})", self.expected_dimension)?;
+        }
+        writeln!(f)?;
+        writeln!(f, "Norm: {:.4}", self.norm)?;
+        let head: Vec<String> = self.head.iter().map(|x| format!("{:.4}", x)).collect();
+        write!(f, "First {}: [{}]", head.len(), head.join(", "))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_mismatched_dimension_is_called_out() {
+        let info = EmbeddingInfo::new("tiny", 3, &[3.0, 0.0, 4.0, 0.0]);
+
+        assert_eq!(info.norm, 5.0);
+        assert!(info.is_mismatched());
+        assert_eq!(
+            info.to_string(),
+            "Model: tiny\nDimension: 4 (expected 3)\nNorm: 5.0000\nFirst 4: [3.0000, 0.0000, 4.0000, 0.0000]"
+        );
+    }
+}
@@ -0,0 +1,107 @@
+//! Indexing that runs in the background while the engine keeps serving.
+//!
+//! A background job indexes through a clone of the engine, which shares its
+//! vector store, so each batch of chunks is searchable as soon as it is stored
+//! and other documents can be added while the job runs.
+
+use super::report::{IndexProgress, IndexResult};
+use std::fmt;
+use std::path::PathBuf;
+use std::sync::Mutex;
+use std::time::Instant;
+
+/// Where a background index job is, returned by
+/// [`RagEngine::index_jobs`](super::RagEngine::index_jobs).
+#[derive(Debug, Clone, PartialEq)]
+pub struct IndexJob {
+    /// Number of the job, starting at 1.
+    pub id: usize,
+    pub dir: PathBuf,
+    pub state: JobState,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum JobState {
+    /// Still indexing. `progress` is the latest update, if there was one.
+    Running {
+        progress: Option<IndexProgress>,
+        started: Instant,
+    },
+    Finished(IndexResult),
+    Failed(String),
+}
+
+impl IndexJob {
+    pub fn is_running(&self) -> bool {
+        matches!(self.state, JobState::Running { .. })
+    }
+}
+
+/// `#1 ./src: running for 12s, [3/10] src/main.rs`, or the final result.
+impl fmt::Display for IndexJob {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "#{} {}: ", self.id, self.dir.display())?;
+        match &self.state {
+            JobState::Running { progress, started } => {
+                write!(f, "running for {}s", started.elapsed().as_secs())?;
+                match progress {
+                    Some(progress) => write!(f, ", {}", progress),
+                    None => write!(f, ", collecting files"),
+                }
+            }
+            JobState::Finished(result) => write!(f, "{}", result),
+            JobState::Failed(error) => write!(f, "failed: {}", error),
+        }
+    }
+}
+
+/// Every background job started by an engine, shared between its clones.
+#[derive(Debug, Default)]
+pub(crate) struct IndexJobs {
+    jobs: Mutex<Vec<IndexJob>>,
+}
+
+impl IndexJobs {
+    /// Records a new running job and returns its ID.
+    pub fn start(&self, dir: PathBuf) -> usize {
+        let mut jobs = self.jobs.lock().unwrap();
+        let id = jobs.len() + 1;
+        jobs.push(IndexJob {
+            id,
+            dir,
+            state: JobState::Running {
+                progress: None,
+                started: Instant::now(),
+            },
+        });
+        id
+    }
+
+    pub fn report(&self, id: usize, update: IndexProgress) {
+        self.update(id, |state| {
+            if let JobState::Running { progress, .. } = state {
+                *progress = Some(update);
+            }
+        });
+    }
+
+    pub fn finish(&self, id: usize, outcome: super::Result<IndexResult>) {
+        self.update(id, |state| {
+            *state = match outcome {
+                Ok(result) => JobState::Finished(result),
+                Err(e) => JobState::Failed(e.to_string()),
+            };
+        });
+    }
+
+    pub fn snapshot(&self) -> Vec<IndexJob> {
+        self.jobs.lock().unwrap().clone()
+    }
+
+    fn update(&self, id: usize, change: impl FnOnce(&mut JobState)) {
+        let mut jobs = self.jobs.lock().unwrap();
+        if let Some(job) = jobs.iter_mut().find(|job| job.id == id) {
+            change(&mut job.state);
+        }
+    }
+}
@@ -2,7 +2,7 @@
 //!
 //! This module provides integration with LanceDB for embedded, in-process vector storage.
 
-use crate::config::StorageConfig;
+use crate::config::{SimilarityMetric, StorageConfig};
 
 use super::store::VectorStore;
 use super::types::{Document, SearchResult};
@@ -16,18 +16,20 @@ use arrow_schema::Field;
 use async_trait::async_trait;
 use futures::stream::TryStreamExt;
 use lancedb::arrow::arrow_schema::Schema;
-use lancedb::query::{ExecutableQuery, QueryBase};
-use lancedb::{connect, Connection, Table};
+use lancedb::query::{ExecutableQuery, QueryBase, Select};
+use lancedb::table::NewColumnTransform;
+use lancedb::{connect, Connection, DistanceType, Table};
+use std::collections::HashMap;
 use std::sync::Arc;
 
 /// LanceDB-based vector store for embedded deployment.
 ///
 /// Provides zero-setup, in-process vector storage using LanceDB.
 pub struct LanceDbStore {
-    storage_config: StorageConfig,
     conn: Connection,
     table: Table,
     vector_size: u64,
+    similarity: SimilarityMetric,
 }
 
 #[async_trait]
@@ -50,7 +52,7 @@ impl VectorStore for LanceDbStore {
         Ok(())
     }
 
-    async fn search(&self, query_embedding: &[f32]) -> Result<Vec<SearchResult>> {
+    async fn search(&self, query_embedding: &[f32], limit: usize) -> Result<Vec<SearchResult>> {
         use tracing::{debug, info};
 
         debug!("LanceDB search: opening table '{}'", self.table.name());
@@ -59,12 +61,16 @@ impl VectorStore for LanceDbStore {
         debug!(
             "LanceDB search: querying with embedding of size {}, limit={}",
             query_embedding.len(),
-            self.storage_config.top_k
+            limit
         );
         let results = table
             .query()
-            .limit(self.storage_config.top_k)
+            .limit(limit)
             .nearest_to(query_embedding)?
+            .distance_type(match self.similarity {
+                SimilarityMetric::Cosine => DistanceType::Cosine,
+                SimilarityMetric::Dot => DistanceType::Dot,
+            })
             .execute()
             .await
             .context("Failed to execute LanceDB query")?;
@@ -109,16 +115,13 @@ impl VectorStore for LanceDbStore {
                 .as_any()
                 .downcast_ref::<Float32Array>()
                 .context("Failed to cast '_distance' to Float32Array")?;
+            let metadata_array = metadata_column(&batch)?;
 
             for i in 0..num_rows {
                 let id = id_array.value(i).to_string();
                 let content = content_array.value(i).to_string();
                 let distance = distance_array.value(i);
-
-                let mut metadata = std::collections::HashMap::new();
-                if !source_col.is_null(i) {
-                    metadata.insert("source".to_string(), source_array.value(i).to_string());
-                }
+                let metadata = row_metadata(source_array, metadata_array, i);
 
                 let document = Document {
                     id,
@@ -127,6 +130,7 @@ impl VectorStore for LanceDbStore {
                     metadata,
                 };
 
+                // Both cosine and dot distances are `1 - similarity`.
                 let score = 1.0 - distance;
 
                 search_results.push(SearchResult { document, score });
@@ -197,6 +201,31 @@ impl VectorStore for LanceDbStore {
         Ok(unique_paths.into_iter().collect())
     }
 
+    async fn source_counts(&self) -> Result<HashMap<String, usize>> {
+        let table = self.conn.open_table(self.table.name()).execute().await?;
+        let batches: Vec<RecordBatch> = table
+            .query()
+            .select(Select::columns(&["source"]))
+            .execute()
+            .await
+            .context("Failed to query sources")?
+            .try_collect()
+            .await
+            .context("Failed to collect query results")?;
+
+        let mut counts = HashMap::new();
+        for batch in batches {
+            let source_array = string_column(&batch, "source")?;
+            for i in 0..batch.num_rows() {
+                if !source_array.is_null(i) {
+                    *counts.entry(source_array.value(i).to_string()).or_default() += 1;
+                }
+            }
+        }
+
+        Ok(counts)
+    }
+
     async fn remove_by_source(&self, source_path: &str) -> Result<usize> {
         use std::path::Path;
 
@@ -255,9 +284,189 @@ impl VectorStore for LanceDbStore {
 
         Ok(count)
     }
+
+    async fn remove_by_sources(&self, sources: &[String]) -> Result<usize> {
+        if sources.is_empty() {
+            return Ok(0);
+        }
+
+        let table = self.conn.open_table(self.table.name()).execute().await?;
+        let quoted: Vec<String> = sources.iter().map(|source| sql_string(source)).collect();
+        let filter = format!("source IN ({})", quoted.join(", "));
+
+        let count = table.count_rows(Some(filter.clone())).await?;
+        if count > 0 {
+            table
+                .delete(&filter)
+                .await
+                .context("Failed to delete documents by source")?;
+        }
+
+        Ok(count)
+    }
+
+    async fn get(&self, id: &str) -> Result<Option<Document>> {
+        let table = self.conn.open_table(self.table.name()).execute().await?;
+        let results = table
+            .query()
+            .only_if(format!("id = {}", sql_string(id)))
+            .limit(1)
+            .execute()
+            .await
+            .context("Failed to query document by id")?;
+
+        let batches: Vec<RecordBatch> = results
+            .try_collect()
+            .await
+            .context("Failed to collect query results")?;
+
+        for batch in batches {
+            if batch.num_rows() == 0 {
+                continue;
+            }
+
+            let id_array = string_column(&batch, "id")?;
+            let content_array = string_column(&batch, "content")?;
+            let source_array = string_column(&batch, "source")?;
+            let metadata_array = metadata_column(&batch)?;
+
+            return Ok(Some(Document {
+                id: id_array.value(0).to_string(),
+                content: content_array.value(0).to_string(),
+                embedding: vec![],
+                metadata: row_metadata(source_array, metadata_array, 0),
+            }));
+        }
+
+        Ok(None)
+    }
+
+    async fn documents(&self) -> Result<Vec<Document>> {
+        self.query_documents(None).await
+    }
+
+    async fn documents_by_source(&self, source: &str) -> Result<Vec<Document>> {
+        self.query_documents(Some(format!("source = {}", sql_string(source))))
+            .await
+    }
+
+    async fn update_metadata(&self, id: &str, metadata: HashMap<String, String>) -> Result<bool> {
+        let table = self.conn.open_table(self.table.name()).execute().await?;
+        let filter = format!("id = {}", sql_string(id));
+
+        if table.count_rows(Some(filter.clone())).await? == 0 {
+            return Ok(false);
+        }
+
+        let json = serde_json::to_string(&metadata).context("Failed to encode metadata")?;
+        let source = match metadata.get("source") {
+            Some(source) => sql_string(source),
+            None => "NULL".to_string(),
+        };
+
+        table
+            .update()
+            .only_if(filter)
+            .column("metadata", sql_string(&json))
+            .column("source", source)
+            .execute()
+            .await
+            .context("Failed to update document metadata")?;
+
+        Ok(true)
+    }
+}
+
+/// Quotes a value as a SQL string literal for LanceDB filter expressions.
+fn sql_string(value: &str) -> String {
+    format!("'{}'", value.replace('\'', "''"))
+}
+
+fn string_column<'a>(batch: &'a RecordBatch, name: &str) -> Result<&'a StringArray> {
+    batch
+        .column_by_name(name)
+        .with_context(|| format!("Missing '{}' column", name))?
+        .as_any()
+        .downcast_ref::<StringArray>()
+        .with_context(|| format!("Failed to cast '{}' to StringArray", name))
+}
+
+/// The JSON metadata column, if the table has one.
+fn metadata_column(batch: &RecordBatch) -> Result<Option<&StringArray>> {
+    if batch.column_by_name("metadata").is_none() {
+        return Ok(None);
+    }
+    string_column(batch, "metadata").map(Some)
+}
+
+fn row_metadata(
+    source_array: &StringArray,
+    metadata_array: Option<&StringArray>,
+    row: usize,
+) -> HashMap<String, String> {
+    let mut metadata: HashMap<String, String> = metadata_array
+        .filter(|array| !array.is_null(row))
+        .and_then(|array| serde_json::from_str(array.value(row)).ok())
+        .unwrap_or_default();
+
+    if !source_array.is_null(row) {
+        metadata.insert("source".to_string(), source_array.value(row).to_string());
+    }
+
+    metadata
 }
 
 impl LanceDbStore {
+    /// Reads the documents matching `filter`, or every document, with their
+    /// embeddings.
+    async fn query_documents(&self, filter: Option<String>) -> Result<Vec<Document>> {
+        let table = self.conn.open_table(self.table.name()).execute().await?;
+        let mut query = table.query();
+        if let Some(filter) = filter {
+            query = query.only_if(filter);
+        }
+        let batches: Vec<RecordBatch> = query
+            .execute()
+            .await
+            .context("Failed to query documents")?
+            .try_collect()
+            .await
+            .context("Failed to collect query results")?;
+
+        let mut documents = Vec::new();
+        for batch in batches {
+            let id_array = string_column(&batch, "id")?;
+            let content_array = string_column(&batch, "content")?;
+            let source_array = string_column(&batch, "source")?;
+            let metadata_array = metadata_column(&batch)?;
+            let vector_array = batch
+                .column_by_name("vector")
+                .context("Missing 'vector' column")?
+                .as_any()
+                .downcast_ref::<FixedSizeListArray>()
+                .context("Failed to cast 'vector' to FixedSizeListArray")?;
+
+            for i in 0..batch.num_rows() {
+                let vector = vector_array.value(i);
+                let embedding = vector
+                    .as_any()
+                    .downcast_ref::<Float32Array>()
+                    .context("Failed to cast vector items to Float32Array")?
+                    .values()
+                    .to_vec();
+
+                documents.push(Document {
+                    id: id_array.value(i).to_string(),
+                    content: content_array.value(i).to_string(),
+                    embedding,
+                    metadata: row_metadata(source_array, metadata_array, i),
+                });
+            }
+        }
+
+        Ok(documents)
+    }
+
     fn create_schema(vector_size: u64) -> Arc<Schema> {
         Arc::new(Schema::new(vec![
             Field::new("id", DataType::Utf8, false),
@@ -271,6 +480,9 @@ impl LanceDbStore {
                 false,
             ),
             Field::new("source", DataType::Utf8, true),
+            // All metadata as a JSON object. `source` is duplicated in its own
+            // column so it can be filtered on.
+            Field::new("metadata", DataType::Utf8, true),
         ]))
     }
 
@@ -295,6 +507,10 @@ impl LanceDbStore {
             .iter()
             .map(|doc| doc.metadata.get("source").map(|s| s.as_str()))
             .collect();
+        let metadata: Vec<Option<String>> = documents
+            .iter()
+            .map(|doc| serde_json::to_string(&doc.metadata).ok())
+            .collect();
 
         let all_vector_values: Vec<f32> = documents
             .iter()
@@ -304,6 +520,7 @@ impl LanceDbStore {
         let id_array = StringArray::from(ids);
         let content_array = StringArray::from(contents);
         let source_array = StringArray::from(sources);
+        let metadata_array = StringArray::from(metadata);
 
         let vector_values = Float32Array::from(all_vector_values);
         let vector_array = FixedSizeListArray::new(
@@ -320,6 +537,7 @@ impl LanceDbStore {
                 Arc::new(content_array) as ArrayRef,
                 Arc::new(vector_array) as ArrayRef,
                 Arc::new(source_array) as ArrayRef,
+                Arc::new(metadata_array) as ArrayRef,
             ],
         )
         .context("Failed to create record batch")
@@ -329,7 +547,7 @@ impl LanceDbStore {
     ///
     /// # Arguments
     ///
-    /// * `storage_config` - Storage configuration including collection name and top_k
+    /// * `storage_config` - Storage configuration including the collection name
     /// * `path` - Directory path where LanceDB should store data
     /// * `vector_size` - Dimension of the embedding vectors
     pub async fn new(storage_config: StorageConfig, path: &str, vector_size: u64) -> Result<Self> {
@@ -342,10 +560,27 @@ impl LanceDbStore {
         let collection_name = &storage_config.vector_db.collection_name;
 
         let table = if table_names.contains(&collection_name.to_string()) {
-            conn.open_table(collection_name)
+            let table = conn
+                .open_table(collection_name)
                 .execute()
                 .await
-                .context("Failed to open LanceDB table")?
+                .context("Failed to open LanceDB table")?;
+
+            // Tables created before metadata was persisted only have `source`.
+            if table.schema().await?.field_with_name("metadata").is_err() {
+                table
+                    .add_columns(
+                        NewColumnTransform::SqlExpressions(vec![(
+                            "metadata".to_string(),
+                            "CAST(NULL AS STRING)".to_string(),
+                        )]),
+                        None,
+                    )
+                    .await
+                    .context("Failed to add metadata column")?;
+            }
+
+            table
         } else {
             let schema = Self::create_schema(vector_size);
 
@@ -356,10 +591,10 @@ impl LanceDbStore {
         };
 
         Ok(Self {
-            storage_config,
             conn,
             table,
             vector_size,
+            similarity: storage_config.vector_db.similarity,
         })
     }
 }
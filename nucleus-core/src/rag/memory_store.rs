@@ -0,0 +1,224 @@
+//! In-memory vector storage.
+
+use super::store::VectorStore;
+use super::types::{Document, SearchResult};
+use crate::config::SimilarityMetric;
+use anyhow::Result;
+use async_trait::async_trait;
+use std::collections::{BTreeSet, HashMap};
+use std::sync::RwLock;
+
+/// In-memory vector store, scoring by cosine similarity unless configured
+/// otherwise.
+///
+/// Nothing is persisted, so the contents are gone once the store is dropped.
+/// Used for session-scoped knowledge and as a test double.
+#[derive(Default)]
+pub(crate) struct MemoryStore {
+    documents: RwLock<Vec<Document>>,
+    similarity: SimilarityMetric,
+    /// The `limit` of every search, in call order.
+    #[cfg(test)]
+    limits: std::sync::Mutex<Vec<usize>>,
+    /// Number of [`VectorStore::remove_by_sources`] calls.
+    #[cfg(test)]
+    removals: std::sync::atomic::AtomicUsize,
+    /// Whether `add` keeps documents whose ID is already stored.
+    #[cfg(test)]
+    appends: bool,
+}
+
+impl MemoryStore {
+    pub(crate) fn new() -> Self {
+        Self::default()
+    }
+
+    pub(crate) fn with_similarity(mut self, similarity: SimilarityMetric) -> Self {
+        self.similarity = similarity;
+        self
+    }
+
+    /// Drops the oldest documents until at most `max` are left.
+    ///
+    /// Documents are kept in the order they were added, and adding one under
+    /// an ID already stored counts as adding it anew.
+    pub(crate) fn keep_latest(&self, max: usize) {
+        let mut documents = self.documents.write().unwrap();
+        let excess = documents.len().saturating_sub(max);
+        documents.drain(..excess);
+    }
+
+    /// Makes `add` append like LanceDB does, keeping any document already
+    /// stored under the same ID, instead of replacing it.
+    #[cfg(test)]
+    pub(crate) fn appending(mut self) -> Self {
+        self.appends = true;
+        self
+    }
+
+    /// IDs of every stored document, sorted.
+    #[cfg(test)]
+    pub(crate) fn ids(&self) -> Vec<String> {
+        let mut ids: Vec<String> = self
+            .documents
+            .read()
+            .unwrap()
+            .iter()
+            .map(|document| document.id.clone())
+            .collect();
+        ids.sort();
+        ids
+    }
+
+    /// Number of times [`VectorStore::search`] has been called.
+    #[cfg(test)]
+    pub(crate) fn searches(&self) -> usize {
+        self.limits.lock().unwrap().len()
+    }
+
+    /// Number of times [`VectorStore::remove_by_sources`] has been called.
+    #[cfg(test)]
+    pub(crate) fn removals(&self) -> usize {
+        self.removals.load(std::sync::atomic::Ordering::Relaxed)
+    }
+
+    /// The `limit` passed to each [`VectorStore::search`] call.
+    #[cfg(test)]
+    pub(crate) fn search_limits(&self) -> Vec<usize> {
+        self.limits.lock().unwrap().clone()
+    }
+}
+
+#[async_trait]
+impl VectorStore for MemoryStore {
+    async fn add(&self, documents: Vec<Document>) -> Result<()> {
+        let mut stored = self.documents.write().unwrap();
+        for document in documents {
+            #[cfg(test)]
+            if self.appends {
+                stored.push(document);
+                continue;
+            }
+            stored.retain(|existing| existing.id != document.id);
+            stored.push(document);
+        }
+        Ok(())
+    }
+
+    async fn search(&self, query_embedding: &[f32], limit: usize) -> Result<Vec<SearchResult>> {
+        #[cfg(test)]
+        self.limits.lock().unwrap().push(limit);
+
+        let mut results: Vec<SearchResult> = self
+            .documents
+            .read()
+            .unwrap()
+            .iter()
+            .map(|document| SearchResult {
+                score: match self.similarity {
+                    SimilarityMetric::Cosine => {
+                        cosine_similarity(query_embedding, &document.embedding)
+                    }
+                    SimilarityMetric::Dot => dot_product(query_embedding, &document.embedding),
+                },
+                document: document.clone(),
+            })
+            .collect();
+
+        results.sort_by(|a, b| {
+            b.score
+                .partial_cmp(&a.score)
+                .unwrap_or(std::cmp::Ordering::Equal)
+        });
+        results.truncate(limit);
+        Ok(results)
+    }
+
+    async fn count(&self) -> Result<usize> {
+        Ok(self.documents.read().unwrap().len())
+    }
+
+    async fn clear(&self) -> Result<()> {
+        self.documents.write().unwrap().clear();
+        Ok(())
+    }
+
+    async fn get_indexed_paths(&self) -> Result<Vec<String>> {
+        let paths: BTreeSet<String> = self
+            .documents
+            .read()
+            .unwrap()
+            .iter()
+            .filter_map(|document| document.metadata.get("source").cloned())
+            .collect();
+        Ok(paths.into_iter().collect())
+    }
+
+    async fn remove_by_source(&self, source_path: &str) -> Result<usize> {
+        let mut stored = self.documents.write().unwrap();
+        let before = stored.len();
+        let dir_prefix = format!("{}/", source_path.trim_end_matches('/'));
+        stored.retain(|document| {
+            !document
+                .metadata
+                .get("source")
+                .is_some_and(|source| source == source_path || source.starts_with(&dir_prefix))
+        });
+        Ok(before - stored.len())
+    }
+
+    async fn remove_by_sources(&self, sources: &[String]) -> Result<usize> {
+        #[cfg(test)]
+        self.removals
+            .fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+        let mut stored = self.documents.write().unwrap();
+        let before = stored.len();
+        stored.retain(|document| {
+            !document
+                .metadata
+                .get("source")
+                .is_some_and(|source| sources.contains(source))
+        });
+        Ok(before - stored.len())
+    }
+
+    async fn get(&self, id: &str) -> Result<Option<Document>> {
+        Ok(self
+            .documents
+            .read()
+            .unwrap()
+            .iter()
+            .find(|document| document.id == id)
+            .cloned())
+    }
+
+    async fn update_metadata(&self, id: &str, metadata: HashMap<String, String>) -> Result<bool> {
+        let mut stored = self.documents.write().unwrap();
+        match stored.iter_mut().find(|document| document.id == id) {
+            Some(document) => {
+                document.metadata = metadata;
+                Ok(true)
+            }
+            None => Ok(false),
+        }
+    }
+
+    async fn documents(&self) -> Result<Vec<Document>> {
+        Ok(self.documents.read().unwrap().clone())
+    }
+}
+
+fn dot_product(a: &[f32], b: &[f32]) -> f32 {
+    a.iter().zip(b).map(|(x, y)| x * y).sum()
+}
+
+fn cosine_similarity(a: &[f32], b: &[f32]) -> f32 {
+    let dot = dot_product(a, b);
+    let norm_a = a.iter().map(|x| x * x).sum::<f32>().sqrt();
+    let norm_b = b.iter().map(|x| x * x).sum::<f32>().sqrt();
+    if norm_a == 0.0 || norm_b == 0.0 {
+        0.0
+    } else {
+        dot / (norm_a * norm_b)
+    }
+}
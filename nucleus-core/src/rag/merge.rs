@@ -0,0 +1,53 @@
+//! Copying one collection's documents into another.
+//!
+//! Documents are copied with their stored embeddings, so nothing is
+//! re-embedded. Both collections must embed with the same model for the
+//! copied vectors to be comparable with the destination's.
+
+use std::fmt;
+
+/// What to do with a document whose ID is already in the destination.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum IdCollision {
+    /// Keep the destination's document and leave the source's out.
+    #[default]
+    Skip,
+    /// Copy the source's document under `<source collection>:<id>`.
+    Prefix,
+}
+
+/// The outcome of [`RagEngine::merge_collections`](super::RagEngine::merge_collections).
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct MergeReport {
+    pub source: String,
+    pub destination: String,
+    /// Documents copied, including renamed ones.
+    pub copied: usize,
+    /// Documents copied under a prefixed ID.
+    pub renamed: usize,
+    /// Documents left out because their ID was taken.
+    pub skipped: usize,
+}
+
+/// `Copied 12 documents from code into prose (2 renamed, 1 skipped)`.
+impl fmt::Display for MergeReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "Copied {} documents from {} into {}",
+            self.copied, self.source, self.destination
+        )?;
+
+        let mut notes = Vec::new();
+        if self.renamed > 0 {
+            notes.push(format!("{} renamed", self.renamed));
+        }
+        if self.skipped > 0 {
+            notes.push(format!("{} skipped", self.skipped));
+        }
+        if !notes.is_empty() {
+            write!(f, " ({})", notes.join(", "))?;
+        }
+        Ok(())
+    }
+}
@@ -38,26 +38,126 @@
 //!    - Context is added to the LLM prompt
 //!    - LLM generates response using the context
 
+mod archive;
+mod cache;
+mod chunker;
+mod citation;
+mod comments;
+mod compare;
+mod contextual;
+mod conversation;
 mod embedder;
+mod eval;
 mod indexer;
+mod inspect;
+mod jobs;
 mod lancedb_store;
+mod memory_store;
+mod merge;
+mod pinned;
+mod preview;
 mod qdrant_store;
+mod redact;
+mod report;
+mod rerank;
+mod roots;
+mod snapshot;
+mod source_diff;
 mod store;
+mod structured;
+mod summary;
+mod trace;
 mod types;
+mod usage;
+mod verify;
+mod which;
 pub mod utils;
 
+#[cfg(test)]
+pub(crate) mod testing;
+
+pub use chunker::{
+    Chunker, ChunkerRegistry, FileMeta, LineChunker, StructuredChunker, TextChunker,
+};
+pub use citation::{cite, BlameInfo, Citation};
+pub use compare::{ComparedHit, RetrievalComparison, RetrievalSettings};
+pub use eval::{EvalReport, LabeledQuery, LabeledSet, QueryEval};
+pub use indexer::{parse_since, FileChunk};
+pub use inspect::EmbeddingInfo;
+pub use jobs::{IndexJob, JobState};
+pub use merge::{IdCollision, MergeReport};
+pub use pinned::is_pinned;
+pub use preview::{preview_chunks, ChunkPreview};
+pub use redact::Redactor;
+pub use report::{FileError, IndexProgress, IndexResult};
+pub use rerank::rerank;
+pub use snapshot::ExportReport;
+pub use source_diff::{DiffLine, SourceDiff};
+pub use store::VectorStore;
+pub use summary::Summarizer;
+pub use trace::{Candidate, DropReason, RetrievalTrace, SearchTimings};
 #[allow(unused)]
-pub use types::{Document, SearchResult};
+pub use types::{Document, RetrievedChunk, SearchResult};
+pub use usage::UsageReport;
+pub use verify::VerifyReport;
+pub use which::CollectionMatch;
 
-use crate::config::Config;
+use crate::config::{
+    CitationAnchor, CitationConfig, Config, EmptyNotice, StorageMode, TrivialQueryConfig,
+};
+use crate::models::EmbeddingModel;
 use crate::provider::Provider;
+use cache::RetrievalCache;
+use citation::chunk_line_ranges;
+use comments::{is_only_comments, path_header, strip_comments};
+use contextual::ContextLines;
+use conversation::Conversations;
 use embedder::Embedder;
 use indexer::Indexer;
-use std::path::Path;
+use jobs::IndexJobs;
+use memory_store::MemoryStore;
+use pinned::PinnedDocuments;
+use roots::IndexedRoots;
+use std::collections::{HashMap, HashSet};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::Arc;
-use store::{create_vector_store, VectorStore};
+use std::time::SystemTime;
+pub(crate) use store::create_vector_store;
 use thiserror::Error;
 
+/// A chunk waiting in a batch to be embedded, with what is stored alongside it.
+struct PendingChunk {
+    id: String,
+    content: String,
+    source: String,
+    index: usize,
+    key_path: Option<String>,
+    content_hash: String,
+    /// First and last line of the chunk in its file, 1-based.
+    lines: Option<(usize, usize)>,
+}
+
+/// Records the lines a chunk spans as `start_line` and `end_line`.
+fn with_line_metadata(document: Document, lines: Option<(usize, usize)>) -> Document {
+    match lines {
+        Some((start, end)) => document
+            .with_metadata("start_line", start.to_string())
+            .with_metadata("end_line", end.to_string()),
+        None => document,
+    }
+}
+
+/// `dir` with symlinks and `..` resolved, so `./src` and `/repo/src` are the
+/// same root. Falls back to `dir` as given if it can't be resolved.
+fn canonical_root(dir: &Path) -> PathBuf {
+    std::fs::canonicalize(dir).unwrap_or_else(|_| dir.to_path_buf())
+}
+
+/// Given by [`RagEngine::empty_notice`].
+const EMPTY_NOTICE: &str = "The knowledge base is empty, so answers use no retrieved context. \
+     Send an index request for a directory to add some.";
+
 #[derive(Debug, Error)]
 pub enum RagError {
     #[error("Embedder error: {0}")]
@@ -68,10 +168,49 @@ pub enum RagError {
 
     #[error("Failed to retrieve context: {0}")]
     Retrieval(String),
+
+    /// A directory has more matching files than `rag.indexer.max_files`.
+    #[error("Found {count} files to index, more than rag.indexer.max_files ({limit})")]
+    TooManyFiles { count: usize, limit: usize },
+
+    /// The directory, or one it is inside of, was already indexed; see
+    /// [`RagEngine::index_directory_forced`] to index it again.
+    #[error("{} is already indexed", .0.display())]
+    AlreadyIndexed(PathBuf),
+
+    #[error("Failed to summarize chunk: {0}")]
+    Summary(#[source] crate::provider::ProviderError),
+
+    /// Adding documents would take an in-memory collection past
+    /// `storage.storage_mode.max_documents`.
+    #[error(
+        "In-memory collection is full ({limit} documents, storage.storage_mode.max_documents). \
+         Use embedded or grpc storage for larger collections"
+    )]
+    CollectionFull { limit: usize },
+
+    #[error("No collection named '{0}' in rag.collections")]
+    UnknownCollection(String),
+
+    #[error("No snapshot labelled '{0}'")]
+    UnknownSnapshot(String),
+
+    #[error("Snapshot failed: {0}")]
+    Snapshot(String),
+
+    #[error("Cannot merge collection '{from}' into '{into}': {reason}")]
+    Merge {
+        from: String,
+        into: String,
+        reason: String,
+    },
 }
 
 pub type Result<T> = std::result::Result<T, RagError>;
 
+/// Number of chunks embedded per provider call while indexing.
+const BATCH_SIZE: usize = 32;
+
 /// The main RAG manager orchestrating all components.
 ///
 /// The manager ties together the embedder, vector store, and indexer to provide
@@ -90,16 +229,78 @@ pub type Result<T> = std::result::Result<T, RagError>;
 /// - `rag.chunk_size`: Size of text chunks in bytes
 /// - `rag.chunk_overlap`: Overlap between chunks in bytes
 /// - `storage.top_k`: Number of results to return from searches
+/// - `rag.candidate_multiplier`: Candidates fetched per result before filtering
+/// - `rag.min_score`: Minimum similarity for a result to be kept
+/// - `rag.rerank`: Re-order candidates by query term coverage
+/// - `rag.max_context_docs`: Most chunks placed in the prompt
+///
+/// # Caching
+///
+/// Search results are cached by query embedding and shared between clones.
+/// Any change to the collection through the engine clears the cache.
+///
+/// # Temporary knowledge
+///
+/// Content added with [`add_temporary`](Self::add_temporary) is kept in memory,
+/// searched alongside the persistent collection, and lost when the engine is
+/// dropped.
+///
+/// # Conversation turns
+///
+/// [`remember_turn`](Self::remember_turn) keeps chat turns in an in-memory
+/// index per conversation that is only searched by
+/// [`recall_turns`](Self::recall_turns) for the same conversation, never by
+/// [`search`](Self::search).
+///
+/// # Collections
+///
+/// Each entry of `rag.collections` is a separate engine with its own vector
+/// store and embedding model, reached with [`collection`](Self::collection).
+/// Documents added to it record the model in their `embedding_model` metadata.
 #[derive(Clone)]
 pub struct RagEngine {
     embedder: Embedder,
     store: Arc<dyn VectorStore>,
     indexer: Indexer,
+    cache: Arc<RetrievalCache>,
+    session: Arc<MemoryStore>,
+    conversations: Arc<Conversations>,
+    /// Directory of the embedded vector database, if storage is embedded.
+    storage_path: Option<PathBuf>,
+    min_score: Option<f32>,
+    citations: CitationConfig,
+    inline_metadata: bool,
+    top_k: usize,
+    candidate_multiplier: usize,
+    /// Writes the text embedded for each indexed chunk, if summary indexing is on.
+    summarizer: Option<Summarizer>,
+    /// Cap on the collection size, for in-memory storage.
+    max_documents: Option<usize>,
+    rerank: bool,
+    max_context_docs: Option<usize>,
+    empty_notice: EmptyNotice,
+    /// Whether the empty knowledge base notice was given, shared between clones.
+    empty_notice_sent: Arc<AtomicBool>,
+    pinned: Arc<PinnedDocuments>,
+    contextual_chunks: bool,
+    embed_without_comments: bool,
+    prepend_source_path: bool,
+    index_paths: bool,
+    trivial_queries: TrivialQueryConfig,
+    jobs: Arc<IndexJobs>,
+    /// Canonical roots of completed directory indexes, shared between clones.
+    indexed_roots: Arc<IndexedRoots>,
+    /// Name of this collection, if it is one of `rag.collections`.
+    collection: Option<String>,
+    collections: Arc<HashMap<String, RagEngine>>,
 }
 
 impl RagEngine {
     /// Creates a new RAG manager with vector database.
     ///
+    /// With `rag.enabled` off no vector database or collection is created;
+    /// the engine only holds an empty in-memory store.
+    ///
     /// # Example
     ///
     /// ```no_run
@@ -113,12 +314,12 @@ impl RagEngine {
     /// ```
     pub async fn new(config: &Config, provider: Arc<dyn Provider>) -> Result<Self> {
         let rag = config.rag.clone().unwrap();
-        let embedder = Embedder::new(provider, rag.embedding_model.clone());
-
+        if !rag.enabled {
+            return Self::with_store(config, provider, Arc::new(MemoryStore::new())).await;
+        }
         let store = create_vector_store(
             config.storage.clone(),
-            rag
-                .embedding_model
+            rag.embedding_model
                 .embedding_dim
                 .try_into()
                 .unwrap_or_default(),
@@ -126,18 +327,290 @@ impl RagEngine {
         .await
         .map_err(|e| RagError::Retrieval(e.to_string()))?;
 
+        Self::with_store(config, provider, store).await
+    }
+
+    /// Like [`new`](Self::new), but stores the default collection in `store`
+    /// instead of the backend `storage.storage_mode` selects.
+    ///
+    /// Use this to plug in a [`VectorStore`] of your own, such as a client for
+    /// another vector database. Named collections in `rag.collections` still
+    /// use the configured backend.
+    ///
+    /// # Example
+    ///
+    /// ```no_run
+    /// # use nucleus_core::{Config, rag::{RagEngine, VectorStore}, provider::OllamaProvider};
+    /// # use std::sync::Arc;
+    /// # async fn example(store: Arc<dyn VectorStore>) {
+    /// let config = Config::load_or_default();
+    /// let provider = Arc::new(OllamaProvider::new(&config.llm.base_url));
+    /// let engine = RagEngine::with_store(&config, provider, store).await.unwrap();
+    /// # }
+    /// ```
+    pub async fn with_store(
+        config: &Config,
+        provider: Arc<dyn Provider>,
+        store: Arc<dyn VectorStore>,
+    ) -> Result<Self> {
+        let rag = config.rag.clone().unwrap();
+        let summarizer = rag.summary_index.enabled.then(|| {
+            let model = rag
+                .summary_index
+                .model
+                .clone()
+                .unwrap_or_else(|| config.llm.model.clone());
+            Summarizer::new(provider.clone(), model)
+        });
+        let embedder_for = |model: &EmbeddingModel| {
+            Embedder::new(provider.clone(), model.clone())
+                .with_cache_capacity(rag.embedding_cache_size)
+                .with_prefixes(rag.document_prefix.clone(), rag.query_prefix.clone())
+                .with_normalization(rag.normalize_embeddings)
+        };
+        let embedder = embedder_for(&rag.embedding_model);
+
         let mut indexer_config = rag.indexer.clone();
 
         indexer_config.chunk_size = rag.indexer.chunk_size;
         indexer_config.chunk_overlap = rag.indexer.chunk_overlap;
-        let indexer = Indexer::new(indexer_config);
+        let indexer = Indexer::new(indexer_config).with_protected_paths(config.data_paths());
+        let similarity = config.storage.vector_db.similarity;
 
-        Ok(Self {
+        let storage_path = match &config.storage.storage_mode {
+            StorageMode::Embedded { path } => Some(PathBuf::from(path)),
+            StorageMode::Grpc { .. } | StorageMode::Memory { .. } => None,
+        };
+
+        let mut engine = Self {
             embedder,
             store,
             indexer,
-        })
+            cache: Arc::new(RetrievalCache::default()),
+            session: Arc::new(MemoryStore::new().with_similarity(similarity)),
+            conversations: Arc::new(Conversations::new(
+                similarity,
+                rag.conversation_recall.max_turns,
+            )),
+            indexed_roots: Arc::new(IndexedRoots::load(storage_path.as_deref())),
+            storage_path,
+            min_score: rag.min_score,
+            citations: rag.citations.clone(),
+            inline_metadata: rag.inline_metadata,
+            top_k: config.storage.top_k,
+            candidate_multiplier: rag.candidate_multiplier,
+            rerank: rag.rerank,
+            max_context_docs: rag.max_context_docs,
+            empty_notice: rag.empty_notice,
+            empty_notice_sent: Arc::default(),
+            pinned: Arc::default(),
+            contextual_chunks: rag.contextual_chunks,
+            embed_without_comments: rag.embed_without_comments,
+            prepend_source_path: rag.prepend_source_path,
+            index_paths: rag.index_paths,
+            trivial_queries: rag.trivial_queries.clone(),
+            jobs: Arc::default(),
+            summarizer,
+            max_documents: match config.storage.storage_mode {
+                StorageMode::Memory { max_documents } => Some(max_documents).filter(|&max| max > 0),
+                _ => None,
+            },
+            collection: None,
+            collections: Arc::default(),
+        };
+        if !rag.enabled {
+            return Ok(engine);
+        }
+
+        for (name, collection) in &rag.collections {
+            let mut storage = config.storage.clone();
+            storage.vector_db.collection_name = name.clone();
+            let dimension = collection.embedding_model.embedding_dim;
+            let store = create_vector_store(storage, dimension.try_into().unwrap_or_default())
+                .await
+                .map_err(|e| RagError::Retrieval(e.to_string()))?;
+            engine = engine.with_collection(name, embedder_for(&collection.embedding_model), store);
+        }
+
+        for source in &rag.pinned {
+            if let Err(e) = engine.pin(Path::new(source)).await {
+                tracing::warn!("Could not pin {}: {}", source, e);
+            }
+        }
+
+        Ok(engine)
+    }
+
+    /// Adds a named collection that embeds with `embedder` and stores into
+    /// `store`. Everything else is shared with this engine's settings.
+    pub(crate) fn with_collection(
+        mut self,
+        name: &str,
+        embedder: Embedder,
+        store: Arc<dyn VectorStore>,
+    ) -> Self {
+        let collection = RagEngine {
+            embedder,
+            store,
+            cache: Arc::new(RetrievalCache::default()),
+            session: Arc::new(MemoryStore::new()),
+            collection: Some(name.to_string()),
+            collections: Arc::default(),
+            ..self.clone()
+        };
+        Arc::make_mut(&mut self.collections).insert(name.to_string(), collection);
+        self
+    }
+
+    /// The engine for a collection of `rag.collections`, which indexes and
+    /// searches with that collection's embedding model.
+    pub fn collection(&self, name: &str) -> Result<&RagEngine> {
+        self.collections
+            .get(name)
+            .ok_or_else(|| RagError::UnknownCollection(name.to_string()))
+    }
+
+    /// Copies every document of collection `source` into `destination`,
+    /// reusing the stored embeddings. Documents whose ID is already in the
+    /// destination are handled by `collisions`.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if either collection doesn't exist, they are the same
+    /// collection or embed with different models, or the stores fail.
+    pub async fn merge_collections(
+        &self,
+        source: &str,
+        destination: &str,
+        collisions: IdCollision,
+    ) -> Result<MergeReport> {
+        let from = self.collection(source)?;
+        let into = self.collection(destination)?;
+        let refuse = |reason: String| RagError::Merge {
+            from: source.to_string(),
+            into: destination.to_string(),
+            reason,
+        };
+        if source == destination {
+            return Err(refuse("they are the same collection".to_string()));
+        }
+        if from.embedder.model_id() != into.embedder.model_id() {
+            return Err(refuse(format!(
+                "they embed with different models ({} and {})",
+                from.embedder.model_id(),
+                into.embedder.model_id()
+            )));
+        }
+
+        let documents = from
+            .store
+            .documents()
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        let mut report = MergeReport {
+            source: source.to_string(),
+            destination: destination.to_string(),
+            ..MergeReport::default()
+        };
+
+        let mut copies = Vec::with_capacity(documents.len());
+        for mut document in documents {
+            if into.contains(&document.id).await? {
+                let prefixed = format!("{}:{}", source, document.id);
+                if collisions == IdCollision::Skip || into.contains(&prefixed).await? {
+                    report.skipped += 1;
+                    continue;
+                }
+                document.id = prefixed;
+                report.renamed += 1;
+            }
+            copies.push(document);
+        }
+
+        report.copied = copies.len();
+        for batch in copies.chunks(BATCH_SIZE) {
+            into.add_documents(batch.to_vec()).await?;
+        }
+        Ok(report)
+    }
+
+    async fn contains(&self, id: &str) -> Result<bool> {
+        self.store
+            .get(id)
+            .await
+            .map(|document| document.is_some())
+            .map_err(|e| RagError::Retrieval(e.to_string()))
+    }
+
+    /// Names of the configured collections, sorted.
+    pub fn collection_names(&self) -> Vec<&str> {
+        let mut names: Vec<&str> = self.collections.keys().map(String::as_str).collect();
+        names.sort_unstable();
+        names
+    }
+
+    /// Searches every collection of `rag.collections` for `query` and reports
+    /// the best score in each, best first, to help pick which one to use.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if embedding the query or searching a collection fails.
+    pub async fn which_collection(&self, query: &str) -> Result<Vec<CollectionMatch>> {
+        let mut matches = Vec::with_capacity(self.collections.len());
+        for name in self.collection_names() {
+            let results = self.collection(name)?.search(query).await?;
+            let top = results.first();
+            matches.push(CollectionMatch {
+                collection: name.to_string(),
+                top_score: top.map(|result| result.score),
+                top_source: top.and_then(|result| result.document.metadata.get("source").cloned()),
+            });
+        }
+        matches.sort_by(CollectionMatch::best_first);
+        Ok(matches)
+    }
+
+    /// Embeds a summary of each indexed chunk, written by `summarizer`,
+    /// instead of the chunk itself. See [`SummaryIndexConfig`](crate::config::SummaryIndexConfig).
+    pub fn with_summarizer(mut self, summarizer: Summarizer) -> Self {
+        self.summarizer = Some(summarizer);
+        self
+    }
+
+    /// Registers a chunking strategy under `name` for files with the given
+    /// extensions, replacing the default for those extensions.
+    ///
+    /// # Example
+    ///
+    /// ```no_run
+    /// # use nucleus_core::rag::{Chunker, FileChunk, FileMeta, RagEngine};
+    /// struct Paragraphs;
+    ///
+    /// impl Chunker for Paragraphs {
+    ///     fn chunk(&self, content: &str, _meta: &FileMeta) -> Option<Vec<FileChunk>> {
+    ///         Some(
+    ///             content
+    ///                 .split("\n\n")
+    ///                 .map(|p| FileChunk { content: p.to_string(), key_path: None })
+    ///                 .collect(),
+    ///         )
+    ///     }
+    /// }
+    ///
+    /// # fn example(engine: RagEngine) {
+    /// let engine = engine.with_chunker("paragraphs", Paragraphs, &["txt"]);
+    /// # }
+    /// ```
+    pub fn with_chunker(
+        mut self,
+        name: impl Into<String>,
+        chunker: impl Chunker + 'static,
+        extensions: &[&str],
+    ) -> Self {
+        self.indexer = self.indexer.with_chunker(name, chunker, extensions);
+        self
     }
+
     /// Adds a single piece of text to the knowledge base.
     ///
     /// The text is embedded and stored as a single document. For large texts,
@@ -154,47 +627,193 @@ impl RagEngine {
     /// Returns an error if embedding generation fails.
     ///
     pub async fn add_knowledge(&self, content: &str, source: &str) -> Result<()> {
-        let embedding = self.embedder.embed(content).await?;
+        let embedding = self.embedder.embed_document(content).await?;
 
         let count = self.store.count().await.unwrap_or(0);
         let id = format!("{}_{}", source, count);
         let document = Document::new(id, content, embedding).with_metadata("source", source);
 
-        self.store
+        self.add_documents(vec![document]).await
+    }
+
+    /// Adds text to the session's temporary knowledge.
+    ///
+    /// The text is searched like the rest of the knowledge base but never
+    /// written to the vector database.
+    pub async fn add_temporary(&self, content: &str, source: &str) -> Result<()> {
+        let embedding = self.embedder.embed_document(content).await?;
+
+        let count = self.session.count().await.unwrap_or(0);
+        let id = format!("session:{}_{}", source, count);
+        let document = Document::new(id, content, embedding)
+            .with_metadata("source", source)
+            .with_metadata("temporary", "true");
+
+        let added = self.session.add(vec![document]).await;
+        self.cache.invalidate();
+        added.map_err(|e| RagError::Retrieval(e.to_string()))
+    }
+
+    /// Discards all temporary knowledge.
+    pub async fn clear_temporary(&self) -> Result<()> {
+        let cleared = self.session.clear().await;
+        self.cache.invalidate();
+        cleared.map_err(|e| RagError::Retrieval(e.to_string()))
+    }
+
+    /// Number of documents in the session's temporary knowledge.
+    pub async fn temporary_count(&self) -> usize {
+        self.session.count().await.unwrap_or(0)
+    }
+
+    /// Embeds a chat turn into the index of `conversation`.
+    ///
+    /// `role` is the speaker, e.g. `user` or `assistant`. Once the index holds
+    /// `rag.conversation_recall.max_turns` turns, the oldest is dropped.
+    pub async fn remember_turn(&self, conversation: &str, role: &str, content: &str) -> Result<()> {
+        if content.trim().is_empty() {
+            return Ok(());
+        }
+
+        let embedding = self.embedder.embed_document(content).await?;
+
+        let conversation = self.conversations.get_or_create(conversation);
+        let document = conversation.turn(role, content, embedding);
+        conversation
+            .turns()
             .add(vec![document])
             .await
             .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        conversation.evict();
         Ok(())
     }
 
+    /// The earlier turns of `conversation` most relevant to `query`, best
+    /// first.
+    ///
+    /// Turns scoring below `rag.min_score` are dropped.
+    pub async fn recall_turns(
+        &self,
+        conversation: &str,
+        query: &str,
+        limit: usize,
+    ) -> Result<Vec<SearchResult>> {
+        let Some(conversation) = self.conversations.get(conversation) else {
+            return Ok(Vec::new());
+        };
+        if limit == 0 || conversation.turns().count().await.unwrap_or(0) == 0 {
+            return Ok(Vec::new());
+        }
+
+        let query_embedding = self.embedder.embed_query(query).await?;
+        let mut turns = conversation
+            .turns()
+            .search(&query_embedding, limit)
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+
+        if let Some(min_score) = self.min_score {
+            turns.retain(|turn| turn.score >= min_score);
+        }
+        Ok(turns)
+    }
+
+    /// Adds documents to the store and invalidates cached search results.
+    async fn add_documents(&self, mut documents: Vec<Document>) -> Result<()> {
+        if let Some(limit) = self.max_documents {
+            let count = self
+                .store
+                .count()
+                .await
+                .map_err(|e| RagError::Retrieval(e.to_string()))?;
+            if count + documents.len() > limit {
+                return Err(RagError::CollectionFull { limit });
+            }
+        }
+
+        if self.collection.is_some() {
+            for document in &mut documents {
+                document.metadata.insert(
+                    "embedding_model".to_string(),
+                    self.embedder.model_id().to_string(),
+                );
+            }
+        }
+
+        let added = self.store.add(documents).await;
+        self.cache.invalidate();
+        added.map_err(|e| RagError::Retrieval(e.to_string()))
+    }
+
+    /// Embeds a batch of pending chunks and stores them.
+    ///
+    /// `replaced` holds the sources whose old chunks this run has already
+    /// removed; the old chunks of any other source in the batch are removed
+    /// as its new ones are stored.
     async fn process_batch(
         &self,
         chunk_batch: &mut Vec<String>,
-        chunk_metadata: &mut Vec<(String, String, String, usize)>,
+        chunk_metadata: &mut Vec<PendingChunk>,
+        replaced: &mut HashSet<String>,
     ) -> Result<()> {
         use tracing::info;
 
         info!("Processing batch of {} chunks", chunk_batch.len());
         let chunk_refs: Vec<&str> = chunk_batch.iter().map(|s| s.as_str()).collect();
 
-        info!("Calling embed_batch for {} texts", chunk_refs.len());
-        let embeddings = self.embedder.embed_batch(&chunk_refs).await?;
+        let summaries = match &self.summarizer {
+            Some(summarizer) => {
+                let mut summaries = Vec::with_capacity(chunk_refs.len());
+                for chunk in &chunk_refs {
+                    summaries.push(
+                        summarizer
+                            .summarize(chunk)
+                            .await
+                            .map_err(RagError::Summary)?,
+                    );
+                }
+                Some(summaries)
+            }
+            None => None,
+        };
+        let embedded: Vec<&str> = match &summaries {
+            Some(summaries) => summaries.iter().map(|s| s.as_str()).collect(),
+            None => chunk_refs,
+        };
+
+        info!("Calling embed_batch for {} texts", embedded.len());
+        let embeddings = self.embedder.embed_documents(&embedded).await?;
         info!("Received {} embeddings", embeddings.len());
 
+        let mut summaries = summaries.map(Vec::into_iter);
         let documents: Vec<Document> = embeddings
             .into_iter()
             .zip(chunk_metadata.drain(..))
-            .map(|(embedding, (id, content, source, chunk_idx))| {
-                Document::new(id, content, embedding)
-                    .with_metadata("source", source)
-                    .with_metadata("chunk", chunk_idx.to_string())
+            .map(|(embedding, pending)| {
+                let mut document = Document::new(pending.id, pending.content, embedding)
+                    .with_metadata("source", pending.source)
+                    .with_metadata("chunk", pending.index.to_string())
+                    .with_metadata("content_hash", pending.content_hash);
+                if let Some(key_path) = pending.key_path {
+                    document = document.with_metadata("key_path", key_path);
+                }
+                document = with_line_metadata(document, pending.lines);
+                if let Some(summary) = summaries.as_mut().and_then(Iterator::next) {
+                    document = document.with_metadata("summary", summary);
+                }
+                document
             })
             .collect();
 
-        self.store
-            .add(documents)
-            .await
-            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        let mut stale = Vec::new();
+        for document in &documents {
+            if let Some(source) = document.metadata.get("source") {
+                if replaced.insert(source.clone()) {
+                    stale.push(source.clone());
+                }
+            }
+        }
+        self.replace_documents(&stale, documents).await?;
 
         info!("Batch processed successfully");
         chunk_batch.clear();
@@ -209,7 +828,9 @@ impl RagEngine {
     /// 2. Each chunk is embedded
     /// 3. Chunks are stored with file path and chunk index metadata
     ///
-    /// Progress is printed to stdout as files are indexed.
+    /// Progress is printed to stdout as files are indexed; see
+    /// [`index_directory_with_progress`](Self::index_directory_with_progress)
+    /// to report it elsewhere.
     ///
     /// # Arguments
     ///
@@ -217,17 +838,226 @@ impl RagEngine {
     ///
     /// # Returns
     ///
-    /// The number of files successfully indexed.
+    /// An [`IndexResult`] with the files indexed, skipped and failed, and the
+    /// chunks added. Files that can't be read are listed in its `errors`
+    /// without stopping the rest of the directory.
     ///
     /// # Errors
     ///
     /// Returns an error if:
     /// - The directory doesn't exist or isn't accessible
     /// - Embedding generation fails for any chunk
+    /// - The directory has more matching files than `rag.indexer.max_files`
+    ///   ([`RagError::TooManyFiles`]); see [`index_directory_forced`](Self::index_directory_forced)
+    /// - The directory, under any spelling of its path, or a directory it is
+    ///   inside of was already indexed ([`RagError::AlreadyIndexed`]), see
+    ///   [`is_indexed_root`](Self::is_indexed_root)
     ///
-    pub async fn index_directory(&self, dir_path: &Path) -> Result<usize> {
-        let files = self.indexer.collect_files(dir_path).await?;
+    pub async fn index_directory(&self, dir_path: &Path) -> Result<IndexResult> {
+        self.index_directory_reporting(dir_path, None, false, |_| {})
+            .await
+    }
+
+    /// Like [`index_directory`](Self::index_directory), but only indexes files
+    /// modified at or after `since`.
+    ///
+    /// Chunks of older files already in the knowledge base are left as they
+    /// are. See [`parse_since`] for turning `24h`-style input into a cutoff.
+    pub async fn index_directory_since(
+        &self,
+        dir_path: &Path,
+        since: SystemTime,
+    ) -> Result<IndexResult> {
+        self.index_directory_reporting(dir_path, Some(since), false, |_| {})
+            .await
+    }
+
+    /// Indexes a directory without the `rag.indexer.max_files` and already
+    /// indexed checks, e.g. once the user has confirmed a large index or
+    /// wants a directory embedded again. `since` works as in
+    /// [`index_directory_since`](Self::index_directory_since).
+    pub async fn index_directory_forced(
+        &self,
+        dir_path: &Path,
+        since: Option<SystemTime>,
+    ) -> Result<IndexResult> {
+        self.index_directory_reporting(dir_path, since, true, |_| {})
+            .await
+    }
+
+    /// Like [`index_directory`](Self::index_directory), reporting each file
+    /// as it starts and the chunks embedded so far within large files.
+    ///
+    /// # Example
+    ///
+    /// ```no_run
+    /// # use nucleus_core::rag::{IndexProgress, RagEngine};
+    /// # use std::path::Path;
+    /// # async fn example(engine: RagEngine) {
+    /// engine
+    ///     .index_directory_with_progress(Path::new("./src"), |progress| {
+    ///         println!("{}", progress);
+    ///     })
+    ///     .await
+    ///     .unwrap();
+    /// # }
+    /// ```
+    pub async fn index_directory_with_progress<F>(
+        &self,
+        dir_path: &Path,
+        on_progress: F,
+    ) -> Result<IndexResult>
+    where
+        F: FnMut(IndexProgress) + Send,
+    {
+        self.index_directory_reporting(dir_path, None, false, on_progress)
+            .await
+    }
+
+    /// What every `index_directory` variant runs: like
+    /// [`index_directory_with_progress`](Self::index_directory_with_progress),
+    /// with `since` as in [`index_directory_since`](Self::index_directory_since)
+    /// and `force` skipping the checks like
+    /// [`index_directory_forced`](Self::index_directory_forced).
+    pub(crate) async fn index_directory_reporting<F>(
+        &self,
+        dir_path: &Path,
+        since: Option<SystemTime>,
+        force: bool,
+        mut on_progress: F,
+    ) -> Result<IndexResult>
+    where
+        F: FnMut(IndexProgress) + Send,
+    {
+        if !force {
+            if since.is_none() {
+                self.check_not_indexed(dir_path)?;
+            }
+            self.check_file_count(dir_path).await?;
+        }
+        self.index_collected(dir_path, since, &mut on_progress)
+            .await
+    }
+
+    /// Starts indexing `dir_path` on a background task and returns the job's
+    /// ID, to look up in [`index_jobs`](Self::index_jobs).
+    ///
+    /// Chunks are searchable as soon as each batch is stored, and the engine
+    /// can be queried and added to while the job runs. Must be called from
+    /// within a Tokio runtime.
+    pub fn index_in_background(&self, dir_path: impl Into<PathBuf>) -> usize {
+        let dir = dir_path.into();
+        let id = self.jobs.start(dir.clone());
+        let engine = self.clone();
+
+        tokio::spawn(async move {
+            let jobs = engine.jobs.clone();
+            let outcome = engine
+                .index_directory_with_progress(&dir, |progress| jobs.report(id, progress))
+                .await;
+            if let Err(e) = &outcome {
+                tracing::warn!("Background index of {} failed: {}", dir.display(), e);
+            }
+            engine.jobs.finish(id, outcome);
+        });
+
+        id
+    }
+
+    /// Every background index job started on this engine, oldest first.
+    pub fn index_jobs(&self) -> Vec<IndexJob> {
+        self.jobs.snapshot()
+    }
+
+    /// Indexes the text files inside a `.zip`, `.tar`, `.tar.gz` or `.tgz`
+    /// archive without unpacking it.
+    ///
+    /// Entries go through the same extension and exclude filters as a
+    /// directory index, and each is stored with its path inside the archive,
+    /// such as `src/lib.rs`, as its source. Binary entries are skipped.
+    pub async fn index_archive(&self, archive_path: &Path) -> Result<IndexResult> {
+        let started = std::time::Instant::now();
+        let collected = self.indexer.collect_archive(archive_path).await?;
+
+        let mut result = self
+            .index_files(archive_path, collected.files, &mut |_| {})
+            .await?;
+        result.files_skipped += collected.binary;
+        result.errors = collected.failed;
+        result.duration = started.elapsed();
+        Ok(result)
+    }
 
+    async fn index_collected(
+        &self,
+        dir_path: &Path,
+        since: Option<SystemTime>,
+        on_progress: &mut (dyn FnMut(IndexProgress) + Send),
+    ) -> Result<IndexResult> {
+        let started = std::time::Instant::now();
+        let collected = self
+            .indexer
+            .collect_files_reporting(dir_path, since)
+            .await?;
+
+        let mut result = self
+            .index_files(dir_path, collected.files, on_progress)
+            .await?;
+        result.files_skipped += collected.binary;
+        result.errors = collected.failed;
+        result.duration = started.elapsed();
+        if since.is_none() {
+            self.indexed_roots.insert(canonical_root(dir_path));
+        }
+        Ok(result)
+    }
+
+    /// Whether a full index of `dir_path`, or of a directory it is inside of,
+    /// has completed since the knowledge base was last cleared.
+    ///
+    /// With embedded storage this is remembered across restarts; otherwise
+    /// only indexes by this engine count.
+    pub fn is_indexed_root(&self, dir_path: &Path) -> bool {
+        self.indexed_roots.covers(&canonical_root(dir_path))
+    }
+
+    /// Whether `query` is small talk that chats answer without retrieving
+    /// context, per `rag.trivial_queries`.
+    ///
+    /// Searches themselves never check this, so explicit retrieval still
+    /// works for short queries such as `db`.
+    pub fn is_trivial_query(&self, query: &str) -> bool {
+        self.trivial_queries.is_trivial(query)
+    }
+
+    fn check_not_indexed(&self, dir_path: &Path) -> Result<()> {
+        if self.is_indexed_root(dir_path) {
+            tracing::warn!("Skipping {}: already indexed", dir_path.display());
+            return Err(RagError::AlreadyIndexed(dir_path.to_path_buf()));
+        }
+        Ok(())
+    }
+
+    /// Counts the files a directory index would cover and fails with
+    /// [`RagError::TooManyFiles`] if there are more than `rag.indexer.max_files`.
+    ///
+    /// Returns the count otherwise.
+    pub async fn check_file_count(&self, dir_path: &Path) -> Result<usize> {
+        let count = self.indexer.count_files(dir_path).await?;
+        match self.indexer.max_files() {
+            Some(limit) if count > limit => Err(RagError::TooManyFiles { count, limit }),
+            _ => Ok(count),
+        }
+    }
+
+    /// Chunks, embeds and stores `files`. The result's errors and duration
+    /// are left for the caller to fill in.
+    async fn index_files(
+        &self,
+        dir_path: &Path,
+        files: Vec<indexer::IndexedFile>,
+        on_progress: &mut (dyn FnMut(IndexProgress) + Send),
+    ) -> Result<IndexResult> {
         use tracing::{debug, info};
         info!("Found {} files to index", files.len());
         for file in &files {
@@ -235,55 +1065,228 @@ impl RagEngine {
         }
         info!("Starting indexing...");
 
-        let mut indexed_count = 0;
+        let mut result = IndexResult::default();
 
-        const BATCH_SIZE: usize = 32;
         let mut chunk_batch = Vec::new();
         let mut chunk_metadata = Vec::new();
+        let mut indexed_paths = Vec::new();
+        // A file's old chunks are removed in the batch that stores its first
+        // new ones, so a failure partway through the run leaves the files
+        // after it as they were.
+        let mut replaced = HashSet::new();
+        let file_count = files.len();
 
-        for file in files {
+        for (index, file) in files.into_iter().enumerate() {
+            on_progress(IndexProgress::File {
+                path: file.path.clone(),
+                index: index + 1,
+                total: file_count,
+            });
+
+            // A file that is now empty or blank has nothing to replace its
+            // old chunks with, so they go straight away rather than staying
+            // searchable.
             if file.content.is_empty() {
                 eprintln!("WARNING: File has empty content: {}", file.path.display());
+                self.remove_stale_chunks(&[file.path.to_string_lossy().to_string()])
+                    .await?;
+                result.files_skipped += 1;
                 continue;
             }
 
-            let chunks = self.indexer.chunk_text(&file.content);
+            let chunks = self.indexer.chunk_file(&file.path, &file.content);
+            let chunks = self.drop_blank_chunks(&file.path, chunks);
 
             if chunks.is_empty() {
                 eprintln!(
                     "WARNING: No chunks created for file: {}",
                     file.path.display()
                 );
+                self.remove_stale_chunks(&[file.path.to_string_lossy().to_string()])
+                    .await?;
+                result.files_skipped += 1;
                 continue;
             }
 
-            for (i, chunk) in chunks.into_iter().enumerate() {
-                chunk_batch.push(chunk.clone());
-                chunk_metadata.push((
-                    format!("{}_chunk_{}", file.path.display(), i),
-                    chunk,
-                    file.path.to_string_lossy().to_string(),
-                    i,
+            let chunk_count = chunks.len();
+            let hash = indexer::content_hash(&file.content);
+            let redacted = self.indexer.redact(&file.content);
+            let lines =
+                chunk_line_ranges(&redacted, chunks.iter().map(|chunk| chunk.content.as_str()));
+            let context_lines = self
+                .contextual_chunks
+                .then(|| ContextLines::new(&file.path, &redacted));
+            for (i, (chunk, lines)) in chunks.into_iter().zip(lines).enumerate() {
+                chunk_batch.push(self.embedded_text(
+                    &file.path,
+                    Some(dir_path),
+                    context_lines.as_ref(),
+                    lines,
+                    &chunk.content,
                 ));
+                chunk_metadata.push(PendingChunk {
+                    id: self
+                        .indexer
+                        .chunk_id(&file.path, Some(dir_path), i, &chunk.content),
+                    content: chunk.content,
+                    source: file.path.to_string_lossy().to_string(),
+                    index: i,
+                    key_path: chunk.key_path,
+                    content_hash: hash.clone(),
+                    lines,
+                });
+                result.chunks_added += 1;
 
                 // Process batch when it reaches BATCH_SIZE
                 if chunk_batch.len() >= BATCH_SIZE {
-                    self.process_batch(&mut chunk_batch, &mut chunk_metadata)
+                    self.process_batch(&mut chunk_batch, &mut chunk_metadata, &mut replaced)
                         .await?;
+                    if i + 1 < chunk_count {
+                        on_progress(IndexProgress::Chunks {
+                            path: file.path.clone(),
+                            embedded: i + 1,
+                            total: chunk_count,
+                        });
+                    }
                 }
             }
 
-            indexed_count += 1;
+            result.files_indexed += 1;
             println!("✓ Indexed: {}", file.path.display());
+            indexed_paths.push(file.path);
         }
 
         // Process remaining chunks
         if !chunk_batch.is_empty() {
-            self.process_batch(&mut chunk_batch, &mut chunk_metadata)
+            self.process_batch(&mut chunk_batch, &mut chunk_metadata, &mut replaced)
                 .await?;
         }
+        self.add_path_documents(Some(dir_path), &indexed_paths)
+            .await?;
+
+        Ok(result)
+    }
+
+    /// Stores a document naming each of `paths`, with `path_document`
+    /// metadata, when `rag.index_paths` is set. Its source is the file, so it
+    /// is replaced along with the file's chunks.
+    async fn add_path_documents(&self, root: Option<&Path>, paths: &[PathBuf]) -> Result<()> {
+        if !self.index_paths {
+            return Ok(());
+        }
+
+        for batch in paths.chunks(BATCH_SIZE) {
+            let texts: Vec<String> = batch
+                .iter()
+                .map(|path| indexer::path_document(path, root))
+                .collect();
+            let refs: Vec<&str> = texts.iter().map(String::as_str).collect();
+            let embeddings = self.embedder.embed_documents(&refs).await?;
+            let documents = batch
+                .iter()
+                .zip(texts)
+                .zip(embeddings)
+                .map(|((path, text), embedding)| {
+                    let source = path.to_string_lossy().to_string();
+                    Document::new(format!("{}_path", source), text, embedding)
+                        .with_metadata("source", source)
+                        .with_metadata("path_document", "true")
+                })
+                .collect();
+            self.add_documents(documents).await?;
+        }
+        Ok(())
+    }
+
+    /// Stores `documents` in place of the chunks stored for `sources`.
+    ///
+    /// The old chunks are only removed once the new ones are embedded, and
+    /// not at all if the new ones wouldn't fit in the collection.
+    async fn replace_documents(&self, sources: &[String], documents: Vec<Document>) -> Result<()> {
+        if let (Some(limit), false) = (self.max_documents, sources.is_empty()) {
+            let retrieval = |e: anyhow::Error| RagError::Retrieval(e.to_string());
+            let count = self.store.count().await.map_err(retrieval)?;
+            let counts = self.store.source_counts().await.map_err(retrieval)?;
+            let stale: usize = sources.iter().filter_map(|source| counts.get(source)).sum();
+            if count.saturating_sub(stale) + documents.len() > limit {
+                return Err(RagError::CollectionFull { limit });
+            }
+        }
+
+        self.remove_stale_chunks(sources).await?;
+        if documents.is_empty() {
+            return Ok(());
+        }
+        self.add_documents(documents).await
+    }
+
+    /// Removes the chunks stored for files before they are re-indexed.
+    ///
+    /// Chunk IDs only overwrite chunks with the same index, so without this a
+    /// file that now yields fewer chunks would keep its old trailing ones.
+    async fn remove_stale_chunks(&self, sources: &[String]) -> Result<usize> {
+        if sources.is_empty() {
+            return Ok(0);
+        }
+
+        let removed = self.store.remove_by_sources(sources).await;
+        self.cache.invalidate();
+        let removed = removed.map_err(|e| RagError::Retrieval(e.to_string()))?;
+        if removed > 0 {
+            tracing::debug!("Removed {} old chunks of {} files", removed, sources.len());
+        }
+        Ok(removed)
+    }
+
+    /// Loads the embedding model with a trivial embed, so the first index or
+    /// query doesn't wait for the model server to load it.
+    pub async fn warm_up_model(&self) -> Result<()> {
+        self.embedder.load_model().await?;
+        Ok(())
+    }
+
+    /// Computes and caches embeddings for every chunk in a directory without
+    /// adding anything to the knowledge base.
+    ///
+    /// A later [`index_directory`](Self::index_directory) over the same files is
+    /// then served from the embedding cache, and embedding errors surface before
+    /// the collection is touched. The cache must be large enough to hold every
+    /// chunk (`rag.embedding_cache_size`) for the later index to benefit fully.
+    ///
+    /// # Returns
+    ///
+    /// The number of chunks embedded.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the directory can't be read or embedding fails.
+    pub async fn warm_embeddings(&self, dir_path: &Path) -> Result<usize> {
+        use tracing::info;
+
+        let files = self.indexer.collect_files(dir_path).await?;
+        info!("Warming embeddings for {} files", files.len());
+
+        let chunks: Vec<String> = files
+            .iter()
+            .filter(|file| !file.content.is_empty())
+            .flat_map(|file| {
+                let chunks = self.indexer.chunk_file(&file.path, &file.content);
+                self.drop_blank_chunks(&file.path, chunks)
+            })
+            .map(|chunk| chunk.content)
+            .collect();
+
+        for batch in chunks.chunks(BATCH_SIZE) {
+            let refs: Vec<&str> = batch.iter().map(|chunk| chunk.as_str()).collect();
+            self.embedder.embed_documents(&refs).await?;
+        }
 
-        Ok(indexed_count)
+        info!(
+            "Warmed {} chunk embeddings ({} cached)",
+            chunks.len(),
+            self.embedder.cached_count()
+        );
+        Ok(chunks.len())
     }
 
     /// Indexes multiple directories in batch.
@@ -320,8 +1323,9 @@ impl RagEngine {
         for dir_path in dir_paths {
             println!("\nIndexing directory: {}", dir_path);
             let dir_path = Path::new(dir_path);
-            let count = self.index_directory(dir_path).await?;
-            total_count += count;
+            let result = self.index_directory(dir_path).await?;
+            println!("{}", result);
+            total_count += result.files_indexed;
         }
 
         println!("\nTotal files indexed: {}", total_count);
@@ -353,100 +1357,750 @@ impl RagEngine {
             .await
             .map_err(|e| RagError::Indexer(indexer::IndexerError::Io(e)))?;
 
-        let chunks = self.indexer.chunk_text(&content);
+        let chunks = self.indexer.chunk_file(Path::new(file_path), &content);
+        let chunks = self.drop_blank_chunks(Path::new(file_path), chunks);
         let chunk_count = chunks.len();
+        let hash = indexer::content_hash(&content);
+        let redacted = self.indexer.redact(&content);
+        let lines = chunk_line_ranges(&redacted, chunks.iter().map(|chunk| chunk.content.as_str()));
+        let context_lines = self
+            .contextual_chunks
+            .then(|| ContextLines::new(Path::new(file_path), &redacted));
+        let cwd = std::env::current_dir().ok();
 
-        for (i, chunk) in chunks.into_iter().enumerate() {
-            let embedding = self.embedder.embed(&chunk).await?;
+        let mut documents = Vec::with_capacity(chunk_count);
+        for (i, (chunk, lines)) in chunks.into_iter().zip(lines).enumerate() {
+            let text = self.embedded_text(
+                Path::new(file_path),
+                cwd.as_deref(),
+                context_lines.as_ref(),
+                lines,
+                &chunk.content,
+            );
+            let summary = match &self.summarizer {
+                Some(summarizer) => Some(
+                    summarizer
+                        .summarize(&text)
+                        .await
+                        .map_err(RagError::Summary)?,
+                ),
+                None => None,
+            };
+            let embedding = self
+                .embedder
+                .embed_document(summary.as_deref().unwrap_or(&text))
+                .await?;
 
-            let id = format!("{}_chunk_{}", file_path, i);
-            let document = Document::new(id, chunk, embedding)
+            let id = self
+                .indexer
+                .chunk_id(Path::new(file_path), cwd.as_deref(), i, &chunk.content);
+            let mut document = Document::new(id, chunk.content, embedding)
                 .with_metadata("source", file_path)
-                .with_metadata("chunk", i.to_string());
+                .with_metadata("chunk", i.to_string())
+                .with_metadata("content_hash", hash.as_str());
+            if let Some(key_path) = chunk.key_path {
+                document = document.with_metadata("key_path", key_path);
+            }
+            document = with_line_metadata(document, lines);
+            if let Some(summary) = summary {
+                document = document.with_metadata("summary", summary);
+            }
+            documents.push(document);
+        }
+        self.replace_documents(&[file_path.to_string()], documents)
+            .await?;
+        if chunk_count > 0 {
+            self.add_path_documents(cwd.as_deref(), &[PathBuf::from(file_path)])
+                .await?;
+        }
 
-            self.store
-                .add(vec![document])
+        println!("✓ Indexed: {} ({} chunks)", file_path, chunk_count);
+        Ok(chunk_count)
+    }
+
+    /// `chunks` of `path` without those that have nothing to embed, when
+    /// `rag.indexer.skip_blank` is set: chunks that are only whitespace, or
+    /// only comments when `rag.embed_without_comments` is set.
+    fn drop_blank_chunks(&self, path: &Path, chunks: Vec<FileChunk>) -> Vec<FileChunk> {
+        if !self.indexer.skip_blank() {
+            return chunks;
+        }
+
+        let total = chunks.len();
+        let kept: Vec<FileChunk> = chunks
+            .into_iter()
+            .filter(|chunk| {
+                !chunk.content.trim().is_empty()
+                    && !(self.embed_without_comments && is_only_comments(path, &chunk.content))
+            })
+            .collect();
+        if kept.is_empty() && total > 0 {
+            tracing::info!(
+                "Skipping {}: no indexable content after filtering",
+                path.display()
+            );
+        } else if kept.len() < total {
+            tracing::info!(
+                "Skipped {} blank chunks of {}",
+                total - kept.len(),
+                path.display()
+            );
+        }
+        kept
+    }
+
+    /// The text embedded for a chunk of `path` spanning `lines`: the chunk
+    /// without comments when `rag.embed_without_comments` is set, under its
+    /// context line when `rag.contextual_chunks` is, and under a line naming
+    /// `path` relative to `root` when `rag.prepend_source_path` is.
+    fn embedded_text(
+        &self,
+        path: &Path,
+        root: Option<&Path>,
+        context: Option<&ContextLines>,
+        lines: Option<(usize, usize)>,
+        chunk: &str,
+    ) -> String {
+        let text = if self.embed_without_comments {
+            strip_comments(path, chunk)
+        } else {
+            chunk.to_string()
+        };
+        let text = match context {
+            Some(context) => context.situate(lines.map(|(start, _)| start), &text),
+            None => text,
+        };
+        if self.prepend_source_path {
+            format!("{}\n{}", path_header(path, root), text)
+        } else {
+            text
+        }
+    }
+
+    /// Compares the index with the files under `dir_path`, which should be
+    /// given as it was when indexed, since sources are stored by that path.
+    ///
+    /// Reports indexed sources that no longer exist, files that aren't
+    /// indexed, and files whose content hash differs from the stored one.
+    /// Nothing is changed; see [`repair`](Self::repair).
+    pub async fn verify(&self, dir_path: &Path) -> Result<VerifyReport> {
+        let indexed: HashSet<String> = self.get_indexed_paths().await?.into_iter().collect();
+        let mut report = VerifyReport::default();
+
+        for file in self.indexer.collect_files(dir_path).await? {
+            let source = file.path.to_string_lossy().to_string();
+            let chunks = self.indexer.chunk_file(&file.path, &file.content);
+            let chunks = self.drop_blank_chunks(&file.path, chunks);
+            let Some(first) = chunks.first() else {
+                // Empty and blank files are never indexed.
+                continue;
+            };
+            report.checked += 1;
+
+            if !indexed.contains(&source) {
+                report.unindexed.push(file.path);
+                continue;
+            }
+
+            let id = self
+                .indexer
+                .chunk_id(&file.path, Some(dir_path), 0, &first.content);
+            let stored = self
+                .store
+                .get(&id)
                 .await
                 .map_err(|e| RagError::Retrieval(e.to_string()))?;
+            let stored_hash =
+                stored.and_then(|document| document.metadata.get("content_hash").cloned());
+            if stored_hash != Some(indexer::content_hash(&file.content)) {
+                report.changed.push(file.path);
+            }
         }
 
-        println!("✓ Indexed: {} ({} chunks)", file_path, chunk_count);
-        Ok(chunk_count)
+        report.missing = indexed
+            .into_iter()
+            .filter(|source| {
+                let path = Path::new(source);
+                path.starts_with(dir_path) && !path.exists()
+            })
+            .collect();
+        report.missing.sort();
+        report.unindexed.sort();
+        report.changed.sort();
+        Ok(report)
     }
 
-    /// Retrieves relevant context from the knowledge base for a query.
+    /// Fixes the drift found by [`verify`](Self::verify): removes the chunks
+    /// of missing files and re-indexes changed and unindexed ones.
+    pub async fn repair(&self, dir_path: &Path, report: &VerifyReport) -> Result<IndexResult> {
+        let started = std::time::Instant::now();
+        for source in &report.missing {
+            self.remove_from_knowledge_base(source).await?;
+        }
+
+        let mut files = Vec::new();
+        let mut errors = Vec::new();
+        for path in report.changed.iter().chain(&report.unindexed) {
+            match tokio::fs::read_to_string(path).await {
+                Ok(content) => files.push(indexer::IndexedFile {
+                    path: path.clone(),
+                    content,
+                }),
+                Err(e) => errors.push(FileError {
+                    path: path.clone(),
+                    error: e.to_string(),
+                }),
+            }
+        }
+
+        let mut result = self.index_files(dir_path, files, &mut |_| {}).await?;
+        result.errors = errors;
+        result.duration = started.elapsed();
+        Ok(result)
+    }
+
+    /// Shows how a file would be chunked with the current settings, without
+    /// embedding or storing anything. With redaction enabled, byte ranges are
+    /// positions in the redacted content.
     ///
-    /// Converts the query to an embedding, searches for the top-k most similar
-    /// documents, and formats them as context that can be added to an LLM prompt.
+    /// # Errors
     ///
-    /// # Arguments
+    /// Returns an error if the file cannot be read.
+    pub async fn preview_chunks(&self, file_path: &Path) -> Result<Vec<ChunkPreview>> {
+        let content = tokio::fs::read_to_string(file_path)
+            .await
+            .map_err(|e| RagError::Indexer(indexer::IndexerError::Io(e)))?;
+
+        let chunks = self.indexer.chunk_file(file_path, &content);
+        Ok(preview_chunks(&self.indexer.redact(&content), &chunks))
+    }
+
+    /// Searches the knowledge base for the chunks most similar to a query.
     ///
-    /// * `query` - The question or text to find relevant context for
+    /// Converts the query to an embedding and returns the top-k matches, ordered
+    /// by descending similarity. Chunks below `rag.min_score` and duplicate
+    /// chunks are dropped. Returns an empty list if the knowledge base is empty.
+    /// Repeated queries with the same embedding are served from the cache.
     ///
-    /// # Returns
+    /// # Errors
     ///
-    /// A formatted string containing the most relevant document chunks, or an
-    /// empty string if the knowledge base is empty or no relevant documents exist.
+    /// Returns an error if embedding generation or the vector search fails.
+    pub async fn search(&self, query: &str) -> Result<Vec<SearchResult>> {
+        let (results, _) = self.search_with_trace(query).await?;
+        Ok(results)
+    }
+
+    /// Like [`search`](Self::search), but also returns a [`RetrievalTrace`]
+    /// listing every candidate, its score, and the stage that dropped it.
+    ///
+    /// The trace is also logged at debug level under `nucleus_core::rag`.
+    pub async fn search_with_trace(
+        &self,
+        query: &str,
+    ) -> Result<(Vec<SearchResult>, RetrievalTrace)> {
+        self.search_traced_with(query, &self.retrieval_settings())
+            .await
+    }
+
+    /// The query-time settings [`search`](Self::search) uses.
+    pub fn retrieval_settings(&self) -> RetrievalSettings {
+        RetrievalSettings {
+            top_k: self.top_k,
+            min_score: self.min_score,
+            candidate_multiplier: self.candidate_multiplier,
+            rerank: self.rerank,
+        }
+    }
+
+    /// Like [`search`](Self::search), but with the given settings instead of
+    /// the configured ones.
+    pub async fn search_with(
+        &self,
+        query: &str,
+        settings: &RetrievalSettings,
+    ) -> Result<Vec<SearchResult>> {
+        let (results, _) = self.search_traced_with(query, settings).await?;
+        Ok(results)
+    }
+
+    async fn search_traced_with(
+        &self,
+        query: &str,
+        settings: &RetrievalSettings,
+    ) -> Result<(Vec<SearchResult>, RetrievalTrace)> {
+        let (mut candidates, _) = self
+            .search_candidates(query, settings.candidate_limit(), true)
+            .await?;
+        if settings.rerank {
+            candidates = rerank::rerank(query, candidates);
+        }
+        let (results, trace) =
+            trace::filter_candidates(query, candidates, settings.min_score, settings.top_k);
+        trace.log();
+        Ok((results, trace))
+    }
+
+    /// Runs [`search`](Self::search) without the embedding or retrieval
+    /// caches and returns its results with how long embedding the query and
+    /// retrieving them took.
     ///
-    /// The format is:
-    /// ```text
+    /// Both are zero for an empty knowledge base, which skips retrieval.
+    pub async fn time_search(&self, query: &str) -> Result<(Vec<SearchResult>, SearchTimings)> {
+        let settings = self.retrieval_settings();
+        let (mut candidates, mut timings) = self
+            .search_candidates(query, settings.candidate_limit(), false)
+            .await?;
+
+        let started = std::time::Instant::now();
+        if settings.rerank {
+            candidates = rerank::rerank(query, candidates);
+        }
+        let (results, _) =
+            trace::filter_candidates(query, candidates, settings.min_score, settings.top_k);
+        timings.retrieval += started.elapsed();
+        Ok((results, timings))
+    }
+
+    /// Runs a query with two sets of settings and returns both result lists
+    /// for diffing.
     ///
-    /// Relevant context from your knowledge base:
+    /// # Example
     ///
-    /// [1] <first most relevant chunk>
-    /// [2] <second most relevant chunk>
-    /// ...
+    /// ```no_run
+    /// # use nucleus_core::rag::RagEngine;
+    /// # async fn example(engine: RagEngine) {
+    /// let current = engine.retrieval_settings();
+    /// let wider = current.with_top_k(current.top_k * 2);
+    /// let comparison = engine.compare("how is config loaded", &current, &wider).await.unwrap();
+    /// println!("{}", comparison);
+    /// # }
     /// ```
+    pub async fn compare(
+        &self,
+        query: &str,
+        first: &RetrievalSettings,
+        second: &RetrievalSettings,
+    ) -> Result<RetrievalComparison> {
+        let hits = |results: Vec<SearchResult>| results.iter().map(ComparedHit::from).collect();
+        Ok(RetrievalComparison {
+            query: query.to_string(),
+            settings: (*first, *second),
+            first: hits(self.search_with(query, first).await?),
+            second: hits(self.search_with(query, second).await?),
+        })
+    }
+
+    /// Embeds `text` as a query and summarizes the vector: its dimension
+    /// against the configured model's, its norm and its first components.
     ///
     /// # Errors
     ///
-    /// Returns an error if embedding generation fails.
+    /// Returns an error if embedding fails.
+    pub async fn inspect_embedding(&self, text: &str) -> Result<EmbeddingInfo> {
+        let embedding = self.embedder.embed_query(text).await?;
+        Ok(EmbeddingInfo::new(
+            self.embedder.model_id(),
+            self.embedder.dimension(),
+            &embedding,
+        ))
+    }
+
+    /// Saves a copy of every document under `label`, replacing an earlier
+    /// snapshot with that label. Returns the number of documents saved.
     ///
-    pub async fn retrieve_context(&self, query: &str) -> Result<String> {
+    /// # Errors
+    ///
+    /// Returns an error without a storage path (only embedded storage has
+    /// one), for a label that isn't a plain file name, or if the store can't
+    /// be read or the snapshot written.
+    pub async fn snapshot(&self, label: &str) -> Result<usize> {
+        let path = self.snapshot_path(label)?;
+        let documents = self
+            .store
+            .documents()
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        snapshot::write(&path, &documents)
+            .await
+            .map_err(|e| RagError::Snapshot(format!("{}: {}", path.display(), e)))?;
+        Ok(documents.len())
+    }
+
+    /// Replaces the knowledge base with the snapshot saved under `label`.
+    /// Returns the number of documents restored.
+    ///
+    /// # Errors
+    ///
+    /// Returns [`RagError::UnknownSnapshot`] if there is no such snapshot,
+    /// or an error if it can't be read or the store can't be rewritten. If
+    /// rewriting fails partway, the previous contents are put back.
+    pub async fn rollback(&self, label: &str) -> Result<usize> {
+        let path = self.snapshot_path(label)?;
+        if !path.exists() {
+            return Err(RagError::UnknownSnapshot(label.to_string()));
+        }
+        let documents = snapshot::read(&path)
+            .await
+            .map_err(|e| RagError::Snapshot(format!("{}: {}", path.display(), e)))?;
+        let previous = self
+            .store
+            .documents()
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+
+        if let Err(e) = self.replace_contents(&documents).await {
+            tracing::warn!("Rollback to '{}' failed, restoring the index: {}", label, e);
+            if let Err(restore) = self.replace_contents(&previous).await {
+                tracing::error!(
+                    "Could not restore the index after a failed rollback: {}",
+                    restore
+                );
+            }
+            return Err(e);
+        }
+        Ok(documents.len())
+    }
+
+    /// Clears the store and adds `documents` in batches.
+    async fn replace_contents(&self, documents: &[Document]) -> Result<()> {
+        let cleared = self.store.clear().await;
+        self.cache.invalidate();
+        cleared.map_err(|e| RagError::Retrieval(e.to_string()))?;
+
+        for batch in documents.chunks(BATCH_SIZE) {
+            self.add_documents(batch.to_vec()).await?;
+        }
+        Ok(())
+    }
+
+    /// Checks an export file, such as a snapshot from another machine,
+    /// against this engine's embedding dimension without importing it.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error only if the file can't be read; problems with its
+    /// content are listed in the report.
+    pub async fn validate_export(&self, path: &Path) -> Result<ExportReport> {
+        let json = tokio::fs::read(path)
+            .await
+            .map_err(|e| RagError::Snapshot(format!("{}: {}", path.display(), e)))?;
+        Ok(snapshot::validate(&json, self.embedder.dimension()))
+    }
+
+    /// Labels of the saved snapshots, sorted.
+    pub fn snapshots(&self) -> Vec<String> {
+        self.storage_path
+            .as_deref()
+            .map(snapshot::labels)
+            .unwrap_or_default()
+    }
+
+    fn snapshot_path(&self, label: &str) -> Result<PathBuf> {
+        let Some(storage_path) = &self.storage_path else {
+            return Err(RagError::Snapshot(
+                "snapshots are kept under the storage path, which only embedded storage has"
+                    .to_string(),
+            ));
+        };
+        if !snapshot::is_valid_label(label) {
+            return Err(RagError::Snapshot(format!(
+                "'{}' is not a valid label; use letters, digits, '-', '_' and '.'",
+                label
+            )));
+        }
+        Ok(snapshot::snapshot_path(storage_path, label))
+    }
+
+    /// Reports how much space the knowledge base takes up.
+    ///
+    /// The on-disk size is only measured for embedded storage.
+    pub async fn usage(&self) -> UsageReport {
+        let disk_bytes = self.storage_path.as_deref().map(usage::dir_size);
+        UsageReport::new(self.count().await, self.embedder.dimension(), disk_bytes)
+    }
+
+    /// Runs every query in a labeled set through [`search`](Self::search) and
+    /// scores the retrieved sources against the expected ones.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if any search fails.
+    pub async fn evaluate(&self, set: &LabeledSet) -> Result<EvalReport> {
+        let mut queries = Vec::with_capacity(set.queries.len());
+        for labeled in &set.queries {
+            let retrieved: Vec<String> = self
+                .search(&labeled.query)
+                .await?
+                .into_iter()
+                .filter_map(|result| result.document.metadata.get("source").cloned())
+                .collect();
+            queries.push(QueryEval::score(
+                &labeled.query,
+                &labeled.expected,
+                &retrieved,
+            ));
+        }
+
+        Ok(EvalReport {
+            k: self.top_k,
+            queries,
+        })
+    }
+
+    /// Like [`search`](Self::search), but only keeps results whose metadata
+    /// contains every key/value pair in `filter`.
+    ///
+    /// The filter is applied to the candidates before they are cut to
+    /// `top_k`, fetching more until the usual candidate pool is filled with
+    /// matches or the store has no more, so matches ranked below documents
+    /// that don't match are still found.
+    pub async fn search_where(
+        &self,
+        query: &str,
+        filter: &HashMap<String, String>,
+    ) -> Result<Vec<SearchResult>> {
+        let settings = self.retrieval_settings();
+        let pool = settings.candidate_limit();
+        let mut limit = pool;
+        loop {
+            let (candidates, _) = self.search_candidates(query, limit, true).await?;
+            let exhausted = candidates.len() < limit;
+            let mut matching: Vec<SearchResult> = candidates
+                .into_iter()
+                .filter(|result| {
+                    filter
+                        .iter()
+                        .all(|(key, value)| result.document.metadata.get(key) == Some(value))
+                })
+                .collect();
+
+            if matching.len() >= pool || exhausted {
+                matching.truncate(pool);
+                if settings.rerank {
+                    matching = rerank::rerank(query, matching);
+                }
+                let (results, _) =
+                    trace::filter_candidates(query, matching, settings.min_score, settings.top_k);
+                return Ok(results);
+            }
+            limit *= 2;
+        }
+    }
+
+    /// Attaches a `citation` metadata label to each result, as configured by
+    /// `rag.citations`, and with `rag.inline_metadata` a `location` such as
+    /// `src/main.rs:10-24` for [`format_context`] to head it with. Does
+    /// nothing when both are disabled.
+    ///
+    /// `allow_commands` gates `git blame`; pass whether execute permission
+    /// is granted.
+    pub async fn annotate_citations(&self, results: &mut [SearchResult], allow_commands: bool) {
+        let citations = self.citations.is_enabled();
+        if !citations && !self.inline_metadata {
+            return;
+        }
+
+        let now = SystemTime::now();
+        for result in results.iter_mut() {
+            let Some(citation) = cite(result, &self.citations, allow_commands).await else {
+                continue;
+            };
+            let metadata = &mut result.document.metadata;
+            if self.inline_metadata {
+                metadata.insert(
+                    "location".to_string(),
+                    citation.location(CitationAnchor::Range),
+                );
+            }
+            if citations {
+                metadata.insert(
+                    "citation".to_string(),
+                    citation.label(self.citations.anchor, now),
+                );
+            }
+        }
+    }
+
+    /// Raw vector search results for a query, before any filtering.
+    ///
+    /// `limit` candidates are fetched. Results are cached by embedding and
+    /// `limit` when `use_cache` is set. Without `use_cache` the query is
+    /// embedded afresh too, so the timings cover a real provider call. They
+    /// leave out the count checks that come first.
+    async fn search_candidates(
+        &self,
+        query: &str,
+        limit: usize,
+        use_cache: bool,
+    ) -> Result<(Vec<SearchResult>, SearchTimings)> {
         use tracing::{debug, info};
 
+        let mut timings = SearchTimings::default();
         let count = self.store.count().await.unwrap_or(0);
-        debug!("Knowledge base count: {}", count);
-        if count == 0 {
-            debug!("Knowledge base is empty, returning empty context");
-            return Ok(String::new());
+        let temporary = self.temporary_count().await;
+        debug!("Knowledge base count: {} (+{} temporary)", count, temporary);
+        if count == 0 && temporary == 0 {
+            debug!("Knowledge base is empty, returning no results");
+            return Ok((Vec::new(), timings));
         }
 
         debug!("Generating query embedding for: {}", query);
-        let query_embedding = self.embedder.embed(query).await?;
+        let started = std::time::Instant::now();
+        let query_embedding = if use_cache {
+            self.embedder.embed_query(query).await?
+        } else {
+            self.embedder.embed_query_uncached(query).await?
+        };
+        timings.embedding = started.elapsed();
         debug!(
             "Query embedding generated, dimension: {}",
             query_embedding.len()
         );
 
-        debug!("Searching vector store...");
-        let results = self
-            .store
-            .search(&query_embedding)
-            .await
-            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        if let Some(results) = self
+            .cache
+            .get(&query_embedding, limit)
+            .filter(|_| use_cache)
+        {
+            debug!("Serving {} results from the retrieval cache", results.len());
+            return Ok((results, timings));
+        }
 
-        info!("Found {} results from RAG search", results.len());
+        debug!("Searching vector store for {} candidates...", limit);
+        let started = std::time::Instant::now();
+        let mut results = if count > 0 {
+            self.store
+                .search(&query_embedding, limit)
+                .await
+                .map_err(|e| RagError::Retrieval(e.to_string()))?
+        } else {
+            Vec::new()
+        };
 
-        if results.is_empty() {
-            debug!("No results found, returning empty context");
-            return Ok(String::new());
+        if temporary > 0 {
+            results.extend(
+                self.session
+                    .search(&query_embedding, limit)
+                    .await
+                    .map_err(|e| RagError::Retrieval(e.to_string()))?,
+            );
+            results.sort_by(|a, b| {
+                b.score
+                    .partial_cmp(&a.score)
+                    .unwrap_or(std::cmp::Ordering::Equal)
+            });
+            results.truncate(limit);
         }
 
-        let mut context = String::from("\n\nRelevant context from your knowledge base:\n");
+        timings.retrieval = started.elapsed();
 
-        for (i, result) in results.iter().enumerate() {
-            debug!(
-                "Result {}: score={}, source={:?}",
-                i + 1,
-                result.score,
-                result.document.metadata.get("source")
-            );
-            context.push_str(&format!("\n[{}] {}\n", i + 1, result.document.content));
+        info!("Found {} results from RAG search", results.len());
+        if use_cache {
+            self.cache.insert(&query_embedding, limit, results.clone());
+        }
+        Ok((results, timings))
+    }
+
+    /// Retrieves relevant context from the knowledge base for a query.
+    ///
+    /// Runs [`search`](Self::search) and formats the results with [`format_context`]
+    /// so they can be added to an LLM prompt.
+    ///
+    /// # Arguments
+    ///
+    /// * `query` - The question or text to find relevant context for
+    ///
+    /// # Returns
+    ///
+    /// A formatted string containing the most relevant document chunks, or an
+    /// empty string if the knowledge base is empty or no relevant documents exist.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if embedding generation fails.
+    pub async fn retrieve_context(&self, query: &str) -> Result<String> {
+        let mut results = self.search(query).await?;
+        self.limit_context(&mut results);
+        Ok(format_context(&self.with_pinned(results)))
+    }
+
+    /// Pins a file so its content goes ahead of the retrieved context of
+    /// every prompt, see [`with_pinned`](Self::with_pinned).
+    ///
+    /// The file is read now; pin it again to pick up later edits.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the file cannot be read.
+    pub async fn pin(&self, path: &Path) -> Result<()> {
+        self.pinned
+            .pin(path)
+            .await
+            .map_err(|e| RagError::Indexer(indexer::IndexerError::Io(e)))
+    }
+
+    /// Unpins a source. Returns whether it was pinned.
+    pub fn unpin(&self, source: &str) -> bool {
+        self.pinned.unpin(source)
+    }
+
+    /// Sources of the pinned files, in the order they were pinned.
+    pub fn pinned_sources(&self) -> Vec<String> {
+        self.pinned.sources()
+    }
+
+    /// Puts the pinned documents ahead of retrieved `results`.
+    ///
+    /// Retrieved chunks of a pinned file are dropped, since the whole file is
+    /// already included. Pinned documents are marked so
+    /// [`PromptParts::trim_to_fit`](crate::chat::PromptParts::trim_to_fit)
+    /// drops them last.
+    pub fn with_pinned(&self, results: Vec<SearchResult>) -> Vec<SearchResult> {
+        self.pinned.prepend_to(results)
+    }
+
+    /// Drops the lowest-ranked results beyond `rag.max_context_docs`.
+    ///
+    /// Applied to the final selection for a prompt, after
+    /// [`search`](Self::search) has filtered and ranked its `top_k` results.
+    pub fn limit_context(&self, results: &mut Vec<SearchResult>) {
+        if let Some(max) = self.max_context_docs {
+            results.truncate(max);
         }
+    }
+
+    /// Like [`retrieve_context`](Self::retrieve_context), but returns the
+    /// chunks with their scores and metadata instead of a prompt block.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if embedding generation fails.
+    pub async fn retrieve_chunks(&self, query: &str) -> Result<Vec<RetrievedChunk>> {
+        let mut results = self.search(query).await?;
+        self.limit_context(&mut results);
+        Ok(self
+            .with_pinned(results)
+            .iter()
+            .map(RetrievedChunk::from)
+            .collect())
+    }
 
-        info!("Generated context with {} results", results.len());
-        Ok(context)
+    /// A hint to index something, returned for the first call made while
+    /// nothing is indexed or held as temporary knowledge.
+    ///
+    /// Returns `None` once there is content, after the notice was given, or
+    /// when `rag.empty_notice` is `silent`.
+    pub async fn empty_notice(&self) -> Option<&'static str> {
+        if self.empty_notice == EmptyNotice::Silent {
+            return None;
+        }
+        if self.count().await > 0 || self.session.count().await.unwrap_or(0) > 0 {
+            return None;
+        }
+        if self.empty_notice_sent.swap(true, Ordering::Relaxed) {
+            return None;
+        }
+        Some(EMPTY_NOTICE)
     }
 
     /// Returns the total number of documents (chunks) in the knowledge base.
@@ -457,13 +2111,49 @@ impl RagEngine {
         self.store.count().await.unwrap_or(0)
     }
 
-    /// Removes all documents from the knowledge base.
-    pub async fn clear(&self) -> Result<()> {
+    /// Returns the document with the given ID, without its embedding.
+    pub async fn get_document(&self, id: &str) -> Result<Option<Document>> {
         self.store
-            .clear()
+            .get(id)
             .await
-            .map_err(|e| RagError::Retrieval(e.to_string()))?;
-        Ok(())
+            .map_err(|e| RagError::Retrieval(e.to_string()))
+    }
+
+    /// Sets metadata keys on an indexed document, keeping its other keys.
+    ///
+    /// The document is updated in place; its content and embedding are left
+    /// alone.
+    ///
+    /// # Returns
+    ///
+    /// The updated document, or `None` if no document has that ID.
+    pub async fn retag(&self, id: &str, tags: &[(String, String)]) -> Result<Option<Document>> {
+        let Some(mut document) = self.get_document(id).await? else {
+            return Ok(None);
+        };
+
+        for (key, value) in tags {
+            document.metadata.insert(key.clone(), value.clone());
+        }
+
+        let updated = self
+            .store
+            .update_metadata(id, document.metadata.clone())
+            .await;
+        self.cache.invalidate();
+
+        match updated.map_err(|e| RagError::Retrieval(e.to_string()))? {
+            true => Ok(Some(document)),
+            false => Ok(None),
+        }
+    }
+
+    /// Removes all documents from the knowledge base.
+    pub async fn clear(&self) -> Result<()> {
+        let cleared = self.store.clear().await;
+        self.cache.invalidate();
+        self.indexed_roots.clear();
+        cleared.map_err(|e| RagError::Retrieval(e.to_string()))
     }
 
     /// Returns all unique file paths that have been indexed in the knowledge base.
@@ -477,13 +2167,139 @@ impl RagEngine {
             .map_err(|e| RagError::Retrieval(e.to_string()))
     }
 
-    /// Removes documents from the knowledge base by source path.
+    /// Every indexed source with the number of chunks stored for it, sorted
+    /// by source.
+    pub async fn source_chunk_counts(&self) -> Result<Vec<(String, usize)>> {
+        let counts = self
+            .store
+            .source_counts()
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+
+        let mut counts: Vec<(String, usize)> = counts.into_iter().collect();
+        counts.sort();
+        Ok(counts)
+    }
+
+    /// Re-embeds the stored chunks of `source` from their stored content, for
+    /// refreshing one file's vectors after the embedding model changes
+    /// without re-reading or re-chunking it.
     ///
-    /// This method removes all documents that match the given source path.
-    /// If the path is a directory, all files within that directory are removed.
-    /// If the path is a file, only that specific file is removed.
+    /// `source` must match the stored source exactly. Chunks keep their IDs
+    /// and metadata; other sources are left alone. The context line added by
+    /// `rag.contextual_chunks` is not, since it comes from the whole file.
     ///
-    /// # Arguments
+    /// # Returns
+    ///
+    /// The number of chunks re-embedded, `0` if nothing is stored for `source`.
+    pub async fn reembed_source(&self, source: &str) -> Result<usize> {
+        let mut documents = self
+            .store
+            .documents_by_source(source)
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        if documents.is_empty() {
+            return Ok(0);
+        }
+
+        let cwd = std::env::current_dir().ok();
+        let texts: Vec<String> = documents
+            .iter()
+            .map(|document| {
+                self.embedded_text(
+                    Path::new(source),
+                    cwd.as_deref(),
+                    None,
+                    None,
+                    &document.content,
+                )
+            })
+            .collect();
+        let texts: Vec<&str> = texts.iter().map(String::as_str).collect();
+        let embeddings = self.embedder.embed_documents(&texts).await?;
+
+        for (document, embedding) in documents.iter_mut().zip(embeddings) {
+            document.embedding = embedding;
+            if let Some(model) = document.metadata.get_mut("embedding_model") {
+                *model = self.embedder.model_id().to_string();
+            }
+        }
+
+        // Stores like LanceDB append rather than replace by ID, so the old
+        // chunks go first. They are only removed once the new vectors exist.
+        self.remove_stale_chunks(&[source.to_string()]).await?;
+        let count = documents.len();
+        let stored = self.store.add(documents).await;
+        self.cache.invalidate();
+        stored.map_err(|e| RagError::Retrieval(e.to_string()))?;
+        Ok(count)
+    }
+
+    /// Compares the content indexed for `source`, rebuilt from its chunks,
+    /// with the file on disk, to show how stale the index is for it.
+    ///
+    /// `source` is the path as it is stored. With redaction enabled the file
+    /// is redacted before comparing, like it was when indexed. Chunks left out
+    /// by `rag.indexer.skip_blank` can't be rebuilt, so blank lines they held
+    /// may be reported as added. Returns `None` if no chunks are stored for
+    /// `source`.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if the store can't be read or the file can't be read.
+    pub async fn diff_source(&self, source: &str) -> Result<Option<SourceDiff>> {
+        let mut chunks: Vec<Document> = self
+            .store
+            .documents_by_source(source)
+            .await
+            .map_err(|e| RagError::Retrieval(e.to_string()))?
+            .into_iter()
+            .filter(|document| !document.metadata.contains_key("path_document"))
+            .collect();
+        if chunks.is_empty() {
+            return Ok(None);
+        }
+        let chunk_index = |document: &Document| {
+            document
+                .metadata
+                .get("chunk")
+                .and_then(|chunk| chunk.parse::<usize>().ok())
+                .unwrap_or(0)
+        };
+        chunks.sort_by_key(chunk_index);
+
+        let content = tokio::fs::read_to_string(source)
+            .await
+            .map_err(|e| RagError::Indexer(indexer::IndexerError::Io(e)))?;
+        let hash = indexer::content_hash(&content);
+        let hash_matches = chunks
+            .iter()
+            .all(|chunk| chunk.metadata.get("content_hash") == Some(&hash));
+
+        let lines = if hash_matches {
+            Vec::new()
+        } else {
+            let indexed = source_diff::reconstruct(
+                chunks.iter().map(|chunk| chunk.content.as_str()),
+                self.indexer.chunk_overlap(),
+            );
+            source_diff::diff_lines(&indexed, &self.indexer.redact(&content))
+        };
+
+        Ok(Some(SourceDiff {
+            source: source.to_string(),
+            hash_matches,
+            lines,
+        }))
+    }
+
+    /// Removes documents from the knowledge base by source path.
+    ///
+    /// This method removes all documents that match the given source path.
+    /// If the path is a directory, all files within that directory are removed.
+    /// If the path is a file, only that specific file is removed.
+    ///
+    /// # Arguments
     ///
     /// * `source_path` - The file or directory path to remove from the knowledge base
     ///
@@ -510,11 +2326,9 @@ impl RagEngine {
     /// # }
     /// ```
     pub async fn remove_from_knowledge_base(&self, source_path: &str) -> Result<usize> {
-        let removed = self
-            .store
-            .remove_by_source(source_path)
-            .await
-            .map_err(|e| RagError::Retrieval(e.to_string()))?;
+        let removed = self.store.remove_by_source(source_path).await;
+        self.cache.invalidate();
+        let removed = removed.map_err(|e| RagError::Retrieval(e.to_string()))?;
 
         if removed > 0 {
             println!("Removed {} document chunks from: {}", removed, source_path);
@@ -525,3 +2339,2084 @@ impl RagEngine {
         Ok(removed)
     }
 }
+
+/// Formats search results as a context block for an LLM prompt.
+///
+/// Returns an empty string when there are no results. Otherwise the format is:
+/// ```text
+///
+/// Relevant context from your knowledge base:
+///
+/// [1] <first most relevant chunk>
+/// [2] <second most relevant chunk>
+/// ...
+/// ```
+///
+/// Results with a `location` (see [`RagEngine::annotate_citations`]) have it
+/// printed in brackets after their number, and results with a `citation`
+/// label have it printed in parentheses after that.
+pub fn format_context(results: &[SearchResult]) -> String {
+    use tracing::debug;
+
+    if results.is_empty() {
+        return String::new();
+    }
+
+    let mut context = String::from("\n\nRelevant context from your knowledge base:\n");
+
+    for (i, result) in results.iter().enumerate() {
+        debug!(
+            "Result {}: score={}, source={:?}",
+            i + 1,
+            result.score,
+            result.document.metadata.get("source")
+        );
+        let metadata = &result.document.metadata;
+        let mut header = format!("[{}]", i + 1);
+        if let Some(location) = metadata.get("location") {
+            header.push_str(&format!(" [{}]", location));
+        }
+        if let Some(citation) = metadata.get("citation") {
+            header.push_str(&format!(" ({})", citation));
+        }
+        if metadata.contains_key("location") || metadata.contains_key("citation") {
+            context.push_str(&format!("\n{}\n{}\n", header, result.document.content));
+        } else {
+            context.push_str(&format!("\n{} {}\n", header, result.document.content));
+        }
+    }
+
+    context
+}
+
+#[cfg(test)]
+mod tests {
+    use super::conversation::Conversations;
+    use super::testing::{test_engine, MemoryStore};
+    use super::{
+        format_context, DropReason, Embedder, IdCollision, IndexProgress, Indexer, JobState,
+        LabeledSet, RagError, RetrievalSettings, Summarizer, VectorStore,
+    };
+    use crate::config::{CitationAnchor, EmptyNotice, IdScheme, IndexerConfig, SimilarityMetric};
+    use crate::models::EmbeddingModel;
+    use crate::provider::testing::{ScaledProvider, ScriptedProvider};
+    use crate::provider::Message;
+    use std::collections::{HashMap, HashSet};
+    use std::sync::Arc;
+    use std::time::Duration;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_repeated_query_hits_cache() {
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine
+            .add_knowledge("The indexer splits files into chunks", "notes")
+            .await
+            .unwrap();
+
+        let first = engine.search("how are files chunked").await.unwrap();
+        let second = engine.search("how are files chunked").await.unwrap();
+
+        assert_eq!(store.searches(), 1);
+        assert_eq!(first.len(), second.len());
+        assert_eq!(first[0].document.id, second[0].document.id);
+    }
+
+    #[tokio::test]
+    async fn test_normalized_embeddings_give_bounded_dot_scores() {
+        let texts = [
+            "The indexer splits files into chunks",
+            "Chunks overlap by fifty bytes so context is not lost at the edges",
+        ];
+        let length = |v: &[f32]| v.iter().map(|x| x * x).sum::<f32>().sqrt();
+
+        for normalize in [false, true] {
+            let store = Arc::new(MemoryStore::new().with_similarity(SimilarityMetric::Dot));
+            let mut engine = test_engine(Arc::new(ScaledProvider), store.clone());
+            engine.embedder = engine.embedder.clone().with_normalization(normalize);
+            for (i, text) in texts.iter().enumerate() {
+                engine
+                    .add_knowledge(text, &format!("note{}", i))
+                    .await
+                    .unwrap();
+            }
+
+            let mut stored = Vec::new();
+            for id in store.ids() {
+                stored.push(store.get(&id).await.unwrap().unwrap().embedding);
+            }
+            let scores: Vec<f32> = engine
+                .search("how are chunks split")
+                .await
+                .unwrap()
+                .iter()
+                .map(|result| result.score)
+                .collect();
+            assert_eq!(scores.len(), 2);
+
+            if normalize {
+                assert!(stored.iter().all(|v| (length(v) - 1.0).abs() < 1e-5));
+                assert!(scores.iter().all(|s| (0.0..=1.0 + 1e-5).contains(s)));
+            } else {
+                assert!(stored.iter().all(|v| length(v) > 1.0));
+                assert!(scores.iter().any(|s| *s > 1.0));
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_adding_a_document_invalidates_cache() {
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine
+            .add_knowledge("The indexer splits files into chunks", "notes")
+            .await
+            .unwrap();
+
+        assert_eq!(engine.search("chunks").await.unwrap().len(), 1);
+
+        engine
+            .add_knowledge("Chunks overlap by fifty bytes", "more_notes")
+            .await
+            .unwrap();
+
+        assert_eq!(engine.search("chunks").await.unwrap().len(), 2);
+        assert_eq!(store.searches(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_warm_embeddings_caches_without_adding() {
+        let dir = tempdir().unwrap();
+        tokio::fs::write(dir.path().join("a.md"), "alpha notes")
+            .await
+            .unwrap();
+        tokio::fs::write(dir.path().join("b.md"), "beta notes")
+            .await
+            .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(provider.clone(), store.clone());
+
+        let chunks = engine.warm_embeddings(dir.path()).await.unwrap();
+
+        assert_eq!(chunks, 2);
+        assert_eq!(provider.embed_calls(), 2);
+        assert!(engine.embedder.is_cached("alpha notes"));
+        assert!(engine.embedder.is_cached("beta notes"));
+        assert_eq!(engine.count().await, 0);
+
+        engine.index_directory(dir.path()).await.unwrap();
+
+        assert_eq!(provider.embed_calls(), 2);
+        assert_eq!(engine.count().await, 2);
+    }
+
+    #[tokio::test]
+    async fn test_relpath_ids_match_across_roots() {
+        let mut ids = Vec::new();
+
+        for _ in 0..2 {
+            let dir = tempdir().unwrap();
+            tokio::fs::create_dir(dir.path().join("src")).await.unwrap();
+            tokio::fs::write(dir.path().join("src/lib.rs"), "pub mod rag;")
+                .await
+                .unwrap();
+
+            let store = Arc::new(MemoryStore::new());
+            let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+            engine.indexer = Indexer::new(IndexerConfig {
+                exclude_patterns: Vec::new(),
+                id_scheme: IdScheme::RelPath,
+                ..IndexerConfig::default()
+            });
+
+            engine.index_directory(dir.path()).await.unwrap();
+            ids.push(store.ids());
+        }
+
+        assert_eq!(ids[0], vec!["src/lib.rs_chunk_0".to_string()]);
+        assert_eq!(ids[0], ids[1]);
+    }
+
+    #[tokio::test]
+    async fn test_search_with_trace_reports_dropped_candidates() {
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store);
+        engine.min_score = Some(0.5);
+
+        engine
+            .add_knowledge("rust chunking code", "a.rs")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("rust chunking code", "b.rs")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("gardening tips", "c.md")
+            .await
+            .unwrap();
+
+        let (results, trace) = engine
+            .search_with_trace("rust chunking code")
+            .await
+            .unwrap();
+
+        assert_eq!(results.len(), 1);
+        assert_eq!(trace.candidates.len(), 3);
+        assert_eq!(trace.selected().count(), 1);
+
+        let reasons: Vec<_> = trace
+            .dropped()
+            .map(|c| (c.source.as_str(), c.dropped))
+            .collect();
+        assert!(reasons.contains(&("c.md", Some(DropReason::BelowThreshold { min_score: 0.5 }))));
+        assert!(reasons
+            .iter()
+            .any(|(source, reason)| *reason == Some(DropReason::Duplicate)
+                && (*source == "a.rs" || *source == "b.rs")));
+    }
+
+    #[tokio::test]
+    async fn test_filtered_search_finds_matches_ranked_below_top_k() {
+        let mut engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine.top_k = 1;
+        engine.candidate_multiplier = 1;
+        for (content, source) in [
+            ("tokens", "a.md"),
+            ("tokens and words", "b.md"),
+            ("tokens split into words by the tokenizer", "c.md"),
+        ] {
+            engine.add_knowledge(content, source).await.unwrap();
+        }
+
+        let filter = HashMap::from([("source".to_string(), "c.md".to_string())]);
+        let results = engine.search_where("tokens", &filter).await.unwrap();
+
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].document.metadata.get("source").unwrap(), "c.md");
+    }
+
+    #[tokio::test]
+    async fn test_retag_updates_metadata_used_by_filtered_search() {
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store);
+
+        engine
+            .add_knowledge("rust chunking code", "a.rs")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("rust chunking notes", "b.md")
+            .await
+            .unwrap();
+
+        let filter = HashMap::from([("team".to_string(), "search".to_string())]);
+        assert!(engine
+            .search_where("rust chunking", &filter)
+            .await
+            .unwrap()
+            .is_empty());
+
+        let updated = engine
+            .retag("a.rs_0", &[("team".to_string(), "search".to_string())])
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(updated.metadata.get("source").unwrap(), "a.rs");
+
+        let document = engine.get_document("a.rs_0").await.unwrap().unwrap();
+        assert_eq!(document.metadata.get("team").unwrap(), "search");
+        assert_eq!(document.content, "rust chunking code");
+
+        let results = engine.search_where("rust chunking", &filter).await.unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].document.id, "a.rs_0");
+
+        assert!(engine
+            .retag("missing", &[("team".to_string(), "search".to_string())])
+            .await
+            .unwrap()
+            .is_none());
+    }
+
+    #[tokio::test]
+    async fn test_empty_notice_given_once_while_nothing_is_indexed() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        assert!(engine.empty_notice().await.unwrap().contains("index"));
+        assert_eq!(engine.clone().empty_notice().await, None);
+
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine.add_knowledge("notes", "notes.md").await.unwrap();
+        assert_eq!(engine.empty_notice().await, None);
+
+        let mut engine = test_engine(provider, Arc::new(MemoryStore::new()));
+        engine.empty_notice = EmptyNotice::Silent;
+        assert_eq!(engine.empty_notice().await, None);
+    }
+
+    #[tokio::test]
+    async fn test_max_context_docs_caps_prompt_below_top_k() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let mut engine = test_engine(provider, Arc::new(MemoryStore::new()));
+        engine.top_k = 10;
+        engine.max_context_docs = Some(2);
+        for (content, source) in [
+            ("the tokenizer splits words into tokens", "src/tokenizer.rs"),
+            ("the vector store saves embeddings to disk", "src/store.rs"),
+            ("yaml config parsing and defaults", "src/config.rs"),
+            ("the indexer walks directories for files", "src/indexer.rs"),
+        ] {
+            engine.add_knowledge(content, source).await.unwrap();
+        }
+
+        assert_eq!(engine.search("tokens").await.unwrap().len(), 4);
+        let context = engine.retrieve_context("tokens").await.unwrap();
+        assert!(context.contains("\n[2] "));
+        assert!(!context.contains("\n[3] "));
+    }
+
+    #[tokio::test]
+    async fn test_retrieve_context_from_empty_knowledge_base_is_empty() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider, Arc::new(MemoryStore::new()));
+
+        let context = engine.retrieve_context("tokens").await.unwrap();
+
+        assert!(context.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_evaluate_labeled_set_against_seeded_corpus() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let mut engine = test_engine(provider, Arc::new(MemoryStore::new()));
+        engine.top_k = 1;
+        for (content, source) in [
+            ("the tokenizer splits words into tokens", "src/tokenizer.rs"),
+            ("the vector store saves embeddings to disk", "src/store.rs"),
+            ("yaml config parsing and defaults", "src/config.rs"),
+        ] {
+            engine.add_knowledge(content, source).await.unwrap();
+        }
+
+        let set = LabeledSet::from_json(
+            r#"{
+                "the tokenizer splits words into tokens": ["tokenizer.rs", "store.rs"],
+                "yaml config parsing and defaults": "config.rs",
+                "the vector store saves embeddings to disk": "config.rs"
+            }"#,
+        )
+        .unwrap();
+
+        let report = engine.evaluate(&set).await.unwrap();
+
+        // Recall: (0.5 + 1 + 0) / 3. Reciprocal ranks: (1 + 1 + 0) / 3.
+        assert_eq!(report.k, 1);
+        assert!((report.recall_at_k() - 0.5).abs() < 1e-9);
+        assert!((report.mrr() - 2.0 / 3.0).abs() < 1e-9);
+    }
+
+    #[tokio::test]
+    async fn test_usage_reports_seeded_collection() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let mut engine = test_engine(provider, Arc::new(MemoryStore::new()));
+        for i in 0..3 {
+            engine
+                .add_knowledge(&format!("note {}", i), "notes.md")
+                .await
+                .unwrap();
+        }
+
+        let usage = engine.usage().await;
+        let dimension = EmbeddingModel::default().embedding_dim;
+        assert_eq!(usage.documents, 3);
+        assert_eq!(usage.dimension, dimension);
+        assert_eq!(usage.vector_bytes, (3 * dimension * 4) as u64);
+        assert_eq!(usage.disk_bytes, None);
+
+        let dir = tempdir().unwrap();
+        std::fs::write(dir.path().join("data.lance"), [0; 256]).unwrap();
+        engine.storage_path = Some(dir.path().to_path_buf());
+        assert_eq!(engine.usage().await.disk_bytes, Some(256));
+    }
+
+    #[tokio::test]
+    async fn test_temporary_knowledge_is_searched_but_not_persisted() {
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine
+            .add_knowledge("persistent rust notes", "notes")
+            .await
+            .unwrap();
+        engine
+            .add_temporary("pasted deployment checklist", "paste")
+            .await
+            .unwrap();
+
+        let results = engine.search("deployment checklist").await.unwrap();
+        assert_eq!(results[0].document.content, "pasted deployment checklist");
+        assert_eq!(
+            results[0].document.metadata.get("temporary").unwrap(),
+            "true"
+        );
+        assert_eq!(engine.count().await, 1);
+        assert_eq!(store.ids(), vec!["notes_0".to_string()]);
+
+        // A restarted engine over the same store has no temporary knowledge.
+        let restarted = test_engine(Arc::new(ScriptedProvider::default()), store);
+        let results = restarted.search("deployment checklist").await.unwrap();
+        assert!(results
+            .iter()
+            .all(|r| r.document.content != "pasted deployment checklist"));
+
+        engine.clear_temporary().await.unwrap();
+        assert_eq!(engine.temporary_count().await, 0);
+        let results = engine.search("deployment checklist").await.unwrap();
+        assert!(results
+            .iter()
+            .all(|r| r.document.content != "pasted deployment checklist"));
+    }
+
+    #[tokio::test]
+    async fn test_turns_are_recalled_only_in_their_conversation() {
+        let engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine
+            .remember_turn("alice", "user", "Deploys go to the aurora cluster")
+            .await
+            .unwrap();
+
+        let alice = engine
+            .recall_turns("alice", "which cluster do deploys go to", 3)
+            .await
+            .unwrap();
+        let bob = engine
+            .recall_turns("bob", "which cluster do deploys go to", 3)
+            .await
+            .unwrap();
+
+        assert_eq!(alice.len(), 1);
+        assert!(bob.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_oldest_turns_are_dropped_beyond_max_turns() {
+        let mut engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine.conversations = Arc::new(Conversations::new(SimilarityMetric::Cosine, 2));
+
+        let turns = [
+            "deploys go to aurora",
+            "tests run nightly",
+            "docs live in the wiki",
+        ];
+        futures::future::join_all(
+            turns
+                .iter()
+                .map(|turn| engine.remember_turn("team", "user", turn)),
+        )
+        .await;
+        engine
+            .remember_turn("team", "assistant", "releases ship on fridays")
+            .await
+            .unwrap();
+
+        let recalled = engine
+            .recall_turns("team", "deploys tests docs releases", 10)
+            .await
+            .unwrap();
+        let mut ids: Vec<_> = recalled
+            .iter()
+            .map(|turn| turn.document.id.as_str())
+            .collect();
+        ids.sort();
+        assert_eq!(recalled.len(), 2);
+        assert!(ids.contains(&"turn:3"), "{:?}", ids);
+        assert_ne!(ids[0], ids[1]);
+    }
+
+    #[tokio::test]
+    async fn test_yaml_files_index_by_top_level_key() {
+        let dir = tempdir().unwrap();
+        tokio::fs::write(
+            dir.path().join("config.yaml"),
+            "llm:\n  model: qwen3:8b\nstorage:\n  mode: embedded\n  top_k: 5\n",
+        )
+        .await
+        .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store);
+        engine.index_directory(dir.path()).await.unwrap();
+
+        let results = engine.search("storage mode embedded").await.unwrap();
+        let key_paths: Vec<_> = results
+            .iter()
+            .filter_map(|r| r.document.metadata.get("key_path").map(String::as_str))
+            .collect();
+
+        assert_eq!(results.len(), 2);
+        assert_eq!(key_paths[0], "storage");
+        assert!(key_paths.contains(&"llm"));
+    }
+
+    #[tokio::test]
+    async fn test_compare_profiles_differing_in_top_k() {
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        for i in 0..6 {
+            engine
+                .add_knowledge(&format!("config loading step {}", i), &format!("{}.md", i))
+                .await
+                .unwrap();
+        }
+
+        let narrow = RetrievalSettings {
+            top_k: 2,
+            min_score: None,
+            candidate_multiplier: 1,
+            rerank: false,
+        };
+        let wide = narrow.with_top_k(4);
+        let comparison = engine
+            .compare("config loading", &narrow, &wide)
+            .await
+            .unwrap();
+
+        assert_eq!(store.search_limits(), vec![2, 4]);
+        assert_eq!(comparison.first.len(), 2);
+        assert_eq!(comparison.second.len(), 4);
+        assert_eq!(comparison.first[..], comparison.second[..2]);
+        assert!(comparison.only_in_first().is_empty());
+        assert_eq!(
+            comparison.only_in_second(),
+            comparison.second[2..].iter().collect::<Vec<_>>()
+        );
+        assert!(!comparison.is_same());
+        assert!(engine
+            .compare("config loading", &wide, &wide)
+            .await
+            .unwrap()
+            .is_same());
+    }
+
+    #[tokio::test]
+    async fn test_summary_index_embeds_summary_but_returns_raw_chunk() {
+        let dir = tempdir().unwrap();
+        let code = "fn load(path: &Path) -> Config { serde_yaml::from_str(&read(path)) }";
+        tokio::fs::write(dir.path().join("config.rs"), code)
+            .await
+            .unwrap();
+
+        let summary = "Reads the settings file from disk and parses it as YAML";
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None, summary,
+        )]));
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(provider.clone(), store.clone())
+            .with_summarizer(Summarizer::new(provider.clone(), "chat-model"));
+
+        engine.index_directory(dir.path()).await.unwrap();
+
+        assert_eq!(provider.embedded_texts(), vec![summary]);
+        assert_eq!(provider.requests()[0].model, "chat-model");
+        assert_eq!(provider.requests()[0].messages[1].content, code);
+
+        let results = engine.search("where are settings parsed").await.unwrap();
+        assert_eq!(results[0].document.content, code);
+        assert_eq!(results[0].document.metadata["summary"], summary);
+        assert!(format_context(&results).contains(code));
+    }
+
+    #[tokio::test]
+    async fn test_summary_index_applies_to_single_files() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("config.rs");
+        let code = "fn load(path: &Path) -> Config { serde_yaml::from_str(&read(path)) }";
+        tokio::fs::write(&path, code).await.unwrap();
+
+        let summary = "Reads the settings file from disk and parses it as YAML";
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None, summary,
+        )]));
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(provider.clone(), store.clone())
+            .with_summarizer(Summarizer::new(provider.clone(), "chat-model"));
+
+        engine.index_file(path.to_str().unwrap()).await.unwrap();
+
+        assert_eq!(provider.embedded_texts(), vec![summary]);
+        let stored = store.get(&store.ids()[0]).await.unwrap().unwrap();
+        assert_eq!(stored.content, code);
+        assert_eq!(stored.metadata["summary"], summary);
+    }
+
+    #[tokio::test]
+    async fn test_candidate_pool_is_top_k_times_multiplier() {
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.top_k = 2;
+        engine.candidate_multiplier = 3;
+
+        for i in 0..8 {
+            engine
+                .add_knowledge(&format!("rust chunk number {}", i), &format!("{}.rs", i))
+                .await
+                .unwrap();
+        }
+
+        let (results, trace) = engine.search_with_trace("rust chunk").await.unwrap();
+
+        assert_eq!(store.search_limits(), vec![6]);
+        assert_eq!(trace.candidates.len(), 6);
+        assert_eq!(results.len(), 2);
+        assert_eq!(
+            trace
+                .dropped()
+                .filter(|c| c.dropped == Some(DropReason::BeyondTopK { top_k: 2 }))
+                .count(),
+            4
+        );
+
+        engine.candidate_multiplier = 1;
+        engine.cache.invalidate();
+        engine.search("rust chunk").await.unwrap();
+        assert_eq!(store.search_limits(), vec![6, 2]);
+    }
+
+    #[tokio::test]
+    async fn test_directory_over_max_files_needs_force() {
+        let dir = tempdir().unwrap();
+        for name in ["a.md", "b.md", "c.md"] {
+            tokio::fs::write(dir.path().join(name), format!("notes in {}", name))
+                .await
+                .unwrap();
+        }
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            max_files: 2,
+            ..IndexerConfig::default()
+        });
+
+        let err = engine.index_directory(dir.path()).await.unwrap_err();
+        assert!(matches!(err, RagError::TooManyFiles { count: 3, limit: 2 }));
+        assert_eq!(store.count().await.unwrap(), 0);
+
+        let indexed = engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap();
+        assert_eq!(indexed.files_indexed, 3);
+    }
+
+    #[tokio::test]
+    async fn test_directory_under_max_files_indexes_normally() {
+        let dir = tempdir().unwrap();
+        tokio::fs::write(dir.path().join("a.md"), "only file")
+            .await
+            .unwrap();
+        tokio::fs::write(dir.path().join("b.md"), "second file")
+            .await
+            .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            max_files: 2,
+            ..IndexerConfig::default()
+        });
+
+        assert_eq!(engine.check_file_count(dir.path()).await.unwrap(), 2);
+        assert_eq!(
+            engine
+                .index_directory(dir.path())
+                .await
+                .unwrap()
+                .files_indexed,
+            2
+        );
+        assert_eq!(store.count().await.unwrap(), 2);
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_index_result_counts_skipped_and_failed_files() {
+        let dir = tempdir().unwrap();
+        let write = |name: &str, content: &[u8]| std::fs::write(dir.path().join(name), content);
+        write("a.md", b"first file").unwrap();
+        write("b.md", b"second file").unwrap();
+        write("empty.md", b"").unwrap();
+        write("image.md", &[0xff, 0xfe, 0x00, 0x9f]).unwrap();
+        std::os::unix::fs::symlink(dir.path().join("missing.md"), dir.path().join("gone.md"))
+            .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            ..IndexerConfig::default()
+        });
+
+        let result = engine.index_directory(dir.path()).await.unwrap();
+
+        assert_eq!(result.files_indexed, 2);
+        assert_eq!(result.files_skipped, 2);
+        assert_eq!(result.chunks_added, 2);
+        assert_eq!(result.errors.len(), 1);
+        assert_eq!(result.errors[0].path, dir.path().join("gone.md"));
+        assert_eq!(store.count().await.unwrap(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_contextual_chunks_embed_the_enclosing_signature() {
+        let dir = tempdir().unwrap();
+        let signature = "fn load_configs() {";
+        let body = ["    let a = read();\n", "    let b = pars();\n", "}\n"];
+        tokio::fs::write(
+            dir.path().join("config.rs"),
+            format!("{}\n{}", signature, body.concat()),
+        )
+        .await
+        .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let mut engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            chunk_size: 20,
+            chunk_overlap: 0,
+            ..IndexerConfig::default()
+        });
+        engine.contextual_chunks = true;
+        engine.index_directory(dir.path()).await.unwrap();
+
+        let embedded = provider.embedded_texts();
+        assert!(embedded.contains(&format!("{}\n", signature)));
+        for chunk in body {
+            assert!(embedded.contains(&format!("{}\n{}", signature, chunk)));
+        }
+
+        let mut stored: Vec<String> = engine
+            .search("read pars")
+            .await
+            .unwrap()
+            .into_iter()
+            .map(|result| result.document.content)
+            .collect();
+        stored.sort();
+        let mut expected: Vec<String> = body.iter().map(|chunk| chunk.to_string()).collect();
+        expected.push(format!("{}\n", signature));
+        expected.sort();
+        assert_eq!(stored, expected);
+    }
+
+    /// A store of its own, as a caller of [`RagEngine::with_store`] would write.
+    #[derive(Default)]
+    struct ListStore {
+        documents: std::sync::Mutex<Vec<super::Document>>,
+    }
+
+    #[async_trait::async_trait]
+    impl VectorStore for ListStore {
+        async fn add(&self, documents: Vec<super::Document>) -> anyhow::Result<()> {
+            let mut stored = self.documents.lock().unwrap();
+            for document in documents {
+                stored.retain(|existing| existing.id != document.id);
+                stored.push(document);
+            }
+            Ok(())
+        }
+
+        async fn search(
+            &self,
+            query_embedding: &[f32],
+            limit: usize,
+        ) -> anyhow::Result<Vec<super::SearchResult>> {
+            let mut results: Vec<_> = self
+                .documents
+                .lock()
+                .unwrap()
+                .iter()
+                .map(|document| super::SearchResult {
+                    score: document
+                        .embedding
+                        .iter()
+                        .zip(query_embedding)
+                        .map(|(a, b)| a * b)
+                        .sum(),
+                    document: document.clone(),
+                })
+                .collect();
+            results.sort_by(|a, b| b.score.total_cmp(&a.score));
+            results.truncate(limit);
+            Ok(results)
+        }
+
+        async fn count(&self) -> anyhow::Result<usize> {
+            Ok(self.documents.lock().unwrap().len())
+        }
+
+        async fn clear(&self) -> anyhow::Result<()> {
+            self.documents.lock().unwrap().clear();
+            Ok(())
+        }
+
+        async fn get_indexed_paths(&self) -> anyhow::Result<Vec<String>> {
+            Ok(self
+                .documents
+                .lock()
+                .unwrap()
+                .iter()
+                .filter_map(|document| document.metadata.get("source").cloned())
+                .collect())
+        }
+
+        async fn remove_by_source(&self, source_path: &str) -> anyhow::Result<usize> {
+            let mut stored = self.documents.lock().unwrap();
+            let before = stored.len();
+            stored.retain(|document| {
+                document.metadata.get("source").map(String::as_str) != Some(source_path)
+            });
+            Ok(before - stored.len())
+        }
+
+        async fn get(&self, id: &str) -> anyhow::Result<Option<super::Document>> {
+            Ok(self
+                .documents
+                .lock()
+                .unwrap()
+                .iter()
+                .find(|document| document.id == id)
+                .cloned())
+        }
+
+        async fn update_metadata(
+            &self,
+            id: &str,
+            metadata: HashMap<String, String>,
+        ) -> anyhow::Result<bool> {
+            let mut stored = self.documents.lock().unwrap();
+            match stored.iter_mut().find(|document| document.id == id) {
+                Some(document) => {
+                    document.metadata = metadata;
+                    Ok(true)
+                }
+                None => Ok(false),
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_engine_drives_a_custom_vector_store() {
+        let store = Arc::new(ListStore::default());
+        let config = crate::Config::default().with_rag_config(crate::config::RagConfig::default());
+        let engine = super::RagEngine::with_store(
+            &config,
+            Arc::new(ScriptedProvider::default()),
+            store.clone(),
+        )
+        .await
+        .unwrap();
+
+        engine
+            .add_knowledge("tokio channels carry chat events", "events.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("lancedb keeps vectors on disk", "storage.md")
+            .await
+            .unwrap();
+        assert_eq!(store.count().await.unwrap(), 2);
+
+        let results = engine.search("which channels carry events").await.unwrap();
+        assert_eq!(results[0].document.metadata["source"], "events.md");
+
+        assert_eq!(
+            engine
+                .remove_from_knowledge_base("events.md")
+                .await
+                .unwrap(),
+            1
+        );
+        let results = engine.search("which channels carry events").await.unwrap();
+        assert!(results
+            .iter()
+            .all(|result| result.document.metadata["source"] == "storage.md"));
+        assert_eq!(engine.count().await, 1);
+    }
+
+    #[tokio::test]
+    async fn test_background_index_is_searchable_while_adding_documents() {
+        let dir = tempdir().unwrap();
+        for i in 0..20 {
+            tokio::fs::write(
+                dir.path().join(format!("module{:02}.txt", i)),
+                format!("background indexed module number {}", i),
+            )
+            .await
+            .unwrap();
+        }
+
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        let id = engine.index_in_background(dir.path());
+        engine
+            .add_knowledge("added while indexing runs", "notes.md")
+            .await
+            .unwrap();
+
+        let job = tokio::time::timeout(Duration::from_secs(10), async {
+            loop {
+                let job = engine
+                    .index_jobs()
+                    .into_iter()
+                    .find(|job| job.id == id)
+                    .unwrap();
+                if !job.is_running() {
+                    return job;
+                }
+                tokio::time::sleep(Duration::from_millis(10)).await;
+            }
+        })
+        .await
+        .unwrap();
+
+        match &job.state {
+            JobState::Finished(result) => assert_eq!(result.files_indexed, 20),
+            other => panic!("job did not finish: {:?}", other),
+        }
+        assert!(job.to_string().starts_with("#1 "));
+        assert_eq!(store.count().await.unwrap(), 21);
+        let results = engine.search("added while indexing").await.unwrap();
+        assert_eq!(results[0].document.metadata["source"], "notes.md");
+    }
+
+    #[tokio::test]
+    async fn test_indexed_chunks_cite_their_first_line() {
+        let dir = tempdir().unwrap();
+        let lines: String = (1..=6).map(|i| format!("line {}\n", i)).collect();
+        tokio::fs::write(dir.path().join("notes.txt"), lines)
+            .await
+            .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            chunk_size: 14,
+            chunk_overlap: 0,
+            ..IndexerConfig::default()
+        });
+        engine.citations.anchor = CitationAnchor::Line;
+        engine.index_directory(dir.path()).await.unwrap();
+
+        let mut results = engine.search("line").await.unwrap();
+        engine.annotate_citations(&mut results, false).await;
+
+        let source = dir.path().join("notes.txt").display().to_string();
+        assert!(!results.is_empty());
+        for result in &results {
+            let metadata = &result.document.metadata;
+            let first = result.document.content.split_whitespace().nth(1).unwrap();
+            assert_eq!(metadata["start_line"], first);
+            assert_eq!(metadata["citation"], format!("{}:{}", source, first));
+        }
+    }
+
+    #[tokio::test]
+    async fn test_inline_metadata_heads_each_context_entry() {
+        let dir = tempdir().unwrap();
+        let lines: String = (1..=6).map(|i| format!("line {}\n", i)).collect();
+        tokio::fs::write(dir.path().join("notes.txt"), lines)
+            .await
+            .unwrap();
+
+        let mut engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            chunk_size: 14,
+            chunk_overlap: 0,
+            ..IndexerConfig::default()
+        });
+        engine.inline_metadata = true;
+        engine.index_directory(dir.path()).await.unwrap();
+
+        let mut results = engine.search("line").await.unwrap();
+        engine.annotate_citations(&mut results, false).await;
+        let context = format_context(&results);
+
+        let source = dir.path().join("notes.txt").display().to_string();
+        assert_eq!(results.len(), 3);
+        for (i, result) in results.iter().enumerate() {
+            let metadata = &result.document.metadata;
+            assert!(!metadata.contains_key("citation"));
+            let header = format!(
+                "[{}] [{}:{}-{}]\n{}",
+                i + 1,
+                source,
+                metadata["start_line"],
+                metadata["end_line"],
+                result.document.content
+            );
+            assert!(
+                context.contains(&header),
+                "missing {:?} in {}",
+                header,
+                context
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn test_progress_reports_chunks_within_a_large_file() {
+        let dir = tempdir().unwrap();
+        let large: String = (0..100).map(|i| format!("chunk{:04} ", i)).collect();
+        tokio::fs::write(dir.path().join("large.txt"), large)
+            .await
+            .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            chunk_size: 10,
+            chunk_overlap: 0,
+            ..IndexerConfig::default()
+        });
+
+        let mut events = Vec::new();
+        let result = engine
+            .index_directory_with_progress(dir.path(), |progress| events.push(progress))
+            .await
+            .unwrap();
+        assert_eq!(result.chunks_added, 100);
+
+        let path = dir.path().join("large.txt");
+        let chunks = |embedded| IndexProgress::Chunks {
+            path: path.clone(),
+            embedded,
+            total: 100,
+        };
+        assert_eq!(
+            events,
+            vec![
+                IndexProgress::File {
+                    path: path.clone(),
+                    index: 1,
+                    total: 1,
+                },
+                chunks(32),
+                chunks(64),
+                chunks(96),
+            ]
+        );
+        assert_eq!(
+            events[1].to_string(),
+            format!("{}: 32/100 chunks", path.display())
+        );
+    }
+
+    #[tokio::test]
+    async fn test_verify_reports_and_repairs_drift() {
+        let dir = tempdir().unwrap();
+        let write = |name: &str, content: &str| std::fs::write(dir.path().join(name), content);
+        write("a.md", "alpha notes").unwrap();
+        write("b.md", "beta notes").unwrap();
+        write("c.md", "gamma notes").unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.index_directory(dir.path()).await.unwrap();
+        assert!(engine.verify(dir.path()).await.unwrap().is_clean());
+
+        write("b.md", "beta notes, edited").unwrap();
+        std::fs::remove_file(dir.path().join("c.md")).unwrap();
+        write("d.md", "delta notes").unwrap();
+
+        let report = engine.verify(dir.path()).await.unwrap();
+        assert_eq!(report.checked, 3);
+        assert_eq!(
+            report.missing,
+            vec![dir.path().join("c.md").to_string_lossy().to_string()]
+        );
+        assert_eq!(report.unindexed, vec![dir.path().join("d.md")]);
+        assert_eq!(report.changed, vec![dir.path().join("b.md")]);
+
+        let repaired = engine.repair(dir.path(), &report).await.unwrap();
+        assert_eq!(repaired.files_indexed, 2);
+        assert!(engine.verify(dir.path()).await.unwrap().is_clean());
+        assert_eq!(store.count().await.unwrap(), 3);
+    }
+
+    #[tokio::test]
+    async fn test_which_collection_reports_top_score_per_collection() {
+        let engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        )
+        .with_collection(
+            "code",
+            Embedder::new(
+                Arc::new(ScriptedProvider::default()),
+                EmbeddingModel::default(),
+            ),
+            Arc::new(MemoryStore::new()),
+        )
+        .with_collection(
+            "prose",
+            Embedder::new(
+                Arc::new(ScriptedProvider::default()),
+                EmbeddingModel::default(),
+            ),
+            Arc::new(MemoryStore::new()),
+        );
+        let code = engine.collection("code").unwrap();
+        code.add_knowledge("fn load_config reads the config file", "config.rs")
+            .await
+            .unwrap();
+        code.add_knowledge("fn main starts the server", "main.rs")
+            .await
+            .unwrap();
+        engine
+            .collection("prose")
+            .unwrap()
+            .add_knowledge("Deploys run every Friday afternoon", "deploy.md")
+            .await
+            .unwrap();
+
+        let query = "fn load_config reads the config file";
+        let matches = engine.which_collection(query).await.unwrap();
+
+        let names: Vec<&str> = matches.iter().map(|m| m.collection.as_str()).collect();
+        assert_eq!(names, vec!["code", "prose"]);
+        let expected = code.search(query).await.unwrap()[0].score;
+        assert_eq!(matches[0].top_score, Some(expected));
+        assert_eq!(matches[0].top_source.as_deref(), Some("config.rs"));
+        assert!(matches[1].top_score.unwrap() < expected);
+        assert_eq!(matches[1].top_source.as_deref(), Some("deploy.md"));
+    }
+
+    #[tokio::test]
+    async fn test_collections_embed_with_their_own_model() {
+        // One provider serves every collection, as in a real engine, so the
+        // model has to come from each embedding call.
+        let provider = Arc::new(ScriptedProvider::default());
+        let prose_store = Arc::new(MemoryStore::new());
+        let model = |id: &str| EmbeddingModel {
+            id: id.to_string(),
+            ..EmbeddingModel::default()
+        };
+
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()))
+            .with_collection(
+                "code",
+                Embedder::new(provider.clone(), model("code-embed")),
+                Arc::new(MemoryStore::new()),
+            )
+            .with_collection(
+                "prose",
+                Embedder::new(provider.clone(), model("prose-embed")),
+                prose_store.clone(),
+            );
+        assert_eq!(engine.collection_names(), vec!["code", "prose"]);
+
+        let code = engine.collection("code").unwrap();
+        let prose = engine.collection("prose").unwrap();
+        code.add_knowledge("fn load_config() reads the file", "config.rs")
+            .await
+            .unwrap();
+        prose
+            .add_knowledge("The config is loaded at startup", "guide.md")
+            .await
+            .unwrap();
+
+        let results = prose.search("when is the config loaded").await.unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].document.metadata["source"], "guide.md");
+        assert_eq!(
+            results[0].document.metadata["embedding_model"],
+            "prose-embed"
+        );
+
+        assert_eq!(
+            provider.embedded_texts(),
+            vec![
+                "fn load_config() reads the file",
+                "The config is loaded at startup",
+                "when is the config loaded"
+            ]
+        );
+        assert_eq!(
+            provider.embedding_models(),
+            vec!["code-embed", "prose-embed", "prose-embed"]
+        );
+        assert_eq!(prose_store.count().await.unwrap(), 1);
+        assert_eq!(engine.count().await, 0);
+        assert!(matches!(
+            engine.collection("images"),
+            Err(RagError::UnknownCollection(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_preview_matches_indexed_chunks_without_storing() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("notes.md");
+        let content: String = (0..60)
+            .map(|i| format!("Note {} about chunking.\n", i))
+            .collect();
+        tokio::fs::write(&path, &content).await.unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+
+        let previews = engine.preview_chunks(&path).await.unwrap();
+        let chunks = engine.indexer.chunk_file(&path, &content);
+        assert!(chunks.len() > 1);
+        assert_eq!(previews.len(), chunks.len());
+        for (preview, chunk) in previews.iter().zip(&chunks) {
+            let (start, end) = preview.bytes.unwrap();
+            assert_eq!(&content[start..end], chunk.content);
+        }
+        assert_eq!(store.count().await.unwrap(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_reindex_of_shorter_file_leaves_no_orphaned_chunks() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("guide.md");
+        let long: String = (0..80)
+            .map(|i| format!("Step {} of the guide.\n", i))
+            .collect();
+        tokio::fs::write(&path, &long).await.unwrap();
+        // A neighbour whose path starts with the same text must be kept.
+        tokio::fs::write(dir.path().join("guide.md.orig"), "original guide")
+            .await
+            .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            ..IndexerConfig::default()
+        });
+        engine.index_directory(dir.path()).await.unwrap();
+        let source = path.to_string_lossy().to_string();
+        let chunks_of = |ids: Vec<String>| {
+            ids.into_iter()
+                .filter(|id| id.starts_with(&format!("{}_chunk_", source)))
+                .count()
+        };
+        assert!(chunks_of(store.ids()) > 2);
+
+        tokio::fs::write(&path, "Step 0 only.\n").await.unwrap();
+        engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap();
+
+        assert_eq!(chunks_of(store.ids()), 1);
+        assert!(store.ids().contains(&format!("{}_chunk_0", source)));
+        assert!(store.ids().contains(&format!("{}.orig_chunk_0", source)));
+        assert_eq!(store.count().await.unwrap(), 2);
+
+        engine.index_file(&source).await.unwrap();
+        assert_eq!(store.count().await.unwrap(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_redaction_scrubs_secrets_from_stored_chunks() {
+        use crate::config::RedactionConfig;
+
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("settings.py");
+        tokio::fs::write(
+            &path,
+            "# Billing client, owned by ops@example.com\n\
+             OPENAI_API_KEY = \"sk-test_9fKq2LzR8wXy4Tb1\"\n\
+             TIMEOUT = 30\n",
+        )
+        .await
+        .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(provider.clone(), store.clone());
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            redaction: RedactionConfig {
+                enabled: true,
+                patterns: Vec::new(),
+            },
+            ..IndexerConfig::default()
+        });
+        engine.index_directory(dir.path()).await.unwrap();
+
+        let id = format!("{}_chunk_0", path.to_string_lossy());
+        let stored = store.get(&id).await.unwrap().unwrap();
+        assert_eq!(
+            stored.content,
+            "# Billing client, owned by [REDACTED_EMAIL]\n\
+             OPENAI_API_KEY = [REDACTED]\n\
+             TIMEOUT = 30\n"
+        );
+        assert!(provider
+            .embedded_texts()
+            .iter()
+            .all(|text| !text.contains("sk-test") && !text.contains("ops@")));
+    }
+
+    #[tokio::test]
+    async fn test_retrieve_chunks_has_no_decoration() {
+        let mut engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine
+            .add_knowledge("Chunks are 512 bytes by default.", "guide.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Overlap is 50 bytes.", "guide.md")
+            .await
+            .unwrap();
+
+        let results = engine.search("chunk size").await.unwrap();
+        let chunks = engine.retrieve_chunks("chunk size").await.unwrap();
+
+        assert_eq!(chunks.len(), results.len());
+        for (chunk, result) in chunks.iter().zip(&results) {
+            assert_eq!(chunk.content, result.document.content);
+            assert_eq!(chunk.score, result.score);
+            assert_eq!(chunk.metadata.get("source").unwrap(), "guide.md");
+        }
+        let mut contents: Vec<&str> = chunks.iter().map(|c| c.content.as_str()).collect();
+        contents.sort();
+        assert_eq!(
+            contents,
+            vec!["Chunks are 512 bytes by default.", "Overlap is 50 bytes."]
+        );
+
+        let json = serde_json::to_string(&chunks).unwrap();
+        assert!(!json.contains("Relevant context"));
+        assert!(!json.contains("[1]"));
+        assert!(!json.contains("embedding"));
+
+        engine.max_context_docs = Some(1);
+        let chunks = engine.retrieve_chunks("chunk size").await.unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].content, results[0].document.content);
+    }
+
+    #[tokio::test]
+    async fn test_retrieve_chunks_puts_pinned_files_first() {
+        let dir = tempdir().unwrap();
+        let conventions = dir.path().join("CONVENTIONS.md");
+        tokio::fs::write(&conventions, "Use snake_case.")
+            .await
+            .unwrap();
+        let engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine
+            .add_knowledge("Overlap is 50 bytes.", "guide.md")
+            .await
+            .unwrap();
+        engine.pin(&conventions).await.unwrap();
+
+        let chunks = engine.retrieve_chunks("chunk size").await.unwrap();
+
+        let contents: Vec<&str> = chunks.iter().map(|c| c.content.as_str()).collect();
+        assert_eq!(contents, vec!["Use snake_case.", "Overlap is 50 bytes."]);
+    }
+
+    #[tokio::test]
+    async fn test_memory_collection_cap_stops_indexing() {
+        let dir = tempdir().unwrap();
+        for i in 0..3 {
+            tokio::fs::write(dir.path().join(format!("{}.md", i)), format!("note {}", i))
+                .await
+                .unwrap();
+        }
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.max_documents = Some(4);
+
+        engine.index_directory(dir.path()).await.unwrap();
+        assert_eq!(store.count().await.unwrap(), 3);
+
+        // Re-indexing replaces the same chunks, so it still fits.
+        engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap();
+        assert_eq!(store.count().await.unwrap(), 3);
+
+        engine.add_knowledge("fourth", "notes").await.unwrap();
+        let err = engine.add_knowledge("fifth", "notes").await.unwrap_err();
+        assert!(matches!(err, RagError::CollectionFull { limit: 4 }));
+        assert!(err.to_string().contains("Use embedded or grpc storage"));
+        assert_eq!(store.count().await.unwrap(), 4);
+
+        tokio::fs::write(dir.path().join("3.md"), "note 3")
+            .await
+            .unwrap();
+        let err = engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap_err();
+        assert!(matches!(err, RagError::CollectionFull { limit: 4 }));
+    }
+
+    #[tokio::test]
+    async fn test_second_index_of_same_root_is_skipped_without_force() {
+        let dir = tempdir().unwrap();
+        tokio::fs::create_dir(dir.path().join("src")).await.unwrap();
+        tokio::fs::write(dir.path().join("notes.md"), "first note")
+            .await
+            .unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), store.clone());
+        engine.index_directory(dir.path()).await.unwrap();
+        assert!(engine.is_indexed_root(dir.path()));
+        let embed_calls = provider.embed_calls();
+
+        // The same root spelled another way is still caught.
+        let respelled = dir.path().join("src").join("..");
+        let err = engine.index_directory(&respelled).await.unwrap_err();
+        assert!(matches!(err, RagError::AlreadyIndexed(_)));
+        assert!(err.to_string().ends_with("is already indexed"));
+        assert_eq!(provider.embed_calls(), embed_calls);
+
+        // So is a directory inside it.
+        let err = engine
+            .index_directory(&dir.path().join("src"))
+            .await
+            .unwrap_err();
+        assert!(matches!(err, RagError::AlreadyIndexed(_)));
+
+        tokio::fs::write(dir.path().join("notes.md"), "second note")
+            .await
+            .unwrap();
+        engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap();
+        let stored = store.get(&store.ids()[0]).await.unwrap().unwrap();
+        assert!(stored.content.contains("second note"));
+
+        engine.clear().await.unwrap();
+        assert!(!engine.is_indexed_root(dir.path()));
+        engine.index_directory(dir.path()).await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_trivial_queries_are_still_searchable() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine
+            .add_knowledge("The db module opens the connection", "notes")
+            .await
+            .unwrap();
+
+        assert!(engine.is_trivial_query("db"));
+        assert!(engine.is_trivial_query("  Thanks! "));
+        assert!(!engine.is_trivial_query("how is the db opened"));
+        assert_eq!(engine.search("db").await.unwrap().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_inspect_embedding_reports_dimension_and_norm() {
+        use crate::provider::testing::{fake_embedding, FAKE_EMBEDDING_DIM};
+
+        let text = "where is the config parsed";
+        let expected: Vec<f32> = fake_embedding(text)
+            .into_iter()
+            .map(|x| x * (1.0 + text.len() as f32))
+            .collect();
+        let expected_norm = expected.iter().map(|x| x * x).sum::<f32>().sqrt();
+
+        let mut engine = test_engine(Arc::new(ScaledProvider), Arc::new(MemoryStore::new()));
+        let info = engine.inspect_embedding(text).await.unwrap();
+        assert_eq!(info.dimension, FAKE_EMBEDDING_DIM);
+        assert_eq!(
+            info.expected_dimension,
+            EmbeddingModel::default().embedding_dim
+        );
+        assert!((info.norm - expected_norm).abs() < 1e-3);
+        assert_eq!(info.head, expected[..8]);
+
+        engine.embedder = engine.embedder.clone().with_normalization(true);
+        let info = engine.inspect_embedding(text).await.unwrap();
+        assert!((info.norm - 1.0).abs() < 1e-5);
+    }
+
+    #[tokio::test]
+    async fn test_comments_stripped_from_embedding_but_stored() {
+        let dir = tempdir().unwrap();
+        let code =
+            "/// Parses the config file.\nfn parse() {\n    // TODO: validate\n    read();\n}\n";
+        tokio::fs::write(dir.path().join("config.rs"), code)
+            .await
+            .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(provider.clone(), store.clone());
+        engine.embed_without_comments = true;
+        engine.index_directory(dir.path()).await.unwrap();
+
+        assert_eq!(
+            provider.embedded_texts(),
+            vec!["fn parse() {\n    read();\n}".to_string()]
+        );
+        let stored = store.get(&store.ids()[0]).await.unwrap().unwrap();
+        assert!(stored.content.contains("/// Parses the config file."));
+        assert!(stored.content.contains("// TODO: validate"));
+    }
+
+    #[tokio::test]
+    async fn test_blank_files_skipped_after_comment_stripping() {
+        let dir = tempdir().unwrap();
+        for (name, content) in [
+            ("license.rs", "// Copyright Example Ltd.\n/* MIT */\n"),
+            ("blank.md", "  \n\n\t\n"),
+            ("main.rs", "// Entry point\nfn main() {}\n"),
+        ] {
+            std::fs::write(dir.path().join(name), content).unwrap();
+        }
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(provider.clone(), store.clone());
+        engine.embed_without_comments = true;
+        let result = engine.index_directory(dir.path()).await.unwrap();
+
+        assert_eq!(result.files_indexed, 1);
+        assert_eq!(result.files_skipped, 2);
+        assert_eq!(provider.embedded_texts(), vec!["fn main() {}".to_string()]);
+        let sources: Vec<String> = store
+            .documents()
+            .await
+            .unwrap()
+            .into_iter()
+            .filter_map(|document| document.metadata.get("source").cloned())
+            .collect();
+        assert_eq!(
+            sources,
+            vec![dir.path().join("main.rs").to_string_lossy().to_string()]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_file_now_blank_loses_its_old_chunks() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("notes.rs");
+        std::fs::write(&path, "fn notes() {}\n").unwrap();
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.embed_without_comments = true;
+        engine.index_directory(dir.path()).await.unwrap();
+        assert_eq!(store.count().await.unwrap(), 1);
+
+        for content in ["// Nothing here yet\n", ""] {
+            std::fs::write(&path, content).unwrap();
+            engine
+                .index_directory_forced(dir.path(), None)
+                .await
+                .unwrap();
+            assert_eq!(store.count().await.unwrap(), 0);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_reindex_removes_old_chunks_in_one_pass() {
+        let dir = tempdir().unwrap();
+        for name in ["a.md", "b.md", "c.md"] {
+            std::fs::write(dir.path().join(name), format!("Notes in {}", name)).unwrap();
+        }
+
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.index_directory(dir.path()).await.unwrap();
+        engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap();
+
+        assert_eq!(store.removals(), 2);
+        assert_eq!(store.count().await.unwrap(), 3);
+    }
+
+    /// Embeds like [`ScriptedProvider`], but fails on any text mentioning
+    /// `broken`.
+    struct BrokenTextProvider;
+
+    #[async_trait::async_trait]
+    impl crate::provider::Provider for BrokenTextProvider {
+        async fn chat<'a>(
+            &'a self,
+            _request: crate::provider::ChatRequest,
+            _callback: Box<dyn FnMut(crate::provider::ChatResponse) + Send + 'a>,
+        ) -> crate::provider::Result<()> {
+            Ok(())
+        }
+
+        async fn embed(
+            &self,
+            text: &str,
+            _model: &EmbeddingModel,
+        ) -> crate::provider::Result<Vec<f32>> {
+            if text.contains("broken") {
+                return Err(crate::provider::ProviderError::Other(
+                    "embedding failed".to_string(),
+                ));
+            }
+            Ok(crate::provider::testing::fake_embedding(text))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_failed_reindex_keeps_old_chunks_of_unembedded_files() {
+        let dir = tempdir().unwrap();
+        // More files than fit in one embedding batch.
+        for i in 0..40 {
+            std::fs::write(
+                dir.path().join(format!("{:02}.md", i)),
+                format!("note {}", i),
+            )
+            .unwrap();
+        }
+
+        let store = Arc::new(MemoryStore::new());
+        let engine = test_engine(Arc::new(BrokenTextProvider), store.clone());
+        engine.index_directory(dir.path()).await.unwrap();
+
+        std::fs::write(dir.path().join("39.md"), "note 39 is broken").unwrap();
+        assert!(engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .is_err());
+
+        assert_eq!(store.count().await.unwrap(), 40);
+        let source = dir.path().join("39.md").to_string_lossy().to_string();
+        let kept = store.documents_by_source(&source).await.unwrap();
+        assert_eq!(kept.len(), 1);
+        assert_eq!(kept[0].content, "note 39");
+    }
+
+    #[tokio::test]
+    async fn test_index_paths_retrieves_files_by_name() {
+        let dir = tempdir().unwrap();
+        std::fs::create_dir_all(dir.path().join("src/auth")).unwrap();
+        for (path, content) in [
+            ("src/auth/token_refresh.rs", "fn run(client: &Client) {}\n"),
+            ("src/main.rs", "fn main() { start(); }\n"),
+        ] {
+            std::fs::write(dir.path().join(path), content).unwrap();
+        }
+
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.index_paths = true;
+        engine.index_directory(dir.path()).await.unwrap();
+        assert_eq!(store.count().await.unwrap(), 4);
+
+        let results = engine.search("where is the token refresh").await.unwrap();
+        let top = &results[0].document;
+        assert_eq!(top.metadata["path_document"], "true");
+        let expected = dir.path().join("src/auth/token_refresh.rs");
+        assert_eq!(
+            top.metadata["source"],
+            expected.to_string_lossy().to_string()
+        );
+        assert!(top.content.starts_with("src/auth/token_refresh.rs\n"));
+
+        engine
+            .index_directory_forced(dir.path(), None)
+            .await
+            .unwrap();
+        assert_eq!(store.count().await.unwrap(), 4);
+    }
+
+    #[tokio::test]
+    async fn test_source_path_header_prepended_to_embedding_only() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("token.rs");
+        tokio::fs::write(&path, "fn refresh() {}\n").await.unwrap();
+        tokio::fs::write(dir.path().join("notes.txt"), "Tokens expire hourly.\n")
+            .await
+            .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(provider.clone(), store.clone());
+        engine.prepend_source_path = true;
+        engine.index_directory(dir.path()).await.unwrap();
+
+        let embedded = provider.embedded_texts();
+        let embedded_for = |text: &str| embedded.iter().find(|e| e.contains(text)).unwrap();
+        assert!(embedded_for("fn refresh()").starts_with("// file: token.rs\nfn refresh()"));
+        assert!(embedded_for("Tokens expire").starts_with("file: notes.txt\nTokens expire"));
+        for id in store.ids() {
+            let stored = store.get(&id).await.unwrap().unwrap();
+            assert!(!stored.content.contains("file: "));
+        }
+    }
+
+    #[tokio::test]
+    async fn test_diff_source_shows_edits_since_indexing() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("notes.md");
+        let lines: Vec<String> = (1..=40)
+            .map(|n| format!("Line {} of the release notes.", n))
+            .collect();
+        std::fs::write(&path, lines.join("\n")).unwrap();
+
+        let mut engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        engine.indexer = Indexer::new(IndexerConfig {
+            exclude_patterns: Vec::new(),
+            chunk_size: 200,
+            chunk_overlap: 40,
+            ..IndexerConfig::default()
+        });
+        engine.index_directory(dir.path()).await.unwrap();
+        let source = path.to_string_lossy().to_string();
+
+        let diff = engine.diff_source(&source).await.unwrap().unwrap();
+        assert!(!diff.has_drift());
+
+        let mut edited = lines.clone();
+        edited[11] = "Line 12 was rewritten after indexing.".to_string();
+        edited.push("Line 41 is new.".to_string());
+        std::fs::write(&path, edited.join("\n")).unwrap();
+
+        let diff = engine.diff_source(&source).await.unwrap().unwrap();
+        assert!(!diff.hash_matches);
+        assert_eq!(
+            diff.lines,
+            vec![
+                DiffLine::Removed(12, "Line 12 of the release notes.".to_string()),
+                DiffLine::Added(12, "Line 12 was rewritten after indexing.".to_string()),
+                DiffLine::Added(41, "Line 41 is new.".to_string()),
+            ]
+        );
+
+        assert!(engine.diff_source("missing.md").await.unwrap().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_reembed_source_only_changes_that_source() {
+        // Appends like LanceDB, so chunks written back must not duplicate.
+        let store = Arc::new(MemoryStore::new().appending());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine
+            .add_knowledge("Tokens expire hourly", "docs/auth.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Chunks are 512 bytes", "docs/chunking.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Refresh tokens last a week", "docs/auth.md")
+            .await
+            .unwrap();
+        let before: HashMap<String, Vec<f32>> = store
+            .documents()
+            .await
+            .unwrap()
+            .into_iter()
+            .map(|document| (document.id, document.embedding))
+            .collect();
+
+        // A different model embeds the same text differently.
+        engine.embedder = Embedder::new(Arc::new(ScaledProvider), EmbeddingModel::default());
+        assert_eq!(engine.reembed_source("docs/auth.md").await.unwrap(), 2);
+        assert_eq!(engine.reembed_source("docs/missing.md").await.unwrap(), 0);
+
+        for document in store.documents().await.unwrap() {
+            let changed = document.embedding != before[&document.id];
+            let auth = document.metadata["source"] == "docs/auth.md";
+            assert_eq!(changed, auth, "{}", document.id);
+        }
+        assert_eq!(store.ids().len(), 3);
+        let refreshed = store.get("docs/auth.md_2").await.unwrap().unwrap();
+        assert_eq!(refreshed.content, "Refresh tokens last a week");
+    }
+
+    #[tokio::test]
+    async fn test_merge_copies_collection_with_stored_embeddings() {
+        let provider = Arc::new(ScriptedProvider::default());
+        let beta_store = Arc::new(MemoryStore::new());
+        let model = |id: &str| EmbeddingModel {
+            id: id.to_string(),
+            ..EmbeddingModel::default()
+        };
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()))
+            .with_collection(
+                "alpha",
+                Embedder::new(provider.clone(), model("shared")),
+                Arc::new(MemoryStore::new()),
+            )
+            .with_collection(
+                "beta",
+                Embedder::new(provider.clone(), model("shared")),
+                beta_store.clone(),
+            )
+            .with_collection(
+                "images",
+                Embedder::new(provider.clone(), model("clip")),
+                Arc::new(MemoryStore::new()),
+            );
+
+        let alpha = engine.collection("alpha").unwrap();
+        let beta = engine.collection("beta").unwrap();
+        for (collection, text, source) in [
+            (alpha, "Channels wrap tokio mpsc senders", "a.md"),
+            (alpha, "Alpha release notes", "notes"),
+            (beta, "Channels close when every sender drops", "b.md"),
+            (beta, "Beta release notes", "notes"),
+        ] {
+            collection.add_knowledge(text, source).await.unwrap();
+        }
+        let embeds = provider.embed_calls();
+
+        let report = engine
+            .merge_collections("alpha", "beta", IdCollision::Prefix)
+            .await
+            .unwrap();
+        assert_eq!((report.copied, report.renamed, report.skipped), (2, 1, 0));
+        assert_eq!(
+            beta_store.ids(),
+            vec!["a.md_0", "alpha:notes_1", "b.md_0", "notes_1"]
+        );
+        assert_eq!(
+            beta_store.get("notes_1").await.unwrap().unwrap().content,
+            "Beta release notes"
+        );
+        assert_eq!(provider.embed_calls(), embeds);
+
+        let again = engine
+            .merge_collections("alpha", "beta", IdCollision::Skip)
+            .await
+            .unwrap();
+        assert_eq!((again.copied, again.skipped), (0, 2));
+
+        let sources: HashSet<String> = beta
+            .search("where are channels senders")
+            .await
+            .unwrap()
+            .into_iter()
+            .filter_map(|result| result.document.metadata.get("source").cloned())
+            .collect();
+        assert!(sources.contains("a.md") && sources.contains("b.md"));
+
+        assert!(matches!(
+            engine
+                .merge_collections("alpha", "images", IdCollision::Skip)
+                .await,
+            Err(RagError::Merge { .. })
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_rollback_restores_snapshot() {
+        let dir = tempdir().unwrap();
+        let provider = Arc::new(ScriptedProvider::default());
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(provider.clone(), store.clone());
+        engine.storage_path = Some(dir.path().to_path_buf());
+        engine
+            .add_knowledge("Chunks are 512 bytes", "chunking.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Config is read at startup", "config.md")
+            .await
+            .unwrap();
+
+        assert_eq!(engine.snapshot("baseline").await.unwrap(), 2);
+        assert_eq!(engine.snapshots(), vec!["baseline"]);
+        let ids = store.ids();
+
+        engine
+            .remove_from_knowledge_base("chunking.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Chunks are 256 bytes", "chunking-small.md")
+            .await
+            .unwrap();
+        let embeds = provider.embed_calls();
+
+        assert_eq!(engine.rollback("baseline").await.unwrap(), 2);
+        assert_eq!(store.ids(), ids);
+        let results = engine.search("how big are chunks").await.unwrap();
+        assert_eq!(results[0].document.content, "Chunks are 512 bytes");
+        assert_eq!(provider.embed_calls(), embeds + 1);
+
+        assert!(matches!(
+            engine.rollback("missing").await,
+            Err(RagError::UnknownSnapshot(_))
+        ));
+        assert!(matches!(
+            engine.snapshot("../escape").await,
+            Err(RagError::Snapshot(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_failed_rollback_keeps_live_index() {
+        let dir = tempdir().unwrap();
+        let store = Arc::new(MemoryStore::new());
+        let mut engine = test_engine(Arc::new(ScriptedProvider::default()), store.clone());
+        engine.storage_path = Some(dir.path().to_path_buf());
+        for (text, source) in [
+            ("Chunks are 512 bytes", "chunking.md"),
+            ("Config is read at startup", "config.md"),
+            ("Logs go to stderr", "logging.md"),
+        ] {
+            engine.add_knowledge(text, source).await.unwrap();
+        }
+        engine.snapshot("baseline").await.unwrap();
+        engine
+            .remove_from_knowledge_base("chunking.md")
+            .await
+            .unwrap();
+        let ids = store.ids();
+
+        // The snapshot no longer fits, so rewriting the store fails.
+        engine.max_documents = Some(2);
+        assert!(matches!(
+            engine.rollback("baseline").await,
+            Err(RagError::CollectionFull { limit: 2 })
+        ));
+        assert_eq!(store.ids(), ids);
+    }
+
+    #[tokio::test]
+    async fn test_disabled_rag_creates_no_vector_store() {
+        use crate::config::{Config, RagConfig, StorageConfig, StorageMode};
+
+        let dir = tempdir().unwrap();
+        let db = dir.path().join("vectordb");
+        let config = Config::default()
+            .with_rag_config(RagConfig {
+                enabled: false,
+                ..RagConfig::default()
+            })
+            .with_storage_config(StorageConfig {
+                storage_mode: StorageMode::Embedded {
+                    path: db.to_string_lossy().to_string(),
+                },
+                ..StorageConfig::default()
+            });
+        let provider = Arc::new(ScriptedProvider::default());
+
+        let engine = super::RagEngine::new(&config, provider.clone())
+            .await
+            .unwrap();
+
+        assert!(!db.exists());
+        assert_eq!(engine.count().await, 0);
+        assert_eq!(provider.embed_calls(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_index_archive_uses_paths_inside_the_archive() {
+        use std::io::Write;
+
+        let dir = tempdir().unwrap();
+        let binary: &[u8] = &[0x89, b'P', b'N', b'G', 0xff, 0xfe];
+        let entries: [(&str, &[u8]); 4] = [
+            ("src/lib.rs", b"pub fn parse() {}\n"),
+            ("docs/guide.md", b"# Guide\n\nRun the server.\n"),
+            ("logo.png", binary),
+            ("target/debug.log", b"build output\n"),
+        ];
+
+        let zip_path = dir.path().join("project.zip");
+        let mut zip = zip::ZipWriter::new(std::fs::File::create(&zip_path).unwrap());
+        for (name, bytes) in entries {
+            zip.start_file(name, zip::write::SimpleFileOptions::default())
+                .unwrap();
+            zip.write_all(bytes).unwrap();
+        }
+        zip.finish().unwrap();
+
+        let tar_path = dir.path().join("project.tar.gz");
+        let gz = flate2::write::GzEncoder::new(
+            std::fs::File::create(&tar_path).unwrap(),
+            flate2::Compression::default(),
+        );
+        let mut tar = tar::Builder::new(gz);
+        for (name, bytes) in entries {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(bytes.len() as u64);
+            header.set_mode(0o644);
+            header.set_cksum();
+            tar.append_data(&mut header, format!("./{}", name), bytes)
+                .unwrap();
+        }
+        tar.into_inner().unwrap().finish().unwrap();
+
+        for archive in [zip_path, tar_path] {
+            let provider = Arc::new(ScriptedProvider::default());
+            let store = Arc::new(MemoryStore::new());
+            let engine = test_engine(provider, store.clone());
+
+            let result = engine.index_archive(&archive).await.unwrap();
+
+            assert_eq!(result.files_indexed, 2, "{}", archive.display());
+            assert_eq!(result.files_skipped, 1);
+            let sources: HashSet<String> = store
+                .documents()
+                .await
+                .unwrap()
+                .into_iter()
+                .filter_map(|document| document.metadata.get("source").cloned())
+                .collect();
+            assert_eq!(
+                sources,
+                HashSet::from(["src/lib.rs".to_string(), "docs/guide.md".to_string()])
+            );
+        }
+
+        let plain = dir.path().join("notes.txt");
+        std::fs::write(&plain, "not an archive").unwrap();
+        let engine = test_engine(
+            Arc::new(ScriptedProvider::default()),
+            Arc::new(MemoryStore::new()),
+        );
+        assert!(matches!(
+            engine.index_archive(&plain).await,
+            Err(RagError::Indexer(_))
+        ));
+    }
+}
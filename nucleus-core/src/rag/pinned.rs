@@ -0,0 +1,130 @@
+//! Documents that accompany every query.
+//!
+//! A pinned file, such as project conventions or a glossary, is read once when
+//! it is pinned and placed ahead of the retrieved chunks in every prompt,
+//! whether or not it is similar to the query. Pinned documents are marked with
+//! `pinned` metadata so prompt trimming drops them only after every retrieved
+//! chunk.
+
+use super::types::{Document, SearchResult};
+use std::io;
+use std::path::Path;
+use std::sync::RwLock;
+
+/// Metadata key set to `true` on pinned documents.
+pub const PINNED_KEY: &str = "pinned";
+
+/// The pinned documents of an engine, shared between its clones.
+#[derive(Debug, Default)]
+pub(crate) struct PinnedDocuments {
+    documents: RwLock<Vec<Document>>,
+}
+
+impl PinnedDocuments {
+    /// Reads `path` and pins its content, replacing an earlier pin of it.
+    pub async fn pin(&self, path: &Path) -> io::Result<()> {
+        let content = tokio::fs::read_to_string(path).await?;
+        let source = path.to_string_lossy();
+        let document = Document::new(format!("{}_pinned", source), content, Vec::new())
+            .with_metadata("source", source.as_ref())
+            .with_metadata(PINNED_KEY, "true");
+
+        let mut documents = self.documents.write().unwrap();
+        documents.retain(|pinned| pinned.metadata.get("source") != document.metadata.get("source"));
+        documents.push(document);
+        Ok(())
+    }
+
+    /// Unpins `source`. Returns whether it was pinned.
+    pub fn unpin(&self, source: &str) -> bool {
+        let mut documents = self.documents.write().unwrap();
+        let before = documents.len();
+        documents
+            .retain(|pinned| pinned.metadata.get("source").map(String::as_str) != Some(source));
+        documents.len() != before
+    }
+
+    /// Sources of the pinned documents, in pin order.
+    pub fn sources(&self) -> Vec<String> {
+        self.documents
+            .read()
+            .unwrap()
+            .iter()
+            .filter_map(|document| document.metadata.get("source").cloned())
+            .collect()
+    }
+
+    /// Puts the pinned documents ahead of `results`, dropping results that
+    /// come from a pinned source since the whole file is already included.
+    pub fn prepend_to(&self, results: Vec<SearchResult>) -> Vec<SearchResult> {
+        let documents = self.documents.read().unwrap();
+        if documents.is_empty() {
+            return results;
+        }
+
+        let pinned_sources: Vec<&String> = documents
+            .iter()
+            .filter_map(|document| document.metadata.get("source"))
+            .collect();
+        documents
+            .iter()
+            .map(|document| SearchResult {
+                document: document.clone(),
+                score: 1.0,
+            })
+            .chain(results.into_iter().filter(|result| {
+                result
+                    .document
+                    .metadata
+                    .get("source")
+                    .map_or(true, |source| !pinned_sources.contains(&source))
+            }))
+            .collect()
+    }
+}
+
+/// Whether a result is a pinned document rather than a retrieved chunk.
+pub fn is_pinned(result: &SearchResult) -> bool {
+    result
+        .document
+        .metadata
+        .get(PINNED_KEY)
+        .is_some_and(|value| value == "true")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    #[tokio::test]
+    async fn test_pinned_documents_lead_and_replace_their_chunks() {
+        let dir = tempdir().unwrap();
+        let glossary = dir.path().join("glossary.md");
+        std::fs::write(&glossary, "RAG: retrieval-augmented generation").unwrap();
+        let source = glossary.to_string_lossy().to_string();
+
+        let pinned = PinnedDocuments::default();
+        pinned.pin(&glossary).await.unwrap();
+        pinned.pin(&glossary).await.unwrap();
+        assert_eq!(pinned.sources(), vec![source.clone()]);
+
+        let chunk = |source: &str| SearchResult {
+            document: Document::new(source, "chunk", vec![]).with_metadata("source", source),
+            score: 0.4,
+        };
+        let results = pinned.prepend_to(vec![chunk("src/lib.rs"), chunk(&source)]);
+
+        assert_eq!(results.len(), 2);
+        assert!(is_pinned(&results[0]));
+        assert_eq!(
+            results[0].document.content,
+            "RAG: retrieval-augmented generation"
+        );
+        assert_eq!(results[1].document.metadata["source"], "src/lib.rs");
+
+        assert!(pinned.unpin(&source));
+        assert!(!pinned.unpin(&source));
+        assert!(pinned.sources().is_empty());
+    }
+}
@@ -0,0 +1,156 @@
+//! Chunking previews for tuning chunk settings.
+//!
+//! A preview runs the configured chunker on one file and reports where each
+//! chunk sits in the file, without embedding or storing anything.
+
+use super::indexer::FileChunk;
+use std::fmt;
+
+/// Characters of chunk content shown in a preview.
+const PREVIEW_CHARS: usize = 60;
+
+/// One chunk of a previewed file.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ChunkPreview {
+    pub index: usize,
+    /// Byte range of the chunk in the file, end exclusive.
+    ///
+    /// `None` for chunks that aren't a verbatim slice of the file, such as
+    /// structured chunks re-serialized with their key path.
+    pub bytes: Option<(usize, usize)>,
+    /// First and last line of the chunk, 1-based.
+    pub lines: Option<(usize, usize)>,
+    pub key_path: Option<String>,
+    /// Length of the chunk in bytes.
+    pub len: usize,
+    /// The start of the chunk, on one line.
+    pub preview: String,
+}
+
+/// Locates each chunk in `content`.
+///
+/// Chunks are searched for in order, each after the start of the previous
+/// one, so overlapping and repeated text maps to the right place.
+pub fn preview_chunks(content: &str, chunks: &[FileChunk]) -> Vec<ChunkPreview> {
+    let mut from = 0;
+
+    chunks
+        .iter()
+        .enumerate()
+        .map(|(index, chunk)| {
+            let bytes = content[from..]
+                .find(&chunk.content)
+                .filter(|_| !chunk.content.is_empty())
+                .map(|offset| (from + offset, from + offset + chunk.content.len()));
+            if let Some((start, _)) = bytes {
+                from = start + 1;
+                while !content.is_char_boundary(from) {
+                    from += 1;
+                }
+            }
+
+            let lines = bytes.map(|(start, end)| {
+                let first = content[..start].matches('\n').count() + 1;
+                let last = first
+                    + content[start..end]
+                        .trim_end_matches('\n')
+                        .matches('\n')
+                        .count();
+                (first, last)
+            });
+
+            ChunkPreview {
+                index,
+                bytes,
+                lines,
+                key_path: chunk.key_path.clone(),
+                len: chunk.content.len(),
+                preview: one_line(&chunk.content),
+            }
+        })
+        .collect()
+}
+
+fn one_line(content: &str) -> String {
+    let flat: String = content.split_whitespace().collect::<Vec<_>>().join(" ");
+    match flat.char_indices().nth(PREVIEW_CHARS) {
+        Some((cut, _)) => format!("{}...", &flat[..cut]),
+        None => flat,
+    }
+}
+
+/// `#<index> bytes <start>..<end> lines <first>-<last> [key] "<preview>"`
+impl fmt::Display for ChunkPreview {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "#{}", self.index)?;
+        match self.bytes {
+            Some((start, end)) => write!(f, " bytes {}..{}", start, end)?,
+            None => write!(f, " {} bytes", self.len)?,
+        }
+        if let Some((first, last)) = self.lines {
+            write!(f, " lines {}-{}", first, last)?;
+        }
+        if let Some(key_path) = &self.key_path {
+            write!(f, " [{}]", key_path)?;
+        }
+        write!(f, " \"{}\"", self.preview)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rag::indexer::chunk_text;
+
+    #[test]
+    fn test_ranges_match_text_chunks() {
+        let content: String = (1..=40).map(|i| format!("line number {}\n", i)).collect();
+        let chunks: Vec<FileChunk> = chunk_text(&content, 100, 20)
+            .into_iter()
+            .map(|content| FileChunk {
+                content,
+                key_path: None,
+            })
+            .collect();
+
+        let previews = preview_chunks(&content, &chunks);
+        assert_eq!(previews.len(), chunks.len());
+        for (preview, chunk) in previews.iter().zip(&chunks) {
+            let (start, end) = preview.bytes.unwrap();
+            assert_eq!(&content[start..end], chunk.content);
+        }
+        // Windows step by chunk_size - overlap.
+        assert_eq!(previews[0].bytes, Some((0, 100)));
+        assert_eq!(previews[1].bytes, Some((80, 180)));
+        assert_eq!(previews[0].lines, Some((1, 8)));
+        assert!(previews[0]
+            .to_string()
+            .starts_with("#0 bytes 0..100 lines 1-8 \"line number 1 line number 2"));
+    }
+
+    #[test]
+    fn test_repeated_text_maps_in_order() {
+        let content = "same\nsame\n";
+        let chunks = vec![
+            FileChunk {
+                content: "same\n".to_string(),
+                key_path: None,
+            },
+            FileChunk {
+                content: "same\n".to_string(),
+                key_path: None,
+            },
+            FileChunk {
+                content: "a: 1".to_string(),
+                key_path: Some("a".to_string()),
+            },
+        ];
+
+        let previews = preview_chunks(content, &chunks);
+        assert_eq!(previews[0].lines, Some((1, 1)));
+        assert_eq!(previews[1].bytes, Some((5, 10)));
+        assert_eq!(previews[1].lines, Some((2, 2)));
+        assert_eq!(previews[2].bytes, None);
+        assert_eq!(previews[2].to_string(), "#2 4 bytes [a] \"a: 1\"");
+    }
+}
@@ -5,16 +5,18 @@
 
 use super::store::VectorStore;
 use super::types::{Document, SearchResult};
-use crate::config::{StorageConfig, StorageMode};
+use crate::config::{SimilarityMetric, StorageConfig, StorageMode};
 use anyhow::{Context, Result};
 use async_trait::async_trait;
 use qdrant_client::{
     qdrant::{
-        vectors_config::Config, CreateCollectionBuilder, DeletePointsBuilder, Distance,
-        PointStruct, ScrollPointsBuilder, SearchPointsBuilder, UpsertPointsBuilder,
-        VectorParamsBuilder, VectorsConfig,
+        vectors_config::Config, vectors_output::VectorsOptions, Condition, CountPointsBuilder,
+        CreateCollectionBuilder, DeletePointsBuilder, Distance, Filter, GetPointsBuilder, PointId,
+        PointStruct, PointsIdsList, ScrollPointsBuilder, SearchPointsBuilder,
+        SetPayloadPointsBuilder, UpsertPointsBuilder, Value, VectorParamsBuilder, VectorsConfig,
+        VectorsOutput,
     },
-    Qdrant,
+    Payload, Qdrant,
 };
 use serde_json::json;
 use std::collections::hash_map::DefaultHasher;
@@ -37,10 +39,10 @@ use std::sync::Arc;
 ///
 #[derive(Clone)]
 pub struct QdrantStore {
-    storage_config: StorageConfig,
     client: Arc<Qdrant>,
     collection_name: String,
     vector_size: u64,
+    similarity: SimilarityMetric,
 }
 
 #[async_trait]
@@ -53,21 +55,8 @@ impl VectorStore for QdrantStore {
         let points: Vec<PointStruct> = documents
             .into_iter()
             .map(|document| {
-                let mut hasher = DefaultHasher::new();
-                document.id.hash(&mut hasher);
-                let numeric_id = hasher.finish();
-
-                let payload: HashMap<String, serde_json::Value> = document
-                    .metadata
-                    .iter()
-                    .map(|(k, v)| (k.clone(), json!(v)))
-                    .chain(vec![
-                        ("content".to_string(), json!(document.content)),
-                        ("id".to_string(), json!(document.id)),
-                    ])
-                    .collect();
-
-                PointStruct::new(numeric_id, document.embedding, payload)
+                let payload = document_payload(&document.id, &document.content, &document.metadata);
+                PointStruct::new(point_id(&document.id), document.embedding, payload)
             })
             .collect();
 
@@ -84,19 +73,19 @@ impl VectorStore for QdrantStore {
     /// # Arguments
     ///
     /// * `query_embedding` - The embedding vector to search for
-    /// * `top_k` - Maximum number of results to return
+    /// * `limit` - Maximum number of results to return
     ///
     /// # Returns
     ///
     /// A vector of search results, sorted by descending similarity score.
-    async fn search(&self, query_embedding: &[f32]) -> Result<Vec<SearchResult>> {
+    async fn search(&self, query_embedding: &[f32], limit: usize) -> Result<Vec<SearchResult>> {
         let search_result = self
             .client
             .search_points(
                 SearchPointsBuilder::new(
                     &self.collection_name,
                     query_embedding.to_vec(),
-                    self.storage_config.top_k as u64,
+                    limit as u64,
                 )
                 .with_payload(true),
             )
@@ -106,38 +95,9 @@ impl VectorStore for QdrantStore {
         let results = search_result
             .result
             .into_iter()
-            .map(|point| {
-                let payload = point.payload;
-                let content = payload
-                    .get("content")
-                    .and_then(|v| v.as_str())
-                    .map(|s| s.to_string())
-                    .unwrap_or_default();
-
-                // Get the original ID from metadata
-                let id = payload
-                    .get("id")
-                    .and_then(|v| v.as_str())
-                    .map(|s| s.to_string())
-                    .unwrap_or_default();
-
-                let metadata: HashMap<String, String> = payload
-                    .iter()
-                    .filter(|(k, _)| k.as_str() != "content" && k.as_str() != "id")
-                    .filter_map(|(k, v)| v.as_str().map(|s| (k.clone(), s.to_string())))
-                    .collect();
-
-                let document = Document {
-                    id,
-                    content,
-                    embedding: vec![], // Don't return embeddings in search results
-                    metadata,
-                };
-
-                SearchResult {
-                    document,
-                    score: point.score,
-                }
+            .map(|point| SearchResult {
+                document: payload_document(&point.payload),
+                score: point.score,
             })
             .collect();
 
@@ -219,6 +179,41 @@ impl VectorStore for QdrantStore {
         Ok(unique_paths.into_iter().collect())
     }
 
+    async fn source_counts(&self) -> Result<HashMap<String, usize>> {
+        let mut counts = HashMap::new();
+        let mut offset: Option<PointId> = None;
+
+        loop {
+            let mut builder = ScrollPointsBuilder::new(&self.collection_name)
+                .limit(100)
+                .with_payload(true);
+
+            if let Some(off) = offset {
+                builder = builder.offset(off);
+            }
+
+            let scroll_result = self
+                .client
+                .scroll(builder)
+                .await
+                .context("Failed to scroll points")?;
+
+            for point in &scroll_result.result {
+                if let Some(source) = point.payload.get("source").and_then(|v| v.as_str()) {
+                    *counts.entry(source.to_string()).or_default() += 1;
+                }
+            }
+
+            if let Some(next_offset) = scroll_result.next_page_offset {
+                offset = Some(next_offset);
+            } else {
+                break;
+            }
+        }
+
+        Ok(counts)
+    }
+
     /// Removes all documents with a matching source path.
     ///
     /// This method deletes all points where the "source" metadata field
@@ -296,6 +291,144 @@ impl VectorStore for QdrantStore {
 
         Ok(count)
     }
+
+    async fn remove_by_sources(&self, sources: &[String]) -> Result<usize> {
+        if sources.is_empty() {
+            return Ok(0);
+        }
+
+        let filter = Filter::must([Condition::matches("source", sources.to_vec())]);
+        let count = self
+            .client
+            .count(
+                CountPointsBuilder::new(&self.collection_name)
+                    .filter(filter.clone())
+                    .exact(true),
+            )
+            .await
+            .context("Failed to count points")?
+            .result
+            .map_or(0, |result| result.count as usize);
+
+        if count > 0 {
+            self.client
+                .delete_points(DeletePointsBuilder::new(&self.collection_name).points(filter))
+                .await
+                .context("Failed to delete points")?;
+        }
+
+        Ok(count)
+    }
+
+    async fn get(&self, id: &str) -> Result<Option<Document>> {
+        let response = self
+            .client
+            .get_points(
+                GetPointsBuilder::new(&self.collection_name, vec![PointId::from(point_id(id))])
+                    .with_payload(true),
+            )
+            .await
+            .context("Failed to get point")?;
+
+        Ok(response
+            .result
+            .first()
+            .map(|point| payload_document(&point.payload)))
+    }
+
+    async fn documents(&self) -> Result<Vec<Document>> {
+        self.scroll_documents(None).await
+    }
+
+    async fn documents_by_source(&self, source: &str) -> Result<Vec<Document>> {
+        self.scroll_documents(Some(Filter::must([Condition::matches(
+            "source",
+            source.to_string(),
+        )])))
+        .await
+    }
+
+    async fn update_metadata(&self, id: &str, metadata: HashMap<String, String>) -> Result<bool> {
+        let Some(document) = self.get(id).await? else {
+            return Ok(false);
+        };
+
+        let payload = Payload::try_from(json!(document_payload(id, &document.content, &metadata)))
+            .context("Failed to build payload")?;
+
+        self.client
+            .overwrite_payload(
+                SetPayloadPointsBuilder::new(&self.collection_name, payload).points_selector(
+                    PointsIdsList {
+                        ids: vec![PointId::from(point_id(id))],
+                    },
+                ),
+            )
+            .await
+            .context("Failed to update payload")?;
+
+        Ok(true)
+    }
+}
+
+/// Qdrant point IDs must be integers or UUIDs, so document IDs are hashed.
+/// The original ID is kept in the payload.
+fn point_id(id: &str) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    id.hash(&mut hasher);
+    hasher.finish()
+}
+
+fn document_payload(
+    id: &str,
+    content: &str,
+    metadata: &HashMap<String, String>,
+) -> HashMap<String, serde_json::Value> {
+    metadata
+        .iter()
+        .map(|(k, v)| (k.clone(), json!(v)))
+        .chain(vec![
+            ("content".to_string(), json!(content)),
+            ("id".to_string(), json!(id)),
+        ])
+        .collect()
+}
+
+/// The dense vector of a scrolled point, empty if it has none.
+#[allow(deprecated)]
+fn point_embedding(vectors: Option<VectorsOutput>) -> Vec<f32> {
+    match vectors.and_then(|vectors| vectors.vectors_options) {
+        Some(VectorsOptions::Vector(vector)) => vector.data,
+        _ => Vec::new(),
+    }
+}
+
+fn payload_document(payload: &HashMap<String, Value>) -> Document {
+    let content = payload
+        .get("content")
+        .and_then(|v| v.as_str())
+        .map(|s| s.to_string())
+        .unwrap_or_default();
+
+    // Get the original ID from metadata
+    let id = payload
+        .get("id")
+        .and_then(|v| v.as_str())
+        .map(|s| s.to_string())
+        .unwrap_or_default();
+
+    let metadata: HashMap<String, String> = payload
+        .iter()
+        .filter(|(k, _)| k.as_str() != "content" && k.as_str() != "id")
+        .filter_map(|(k, v)| v.as_str().map(|s| (k.clone(), s.to_string())))
+        .collect();
+
+    Document {
+        id,
+        content,
+        embedding: vec![], // Don't return embeddings in search results
+        metadata,
+    }
 }
 
 impl QdrantStore {
@@ -320,10 +453,10 @@ impl QdrantStore {
         let collection_name = storage_config.vector_db.collection_name.clone();
 
         let store = Self {
-            storage_config,
             client,
             collection_name,
             vector_size,
+            similarity: storage_config.vector_db.similarity,
         };
 
         store.ensure_collection().await?;
@@ -331,6 +464,47 @@ impl QdrantStore {
         Ok(store)
     }
 
+    /// Scrolls through the points matching `filter`, or every point, and
+    /// returns them as documents with their embeddings.
+    async fn scroll_documents(&self, filter: Option<Filter>) -> Result<Vec<Document>> {
+        let mut documents = Vec::new();
+        let mut offset: Option<PointId> = None;
+
+        loop {
+            let mut builder = ScrollPointsBuilder::new(&self.collection_name)
+                .limit(100)
+                .with_payload(true)
+                .with_vectors(true);
+
+            if let Some(filter) = &filter {
+                builder = builder.filter(filter.clone());
+            }
+            if let Some(off) = offset {
+                builder = builder.offset(off);
+            }
+
+            let scroll_result = self
+                .client
+                .scroll(builder)
+                .await
+                .context("Failed to scroll points")?;
+
+            for point in scroll_result.result {
+                let mut document = payload_document(&point.payload);
+                document.embedding = point_embedding(point.vectors);
+                documents.push(document);
+            }
+
+            if let Some(next_offset) = scroll_result.next_page_offset {
+                offset = Some(next_offset);
+            } else {
+                break;
+            }
+        }
+
+        Ok(documents)
+    }
+
     async fn ensure_collection(&self) -> Result<()> {
         let collections = self
             .client
@@ -339,13 +513,16 @@ impl QdrantStore {
             .context("Failed to check collection")?;
 
         if !collections {
+            let distance = match self.similarity {
+                SimilarityMetric::Cosine => Distance::Cosine,
+                SimilarityMetric::Dot => Distance::Dot,
+            };
             self.client
                 .create_collection(
                     CreateCollectionBuilder::new(&self.collection_name).vectors_config(
                         VectorsConfig {
                             config: Some(Config::Params(
-                                VectorParamsBuilder::new(self.vector_size, Distance::Cosine)
-                                    .build(),
+                                VectorParamsBuilder::new(self.vector_size, distance).build(),
                             )),
                         },
                     ),
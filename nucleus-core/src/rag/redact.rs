@@ -0,0 +1,126 @@
+//! Secret redaction for indexed content.
+//!
+//! With redaction enabled, file content is scrubbed before it is chunked, so
+//! API keys, tokens and email addresses never reach the embedding model or the
+//! vector store. Each match is replaced with a placeholder naming what was
+//! removed, and the surrounding text is left as is.
+
+use crate::config::RedactionConfig;
+use regex::Regex;
+use std::borrow::Cow;
+
+/// Placeholder for matches of user-supplied patterns.
+const REDACTED: &str = "[REDACTED]";
+
+/// Built-in rules as `(pattern, replacement)`, applied in order.
+///
+/// Replacements may refer to capture groups, so `api_key = "..."` keeps the
+/// key name and only the value is replaced.
+const BUILTIN_RULES: &[(&str, &str)] = &[
+    (
+        r"-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----",
+        "[REDACTED_PRIVATE_KEY]",
+    ),
+    (r"\bAKIA[0-9A-Z]{16}\b", "[REDACTED_AWS_KEY]"),
+    (r"\bgh[pousr]_[A-Za-z0-9]{36,}\b", "[REDACTED_TOKEN]"),
+    (r"\bxox[abprs]-[A-Za-z0-9-]{10,}", "[REDACTED_TOKEN]"),
+    (r"\b(?:sk|pk|rk)-[A-Za-z0-9_-]{16,}", "[REDACTED_API_KEY]"),
+    (
+        r#"(?i)\b(\w*(?:api[_-]?key|secret|token|password))\b(\s*[:=]\s*)["']?[^\s"']{8,}["']?"#,
+        "${1}${2}[REDACTED]",
+    ),
+    (
+        r"\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b",
+        "[REDACTED_EMAIL]",
+    ),
+];
+
+/// Replaces secrets in text with placeholders.
+#[derive(Debug, Clone)]
+pub struct Redactor {
+    rules: Vec<(Regex, String)>,
+}
+
+impl Redactor {
+    /// Builds a redactor from the built-in rules plus `config.patterns`.
+    ///
+    /// User patterns that aren't valid regular expressions are skipped with a
+    /// warning rather than failing indexing.
+    pub fn new(config: &RedactionConfig) -> Self {
+        let builtin = BUILTIN_RULES.iter().map(|(pattern, replacement)| {
+            let regex = Regex::new(pattern).expect("built-in redaction pattern");
+            (regex, replacement.to_string())
+        });
+
+        let custom = config
+            .patterns
+            .iter()
+            .filter_map(|pattern| match Regex::new(pattern) {
+                Ok(regex) => Some((regex, REDACTED.to_string())),
+                Err(e) => {
+                    tracing::warn!("Skipping invalid redaction pattern {:?}: {}", pattern, e);
+                    None
+                }
+            });
+
+        Self {
+            rules: builtin.chain(custom).collect(),
+        }
+    }
+
+    /// Returns `text` with every match replaced, borrowing it when nothing
+    /// matched.
+    pub fn redact<'a>(&self, text: &'a str) -> Cow<'a, str> {
+        let mut text = Cow::Borrowed(text);
+        for (regex, replacement) in &self.rules {
+            let replaced = match regex.replace_all(&text, replacement.as_str()) {
+                Cow::Owned(replaced) => Some(replaced),
+                Cow::Borrowed(_) => None,
+            };
+            if let Some(replaced) = replaced {
+                text = Cow::Owned(replaced);
+            }
+        }
+        text
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn redactor(patterns: &[&str]) -> Redactor {
+        Redactor::new(&RedactionConfig {
+            enabled: true,
+            patterns: patterns.iter().map(|p| p.to_string()).collect(),
+        })
+    }
+
+    #[test]
+    fn test_builtin_rules_keep_surrounding_text() {
+        let text = "client = Client(api_key=\"sk-live_4f9aT2mQ8xZ1bN7cR3vK\")\n\
+                    # Contact jane.doe@example.com for access.\n";
+
+        let redacted = redactor(&[]).redact(text);
+
+        assert_eq!(
+            redacted,
+            "client = Client(api_key=[REDACTED])\n\
+             # Contact [REDACTED_EMAIL] for access.\n"
+        );
+    }
+
+    #[test]
+    fn test_custom_patterns_and_untouched_text() {
+        let redactor = redactor(&[r"INTERNAL-\d+", "(unclosed"]);
+
+        assert_eq!(
+            redactor.redact("see INTERNAL-4521 for details"),
+            "see [REDACTED] for details"
+        );
+        assert!(matches!(
+            redactor.redact("nothing secret here"),
+            Cow::Borrowed(_)
+        ));
+    }
+}
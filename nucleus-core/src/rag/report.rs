@@ -0,0 +1,119 @@
+//! Progress and outcome of indexing a directory.
+
+use std::fmt;
+use std::path::PathBuf;
+use std::time::Duration;
+
+/// What a directory index did, returned by
+/// [`RagEngine::index_directory`](super::RagEngine::index_directory).
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct IndexResult {
+    /// Files whose chunks were added.
+    pub files_indexed: usize,
+    /// Files left out because they are empty, binary or produced no chunks.
+    pub files_skipped: usize,
+    /// Chunks added across all indexed files.
+    pub chunks_added: usize,
+    /// Files that couldn't be read. The rest of the directory is still indexed.
+    pub errors: Vec<FileError>,
+    pub duration: Duration,
+}
+
+/// A file that failed to index.
+#[derive(Debug, Clone, PartialEq)]
+pub struct FileError {
+    pub path: PathBuf,
+    pub error: String,
+}
+
+impl IndexResult {
+    /// Adds the counts of another run, e.g. of a second directory.
+    pub fn merge(&mut self, other: IndexResult) {
+        self.files_indexed += other.files_indexed;
+        self.files_skipped += other.files_skipped;
+        self.chunks_added += other.chunks_added;
+        self.errors.extend(other.errors);
+        self.duration += other.duration;
+    }
+}
+
+/// Reported while a directory is indexed, through
+/// [`RagEngine::index_directory_with_progress`](super::RagEngine::index_directory_with_progress).
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum IndexProgress {
+    /// Indexing of the `index`th of `total` files (1-based) has started.
+    File {
+        path: PathBuf,
+        index: usize,
+        total: usize,
+    },
+    /// `embedded` of the file's `total` chunks are embedded and stored.
+    ///
+    /// Sent after each embedding batch that ends partway through a file, so
+    /// files with more chunks than fit in one batch don't look stalled.
+    Chunks {
+        path: PathBuf,
+        embedded: usize,
+        total: usize,
+    },
+}
+
+/// `[3/10] src/main.rs` for a file, `src/main.rs: 120/400 chunks` within one.
+impl fmt::Display for IndexProgress {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            Self::File { path, index, total } => {
+                write!(f, "[{}/{}] {}", index, total, path.display())
+            }
+            Self::Chunks {
+                path,
+                embedded,
+                total,
+            } => write!(f, "{}: {}/{} chunks", path.display(), embedded, total),
+        }
+    }
+}
+
+/// `Indexed <n> files (<n> chunks) in <secs>s, skipped <n>, <n> failed`,
+/// followed by one line per failed file.
+impl fmt::Display for IndexResult {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "Indexed {} files ({} chunks) in {:.1}s, skipped {}, {} failed",
+            self.files_indexed,
+            self.chunks_added,
+            self.duration.as_secs_f64(),
+            self.files_skipped,
+            self.errors.len()
+        )?;
+        for error in &self.errors {
+            write!(f, "\n  {}: {}", error.path.display(), error.error)?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_display_lists_failed_files() {
+        let result = IndexResult {
+            files_indexed: 3,
+            files_skipped: 1,
+            chunks_added: 7,
+            errors: vec![FileError {
+                path: PathBuf::from("src/secret.rs"),
+                error: "Permission denied".to_string(),
+            }],
+            duration: Duration::from_millis(1300),
+        };
+
+        assert_eq!(
+            result.to_string(),
+            "Indexed 3 files (7 chunks) in 1.3s, skipped 1, 1 failed\n  src/secret.rs: Permission denied"
+        );
+    }
+}
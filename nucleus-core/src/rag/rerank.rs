@@ -0,0 +1,79 @@
+//! Keyword reranking of retrieved candidates.
+//!
+//! Vector similarity favors chunks that repeat one strong term, even when
+//! another chunk mentions every term of the query. Reranking re-orders the
+//! candidates by their vector score blended with the share of query terms
+//! each one contains, before `min_score`, dedup and `top_k` are applied.
+//! Scores themselves are left as the vector scores.
+
+use super::types::SearchResult;
+use std::collections::HashSet;
+
+/// Weight of query term coverage against the vector score.
+const KEYWORD_WEIGHT: f32 = 0.5;
+
+/// Re-orders `results` best first by blended score. Ties keep their order.
+pub fn rerank(query: &str, results: Vec<SearchResult>) -> Vec<SearchResult> {
+    let terms = terms(query);
+    if terms.is_empty() {
+        return results;
+    }
+
+    let blended = |result: &SearchResult| {
+        let content = terms_of(&result.document.content);
+        let covered = terms.intersection(&content).count();
+        let coverage = covered as f32 / terms.len() as f32;
+        (1.0 - KEYWORD_WEIGHT) * result.score + KEYWORD_WEIGHT * coverage
+    };
+
+    let mut keyed: Vec<(f32, SearchResult)> = results
+        .into_iter()
+        .map(|result| (blended(&result), result))
+        .collect();
+    keyed.sort_by(|a, b| b.0.partial_cmp(&a.0).unwrap_or(std::cmp::Ordering::Equal));
+    keyed.into_iter().map(|(_, result)| result).collect()
+}
+
+/// Lowercase words of a query, ignoring one-letter words.
+fn terms(query: &str) -> HashSet<String> {
+    terms_of(query)
+        .into_iter()
+        .filter(|term| term.chars().count() > 1)
+        .collect()
+}
+
+fn terms_of(text: &str) -> HashSet<String> {
+    text.split(|c: char| !c.is_alphanumeric())
+        .filter(|word| !word.is_empty())
+        .map(str::to_lowercase)
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rag::Document;
+
+    fn result(id: &str, content: &str, score: f32) -> SearchResult {
+        SearchResult {
+            document: Document::new(id, content, vec![]),
+            score,
+        }
+    }
+
+    #[test]
+    fn test_full_coverage_outranks_a_repeated_term() {
+        let results = vec![
+            result("a", "retry retry retry", 0.7),
+            result("b", "retry after a timeout", 0.45),
+            result("c", "unrelated", 0.1),
+        ];
+
+        let ids: Vec<String> = rerank("retry timeout", results)
+            .into_iter()
+            .map(|result| result.document.id)
+            .collect();
+
+        assert_eq!(ids, vec!["b", "a", "c"]);
+    }
+}
@@ -0,0 +1,99 @@
+//! Roots of completed directory indexes.
+//!
+//! With embedded storage the roots are written to `indexed_roots.json` under
+//! the storage path, next to the documents they describe, so indexing the same
+//! directory again after a restart is still caught. Other backends keep them
+//! for the life of the engine.
+
+use std::collections::HashSet;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+const ROOTS_FILE: &str = "indexed_roots.json";
+
+/// The indexed roots of an engine, shared between its clones.
+#[derive(Debug, Default)]
+pub(crate) struct IndexedRoots {
+    roots: Mutex<HashSet<PathBuf>>,
+    /// Where the roots are saved, if anywhere.
+    file: Option<PathBuf>,
+}
+
+impl IndexedRoots {
+    /// Loads the roots saved under `storage_path`. An unreadable file counts
+    /// as no roots.
+    pub fn load(storage_path: Option<&Path>) -> Self {
+        let file = storage_path.map(|path| path.join(ROOTS_FILE));
+        let roots = file
+            .as_deref()
+            .and_then(|file| std::fs::read(file).ok())
+            .and_then(|json| serde_json::from_slice::<HashSet<PathBuf>>(&json).ok())
+            .unwrap_or_default();
+
+        Self {
+            roots: Mutex::new(roots),
+            file,
+        }
+    }
+
+    /// Records `root`, which must already be canonical.
+    pub fn insert(&self, root: PathBuf) {
+        let mut roots = self.roots.lock().unwrap();
+        if roots.insert(root) {
+            self.save(&roots);
+        }
+    }
+
+    /// Whether `dir`, or a directory it is inside of, was indexed. `dir` must
+    /// already be canonical.
+    pub fn covers(&self, dir: &Path) -> bool {
+        self.roots
+            .lock()
+            .unwrap()
+            .iter()
+            .any(|root| dir.starts_with(root))
+    }
+
+    pub fn clear(&self) {
+        let mut roots = self.roots.lock().unwrap();
+        roots.clear();
+        self.save(&roots);
+    }
+
+    fn save(&self, roots: &HashSet<PathBuf>) {
+        let Some(file) = &self.file else {
+            return;
+        };
+        let saved = serde_json::to_vec(roots)
+            .map_err(std::io::Error::from)
+            .and_then(|json| {
+                if let Some(parent) = file.parent() {
+                    std::fs::create_dir_all(parent)?;
+                }
+                std::fs::write(file, json)
+            });
+        if let Err(e) = saved {
+            tracing::warn!("Failed to save indexed roots to {}: {}", file.display(), e);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_roots_survive_reload() {
+        let storage = tempfile::tempdir().unwrap();
+        let roots = IndexedRoots::load(Some(storage.path()));
+        roots.insert(PathBuf::from("/repo"));
+
+        let reloaded = IndexedRoots::load(Some(storage.path()));
+        assert!(reloaded.covers(Path::new("/repo")));
+        assert!(reloaded.covers(Path::new("/repo/src")));
+        assert!(!reloaded.covers(Path::new("/repository")));
+
+        reloaded.clear();
+        assert!(!IndexedRoots::load(Some(storage.path())).covers(Path::new("/repo")));
+    }
+}
@@ -0,0 +1,197 @@
+//! Labelled copies of the knowledge base to roll back to.
+//!
+//! A snapshot is a full copy of every document, embeddings included, written
+//! as JSON to `snapshots/<label>.json` under the storage path. Rolling back
+//! replaces the collection with the copy, so nothing is re-embedded.
+//!
+//! A snapshot file doubles as an export of the knowledge base. Files from
+//! elsewhere can be checked with [`validate`] before they are rolled back to.
+
+use super::types::Document;
+use serde_json::Value;
+use std::collections::HashSet;
+use std::fmt;
+use std::io;
+use std::path::{Path, PathBuf};
+
+const SNAPSHOT_DIR: &str = "snapshots";
+
+/// Whether `label` can name a snapshot file: letters, digits, `-`, `_`
+/// and `.`, not starting with a `.`.
+pub(crate) fn is_valid_label(label: &str) -> bool {
+    !label.is_empty()
+        && !label.starts_with('.')
+        && label
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '_' | '.'))
+}
+
+pub(crate) fn snapshot_path(storage_path: &Path, label: &str) -> PathBuf {
+    storage_path
+        .join(SNAPSHOT_DIR)
+        .join(format!("{}.json", label))
+}
+
+pub(crate) async fn write(path: &Path, documents: &[Document]) -> io::Result<()> {
+    if let Some(parent) = path.parent() {
+        tokio::fs::create_dir_all(parent).await?;
+    }
+    let json = serde_json::to_vec(documents)?;
+    tokio::fs::write(path, json).await
+}
+
+pub(crate) async fn read(path: &Path) -> io::Result<Vec<Document>> {
+    let json = tokio::fs::read(path).await?;
+    Ok(serde_json::from_slice(&json)?)
+}
+
+/// Labels of the snapshots under `storage_path`, sorted.
+pub(crate) fn labels(storage_path: &Path) -> Vec<String> {
+    let Ok(entries) = std::fs::read_dir(storage_path.join(SNAPSHOT_DIR)) else {
+        return Vec::new();
+    };
+
+    let mut labels: Vec<String> = entries
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| {
+            let name = entry.file_name().to_string_lossy().to_string();
+            name.strip_suffix(".json").map(str::to_string)
+        })
+        .collect();
+    labels.sort();
+    labels
+}
+
+/// What [`validate`] found in an export file.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct ExportReport {
+    /// Number of records in the file.
+    pub records: usize,
+    /// Dimension the records were checked against.
+    pub dimension: usize,
+    /// One entry per problem, naming the record it was found in.
+    pub issues: Vec<String>,
+}
+
+impl ExportReport {
+    pub fn is_valid(&self) -> bool {
+        self.issues.is_empty()
+    }
+}
+
+/// `12 records, all valid for 768-dimensional embeddings`, or the issues.
+impl fmt::Display for ExportReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.is_valid() {
+            return write!(
+                f,
+                "{} records, all valid for {}-dimensional embeddings",
+                self.records, self.dimension
+            );
+        }
+        write!(
+            f,
+            "{} records, {} issues:\n  {}",
+            self.records,
+            self.issues.len(),
+            self.issues.join("\n  ")
+        )
+    }
+}
+
+/// Checks that `json` is an export that could be imported into a collection
+/// embedded with `dimension`-length vectors, without importing it.
+///
+/// Each record must parse as a document, with a unique non-empty ID and an
+/// embedding of `dimension` values.
+pub(crate) fn validate(json: &[u8], dimension: usize) -> ExportReport {
+    let mut report = ExportReport {
+        dimension,
+        ..ExportReport::default()
+    };
+    let records: Vec<Value> = match serde_json::from_slice(json) {
+        Ok(Value::Array(records)) => records,
+        Ok(_) => {
+            report
+                .issues
+                .push("not an export: expected a JSON array of documents".to_string());
+            return report;
+        }
+        Err(e) => {
+            report.issues.push(format!("not valid JSON: {}", e));
+            return report;
+        }
+    };
+    report.records = records.len();
+
+    let mut ids = HashSet::new();
+    for (index, record) in records.into_iter().enumerate() {
+        let number = index + 1;
+        let document: Document = match serde_json::from_value(record) {
+            Ok(document) => document,
+            Err(e) => {
+                report.issues.push(format!("record {}: {}", number, e));
+                continue;
+            }
+        };
+
+        let mut problems = Vec::new();
+        if document.id.is_empty() {
+            problems.push("empty id".to_string());
+        } else if !ids.insert(document.id.clone()) {
+            problems.push("duplicate id".to_string());
+        }
+        if document.embedding.len() != dimension {
+            problems.push(format!(
+                "embedding has {} values, expected {}",
+                document.embedding.len(),
+                dimension
+            ));
+        }
+        for problem in problems {
+            report
+                .issues
+                .push(format!("record {} ({}): {}", number, document.id, problem));
+        }
+    }
+    report
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn export(documents: &[Document]) -> Vec<u8> {
+        serde_json::to_vec(documents).unwrap()
+    }
+
+    #[test]
+    fn test_validate_reports_dimension_mismatches() {
+        let valid = export(&[
+            Document::new("a_0", "alpha", vec![0.1, 0.2, 0.3]),
+            Document::new("b_0", "beta", vec![0.3, 0.2, 0.1]).with_metadata("source", "b.md"),
+        ]);
+        let report = validate(&valid, 3);
+        assert!(report.is_valid());
+        assert_eq!(
+            report.to_string(),
+            "2 records, all valid for 3-dimensional embeddings"
+        );
+
+        let mismatched = export(&[
+            Document::new("a_0", "alpha", vec![0.1, 0.2, 0.3]),
+            Document::new("b_0", "beta", vec![0.1, 0.2]),
+        ]);
+        let report = validate(&mismatched, 3);
+        assert_eq!(report.records, 2);
+        assert_eq!(
+            report.issues,
+            vec!["record 2 (b_0): embedding has 2 values, expected 3"]
+        );
+
+        let report = validate(br#"[{"id": "a_0", "content": "alpha"}]"#, 3);
+        assert_eq!(report.issues.len(), 1);
+        assert!(report.issues[0].starts_with("record 1: missing field `embedding`"));
+        assert!(!validate(b"{}", 3).is_valid());
+    }
+}
@@ -0,0 +1,168 @@
+//! Comparing what the index holds for a file with the file on disk.
+//!
+//! The indexed content is rebuilt from the file's stored chunks, in chunk
+//! order with the overlap between neighbours removed, then diffed line by
+//! line against the current file. Chunks of structured files are split by
+//! key rather than cut from the text, so their rebuilt content is only an
+//! approximation. Neither is the content of chunks left out by
+//! `rag.indexer.skip_blank`: the whitespace they held is missing from the
+//! rebuilt text, so blank lines there can show up as added.
+
+use std::fmt;
+
+/// A line that differs between the index and the file on disk.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum DiffLine {
+    /// In the index but no longer in the file, with its indexed line number.
+    Removed(usize, String),
+    /// In the file but not in the index, with its line number on disk.
+    Added(usize, String),
+}
+
+/// How a source's indexed content differs from the file on disk, returned by
+/// [`RagEngine::diff_source`](super::RagEngine::diff_source).
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct SourceDiff {
+    pub source: String,
+    /// Whether the file's content hash matches the one stored at indexing.
+    /// Chunks indexed before hashes were stored never match.
+    pub hash_matches: bool,
+    /// Differing lines in file order. Empty when the file is unchanged.
+    pub lines: Vec<DiffLine>,
+}
+
+impl SourceDiff {
+    /// Whether the index is out of date for this file.
+    pub fn has_drift(&self) -> bool {
+        !self.hash_matches || !self.lines.is_empty()
+    }
+}
+
+/// `<source> matches the index`, or the differing lines marked `-` for
+/// indexed and `+` for on disk.
+impl fmt::Display for SourceDiff {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if !self.has_drift() {
+            return write!(f, "{} matches the index", self.source);
+        }
+        if self.lines.is_empty() {
+            return write!(
+                f,
+                "{} changed since it was indexed, but no lines differ",
+                self.source
+            );
+        }
+
+        write!(f, "{} changed since it was indexed:", self.source)?;
+        for line in &self.lines {
+            match line {
+                DiffLine::Removed(number, text) => write!(f, "\n- {:>4} | {}", number, text)?,
+                DiffLine::Added(number, text) => write!(f, "\n+ {:>4} | {}", number, text)?,
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Joins chunks back into the text they were cut from. The longest end of
+/// the text so far, up to `max_overlap` bytes, that the next chunk starts with
+/// is only kept once.
+pub(crate) fn reconstruct<'a>(
+    chunks: impl IntoIterator<Item = &'a str>,
+    max_overlap: usize,
+) -> String {
+    let mut text = String::new();
+    for chunk in chunks {
+        let overlap = (1..=chunk.len().min(text.len()).min(max_overlap))
+            .rev()
+            .filter(|&len| chunk.is_char_boundary(len))
+            .find(|&len| text.ends_with(&chunk[..len]))
+            .unwrap_or(0);
+        text.push_str(&chunk[overlap..]);
+    }
+    text
+}
+
+/// Lines removed from `indexed` and added in `current`, from their longest
+/// common subsequence of lines.
+pub(crate) fn diff_lines(indexed: &str, current: &str) -> Vec<DiffLine> {
+    let old: Vec<&str> = indexed.lines().collect();
+    let new: Vec<&str> = current.lines().collect();
+
+    // Only the middle that differs needs the quadratic table.
+    let prefix = old.iter().zip(&new).take_while(|(a, b)| a == b).count();
+    let suffix = old[prefix..]
+        .iter()
+        .rev()
+        .zip(new[prefix..].iter().rev())
+        .take_while(|(a, b)| a == b)
+        .count();
+    let old_middle = &old[prefix..old.len() - suffix];
+    let new_middle = &new[prefix..new.len() - suffix];
+
+    // common[i][j]: length of the longest common subsequence of
+    // old_middle[i..] and new_middle[j..].
+    let mut common = vec![vec![0usize; new_middle.len() + 1]; old_middle.len() + 1];
+    for i in (0..old_middle.len()).rev() {
+        for j in (0..new_middle.len()).rev() {
+            common[i][j] = if old_middle[i] == new_middle[j] {
+                common[i + 1][j + 1] + 1
+            } else {
+                common[i + 1][j].max(common[i][j + 1])
+            };
+        }
+    }
+
+    let mut lines = Vec::new();
+    let (mut i, mut j) = (0, 0);
+    while i < old_middle.len() || j < new_middle.len() {
+        if i < old_middle.len() && j < new_middle.len() && old_middle[i] == new_middle[j] {
+            i += 1;
+            j += 1;
+        } else if j == new_middle.len()
+            || (i < old_middle.len() && common[i + 1][j] >= common[i][j + 1])
+        {
+            lines.push(DiffLine::Removed(prefix + i + 1, old_middle[i].to_string()));
+            i += 1;
+        } else {
+            lines.push(DiffLine::Added(prefix + j + 1, new_middle[j].to_string()));
+            j += 1;
+        }
+    }
+    lines
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_reconstruct_drops_overlap_between_chunks() {
+        let chunks = ["0123456789", "89ABCDEF"];
+        assert_eq!(reconstruct(chunks, 2), "0123456789ABCDEF");
+        assert_eq!(reconstruct(["ab\n", "\ncd"], 0), "ab\n\ncd");
+    }
+
+    #[test]
+    fn test_reconstruct_overlap_is_capped() {
+        // Repeated text matches far more than the configured overlap.
+        let chunks = ["aaaa\naaaa\n", "a\naaaa\nbb"];
+        assert_eq!(reconstruct(chunks, 2), "aaaa\naaaa\naaaa\nbb");
+    }
+
+    #[test]
+    fn test_diff_lines_reports_changed_lines() {
+        let indexed = "fn a() {}\nfn b() {}\nfn c() {}\n";
+        let current = "fn a() {}\nfn b2() {}\nfn c() {}\nfn d() {}\n";
+
+        assert_eq!(
+            diff_lines(indexed, current),
+            vec![
+                DiffLine::Removed(2, "fn b() {}".to_string()),
+                DiffLine::Added(2, "fn b2() {}".to_string()),
+                DiffLine::Added(4, "fn d() {}".to_string()),
+            ]
+        );
+        assert!(diff_lines(indexed, indexed).is_empty());
+    }
+}
@@ -3,11 +3,13 @@
 //! This module provides a unified interface for different vector database implementations.
 
 use super::lancedb_store::LanceDbStore;
+use super::memory_store::MemoryStore;
 use super::qdrant_store::QdrantStore;
 use super::types::{Document, SearchResult};
 use crate::config::{StorageConfig, StorageMode};
 use anyhow::Result;
 use async_trait::async_trait;
+use std::collections::HashMap;
 use std::sync::Arc;
 
 /// Unified interface for vector database operations.
@@ -23,12 +25,12 @@ pub trait VectorStore: Send + Sync {
     /// # Arguments
     ///
     /// * `query_embedding` - The embedding vector to search for
-    /// * `top_k` - Maximum number of results to return
+    /// * `limit` - Maximum number of results to return
     ///
     /// # Returns
     ///
     /// A vector of search results, sorted by descending similarity score.
-    async fn search(&self, query_embedding: &[f32]) -> Result<Vec<SearchResult>>;
+    async fn search(&self, query_embedding: &[f32], limit: usize) -> Result<Vec<SearchResult>>;
 
     /// Returns the total number of documents in the store.
     async fn count(&self) -> Result<usize>;
@@ -39,6 +41,20 @@ pub trait VectorStore: Send + Sync {
     /// Returns all unique source file paths that have been indexed.
     async fn get_indexed_paths(&self) -> Result<Vec<String>>;
 
+    /// Returns the number of documents stored for each source.
+    ///
+    /// The default counts [`documents`](Self::documents); stores override it
+    /// to read only the sources.
+    async fn source_counts(&self) -> Result<HashMap<String, usize>> {
+        let mut counts = HashMap::new();
+        for document in self.documents().await? {
+            if let Some(source) = document.metadata.get("source") {
+                *counts.entry(source.clone()).or_default() += 1;
+            }
+        }
+        Ok(counts)
+    }
+
     /// Removes all documents with a matching source path.
     ///
     /// # Arguments
@@ -49,12 +65,64 @@ pub trait VectorStore: Send + Sync {
     ///
     /// The number of documents removed.
     async fn remove_by_source(&self, source_path: &str) -> Result<usize>;
+
+    /// Removes all documents from any of the files in `sources`.
+    ///
+    /// The default calls [`remove_by_source`](Self::remove_by_source) for each;
+    /// stores override it to remove them all in one pass instead of scanning
+    /// once per file.
+    ///
+    /// # Returns
+    ///
+    /// The number of documents removed.
+    async fn remove_by_sources(&self, sources: &[String]) -> Result<usize> {
+        let mut removed = 0;
+        for source in sources {
+            removed += self.remove_by_source(source).await?;
+        }
+        Ok(removed)
+    }
+
+    /// Fetches a single document by ID. The embedding may be left empty.
+    async fn get(&self, id: &str) -> Result<Option<Document>>;
+
+    /// Replaces the metadata of the document with the given ID.
+    ///
+    /// # Returns
+    ///
+    /// `false` if no document has that ID.
+    async fn update_metadata(&self, id: &str, metadata: HashMap<String, String>) -> Result<bool>;
+
+    /// Returns every document in the store, with its embedding.
+    ///
+    /// Used to copy documents between stores without re-embedding them.
+    /// Stores that can't list their contents keep the default, which fails.
+    async fn documents(&self) -> Result<Vec<Document>> {
+        Err(anyhow::anyhow!(
+            "This vector store cannot list its documents"
+        ))
+    }
+
+    /// Returns the documents stored for the file `source`, with their
+    /// embeddings. `source` must match the stored source exactly.
+    ///
+    /// The default filters [`documents`](Self::documents); stores override it
+    /// to filter in the store instead of loading every document.
+    async fn documents_by_source(&self, source: &str) -> Result<Vec<Document>> {
+        Ok(self
+            .documents()
+            .await?
+            .into_iter()
+            .filter(|document| document.metadata.get("source").map(String::as_str) == Some(source))
+            .collect())
+    }
 }
 
 /// Creates a vector store instance based on the storage mode.
 ///
 /// - `Embedded` mode uses LanceDB for zero-setup, in-process storage
 /// - `Grpc` mode uses Qdrant for remote server connectivity
+/// - `Memory` mode keeps everything in process memory, unpersisted
 ///
 /// # Arguments
 ///
@@ -77,5 +145,8 @@ pub async fn create_vector_store(
             let store = QdrantStore::new(storage_config, vector_size).await?;
             Ok(Arc::new(store))
         }
+        StorageMode::Memory { .. } => Ok(Arc::new(
+            MemoryStore::new().with_similarity(storage_config.vector_db.similarity),
+        )),
     }
 }
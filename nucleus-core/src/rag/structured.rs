@@ -0,0 +1,202 @@
+//! Chunking for structured data files.
+//!
+//! JSON and YAML files are split by top-level keys so each chunk is a whole
+//! config block rather than an arbitrary character window. Sections too large
+//! for one chunk are split by their own keys, and values that still don't fit
+//! fall back to character chunking.
+
+use super::indexer::chunk_text;
+use serde_yaml::{Mapping, Value};
+use std::path::Path;
+
+/// A chunk of a structured file and the key path it came from.
+#[derive(Debug, Clone, PartialEq)]
+pub(crate) struct StructuredChunk {
+    pub content: String,
+    /// Dotted path of the section, e.g. `server.tls`.
+    pub key_path: String,
+}
+
+/// Structured data formats with key-aware chunking.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum Format {
+    Json,
+    Yaml,
+}
+
+impl Format {
+    /// The format for a file, judged by its extension.
+    pub(crate) fn from_path(path: &Path) -> Option<Self> {
+        match path.extension()?.to_str()? {
+            "json" => Some(Self::Json),
+            "yaml" | "yml" => Some(Self::Yaml),
+            _ => None,
+        }
+    }
+
+    fn parse(self, text: &str) -> Option<Value> {
+        match self {
+            Self::Json => {
+                let value: serde_json::Value = serde_json::from_str(text).ok()?;
+                serde_yaml::to_value(value).ok()
+            }
+            Self::Yaml => serde_yaml::from_str(text).ok(),
+        }
+    }
+
+    fn render(self, value: &Value) -> Option<String> {
+        match self {
+            Self::Json => serde_json::to_string_pretty(value).ok(),
+            Self::Yaml => serde_yaml::to_string(value).ok(),
+        }
+    }
+}
+
+/// Splits a structured document into one chunk per top-level key.
+///
+/// Returns `None` if the text doesn't parse or isn't a non-empty mapping, in
+/// which case the caller should chunk it as plain text.
+pub(crate) fn chunk_structured(
+    format: Format,
+    text: &str,
+    chunk_size: usize,
+    overlap: usize,
+) -> Option<Vec<StructuredChunk>> {
+    let Value::Mapping(root) = format.parse(text)? else {
+        return None;
+    };
+    if root.is_empty() {
+        return None;
+    }
+
+    let mut chunks = Vec::new();
+    for (key, value) in &root {
+        push_section(
+            format,
+            vec![key_name(key)],
+            value,
+            chunk_size,
+            overlap,
+            &mut chunks,
+        );
+    }
+    Some(chunks)
+}
+
+fn push_section(
+    format: Format,
+    path: Vec<String>,
+    value: &Value,
+    chunk_size: usize,
+    overlap: usize,
+    chunks: &mut Vec<StructuredChunk>,
+) {
+    let rendered = format.render(&nest(&path, value)).unwrap_or_default();
+
+    if rendered.len() <= chunk_size {
+        chunks.push(StructuredChunk {
+            content: rendered,
+            key_path: path.join("."),
+        });
+        return;
+    }
+
+    match value {
+        Value::Mapping(map) if !map.is_empty() => {
+            for (key, child) in map {
+                let mut child_path = path.clone();
+                child_path.push(key_name(key));
+                push_section(format, child_path, child, chunk_size, overlap, chunks);
+            }
+        }
+        _ => {
+            let key_path = path.join(".");
+            chunks.extend(
+                chunk_text(&rendered, chunk_size, overlap)
+                    .into_iter()
+                    .map(|content| StructuredChunk {
+                        content,
+                        key_path: key_path.clone(),
+                    }),
+            );
+        }
+    }
+}
+
+/// Wraps `value` in mappings for each key in `path`, so a chunk shows where
+/// in the file it lives.
+fn nest(path: &[String], value: &Value) -> Value {
+    path.iter().rev().fold(value.clone(), |inner, key| {
+        let mut mapping = Mapping::new();
+        mapping.insert(Value::String(key.clone()), inner);
+        Value::Mapping(mapping)
+    })
+}
+
+fn key_name(key: &Value) -> String {
+    match key {
+        Value::String(key) => key.clone(),
+        other => serde_yaml::to_string(other)
+            .map(|s| s.trim().to_string())
+            .unwrap_or_default(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const FIXTURE: &str = "\
+llm:
+  model: qwen3:8b
+  temperature: 0.7
+rag:
+  embedding_model:
+    name: nomic-embed-text
+    dim: 768
+  indexer:
+    chunk_size: 512
+    exclude_patterns: [target, node_modules, .git]
+storage:
+  mode: embedded
+";
+
+    #[test]
+    fn test_yaml_chunks_align_to_top_level_keys() {
+        let chunks = chunk_structured(Format::Yaml, FIXTURE, 512, 50).unwrap();
+        let paths: Vec<&str> = chunks.iter().map(|c| c.key_path.as_str()).collect();
+
+        assert_eq!(paths, vec!["llm", "rag", "storage"]);
+        assert!(chunks[0].content.starts_with("llm:"));
+        assert!(chunks[1].content.contains("chunk_size: 512"));
+        assert!(!chunks[1].content.contains("qwen3"));
+    }
+
+    #[test]
+    fn test_oversized_section_splits_by_nested_keys() {
+        let chunks = chunk_structured(Format::Yaml, FIXTURE, 120, 10).unwrap();
+        let paths: Vec<&str> = chunks.iter().map(|c| c.key_path.as_str()).collect();
+
+        assert_eq!(
+            paths,
+            vec!["llm", "rag.embedding_model", "rag.indexer", "storage"]
+        );
+        assert!(chunks[2].content.starts_with("rag:\n  indexer:"));
+    }
+
+    #[test]
+    fn test_oversized_scalar_falls_back_to_character_chunks() {
+        let text = format!("{{\"notes\": \"{}\"}}", "x".repeat(100));
+        let chunks = chunk_structured(Format::Json, &text, 40, 0).unwrap();
+
+        assert!(chunks.len() > 1);
+        assert!(chunks.iter().all(|c| c.key_path == "notes"));
+        assert!(chunks.iter().all(|c| c.content.len() <= 40));
+    }
+
+    #[test]
+    fn test_unstructured_input_is_rejected() {
+        assert!(chunk_structured(Format::Json, "not json", 512, 50).is_none());
+        assert!(chunk_structured(Format::Yaml, "- a\n- b\n", 512, 50).is_none());
+    }
+}
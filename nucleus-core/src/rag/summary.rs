@@ -0,0 +1,61 @@
+//! LLM-written chunk summaries for summary indexing.
+//!
+//! Raw code chunks often embed poorly against conceptual questions ("where do
+//! we retry failed requests?"). With summary indexing each chunk is summarized
+//! by the chat model while indexing, and the summary is embedded in place of
+//! the chunk. The raw chunk is still what gets stored and added to prompts.
+
+use crate::provider::{ChatRequest, Message, Provider, ProviderError};
+use std::sync::Arc;
+
+/// Instruction sent with every chunk.
+const SUMMARY_PROMPT: &str = "Summarize what the following content does or describes in one or \
+two plain sentences. Mention the important names it defines or uses. Reply with the summary only.";
+
+/// Asks a chat model for a short summary of each chunk.
+#[derive(Clone)]
+pub struct Summarizer {
+    provider: Arc<dyn Provider>,
+    model: String,
+}
+
+impl Summarizer {
+    pub fn new(provider: Arc<dyn Provider>, model: impl Into<String>) -> Self {
+        Self {
+            provider,
+            model: model.into(),
+        }
+    }
+
+    /// Summarizes one chunk. Falls back to the chunk itself if the model
+    /// returns an empty reply.
+    pub async fn summarize(&self, chunk: &str) -> Result<String, ProviderError> {
+        let request = ChatRequest::new(
+            &self.model,
+            vec![
+                Message::system(None, SUMMARY_PROMPT),
+                Message::user(None, chunk),
+            ],
+        )
+        .with_temperature(0.0);
+
+        let mut summary = String::new();
+        self.provider
+            .chat(
+                request,
+                Box::new(|response| {
+                    if !response.done {
+                        summary.push_str(&response.content);
+                    }
+                }),
+            )
+            .await?;
+
+        let summary = summary.trim();
+        Ok(if summary.is_empty() {
+            chunk.to_string()
+        } else {
+            summary.to_string()
+        })
+    }
+}
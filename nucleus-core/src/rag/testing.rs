@@ -0,0 +1,66 @@
+//! Test doubles for exercising the RAG pipeline without a vector database.
+
+use super::conversation::Conversations;
+use super::indexer::Indexer;
+use super::store::VectorStore;
+use super::{Embedder, RagEngine, RetrievalCache};
+use crate::config::{ConversationRecallConfig, IndexerConfig, RagConfig};
+use crate::models::EmbeddingModel;
+use crate::provider::Provider;
+use std::sync::Arc;
+
+pub(crate) use super::memory_store::MemoryStore;
+
+/// Builds an engine around `provider` and `store` with default indexing settings
+/// and a `top_k` of 5.
+///
+/// Exclude patterns are cleared because temporary directories live under
+/// `/tmp`, which the default `tmp` pattern would skip entirely.
+pub(crate) fn test_engine(provider: Arc<dyn Provider>, store: Arc<dyn VectorStore>) -> RagEngine {
+    let indexer_config = IndexerConfig {
+        exclude_patterns: Vec::new(),
+        ..IndexerConfig::default()
+    };
+
+    RagEngine {
+        embedder: Embedder::new(provider, EmbeddingModel::default()),
+        store,
+        indexer: Indexer::new(indexer_config),
+        cache: Arc::new(RetrievalCache::default()),
+        session: Arc::new(MemoryStore::new()),
+        conversations: Arc::new(Conversations::new(
+            Default::default(),
+            ConversationRecallConfig::default().max_turns,
+        )),
+        storage_path: None,
+        min_score: None,
+        citations: Default::default(),
+        inline_metadata: false,
+        top_k: 5,
+        candidate_multiplier: RagConfig::default().candidate_multiplier,
+        summarizer: None,
+        max_documents: None,
+        rerank: false,
+        max_context_docs: None,
+        empty_notice: Default::default(),
+        empty_notice_sent: Arc::default(),
+        pinned: Arc::default(),
+        contextual_chunks: false,
+        embed_without_comments: false,
+        prepend_source_path: false,
+        index_paths: false,
+        trivial_queries: Default::default(),
+        jobs: Arc::default(),
+        indexed_roots: Arc::default(),
+        collection: None,
+        collections: Arc::default(),
+    }
+}
+
+impl RagEngine {
+    /// Turns on `rag.inline_metadata`, for tests outside this module.
+    pub(crate) fn with_inline_metadata(mut self) -> Self {
+        self.inline_metadata = true;
+        self
+    }
+}
@@ -0,0 +1,169 @@
+//! Diagnostics explaining which retrieved chunks were kept and why.
+
+use super::types::SearchResult;
+use std::collections::HashSet;
+use std::time::Duration;
+use tracing::debug;
+
+/// Why a candidate chunk was left out of the retrieval result.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum DropReason {
+    /// Scored below `rag.min_score`.
+    BelowThreshold { min_score: f32 },
+    /// Same content as a higher-scored candidate.
+    Duplicate,
+    /// Passed every filter, but `top_k` better candidates already did.
+    BeyondTopK { top_k: usize },
+}
+
+/// One chunk returned by the vector search, and what happened to it.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Candidate {
+    pub id: String,
+    pub source: String,
+    pub score: f32,
+    /// `None` if the chunk made it into the result.
+    pub dropped: Option<DropReason>,
+}
+
+/// Record of a single retrieval: every candidate from the vector search, in
+/// score order, with the stage that dropped it if it was rejected.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct RetrievalTrace {
+    pub query: String,
+    pub candidates: Vec<Candidate>,
+}
+
+impl RetrievalTrace {
+    /// Candidates that made it into the result.
+    pub fn selected(&self) -> impl Iterator<Item = &Candidate> {
+        self.candidates.iter().filter(|c| c.dropped.is_none())
+    }
+
+    /// Candidates that were filtered out.
+    pub fn dropped(&self) -> impl Iterator<Item = &Candidate> {
+        self.candidates.iter().filter(|c| c.dropped.is_some())
+    }
+
+    /// Logs every candidate at debug level.
+    pub fn log(&self) {
+        for candidate in &self.candidates {
+            debug!(
+                target: "nucleus_core::rag",
+                query = %self.query,
+                id = %candidate.id,
+                source = %candidate.source,
+                score = candidate.score,
+                dropped = ?candidate.dropped,
+                "Retrieval candidate"
+            );
+        }
+    }
+}
+
+/// How long the phases of a search took, from
+/// [`RagEngine::time_search`](super::RagEngine::time_search).
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct SearchTimings {
+    /// Embedding the query.
+    pub embedding: Duration,
+    /// The vector search, reranking and filtering of its results.
+    pub retrieval: Duration,
+}
+
+/// Applies the score threshold and content dedup to raw search results, then
+/// keeps at most `top_k` of the survivors.
+///
+/// Results are expected in descending score order, so the first copy of any
+/// duplicated content is the one kept.
+pub(crate) fn filter_candidates(
+    query: &str,
+    results: Vec<SearchResult>,
+    min_score: Option<f32>,
+    top_k: usize,
+) -> (Vec<SearchResult>, RetrievalTrace) {
+    let mut seen = HashSet::new();
+    let mut kept = Vec::new();
+    let mut trace = RetrievalTrace {
+        query: query.to_string(),
+        candidates: Vec::with_capacity(results.len()),
+    };
+
+    for result in results {
+        let dropped = match min_score {
+            Some(min_score) if result.score < min_score => {
+                Some(DropReason::BelowThreshold { min_score })
+            }
+            _ if !seen.insert(result.document.content.clone()) => Some(DropReason::Duplicate),
+            _ if kept.len() >= top_k => Some(DropReason::BeyondTopK { top_k }),
+            _ => None,
+        };
+
+        trace.candidates.push(Candidate {
+            id: result.document.id.clone(),
+            source: result
+                .document
+                .metadata
+                .get("source")
+                .cloned()
+                .unwrap_or_default(),
+            score: result.score,
+            dropped,
+        });
+
+        if dropped.is_none() {
+            kept.push(result);
+        }
+    }
+
+    (kept, trace)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rag::Document;
+
+    fn result(id: &str, content: &str, score: f32) -> SearchResult {
+        SearchResult {
+            document: Document::new(id, content, vec![]).with_metadata("source", id),
+            score,
+        }
+    }
+
+    #[test]
+    fn test_trace_records_threshold_and_duplicates() {
+        let results = vec![
+            result("a", "fn main() {}", 0.9),
+            result("b", "fn main() {}", 0.8),
+            result("c", "fn helper() {}", 0.6),
+            result("d", "fn unrelated() {}", 0.1),
+        ];
+
+        let (kept, trace) = filter_candidates("main", results, Some(0.5), 10);
+
+        let kept_ids: Vec<_> = kept.iter().map(|r| r.document.id.as_str()).collect();
+        assert_eq!(kept_ids, vec!["a", "c"]);
+
+        assert_eq!(trace.candidates.len(), 4);
+        assert_eq!(trace.candidates[0].dropped, None);
+        assert_eq!(trace.candidates[1].dropped, Some(DropReason::Duplicate));
+        assert_eq!(trace.candidates[2].dropped, None);
+        assert_eq!(
+            trace.candidates[3].dropped,
+            Some(DropReason::BelowThreshold { min_score: 0.5 })
+        );
+        assert_eq!(trace.selected().count(), 2);
+        assert_eq!(trace.dropped().count(), 2);
+    }
+
+    #[test]
+    fn test_no_threshold_keeps_low_scores() {
+        let results = vec![result("a", "alpha", 0.2), result("b", "beta", -0.1)];
+
+        let (kept, trace) = filter_candidates("q", results, None, 10);
+
+        assert_eq!(kept.len(), 2);
+        assert_eq!(trace.dropped().count(), 0);
+    }
+}
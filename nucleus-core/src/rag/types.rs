@@ -60,3 +60,27 @@ pub struct SearchResult {
     pub document: Document,
     pub score: f32,
 }
+
+/// A retrieved chunk without the prompt formatting of
+/// [`format_context`](super::format_context), for programmatic consumers.
+///
+/// Unlike [`SearchResult`] it leaves out the embedding, so it serializes
+/// compactly.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct RetrievedChunk {
+    pub id: String,
+    pub content: String,
+    pub score: f32,
+    pub metadata: HashMap<String, String>,
+}
+
+impl From<&SearchResult> for RetrievedChunk {
+    fn from(result: &SearchResult) -> Self {
+        Self {
+            id: result.document.id.clone(),
+            content: result.document.content.clone(),
+            score: result.score,
+            metadata: result.document.metadata.clone(),
+        }
+    }
+}
@@ -0,0 +1,99 @@
+//! Storage usage of the knowledge base.
+
+use std::fmt;
+use std::path::Path;
+
+/// How much space the knowledge base takes up.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct UsageReport {
+    pub documents: usize,
+    /// Embedding dimension of the configured model.
+    pub dimension: usize,
+    /// Estimated bytes held by the vectors alone: documents × dimension × 4.
+    pub vector_bytes: u64,
+    /// Total size of the storage directory, for embedded storage.
+    pub disk_bytes: Option<u64>,
+}
+
+impl UsageReport {
+    pub(crate) fn new(documents: usize, dimension: usize, disk_bytes: Option<u64>) -> Self {
+        Self {
+            documents,
+            dimension,
+            vector_bytes: documents as u64 * dimension as u64 * std::mem::size_of::<f32>() as u64,
+            disk_bytes,
+        }
+    }
+}
+
+impl fmt::Display for UsageReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "Documents: {}", self.documents)?;
+        write!(
+            f,
+            "Vectors: {} (estimated, {} dimensions)",
+            format_bytes(self.vector_bytes),
+            self.dimension
+        )?;
+        if let Some(disk_bytes) = self.disk_bytes {
+            write!(f, "\nOn disk: {}", format_bytes(disk_bytes))?;
+        }
+        Ok(())
+    }
+}
+
+/// Total size of the files under `path`. Unreadable entries are skipped.
+pub(crate) fn dir_size(path: &Path) -> u64 {
+    let Ok(entries) = std::fs::read_dir(path) else {
+        return 0;
+    };
+
+    entries
+        .filter_map(|entry| entry.ok())
+        .map(|entry| match entry.metadata() {
+            Ok(metadata) if metadata.is_dir() => dir_size(&entry.path()),
+            Ok(metadata) => metadata.len(),
+            Err(_) => 0,
+        })
+        .sum()
+}
+
+fn format_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KB", "MB", "GB", "TB"];
+
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+
+    let mut value = bytes as f64 / 1024.0;
+    let mut unit = 0;
+    while value >= 1024.0 && unit < UNITS.len() - 1 {
+        value /= 1024.0;
+        unit += 1;
+    }
+    format!("{:.1} {}", value, UNITS[unit])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_dir_size_counts_nested_files() {
+        let dir = tempdir().unwrap();
+        std::fs::write(dir.path().join("a"), [0; 100]).unwrap();
+        std::fs::create_dir(dir.path().join("sub")).unwrap();
+        std::fs::write(dir.path().join("sub/b"), [0; 28]).unwrap();
+
+        assert_eq!(dir_size(dir.path()), 128);
+        assert_eq!(dir_size(&dir.path().join("missing")), 0);
+    }
+
+    #[test]
+    fn test_format_bytes() {
+        assert_eq!(format_bytes(512), "512 B");
+        assert_eq!(format_bytes(1536), "1.5 KB");
+        assert_eq!(format_bytes(3 * 1024 * 1024), "3.0 MB");
+    }
+}
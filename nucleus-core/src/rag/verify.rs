@@ -0,0 +1,96 @@
+//! Comparing the index with the files on disk.
+//!
+//! Every indexed chunk records the SHA-256 of its file's content as
+//! `content_hash`, so a file edited since it was indexed can be told apart
+//! from one that is up to date without re-embedding anything.
+
+use std::fmt;
+use std::path::PathBuf;
+
+/// How an indexed directory differs from the filesystem, returned by
+/// [`RagEngine::verify`](super::RagEngine::verify).
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct VerifyReport {
+    /// Files on disk that indexing would cover.
+    pub checked: usize,
+    /// Indexed sources under the directory that no longer exist.
+    pub missing: Vec<String>,
+    /// Files on disk with no chunks in the index.
+    pub unindexed: Vec<PathBuf>,
+    /// Indexed files whose content changed since they were indexed. Chunks
+    /// indexed before content hashes were stored are counted here too.
+    pub changed: Vec<PathBuf>,
+}
+
+impl VerifyReport {
+    /// Whether the index matches the filesystem.
+    pub fn is_clean(&self) -> bool {
+        self.missing.is_empty() && self.unindexed.is_empty() && self.changed.is_empty()
+    }
+}
+
+/// `Index matches all <n> files`, or one section per kind of drift.
+impl fmt::Display for VerifyReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        if self.is_clean() {
+            return write!(f, "Index matches all {} files", self.checked);
+        }
+
+        let mut sections = Vec::new();
+        let mut section = |title: &str, entries: Vec<String>| {
+            if !entries.is_empty() {
+                sections.push(format!(
+                    "{} ({}):\n  {}",
+                    title,
+                    entries.len(),
+                    entries.join("\n  ")
+                ));
+            }
+        };
+        section("Indexed but missing on disk", self.missing.clone());
+        section(
+            "On disk but not indexed",
+            self.unindexed
+                .iter()
+                .map(|p| p.display().to_string())
+                .collect(),
+        );
+        section(
+            "Changed since indexed",
+            self.changed
+                .iter()
+                .map(|p| p.display().to_string())
+                .collect(),
+        );
+        write!(f, "{}", sections.join("\n"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_display_skips_empty_sections() {
+        let report = VerifyReport {
+            checked: 3,
+            missing: vec!["docs/old.md".to_string()],
+            unindexed: Vec::new(),
+            changed: vec![PathBuf::from("src/a.rs"), PathBuf::from("src/b.rs")],
+        };
+
+        assert_eq!(
+            report.to_string(),
+            "Indexed but missing on disk (1):\n  docs/old.md\n\
+             Changed since indexed (2):\n  src/a.rs\n  src/b.rs"
+        );
+        assert_eq!(
+            VerifyReport {
+                checked: 3,
+                ..VerifyReport::default()
+            }
+            .to_string(),
+            "Index matches all 3 files"
+        );
+    }
+}
@@ -0,0 +1,69 @@
+//! Finding which collection answers a query best, before picking one to
+//! search.
+
+use std::cmp::Ordering;
+use std::fmt;
+
+/// How well one collection of `rag.collections` matched a query.
+#[derive(Debug, Clone, PartialEq)]
+pub struct CollectionMatch {
+    pub collection: String,
+    /// Score of the best chunk retrieved, or `None` if nothing was.
+    pub top_score: Option<f32>,
+    /// Source of that chunk.
+    pub top_source: Option<String>,
+}
+
+impl CollectionMatch {
+    /// Orders matches best first, with collections that retrieved nothing last.
+    pub(crate) fn best_first(a: &Self, b: &Self) -> Ordering {
+        match (a.top_score, b.top_score) {
+            (Some(a), Some(b)) => b.total_cmp(&a),
+            (Some(_), None) => Ordering::Less,
+            (None, Some(_)) => Ordering::Greater,
+            (None, None) => Ordering::Equal,
+        }
+        .then_with(|| a.collection.cmp(&b.collection))
+    }
+}
+
+/// `code: 0.912 (src/config.rs)`, or `prose: no results`.
+impl fmt::Display for CollectionMatch {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match (self.top_score, &self.top_source) {
+            (Some(score), Some(source)) => {
+                write!(f, "{}: {:.3} ({})", self.collection, score, source)
+            }
+            (Some(score), None) => write!(f, "{}: {:.3}", self.collection, score),
+            (None, _) => write!(f, "{}: no results", self.collection),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn matched(collection: &str, top_score: Option<f32>) -> CollectionMatch {
+        CollectionMatch {
+            collection: collection.to_string(),
+            top_score,
+            top_source: top_score.map(|_| "notes.md".to_string()),
+        }
+    }
+
+    #[test]
+    fn test_best_first_puts_empty_collections_last() {
+        let mut matches = vec![
+            matched("empty", None),
+            matched("prose", Some(0.4)),
+            matched("code", Some(0.9)),
+        ];
+        matches.sort_by(CollectionMatch::best_first);
+
+        let order: Vec<&str> = matches.iter().map(|m| m.collection.as_str()).collect();
+        assert_eq!(order, vec!["code", "prose", "empty"]);
+        assert_eq!(matches[0].to_string(), "code: 0.900 (notes.md)");
+        assert_eq!(matches[2].to_string(), "empty: no results");
+    }
+}
@@ -0,0 +1,143 @@
+//! Latency figures for the `bench` request.
+//!
+//! Each run of the query is timed in three phases: embedding the query,
+//! searching the knowledge base and generating the answer. The report gives
+//! the min, median and p95 of each phase and of their total across runs.
+
+use std::fmt;
+use std::time::Duration;
+
+/// Runs made when the request doesn't give `--runs`.
+pub const DEFAULT_RUNS: usize = 5;
+
+/// Most runs a single request may ask for.
+pub const MAX_RUNS: usize = 100;
+
+/// How long each phase of one run took.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct PhaseTimings {
+    pub embedding: Duration,
+    pub retrieval: Duration,
+    pub generation: Duration,
+}
+
+impl PhaseTimings {
+    pub fn total(&self) -> Duration {
+        self.embedding + self.retrieval + self.generation
+    }
+}
+
+/// Min, median and p95 of one phase across runs.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct PhaseStats {
+    pub min: Duration,
+    pub median: Duration,
+    pub p95: Duration,
+}
+
+impl PhaseStats {
+    /// Nearest-rank statistics of `samples`, which must not be empty.
+    fn of(mut samples: Vec<Duration>) -> Self {
+        samples.sort();
+        let rank = |percentile: usize| {
+            let rank = (samples.len() * percentile).div_ceil(100);
+            samples[rank.saturating_sub(1)]
+        };
+        Self {
+            min: samples[0],
+            median: rank(50),
+            p95: rank(95),
+        }
+    }
+}
+
+/// The phase statistics of a `bench` request.
+#[derive(Debug, Clone, PartialEq)]
+pub struct LatencyReport {
+    pub query: String,
+    pub runs: usize,
+    pub embedding: PhaseStats,
+    pub retrieval: PhaseStats,
+    pub generation: PhaseStats,
+    pub total: PhaseStats,
+}
+
+impl LatencyReport {
+    /// Summarizes `samples`, one per run. Returns `None` without samples.
+    pub fn new(query: &str, samples: &[PhaseTimings]) -> Option<Self> {
+        if samples.is_empty() {
+            return None;
+        }
+        let stats = |phase: fn(&PhaseTimings) -> Duration| {
+            PhaseStats::of(samples.iter().map(phase).collect())
+        };
+        Some(Self {
+            query: query.to_string(),
+            runs: samples.len(),
+            embedding: stats(|t| t.embedding),
+            retrieval: stats(|t| t.retrieval),
+            generation: stats(|t| t.generation),
+            total: stats(PhaseTimings::total),
+        })
+    }
+}
+
+/// A header line, then one line per phase in milliseconds:
+/// `embedding    min 12.0ms  median 13.1ms  p95 15.4ms`.
+impl fmt::Display for LatencyReport {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        writeln!(f, "{} runs of \"{}\":", self.runs, self.query)?;
+        let phases = [
+            ("embedding", &self.embedding),
+            ("retrieval", &self.retrieval),
+            ("generation", &self.generation),
+            ("total", &self.total),
+        ];
+        for (i, (name, stats)) in phases.iter().enumerate() {
+            if i > 0 {
+                writeln!(f)?;
+            }
+            write!(
+                f,
+                "{:<12} min {}  median {}  p95 {}",
+                name,
+                millis(stats.min),
+                millis(stats.median),
+                millis(stats.p95)
+            )?;
+        }
+        Ok(())
+    }
+}
+
+fn millis(duration: Duration) -> String {
+    format!("{:.1}ms", duration.as_secs_f64() * 1000.0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_stats_use_nearest_rank() {
+        let ms = Duration::from_millis;
+        let samples: Vec<PhaseTimings> = (1..=20)
+            .map(|i| PhaseTimings {
+                generation: ms(i * 10),
+                ..PhaseTimings::default()
+            })
+            .collect();
+
+        let report = LatencyReport::new("q", &samples).unwrap();
+
+        assert_eq!(report.runs, 20);
+        assert_eq!(report.generation.min, ms(10));
+        assert_eq!(report.generation.median, ms(100));
+        assert_eq!(report.generation.p95, ms(190));
+        assert_eq!(report.total, report.generation);
+        assert!(report
+            .to_string()
+            .contains("generation   min 10.0ms  median 100.0ms  p95 190.0ms"));
+        assert!(LatencyReport::new("q", &[]).is_none());
+    }
+}
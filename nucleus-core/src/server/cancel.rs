@@ -0,0 +1,162 @@
+use std::collections::HashMap;
+use std::future::Future;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use tokio::signal;
+use tokio::sync::mpsc;
+use tokio_util::sync::CancellationToken;
+
+/// What an interrupt (Ctrl-C) did.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Interrupt {
+    /// Requests were running and have been cancelled; the server keeps going.
+    Cancelled(usize),
+    /// Nothing was running, so the server should shut down.
+    Shutdown,
+}
+
+/// Cancellation tokens of the requests currently being handled.
+///
+/// The first Ctrl-C cancels whatever is generating and leaves the server
+/// running; a Ctrl-C while idle shuts it down.
+#[derive(Default)]
+pub struct InFlight {
+    requests: Mutex<HashMap<u64, CancellationToken>>,
+    next_id: AtomicU64,
+}
+
+/// A request registered with [`InFlight`]. Unregistered when dropped.
+pub struct Tracked<'a> {
+    in_flight: &'a InFlight,
+    id: u64,
+    token: CancellationToken,
+}
+
+impl InFlight {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Registers a request until the returned guard is dropped.
+    pub fn track(&self) -> Tracked<'_> {
+        let id = self.next_id.fetch_add(1, Ordering::Relaxed);
+        let token = CancellationToken::new();
+        self.requests.lock().unwrap().insert(id, token.clone());
+        Tracked {
+            in_flight: self,
+            id,
+            token,
+        }
+    }
+
+    /// Cancels every running request, or asks for shutdown if none are.
+    pub fn interrupt(&self) -> Interrupt {
+        let requests = std::mem::take(&mut *self.requests.lock().unwrap());
+        if requests.is_empty() {
+            return Interrupt::Shutdown;
+        }
+        for token in requests.values() {
+            token.cancel();
+        }
+        Interrupt::Cancelled(requests.len())
+    }
+}
+
+impl Tracked<'_> {
+    pub fn token(&self) -> CancellationToken {
+        self.token.clone()
+    }
+}
+
+impl Drop for Tracked<'_> {
+    fn drop(&mut self) {
+        self.in_flight.requests.lock().unwrap().remove(&self.id);
+    }
+}
+
+/// Runs `future` until it finishes or `token` is cancelled, returning `None`
+/// if it was cancelled.
+pub async fn cancellable<F: Future>(token: CancellationToken, future: F) -> Option<F::Output> {
+    tokio::select! {
+        output = future => Some(output),
+        _ = token.cancelled() => None,
+    }
+}
+
+/// Forwards every Ctrl-C the process receives.
+pub fn ctrl_c_interrupts() -> mpsc::UnboundedReceiver<()> {
+    let (sender, receiver) = mpsc::unbounded_channel();
+    tokio::spawn(async move {
+        while signal::ctrl_c().await.is_ok() {
+            if sender.send(()).is_err() {
+                break;
+            }
+        }
+    });
+    receiver
+}
+
+/// Handles interrupts until one arrives while no request is running.
+///
+/// Interrupts during a request cancel it and the server keeps serving.
+pub async fn wait_for_shutdown(
+    mut interrupts: mpsc::UnboundedReceiver<()>,
+    in_flight: Arc<InFlight>,
+) {
+    while interrupts.recv().await.is_some() {
+        match in_flight.interrupt() {
+            Interrupt::Cancelled(count) => {
+                println!(
+                    "\nCancelled {} request(s), press Ctrl-C again to shut down",
+                    count
+                );
+            }
+            Interrupt::Shutdown => return,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_interrupt_cancels_running_request_then_shuts_down() {
+        let in_flight = Arc::new(InFlight::new());
+        let (interrupts, received) = mpsc::unbounded_channel();
+        let (started, mut is_started) = mpsc::unbounded_channel();
+        let shutdown = tokio::spawn(wait_for_shutdown(received, in_flight.clone()));
+
+        let request = tokio::spawn({
+            let in_flight = in_flight.clone();
+            async move {
+                let tracked = in_flight.track();
+                started.send(()).unwrap();
+                cancellable(tracked.token(), std::future::pending::<()>()).await
+            }
+        });
+        is_started.recv().await.unwrap();
+
+        interrupts.send(()).unwrap();
+        assert_eq!(request.await.unwrap(), None);
+        tokio::task::yield_now().await;
+        assert!(!shutdown.is_finished());
+
+        // Back at idle, so the next interrupt exits.
+        interrupts.send(()).unwrap();
+        shutdown.await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_finished_request_is_not_cancelled() {
+        let in_flight = InFlight::new();
+
+        let tracked = in_flight.track();
+        let token = tracked.token();
+        assert_eq!(cancellable(tracked.token(), async { 7 }).await, Some(7));
+        drop(tracked);
+
+        assert_eq!(in_flight.interrupt(), Interrupt::Shutdown);
+        assert!(!token.is_cancelled());
+    }
+}
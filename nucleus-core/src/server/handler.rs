@@ -1,6 +1,15 @@
+use super::bench::{LatencyReport, PhaseTimings, DEFAULT_RUNS, MAX_RUNS};
+use super::limiter::ChatLimiter;
+use super::priority::PriorityProvider;
 use super::types::{Request, RequestType, StreamChunk};
+use crate::chat::{
+    context_sources, estimate_tokens, load_template, load_templates, parse_questions,
+    render_markdown, render_messages, BatchAnswer, PromptParts, PromptTemplate, ThinkingFilter,
+};
 use crate::{config::Config, provider::Provider, rag};
-use std::{path::Path, sync::Arc};
+use nucleus_plugin::{Permission, PluginRegistry, ToolInfo};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
 use tokio::sync::mpsc;
 
 pub type ChunkSender = mpsc::UnboundedSender<StreamChunk>;
@@ -9,61 +18,209 @@ pub type ChunkSender = mpsc::UnboundedSender<StreamChunk>;
 pub struct RequestHandler {
     config: Config,
     provider: Arc<dyn Provider>,
+    registry: Arc<PluginRegistry>,
     rag_manager: rag::RagEngine,
+    chat_limiter: ChatLimiter,
 }
 
 impl RequestHandler {
-    pub async fn new(config: Config, provider: Arc<dyn Provider>) -> Result<Self, rag::RagError> {
+    pub async fn new(
+        config: Config,
+        provider: Arc<dyn Provider>,
+        registry: Arc<PluginRegistry>,
+    ) -> Result<Self, rag::RagError> {
+        let chat_limiter = ChatLimiter::new(&config.server);
+        let provider: Arc<dyn Provider> = Arc::new(
+            PriorityProvider::new(provider, &config.server).with_activity(chat_limiter.activity()),
+        );
         let rag_manager = rag::RagEngine::new(&config, provider.clone()).await?;
 
-        Ok(Self {
+        let handler = Self {
             config,
             provider,
+            registry,
             rag_manager,
-        })
+            chat_limiter,
+        };
+        handler.warm_up().await;
+        Ok(handler)
+    }
+
+    /// Loads the embedding model when `rag.warmup_embedding_model` is set.
+    /// A failure is logged rather than stopping the server, since the model
+    /// will still load on first use.
+    async fn warm_up(&self) {
+        let enabled = self
+            .config
+            .rag
+            .as_ref()
+            .is_some_and(|rag| rag.enabled && rag.warmup_embedding_model);
+        if !enabled {
+            return;
+        }
+        match self.rag_manager.warm_up_model().await {
+            Ok(()) => tracing::info!("Embedding model loaded"),
+            Err(e) => tracing::warn!("Failed to warm up the embedding model: {}", e),
+        }
     }
 
     /// Routes request to appropriate handler based on type.
     pub async fn handle(&self, request: Request, sender: ChunkSender) {
+        if self.config.rag_disabled() && needs_knowledge_base(request.request_type) {
+            let _ = sender.send(StreamChunk::error(
+                "The knowledge base is disabled (rag.enabled is false)",
+            ));
+            return;
+        }
+
         match request.request_type {
-            RequestType::Chat | RequestType::Edit => self.handle_chat(request, sender).await,
+            RequestType::Chat | RequestType::Ask | RequestType::Edit => {
+                self.handle_limited_chat(request, sender).await
+            }
             RequestType::Add => self.handle_add(request, sender).await,
             RequestType::Index => self.handle_index(request, sender).await,
+            RequestType::IndexBackground => self.handle_index_background(request, sender),
+            RequestType::IndexArchive => self.handle_index_archive(request, sender).await,
+            RequestType::IndexStatus => self.handle_index_status(sender),
             RequestType::Stats => self.handle_stats(sender).await,
+            RequestType::Config => self.handle_config(request, sender),
+            RequestType::Usage => self.handle_usage(sender).await,
+            RequestType::Compare => self.handle_compare(request, sender).await,
+            RequestType::Explain => self.handle_explain(request, sender).await,
+            RequestType::EmbedWarm => self.handle_embed_warm(request, sender).await,
+            RequestType::Meta => self.handle_meta(request, sender).await,
+            RequestType::Retag => self.handle_retag(request, sender).await,
+            RequestType::ReembedSource => self.handle_reembed_source(request, sender).await,
+            RequestType::DiffSource => self.handle_diff_source(request, sender).await,
+            RequestType::TempAdd => self.handle_temp_add(request, sender).await,
+            RequestType::TempClear => self.handle_temp_clear(sender).await,
+            RequestType::Eval => self.handle_eval(request, sender).await,
+            RequestType::Templates => self.handle_templates(request, sender).await,
+            RequestType::UseTemplate => self.handle_use_template(request, sender).await,
+            RequestType::ChunkPreview => self.handle_chunk_preview(request, sender).await,
+            RequestType::Batch => self.handle_batch(request, sender).await,
+            RequestType::Tools => self.handle_tools(sender).await,
+            RequestType::Retrieve => self.handle_retrieve(request, sender).await,
+            RequestType::Sources => self.handle_sources(request, sender).await,
+            RequestType::Verify => self.handle_verify(request, sender).await,
+            RequestType::ExportChat => self.handle_export_chat(request, sender).await,
+            RequestType::Pin => self.handle_pin(request, sender).await,
+            RequestType::CompareModels => self.handle_compare_models(request, sender).await,
+            RequestType::Embed => self.handle_embed(request, sender).await,
+            RequestType::Merge => self.handle_merge(request, sender).await,
+            RequestType::Which => self.handle_which(request, sender).await,
+            RequestType::Snapshot => self.handle_snapshot(request, sender).await,
+            RequestType::Rollback => self.handle_rollback(request, sender).await,
+            RequestType::ValidateExport => self.handle_validate_export(request, sender).await,
+            RequestType::Bench => self.handle_bench(request, sender).await,
         }
     }
 
-    async fn handle_chat(&self, request: Request, sender: ChunkSender) {
+    /// Runs a chat once a slot is free, or reports that the server is busy.
+    ///
+    /// The finished exchange is remembered only after the slot is released:
+    /// embedding it waits for chats to finish when they take priority, and
+    /// the slot counts this chat as one of them.
+    async fn handle_limited_chat(&self, request: Request, sender: ChunkSender) {
+        let Some(permit) = self.chat_limiter.acquire().await else {
+            let _ = sender.send(StreamChunk::error(self.busy_message()));
+            return;
+        };
+        let session = request.session.clone();
+        let exchange = self.handle_chat(request, sender).await;
+        drop(permit);
+
+        if let (Some(session), Some((question, answer))) = (session, exchange) {
+            if self.recall_limit().is_some() {
+                self.remember_exchange(&session, &question, &answer).await;
+            }
+        }
+    }
+
+    fn busy_message(&self) -> String {
+        format!(
+            "Server is busy ({} chats in progress), try again later",
+            self.chat_limiter.max_concurrent()
+        )
+    }
+
+    /// Answers a chat, returning the question and answer if it succeeded.
+    async fn handle_chat(&self, request: Request, sender: ChunkSender) -> Option<(String, String)> {
         use crate::provider::ChatRequest;
 
-        let messages = self.build_messages(request);
+        let max_tokens = request.max_tokens.or(self.config.llm.max_tokens);
+        let question = request.content.clone();
+        if uses_rag(&self.config, &request) {
+            if let Some(notice) = self.rag_manager.empty_notice().await {
+                let _ = sender.send(StreamChunk::chunk(format!("{}\n\n", notice)));
+            }
+        }
+        let messages = self.build_messages(request).await;
 
         let chat_request = ChatRequest::new(&self.config.llm.model, messages)
-            .with_temperature(self.config.llm.temperature);
+            .with_temperature(self.config.llm.temperature)
+            .with_max_tokens(max_tokens);
 
         let mut full_response = String::new();
+        let mut thinking = ThinkingFilter::new(&self.config.llm.thinking);
 
         let result = self
             .provider
             .chat(
                 chat_request,
                 Box::new(|response| {
-                    if !response.message.content.is_empty() {
-                        full_response.push_str(&response.message.content);
-                        let _ = sender.send(StreamChunk::chunk(&response.message.content));
+                    let text = match &mut thinking {
+                        Some(filter) => filter.push(&response.message.content),
+                        None => response.message.content.clone(),
+                    };
+                    if !text.is_empty() {
+                        full_response.push_str(&text);
+                        let _ = sender.send(StreamChunk::chunk(&text));
                     }
                 }),
             )
             .await;
 
+        if let Some(rest) = thinking.map(|mut filter| filter.finish()) {
+            if !rest.is_empty() {
+                full_response.push_str(&rest);
+                let _ = sender.send(StreamChunk::chunk(&rest));
+            }
+        }
+
         match result {
             Ok(_) => {
                 let _ = sender.send(StreamChunk::done(&full_response));
+                return Some((question, full_response));
+            }
+            Err(e) if self.config.server.partial_on_error && !full_response.is_empty() => {
+                let _ = sender.send(StreamChunk::partial_error(&full_response, e.to_string()));
             }
             Err(e) => {
                 let _ = sender.send(StreamChunk::error(e.to_string()));
             }
         }
+        None
+    }
+
+    /// Adds a finished question and answer to the index of `session`.
+    async fn remember_exchange(&self, session: &str, question: &str, answer: &str) {
+        for (role, content) in [("user", question), ("assistant", answer)] {
+            if let Err(e) = self.rag_manager.remember_turn(session, role, content).await {
+                tracing::debug!("Could not remember {} turn: {}", role, e);
+            }
+        }
+    }
+
+    /// How many earlier turns to recall per chat, if conversation recall is on.
+    fn recall_limit(&self) -> Option<usize> {
+        self.config
+            .rag
+            .as_ref()
+            .filter(|rag| rag.enabled)
+            .map(|rag| &rag.conversation_recall)
+            .filter(|recall| recall.enabled)
+            .map(|recall| recall.top_k)
     }
 
     async fn handle_add(&self, request: Request, sender: ChunkSender) {
@@ -81,14 +238,79 @@ impl RequestHandler {
         }
     }
 
+    async fn handle_temp_add(&self, request: Request, sender: ChunkSender) {
+        match self
+            .rag_manager
+            .add_temporary(&request.content, "user_input")
+            .await
+        {
+            Ok(_) => {
+                let _ = sender.send(StreamChunk::done("Added to temporary knowledge"));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to add: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_temp_clear(&self, sender: ChunkSender) {
+        match self.rag_manager.clear_temporary().await {
+            Ok(_) => {
+                let _ = sender.send(StreamChunk::done("Cleared temporary knowledge"));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to clear: {}", e)));
+            }
+        }
+    }
+
     async fn handle_index(&self, request: Request, sender: ChunkSender) {
-        let dir = request.pwd.clone().expect("Invalid directory");
+        let Some(dir) = request.pwd.clone() else {
+            let _ = sender.send(StreamChunk::error("Missing working directory"));
+            return;
+        };
         let path_dir = Path::new(&dir);
-        match self.rag_manager.index_directory(&path_dir).await {
-            Ok(count) => {
+        let (target, since) = split_since(&request.content);
+        let (target, force) = split_force(&target);
+        let (target, progress) = split_flag(&target, "--progress");
+
+        let since = match since {
+            Some(since) => match rag::parse_since(&since, std::time::SystemTime::now()) {
+                Some(cutoff) => Some(cutoff),
+                None => {
+                    let _ = sender.send(StreamChunk::error(format!(
+                        "Invalid --since value '{}', expected e.g. 24h, 30m, 7d or a Unix timestamp",
+                        since
+                    )));
+                    return;
+                }
+            },
+            None => None,
+        };
+
+        let indexed = self
+            .rag_manager
+            .index_directory_reporting(path_dir, since, force, |update| {
+                if progress {
+                    let _ = sender.send(StreamChunk::chunk(update.to_string()));
+                }
+            })
+            .await;
+
+        match indexed {
+            Ok(result) => {
+                let _ = sender.send(StreamChunk::done(format!("{}: {}", target, result)));
+            }
+            Err(e @ rag::RagError::TooManyFiles { .. }) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "{}. Add --force to index anyway.",
+                    e
+                )));
+            }
+            Err(e @ rag::RagError::AlreadyIndexed(_)) => {
                 let _ = sender.send(StreamChunk::done(format!(
-                    "Indexed {} files from: {}",
-                    count, request.content
+                    "Skipped: {}. Add --force to index it again, or --since to pick up changes.",
+                    e
                 )));
             }
             Err(e) => {
@@ -97,6 +319,239 @@ impl RequestHandler {
         }
     }
 
+    fn handle_index_background(&self, request: Request, sender: ChunkSender) {
+        let Some(dir) = request.pwd else {
+            let _ = sender.send(StreamChunk::error("No directory given to index"));
+            return;
+        };
+
+        let id = self.rag_manager.index_in_background(&dir);
+        let _ = sender.send(StreamChunk::done(format!(
+            "Started background index #{} of {}. Send index-status to follow it.",
+            id, dir
+        )));
+    }
+
+    fn handle_index_status(&self, sender: ChunkSender) {
+        let jobs = self.rag_manager.index_jobs();
+        let status = if jobs.is_empty() {
+            "No background index jobs".to_string()
+        } else {
+            jobs.iter()
+                .map(ToString::to_string)
+                .collect::<Vec<_>>()
+                .join("\n")
+        };
+        let _ = sender.send(StreamChunk::done(status));
+    }
+
+    async fn handle_embed_warm(&self, request: Request, sender: ChunkSender) {
+        let dir = match (request.content.is_empty(), request.pwd) {
+            (false, _) => request.content,
+            (true, Some(pwd)) => pwd,
+            (true, None) => {
+                let _ = sender.send(StreamChunk::error("No directory given to warm"));
+                return;
+            }
+        };
+
+        match self.rag_manager.warm_embeddings(Path::new(&dir)).await {
+            Ok(count) => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "Cached embeddings for {} chunks from: {}",
+                    count, dir
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to warm: {}", e)));
+            }
+        }
+    }
+
+    /// Replies with the retrieved chunks as JSON, without the prompt
+    /// formatting used for chat context.
+    async fn handle_retrieve(&self, request: Request, sender: ChunkSender) {
+        let chunks = match self.rag_manager.retrieve_chunks(&request.content).await {
+            Ok(chunks) => chunks,
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to retrieve: {}", e)));
+                return;
+            }
+        };
+
+        match serde_json::to_string_pretty(&chunks) {
+            Ok(json) => {
+                let _ = sender.send(StreamChunk::done(json));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e.to_string()));
+            }
+        }
+    }
+
+    async fn handle_embed(&self, request: Request, sender: ChunkSender) {
+        match self.rag_manager.inspect_embedding(&request.content).await {
+            Ok(info) => {
+                let _ = sender.send(StreamChunk::done(info.to_string()));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to embed: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_merge(&self, request: Request, sender: ChunkSender) {
+        let (names, prefix) = split_flag(&request.content, "--prefix");
+        let names: Vec<&str> = names.split_whitespace().collect();
+        let [source, destination] = names[..] else {
+            let _ = sender.send(StreamChunk::error(
+                "Usage: merge <source-collection> <destination-collection> [--prefix]",
+            ));
+            return;
+        };
+        let collisions = if prefix {
+            rag::IdCollision::Prefix
+        } else {
+            rag::IdCollision::Skip
+        };
+
+        match self
+            .rag_manager
+            .merge_collections(source, destination, collisions)
+            .await
+        {
+            Ok(report) => {
+                let _ = sender.send(StreamChunk::done(report.to_string()));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to merge: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_snapshot(&self, request: Request, sender: ChunkSender) {
+        let label = request.content.trim();
+        if label.is_empty() {
+            let snapshots = self.rag_manager.snapshots();
+            let message = if snapshots.is_empty() {
+                "No snapshots".to_string()
+            } else {
+                snapshots.join("\n")
+            };
+            let _ = sender.send(StreamChunk::done(message));
+            return;
+        }
+
+        match self.rag_manager.snapshot(label).await {
+            Ok(count) => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "Saved {} documents as snapshot '{}'",
+                    count, label
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e.to_string()));
+            }
+        }
+    }
+
+    async fn handle_index_archive(&self, request: Request, sender: ChunkSender) {
+        let target = request.content.trim();
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(target),
+            None => Path::new(target).to_path_buf(),
+        };
+
+        match self.rag_manager.index_archive(&path).await {
+            Ok(result) => {
+                let _ = sender.send(StreamChunk::done(format!("{}: {}", target, result)));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to index {}: {}",
+                    target, e
+                )));
+            }
+        }
+    }
+
+    fn handle_config(&self, request: Request, sender: ChunkSender) {
+        if request.content.trim() == "--explain" {
+            let _ = sender.send(StreamChunk::done(self.config.explain_retrieval()));
+            return;
+        }
+
+        match serde_yaml::to_string(&self.config.redacted()) {
+            Ok(yaml) => {
+                let _ = sender.send(StreamChunk::done(yaml));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to render config: {}",
+                    e
+                )));
+            }
+        }
+    }
+
+    async fn handle_validate_export(&self, request: Request, sender: ChunkSender) {
+        let target = request.content.trim();
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(target),
+            None => Path::new(target).to_path_buf(),
+        };
+
+        match self.rag_manager.validate_export(&path).await {
+            Ok(report) => {
+                let _ = sender.send(StreamChunk::done(format!("{}: {}", target, report)));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to validate {}: {}",
+                    target, e
+                )));
+            }
+        }
+    }
+
+    async fn handle_rollback(&self, request: Request, sender: ChunkSender) {
+        let label = request.content.trim();
+        match self.rag_manager.rollback(label).await {
+            Ok(count) => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "Restored {} documents from snapshot '{}'",
+                    count, label
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to roll back: {}", e)));
+            }
+        }
+    }
+
+    /// Replies with the best score each collection gets for the query, one
+    /// collection per line, best first.
+    async fn handle_which(&self, request: Request, sender: ChunkSender) {
+        let query = request.content.trim();
+        if query.is_empty() {
+            let _ = sender.send(StreamChunk::error("Usage: which <query>"));
+            return;
+        }
+
+        match self.rag_manager.which_collection(query).await {
+            Ok(matches) if matches.is_empty() => {
+                let _ = sender.send(StreamChunk::error("No collections in rag.collections"));
+            }
+            Ok(matches) => {
+                let lines: Vec<String> = matches.iter().map(ToString::to_string).collect();
+                let _ = sender.send(StreamChunk::done(lines.join("\n")));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to search: {}", e)));
+            }
+        }
+    }
+
     async fn handle_stats(&self, sender: ChunkSender) {
         let count = self.rag_manager.count().await;
         let _ = sender.send(StreamChunk::done(format!(
@@ -105,24 +560,1950 @@ impl RequestHandler {
         )));
     }
 
-    fn build_messages(&self, request: Request) -> Vec<crate::provider::Message> {
-        use crate::provider::Message;
+    async fn handle_tools(&self, sender: ChunkSender) {
+        let tools = self.registry.tools().await;
+        let _ = sender.send(StreamChunk::done(format_tools(
+            &tools,
+            self.registry.granted_permissions(),
+        )));
+    }
 
-        let mut messages = vec![Message::system(None, &self.config.system_prompt)];
+    async fn handle_usage(&self, sender: ChunkSender) {
+        let usage = self.rag_manager.usage().await;
+        let _ = sender.send(StreamChunk::done(usage.to_string()));
+    }
 
-        if let Some(history) = request.history {
-            for msg in history {
-                messages.push(Message {
-                    role: "user".to_string(),
-                    context: None,
-                    content: msg.content.clone(),
-                    images: None,
-                    tool_calls: None,
-                });
+    async fn handle_compare(&self, request: Request, sender: ChunkSender) {
+        let current = self.rag_manager.retrieval_settings();
+        let (first, second, query) = match parse_compare(&request.content, current) {
+            Ok(parsed) => parsed,
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e));
+                return;
+            }
+        };
+
+        match self.rag_manager.compare(&query, &first, &second).await {
+            Ok(comparison) => {
+                let _ = sender.send(StreamChunk::done(comparison.to_string()));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to compare: {}", e)));
+            }
+        }
+    }
+
+    /// Lists the sources retrieved for a query, or with `--rerank`, their
+    /// order with and without reranking. The answer isn't regenerated.
+    async fn handle_sources(&self, request: Request, sender: ChunkSender) {
+        let (query, rerank) = split_flag(&request.content, "--rerank");
+        let Some(query) = Some(query)
+            .filter(|query| !query.is_empty())
+            .or_else(|| last_user_message(&request))
+        else {
+            let _ = sender.send(StreamChunk::error(
+                "No query given and no earlier question in the history",
+            ));
+            return;
+        };
+
+        let current = self.rag_manager.retrieval_settings();
+        let reply = if rerank {
+            self.rag_manager
+                .compare(
+                    &query,
+                    &current.with_rerank(false),
+                    &current.with_rerank(true),
+                )
+                .await
+                .map(|comparison| comparison.to_string())
+        } else {
+            self.rag_manager
+                .search(&query)
+                .await
+                .map(|results| format_sources(&query, &results))
+        };
+
+        match reply {
+            Ok(reply) => {
+                let _ = sender.send(StreamChunk::done(reply));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to retrieve: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_verify(&self, request: Request, sender: ChunkSender) {
+        let Some(dir) = request.pwd.clone() else {
+            let _ = sender.send(StreamChunk::error("No directory given to verify"));
+            return;
+        };
+        let dir = Path::new(&dir);
+        let (_, fix) = split_flag(&request.content, "--fix");
+
+        let report = match self.rag_manager.verify(dir).await {
+            Ok(report) => report,
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to verify: {}", e)));
+                return;
+            }
+        };
+        if !fix || report.is_clean() {
+            let _ = sender.send(StreamChunk::done(report.to_string()));
+            return;
+        }
+
+        match self.rag_manager.repair(dir, &report).await {
+            Ok(result) => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "{}\nRemoved {} missing files. {}",
+                    report,
+                    report.missing.len(),
+                    result
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "{}\nFailed to fix: {}",
+                    report, e
+                )));
+            }
+        }
+    }
+
+    async fn handle_pin(&self, request: Request, sender: ChunkSender) {
+        let (target, remove) = split_flag(&request.content, "--remove");
+        if target.is_empty() {
+            let sources = self.rag_manager.pinned_sources();
+            let listing = if sources.is_empty() {
+                "No pinned files".to_string()
+            } else {
+                sources.join("\n")
+            };
+            let _ = sender.send(StreamChunk::done(listing));
+            return;
+        }
+
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(&target),
+            None => PathBuf::from(&target),
+        };
+        if remove {
+            let source = path.to_string_lossy();
+            let chunk = if self.rag_manager.unpin(&source) {
+                StreamChunk::done(format!("Unpinned {}", source))
+            } else {
+                StreamChunk::error(format!("{} is not pinned", source))
+            };
+            let _ = sender.send(chunk);
+            return;
+        }
+
+        match self.rag_manager.pin(&path).await {
+            Ok(()) => {
+                let _ = sender.send(StreamChunk::done(format!("Pinned {}", path.display())));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to pin: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_meta(&self, request: Request, sender: ChunkSender) {
+        let id = request.content.trim();
+        match self.rag_manager.get_document(id).await {
+            Ok(Some(document)) => {
+                let _ = sender.send(StreamChunk::done(format_metadata(&document)));
+            }
+            Ok(None) => {
+                let _ = sender.send(StreamChunk::error(format!("No document with id: {}", id)));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to get document: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_retag(&self, request: Request, sender: ChunkSender) {
+        let Some((id, tags)) = parse_retag(&request.content) else {
+            let _ = sender.send(StreamChunk::error(
+                "Usage: retag <id> key=value [key=value ...]",
+            ));
+            return;
+        };
+
+        match self.rag_manager.retag(&id, &tags).await {
+            Ok(Some(document)) => {
+                let _ = sender.send(StreamChunk::done(format_metadata(&document)));
+            }
+            Ok(None) => {
+                let _ = sender.send(StreamChunk::error(format!("No document with id: {}", id)));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to retag: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_reembed_source(&self, request: Request, sender: ChunkSender) {
+        let source = request.content.trim();
+        if source.is_empty() {
+            let _ = sender.send(StreamChunk::error("Usage: reembed-source <source>"));
+            return;
+        }
+
+        match self.rag_manager.reembed_source(source).await {
+            Ok(0) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "No chunks stored for: {}",
+                    source
+                )));
+            }
+            Ok(count) => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "Re-embedded {} chunks of {}",
+                    count, source
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to re-embed {}: {}",
+                    source, e
+                )));
+            }
+        }
+    }
+
+    async fn handle_diff_source(&self, request: Request, sender: ChunkSender) {
+        let source = request.content.trim();
+        if source.is_empty() {
+            let _ = sender.send(StreamChunk::error("Usage: diff-source <source>"));
+            return;
+        }
+
+        match self.rag_manager.diff_source(source).await {
+            Ok(Some(diff)) => {
+                let _ = sender.send(StreamChunk::done(diff.to_string()));
+            }
+            Ok(None) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "No chunks stored for: {}",
+                    source
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to diff {}: {}",
+                    source, e
+                )));
+            }
+        }
+    }
+
+    async fn handle_eval(&self, request: Request, sender: ChunkSender) {
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(request.content.trim()),
+            None => Path::new(request.content.trim()).to_path_buf(),
+        };
+
+        let set = match rag::LabeledSet::load(&path) {
+            Ok(set) => set,
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e));
+                return;
+            }
+        };
+
+        match self.rag_manager.evaluate(&set).await {
+            Ok(report) => {
+                let _ = sender.send(StreamChunk::done(report.to_string()));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to evaluate: {}", e)));
+            }
+        }
+    }
+
+    /// Answers each question of a file in order, holding one chat slot for
+    /// the whole batch.
+    async fn handle_batch(&self, request: Request, sender: ChunkSender) {
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(request.content.trim()),
+            None => Path::new(request.content.trim()).to_path_buf(),
+        };
+
+        let questions = match tokio::fs::read_to_string(&path).await {
+            Ok(text) => parse_questions(&text),
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to read {}: {}",
+                    path.display(),
+                    e
+                )));
+                return;
             }
+        };
+
+        let Some(_permit) = self.chat_limiter.acquire().await else {
+            let _ = sender.send(StreamChunk::error(self.busy_message()));
+            return;
+        };
+
+        let mut answers = Vec::with_capacity(questions.len());
+        for question in &questions {
+            answers.push(self.answer(question, request.max_tokens).await);
         }
 
-        messages.push(Message::user(None, &request.content));
-        messages
+        match serde_json::to_string_pretty(&answers) {
+            Ok(json) => {
+                let _ = sender.send(StreamChunk::done(json));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e.to_string()));
+            }
+        }
+    }
+
+    /// Answers one question with retrieved context, without streaming.
+    async fn answer(&self, question: &str, max_tokens: Option<usize>) -> BatchAnswer {
+        let request = Request {
+            request_type: RequestType::Ask,
+            content: question.to_string(),
+            pwd: None,
+            history: None,
+            max_tokens,
+            rag: None,
+            session: None,
+        };
+        let parts = self.build_parts(request).await;
+        let sources = context_sources(&parts.context);
+        let result = self
+            .generate(&self.config.llm.model, parts.into_messages(), max_tokens)
+            .await;
+
+        match result {
+            Ok(answer) => BatchAnswer::answered(question, answer, sources),
+            Err(e) => BatchAnswer::failed(question, sources, e),
+        }
+    }
+
+    /// Runs a prompt against `model` and returns the whole reply.
+    async fn generate(
+        &self,
+        model: &str,
+        messages: Vec<crate::provider::Message>,
+        max_tokens: Option<usize>,
+    ) -> crate::provider::Result<String> {
+        use crate::provider::ChatRequest;
+
+        let chat_request = ChatRequest::new(model, messages)
+            .with_temperature(self.config.llm.temperature)
+            .with_max_tokens(max_tokens.or(self.config.llm.max_tokens));
+
+        let mut answer = String::new();
+        self.provider
+            .chat(
+                chat_request,
+                Box::new(|response| {
+                    if !response.done {
+                        answer.push_str(&response.content);
+                    }
+                }),
+            )
+            .await?;
+        match ThinkingFilter::new(&self.config.llm.thinking) {
+            Some(mut filter) => Ok(filter.strip(&answer)),
+            None => Ok(answer),
+        }
+    }
+
+    /// Answers one question with two models from the same assembled prompt,
+    /// so the answers differ only by model.
+    async fn handle_compare_models(&self, request: Request, sender: ChunkSender) {
+        let Some((first, second, question)) = parse_compare_models(&request.content) else {
+            let _ = sender.send(StreamChunk::error(
+                "Usage: compare-models <model-a> <model-b> <question>",
+            ));
+            return;
+        };
+
+        let Some(_permit) = self.chat_limiter.acquire().await else {
+            let _ = sender.send(StreamChunk::error(self.busy_message()));
+            return;
+        };
+
+        let ask = Request {
+            request_type: RequestType::Ask,
+            content: question,
+            ..request
+        };
+        let max_tokens = ask.max_tokens;
+        let parts = self.build_parts(ask).await;
+        let prompt_tokens = parts.estimate_tokens();
+        let messages = parts.into_messages();
+
+        let mut sections = Vec::with_capacity(2);
+        for model in [first, second] {
+            let section = match self.generate(&model, messages.clone(), max_tokens).await {
+                Ok(answer) => format!(
+                    "## {}\n\n{}\n\n~{} prompt tokens, ~{} answer tokens",
+                    model,
+                    answer.trim(),
+                    prompt_tokens,
+                    estimate_tokens(&answer)
+                ),
+                Err(e) => format!("## {}\n\nFailed: {}", model, e),
+            };
+            sections.push(section);
+        }
+
+        let _ = sender.send(StreamChunk::done(sections.join("\n\n")));
+    }
+
+    /// Runs a query several times and reports the spread of its embedding,
+    /// retrieval and generation latency. The prompt is assembled once, and
+    /// each run searches again without the retrieval cache.
+    async fn handle_bench(&self, request: Request, sender: ChunkSender) {
+        let (query, runs) = split_option(&request.content, "--runs");
+        let runs = match runs.map(|runs| runs.parse::<usize>()) {
+            None => DEFAULT_RUNS,
+            Some(Ok(runs)) if (1..=MAX_RUNS).contains(&runs) => runs,
+            Some(_) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Invalid --runs value, expected 1 to {}",
+                    MAX_RUNS
+                )));
+                return;
+            }
+        };
+        if query.is_empty() {
+            let _ = sender.send(StreamChunk::error("Usage: bench [--runs <n>] <query>"));
+            return;
+        }
+
+        let Some(_permit) = self.chat_limiter.acquire().await else {
+            let _ = sender.send(StreamChunk::error(self.busy_message()));
+            return;
+        };
+
+        let ask = Request {
+            request_type: RequestType::Ask,
+            content: query.clone(),
+            ..request
+        };
+        let use_rag = uses_rag(&self.config, &ask);
+        let max_tokens = ask.max_tokens;
+
+        let mut samples = Vec::with_capacity(runs);
+        for _ in 0..runs {
+            let (context, search) = if use_rag {
+                match self.rag_manager.time_search(&query).await {
+                    Ok((results, timings)) => (self.chat_context(results).await, timings),
+                    Err(e) => {
+                        let _ = sender.send(StreamChunk::error(format!("Bench failed: {}", e)));
+                        return;
+                    }
+                }
+            } else {
+                (Vec::new(), rag::SearchTimings::default())
+            };
+            let messages = self
+                .parts_with_context(ask.clone(), context)
+                .await
+                .into_messages();
+
+            let started = std::time::Instant::now();
+            let generated = self
+                .generate(&self.config.llm.model, messages, max_tokens)
+                .await;
+            if let Err(e) = generated {
+                let _ = sender.send(StreamChunk::error(format!("Bench failed: {}", e)));
+                return;
+            }
+
+            samples.push(PhaseTimings {
+                embedding: search.embedding,
+                retrieval: search.retrieval,
+                generation: started.elapsed(),
+            });
+        }
+
+        match LatencyReport::new(&query, &samples) {
+            Some(report) => {
+                let _ = sender.send(StreamChunk::done(report.to_string()));
+            }
+            None => {
+                let _ = sender.send(StreamChunk::error("Bench made no runs"));
+            }
+        }
+    }
+
+    async fn handle_chunk_preview(&self, request: Request, sender: ChunkSender) {
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(request.content.trim()),
+            None => Path::new(request.content.trim()).to_path_buf(),
+        };
+
+        match self.rag_manager.preview_chunks(&path).await {
+            Ok(previews) => {
+                let _ = sender.send(StreamChunk::done(format_chunk_previews(&path, &previews)));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!("Failed to preview: {}", e)));
+            }
+        }
+    }
+
+    async fn handle_export_chat(&self, request: Request, sender: ChunkSender) {
+        let path = match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(request.content.trim()),
+            None => Path::new(request.content.trim()).to_path_buf(),
+        };
+        let messages = history_messages(request.history);
+        if messages.is_empty() {
+            let _ = sender.send(StreamChunk::error(
+                "No conversation in the history to export",
+            ));
+            return;
+        }
+
+        match tokio::fs::write(&path, render_markdown(&messages)).await {
+            Ok(()) => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "Exported {} messages to {}",
+                    messages.len(),
+                    path.display()
+                )));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(format!(
+                    "Failed to write {}: {}",
+                    path.display(),
+                    e
+                )));
+            }
+        }
+    }
+
+    /// The templates directory for a request.
+    fn templates_dir(&self, request: &Request) -> PathBuf {
+        match &request.pwd {
+            Some(pwd) => Path::new(pwd).join(&self.config.templates_dir),
+            None => PathBuf::from(&self.config.templates_dir),
+        }
+    }
+
+    async fn handle_templates(&self, request: Request, sender: ChunkSender) {
+        let dir = self.templates_dir(&request);
+        match load_templates(&dir) {
+            Ok(templates) if templates.is_empty() => {
+                let _ = sender.send(StreamChunk::done(format!(
+                    "No templates in {}",
+                    dir.display()
+                )));
+            }
+            Ok(templates) => {
+                let _ = sender.send(StreamChunk::done(format_templates(&templates)));
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e.to_string()));
+            }
+        }
+    }
+
+    async fn handle_use_template(&self, mut request: Request, sender: ChunkSender) {
+        let content = request.content.trim();
+        let (name, args) = content
+            .split_once(char::is_whitespace)
+            .unwrap_or((content, ""));
+        if name.is_empty() {
+            let _ = sender.send(StreamChunk::error(
+                "Usage: use-template <name> [key=value ...] [input]",
+            ));
+            return;
+        }
+
+        let filled = load_template(&self.templates_dir(&request), name)
+            .and_then(|template| template.fill(args));
+        match filled {
+            Ok(prompt) => {
+                request.request_type = RequestType::Chat;
+                request.content = prompt;
+                self.handle_limited_chat(request, sender).await
+            }
+            Err(e) => {
+                let _ = sender.send(StreamChunk::error(e.to_string()));
+            }
+        }
+    }
+
+    async fn handle_explain(&self, request: Request, sender: ChunkSender) {
+        let messages = self.build_messages(request).await;
+        let _ = sender.send(StreamChunk::done(render_messages(&messages)));
+    }
+
+    async fn build_messages(&self, request: Request) -> Vec<crate::provider::Message> {
+        self.build_parts(request).await.into_messages()
+    }
+
+    /// The prompt for a request, with context retrieved when RAG applies.
+    async fn build_parts(&self, request: Request) -> PromptParts {
+        let context = if uses_rag(&self.config, &request) {
+            let results = if self.rag_manager.is_trivial_query(&request.content) {
+                tracing::debug!("Skipping retrieval for trivial query: {}", request.content);
+                Vec::new()
+            } else {
+                self.rag_manager
+                    .search(&request.content)
+                    .await
+                    .unwrap_or_else(|e| {
+                        tracing::debug!("Could not retrieve RAG context: {}", e);
+                        Vec::new()
+                    })
+            };
+            self.chat_context(results).await
+        } else {
+            Vec::new()
+        };
+
+        self.parts_with_context(request, context).await
+    }
+
+    /// Search results cut to the context budget, with pinned documents added
+    /// and citations attached as `rag.citations` and `rag.inline_metadata` ask.
+    async fn chat_context(&self, mut results: Vec<rag::SearchResult>) -> Vec<rag::SearchResult> {
+        self.rag_manager.limit_context(&mut results);
+        let mut results = self.rag_manager.with_pinned(results);
+        let allow_commands = self.registry.granted_permissions().execute;
+        self.rag_manager
+            .annotate_citations(&mut results, allow_commands)
+            .await;
+        results
+    }
+
+    /// The prompt for a request around already retrieved `context`.
+    async fn parts_with_context(
+        &self,
+        request: Request,
+        context: Vec<rag::SearchResult>,
+    ) -> PromptParts {
+        let history = history_messages(request.history);
+        let mut parts = PromptParts::new(&self.config.system_prompt, &request.content)
+            .with_response_language(self.config.response_language.clone())
+            .with_system_suffix(&self.config.system_prompt_suffix)
+            .with_history(history)
+            .with_context(context);
+        parts.keep_last_turns(self.config.llm.max_history_turns);
+        parts.trim_to_fit(self.config.llm.context_length);
+
+        if let (Some(limit), Some(session)) = (self.recall_limit(), &request.session) {
+            let turns = self.recall_turns(session, &parts, limit).await;
+            parts.context.extend(turns);
+            parts.trim_to_fit(self.config.llm.context_length);
+        }
+
+        parts
+    }
+
+    /// Earlier turns of `session` relevant to the user message that aren't
+    /// already in the live history, labelled so the model knows where they
+    /// came from.
+    async fn recall_turns(
+        &self,
+        session: &str,
+        parts: &PromptParts,
+        limit: usize,
+    ) -> Vec<rag::SearchResult> {
+        let turns = self
+            .rag_manager
+            .recall_turns(session, &parts.user_message, limit + parts.history.len())
+            .await
+            .unwrap_or_else(|e| {
+                tracing::debug!("Could not recall earlier turns: {}", e);
+                Vec::new()
+            });
+
+        turns
+            .into_iter()
+            .filter(|turn| {
+                !parts
+                    .history
+                    .iter()
+                    .any(|message| message.content == turn.document.content)
+            })
+            .take(limit)
+            .map(|mut turn| {
+                let role = turn
+                    .document
+                    .metadata
+                    .get("role")
+                    .cloned()
+                    .unwrap_or_default();
+                turn.document.metadata.insert(
+                    "citation".to_string(),
+                    format!("earlier in this conversation, {}", role),
+                );
+                turn
+            })
+            .collect()
+    }
+}
+
+/// Whether a chat request should get retrieved context. On by default for ask,
+/// and never while the knowledge base is disabled.
+fn uses_rag(config: &Config, request: &Request) -> bool {
+    !config.rag_disabled()
+        && request
+            .rag
+            .unwrap_or(request.request_type == RequestType::Ask)
+}
+
+/// Whether a request only makes sense with a knowledge base. Everything else,
+/// such as chats, prompt templates, tool listings, usage and chunk previews,
+/// still works while it is disabled.
+fn needs_knowledge_base(request_type: RequestType) -> bool {
+    matches!(
+        request_type,
+        RequestType::Add
+            | RequestType::Index
+            | RequestType::IndexBackground
+            | RequestType::IndexArchive
+            | RequestType::IndexStatus
+            | RequestType::Stats
+            | RequestType::EmbedWarm
+            | RequestType::Meta
+            | RequestType::Retag
+            | RequestType::ReembedSource
+            | RequestType::DiffSource
+            | RequestType::TempAdd
+            | RequestType::TempClear
+            | RequestType::Eval
+            | RequestType::Compare
+            | RequestType::Retrieve
+            | RequestType::Sources
+            | RequestType::Verify
+            | RequestType::Pin
+            | RequestType::Embed
+            | RequestType::Merge
+            | RequestType::Which
+            | RequestType::Snapshot
+            | RequestType::Rollback
+            | RequestType::ValidateExport
+    )
+}
+
+/// Converts a request's conversation history into provider messages.
+fn history_messages(history: Option<Vec<super::types::Message>>) -> Vec<crate::provider::Message> {
+    history
+        .unwrap_or_default()
+        .into_iter()
+        .map(|msg| crate::provider::Message {
+            role: msg.role,
+            context: None,
+            content: msg.content,
+            images: None,
+            tool_calls: None,
+            tool_name: None,
+            tool_call_id: None,
+        })
+        .collect()
+}
+
+/// Separates a `--since <cutoff>` option from the rest of an index request.
+fn split_since(content: &str) -> (String, Option<String>) {
+    split_option(content, "--since")
+}
+
+/// Separates `option <value>` or `option=<value>` from the rest of a request.
+fn split_option(content: &str, option: &str) -> (String, Option<String>) {
+    let mut rest = Vec::new();
+    let mut found = None;
+    let mut words = content.split_whitespace();
+
+    while let Some(word) = words.next() {
+        match word.strip_prefix(option) {
+            Some("") => found = words.next().map(str::to_string),
+            Some(value) if value.starts_with('=') => found = Some(value[1..].to_string()),
+            _ => rest.push(word),
+        }
+    }
+
+    (rest.join(" "), found)
+}
+
+/// One line per tool: name, status, required permission and description.
+fn format_tools(tools: &[ToolInfo], granted: Permission) -> String {
+    if tools.is_empty() {
+        return "No tools registered".to_string();
+    }
+    let mut out = format!("{} tools (granted: {})\n", tools.len(), granted);
+    for tool in tools {
+        out.push_str(&format!(
+            "{} [{}] needs {}: {}\n",
+            tool.name, tool.status, tool.required_permission, tool.description
+        ));
+    }
+    out
+}
+
+fn format_chunk_previews(path: &Path, previews: &[rag::ChunkPreview]) -> String {
+    let mut out = format!("{} chunks from {}\n", previews.len(), path.display());
+    for preview in previews {
+        out.push_str(&format!("{}\n", preview));
+    }
+    out
+}
+
+/// Separates a `--force` flag from the rest of an index request.
+fn split_force(content: &str) -> (String, bool) {
+    split_flag(content, "--force")
+}
+
+/// Separates `flag` from the rest of a request, returning whether it was given.
+fn split_flag(content: &str, flag: &str) -> (String, bool) {
+    let mut found = false;
+    let rest: Vec<&str> = content
+        .split_whitespace()
+        .filter(|word| {
+            let is_flag = *word == flag;
+            found |= is_flag;
+            !is_flag
+        })
+        .collect();
+    (rest.join(" "), found)
+}
+
+/// The most recent user message in the request history.
+fn last_user_message(request: &Request) -> Option<String> {
+    request
+        .history
+        .as_ref()?
+        .iter()
+        .rev()
+        .find(|message| message.role == "user")
+        .map(|message| message.content.clone())
+}
+
+/// `#<rank> <score> <source> (<id>)` per result, best first.
+fn format_sources(query: &str, results: &[rag::SearchResult]) -> String {
+    let mut out = format!("Sources for: {}\n", query);
+    for (rank, hit) in results.iter().map(rag::ComparedHit::from).enumerate() {
+        out.push_str(&format!(
+            "#{} {:.3} {} ({})\n",
+            rank + 1,
+            hit.score,
+            hit.source,
+            hit.id
+        ));
+    }
+    out
+}
+
+/// Splits `a.top_k=3 b.top_k=8 <query>` into both sides' settings and the
+/// query. Sides without overrides keep `base`.
+fn parse_compare(
+    content: &str,
+    base: rag::RetrievalSettings,
+) -> Result<(rag::RetrievalSettings, rag::RetrievalSettings, String), String> {
+    let (mut first, mut second) = (base, base);
+    let mut words = content.split_whitespace().peekable();
+
+    while let Some(word) = words.peek() {
+        let Some((side, setting)) = word.split_once('.') else {
+            break;
+        };
+        let Some((key, value)) = setting.split_once('=') else {
+            break;
+        };
+        match side {
+            "a" => first.set(key, value)?,
+            "b" => second.set(key, value)?,
+            _ => break,
+        }
+        words.next();
+    }
+
+    let query = words.collect::<Vec<_>>().join(" ");
+    if query.is_empty() {
+        return Err(
+            "Usage: compare [a.<setting>=<value> ...] [b.<setting>=<value> ...] <query>"
+                .to_string(),
+        );
+    }
+    Ok((first, second, query))
+}
+
+/// Splits `<model-a> <model-b> <question>` into its parts.
+fn parse_compare_models(content: &str) -> Option<(String, String, String)> {
+    let mut words = content.split_whitespace();
+    let first = words.next()?.to_string();
+    let second = words.next()?.to_string();
+    let question = words.collect::<Vec<_>>().join(" ");
+    (!question.is_empty()).then_some((first, second, question))
+}
+
+/// Splits `<id> key=value ...` into the ID and its tags.
+///
+/// Tags are read from the end so IDs containing spaces still work.
+fn parse_retag(content: &str) -> Option<(String, Vec<(String, String)>)> {
+    let mut rest = content.trim();
+    let mut tags = Vec::new();
+
+    while let Some((head, last)) = rest.rsplit_once(char::is_whitespace) {
+        let Some((key, value)) = last.split_once('=') else {
+            break;
+        };
+        if key.is_empty() {
+            break;
+        }
+        tags.push((key.to_string(), value.to_string()));
+        rest = head.trim_end();
+    }
+
+    if tags.is_empty() || rest.is_empty() {
+        return None;
+    }
+    tags.reverse();
+    Some((rest.to_string(), tags))
+}
+
+/// One line per template: its name and the placeholders it takes.
+fn format_templates(templates: &[PromptTemplate]) -> String {
+    templates
+        .iter()
+        .map(|template| {
+            let placeholders = template.placeholders();
+            if placeholders.is_empty() {
+                template.name.clone()
+            } else {
+                format!("{} ({})", template.name, placeholders.join(", "))
+            }
+        })
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+fn format_metadata(document: &rag::Document) -> String {
+    let mut keys: Vec<_> = document.metadata.keys().collect();
+    keys.sort();
+
+    let mut out = format!("id: {}", document.id);
+    for key in keys {
+        out.push_str(&format!("\n{}: {}", key, document.metadata[key]));
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::ServerConfig;
+    use crate::models::EmbeddingModel;
+    use crate::provider::{ChatRequest, ChatResponse, Message};
+    use crate::rag::testing::{test_engine, MemoryStore};
+    use crate::server::types::ChunkType;
+    use async_trait::async_trait;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::time::Duration;
+
+    /// Takes a while to answer and records the peak number of concurrent chats.
+    #[derive(Default)]
+    struct SlowProvider {
+        in_flight: AtomicUsize,
+        peak: AtomicUsize,
+    }
+
+    #[async_trait]
+    impl Provider for SlowProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> crate::provider::Result<()> {
+            let now = self.in_flight.fetch_add(1, Ordering::SeqCst) + 1;
+            self.peak.fetch_max(now, Ordering::SeqCst);
+
+            tokio::time::sleep(Duration::from_millis(50)).await;
+
+            self.in_flight.fetch_sub(1, Ordering::SeqCst);
+            callback(ChatResponse {
+                model: request.model,
+                content: "ok".to_string(),
+                done: true,
+                message: Message::assistant(None, "ok"),
+            });
+            Ok(())
+        }
+
+        async fn embed(
+            &self,
+            _text: &str,
+            _model: &EmbeddingModel,
+        ) -> crate::provider::Result<Vec<f32>> {
+            Ok(vec![0.0; 4])
+        }
+    }
+
+    fn handler(provider: Arc<dyn Provider>, config: Config) -> RequestHandler {
+        RequestHandler {
+            chat_limiter: ChatLimiter::new(&config.server),
+            rag_manager: test_engine(provider.clone(), Arc::new(MemoryStore::new())),
+            provider,
+            registry: Arc::new(PluginRegistry::new(Permission::ALL)),
+            config,
+        }
+    }
+
+    #[tokio::test]
+    async fn test_disabled_knowledge_base_only_refuses_rag_requests() {
+        use crate::config::RagConfig;
+
+        let rag = RagConfig {
+            enabled: false,
+            ..RagConfig::default()
+        };
+        let config = Config::default().with_rag_config(rag);
+        let handler = handler(Arc::new(SlowProvider::default()), config);
+
+        for (request_type, refused) in [
+            (RequestType::Stats, true),
+            (RequestType::Retrieve, true),
+            (RequestType::Usage, false),
+            (RequestType::ChunkPreview, false),
+        ] {
+            let mut request = chat("notes.md");
+            request.request_type = request_type;
+            let (sender, mut receiver) = mpsc::unbounded_channel();
+            handler.handle(request, sender).await;
+
+            let chunk = receiver.recv().await.unwrap();
+            let disabled = chunk.error.as_deref()
+                == Some("The knowledge base is disabled (rag.enabled is false)");
+            assert_eq!(disabled, refused, "{:?}", request_type);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_index_without_directory_reports_error() {
+        let handler = handler(Arc::new(SlowProvider::default()), Config::default());
+
+        let mut index = chat("");
+        index.request_type = RequestType::Index;
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(index, sender).await;
+
+        let chunk = receiver.recv().await.unwrap();
+        assert_eq!(chunk.chunk_type, ChunkType::Error);
+        assert_eq!(chunk.error.as_deref(), Some("Missing working directory"));
+    }
+
+    #[tokio::test]
+    async fn test_index_streams_progress_for_each_file() {
+        let dir = tempfile::tempdir().unwrap();
+        for name in ["a.md", "b.md", "c.md"] {
+            std::fs::write(dir.path().join(name), format!("notes in {}", name)).unwrap();
+        }
+        let handler = handler(Arc::new(SlowProvider::default()), Config::default());
+
+        let mut index = chat("--progress");
+        index.request_type = RequestType::Index;
+        index.pwd = Some(dir.path().to_string_lossy().to_string());
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(index, sender).await;
+        let mut chunks = Vec::new();
+        while let Some(chunk) = receiver.recv().await {
+            chunks.push(chunk);
+        }
+
+        let (last, progress) = chunks.split_last().unwrap();
+        assert_eq!(last.chunk_type, ChunkType::Done);
+        assert!(last.content.contains("Indexed 3 files"), "{}", last.content);
+        assert_eq!(progress.len(), 3);
+        assert!(progress.iter().all(|c| c.chunk_type == ChunkType::Chunk));
+        for name in ["a.md", "b.md", "c.md"] {
+            assert!(progress.iter().any(|c| c.content.ends_with(name)));
+        }
+        assert!(progress.iter().any(|c| c.content.starts_with("[3/3] ")));
+    }
+
+    fn chat(content: &str) -> Request {
+        Request {
+            request_type: RequestType::Chat,
+            content: content.to_string(),
+            pwd: None,
+            history: None,
+            max_tokens: None,
+            rag: None,
+            session: None,
+        }
+    }
+
+    /// Fires `count` chats at once and returns the final chunk of each.
+    async fn fire(handler: &RequestHandler, count: usize) -> Vec<StreamChunk> {
+        let chats = (0..count).map(|i| async move {
+            let (sender, mut receiver) = mpsc::unbounded_channel();
+            handler
+                .handle(chat(&format!("question {}", i)), sender)
+                .await;
+
+            let mut last = None;
+            while let Some(chunk) = receiver.recv().await {
+                last = Some(chunk);
+            }
+            last.expect("every request gets a final chunk")
+        });
+        futures::future::join_all(chats).await
+    }
+
+    #[tokio::test]
+    async fn test_chats_beyond_limit_are_queued() {
+        let provider = Arc::new(SlowProvider::default());
+        let handler = handler(
+            provider.clone(),
+            Config::default().with_server_config(ServerConfig {
+                max_concurrent_chats: 2,
+                reject_when_busy: false,
+                ..ServerConfig::default()
+            }),
+        );
+
+        let finals = fire(&handler, 5).await;
+
+        assert!(finals.iter().all(|c| c.chunk_type == ChunkType::Done));
+        assert_eq!(provider.peak.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_chats_beyond_limit_are_rejected() {
+        let provider = Arc::new(SlowProvider::default());
+        let handler = handler(
+            provider.clone(),
+            Config::default().with_server_config(ServerConfig {
+                max_concurrent_chats: 2,
+                reject_when_busy: true,
+                ..ServerConfig::default()
+            }),
+        );
+
+        let finals = fire(&handler, 5).await;
+
+        let done = finals
+            .iter()
+            .filter(|c| c.chunk_type == ChunkType::Done)
+            .count();
+        let busy = finals
+            .iter()
+            .filter(|c| c.chunk_type == ChunkType::Error)
+            .filter(|c| c.error.as_deref().unwrap_or_default().contains("busy"))
+            .count();
+
+        assert_eq!(done, 2);
+        assert_eq!(busy, 3);
+        assert!(provider.peak.load(Ordering::SeqCst) <= 2);
+    }
+
+    #[tokio::test]
+    async fn test_warm_up_embeds_only_when_enabled() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let mut rag = RagConfig::default();
+        let mut handler = handler(
+            provider.clone(),
+            Config::default().with_rag_config(rag.clone()),
+        );
+
+        handler.warm_up().await;
+        assert_eq!(provider.embed_calls(), 0);
+
+        rag.warmup_embedding_model = true;
+        handler.config = Config::default().with_rag_config(rag);
+        handler.warm_up().await;
+        handler.warm_up().await;
+        // Not served from the cache, so every warmup reaches the provider.
+        assert_eq!(provider.embedded_texts(), vec!["warmup", "warmup"]);
+    }
+
+    #[tokio::test]
+    async fn test_ask_adds_retrieved_context_and_chat_does_not() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let config = Config::default().with_rag_config(RagConfig::default());
+        let handler = handler(provider.clone(), config);
+        handler
+            .rag_manager
+            .add_knowledge("Channels in this codebase wrap tokio mpsc", "notes.md")
+            .await
+            .unwrap();
+
+        let question = "What is the syntax for a channel?";
+        let mut ask = chat(question);
+        ask.request_type = RequestType::Ask;
+        let mut chat_with_rag = chat(question);
+        chat_with_rag.rag = Some(true);
+
+        for request in [chat(question), ask, chat_with_rag] {
+            let (sender, _receiver) = mpsc::unbounded_channel();
+            handler.handle(request, sender).await;
+        }
+
+        let requests = provider.requests();
+        let sent = |i: usize| requests[i].messages.last().unwrap().content.clone();
+        assert_eq!(sent(0), question);
+        assert!(sent(1).contains("wrap tokio mpsc"));
+        assert!(sent(2).contains("wrap tokio mpsc"));
+    }
+
+    #[tokio::test]
+    async fn test_chat_context_carries_inline_locations() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(dir.path().join("channels.md"), "Channels wrap tokio mpsc\n").unwrap();
+        let provider = Arc::new(ScriptedProvider::default());
+        let config = Config::default().with_rag_config(RagConfig::default());
+        let mut handler = handler(provider.clone(), config);
+        handler.rag_manager =
+            test_engine(provider.clone(), Arc::new(MemoryStore::new())).with_inline_metadata();
+        handler
+            .rag_manager
+            .index_directory(dir.path())
+            .await
+            .unwrap();
+
+        let mut ask = chat("How do channels work?");
+        ask.request_type = RequestType::Ask;
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(ask, sender).await;
+
+        let location = format!("[{}:1-1]", dir.path().join("channels.md").display());
+        let requests = provider.requests();
+        let sent = &requests[0].messages.last().unwrap().content;
+        assert!(sent.contains(&location), "missing {} in {}", location, sent);
+    }
+
+    #[tokio::test]
+    async fn test_batch_returns_one_answer_per_question_in_order() {
+        use crate::provider::testing::ScriptedProvider;
+
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(
+            dir.path().join("questions.txt"),
+            "What wraps mpsc?\n# skipped\nWho reviews PRs?\n",
+        )
+        .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            Message::assistant(None, "The channel module."),
+            Message::assistant(None, "The core team."),
+        ]));
+        let config = Config::default();
+        let handler = handler(provider.clone(), config);
+        handler
+            .rag_manager
+            .add_knowledge("Channels in this codebase wrap tokio mpsc", "notes.md")
+            .await
+            .unwrap();
+
+        let mut request = chat("questions.txt");
+        request.request_type = RequestType::Batch;
+        request.pwd = Some(dir.path().display().to_string());
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(request, sender).await;
+
+        let done = receiver.recv().await.unwrap();
+        assert_eq!(done.chunk_type, ChunkType::Done);
+        let answers: serde_json::Value = serde_json::from_str(&done.content).unwrap();
+        assert_eq!(answers.as_array().unwrap().len(), 2);
+        assert_eq!(answers[0]["question"], "What wraps mpsc?");
+        assert_eq!(answers[0]["answer"], "The channel module.");
+        assert_eq!(answers[0]["sources"][0], "notes.md");
+        assert_eq!(answers[1]["question"], "Who reviews PRs?");
+        assert_eq!(answers[1]["answer"], "The core team.");
+        assert!(provider.requests()[0]
+            .messages
+            .last()
+            .unwrap()
+            .content
+            .contains("wrap tokio mpsc"));
+    }
+
+    #[tokio::test]
+    async fn test_use_template_sends_filled_prompt() {
+        use crate::provider::testing::ScriptedProvider;
+
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::create_dir(dir.path().join("templates")).unwrap();
+        std::fs::write(
+            dir.path().join("templates/review.md"),
+            "Review this {{language}} code:\n{{input}}",
+        )
+        .unwrap();
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let config = Config::default();
+        let handler = handler(provider.clone(), config);
+        let pwd = Some(dir.path().to_string_lossy().into_owned());
+
+        let mut list = chat("");
+        list.request_type = RequestType::Templates;
+        list.pwd = pwd.clone();
+        let mut use_template = chat("review language=Rust fn main() {}");
+        use_template.request_type = RequestType::UseTemplate;
+        use_template.pwd = pwd;
+
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(list, sender).await;
+        let listed = receiver.recv().await.unwrap();
+        assert_eq!(listed.content, "review (language, input)");
+
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(use_template, sender).await;
+        let requests = provider.requests();
+        assert_eq!(
+            requests[0].messages.last().unwrap().content,
+            "Review this Rust code:\nfn main() {}"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_earlier_turn_recalled_beyond_history_cap() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+        use crate::server::types::Message as HistoryMessage;
+
+        let turns = [
+            (
+                "Our deploy target is the staging cluster named aurora",
+                "Noted, deploys go to aurora",
+            ),
+            ("What is the capital of France?", "Paris is the capital."),
+            ("Recommend a good book", "Try reading Dune."),
+            ("How tall is Everest?", "About 8849 metres."),
+        ];
+        let mut replies: Vec<Message> = turns
+            .iter()
+            .map(|(_, answer)| Message::assistant(None, *answer))
+            .collect();
+        replies.push(Message::assistant(None, "aurora"));
+        let provider = Arc::new(ScriptedProvider::new(replies));
+
+        let mut rag = RagConfig::default();
+        rag.conversation_recall.enabled = true;
+        rag.conversation_recall.top_k = 1;
+        let config = Config::default()
+            .with_system_prompt("")
+            .with_context_length(60)
+            .with_rag_config(rag);
+        let handler = handler(provider.clone(), config);
+
+        let mut history = Vec::new();
+        for (question, answer) in turns {
+            let mut request = chat(question);
+            request.history = Some(history.clone());
+            request.session = Some("deploys".to_string());
+            let (sender, _receiver) = mpsc::unbounded_channel();
+            handler.handle(request, sender).await;
+
+            for (role, content) in [("user", question), ("assistant", answer)] {
+                history.push(HistoryMessage {
+                    role: role.to_string(),
+                    content: content.to_string(),
+                });
+            }
+        }
+
+        let mut request = chat("Which cluster do we deploy to?");
+        request.history = Some(history);
+        request.session = Some("deploys".to_string());
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(request, sender).await;
+
+        let sent = provider.requests().pop().unwrap().messages;
+        let (question, live_history) = sent.split_last().unwrap();
+        assert!(live_history
+            .iter()
+            .all(|message| !message.content.contains("aurora")));
+        assert!(question
+            .content
+            .contains("(earlier in this conversation, user)\nOur deploy target is the staging cluster named aurora"));
+    }
+
+    #[tokio::test]
+    async fn test_turns_are_only_recalled_in_their_session() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![
+            Message::assistant(None, "Noted, deploys go to aurora"),
+            Message::assistant(None, "I don't know"),
+            Message::assistant(None, "I don't know"),
+        ]));
+        let mut rag = RagConfig::default();
+        rag.conversation_recall.enabled = true;
+        let config = Config::default()
+            .with_system_prompt("")
+            .with_rag_config(rag);
+        let handler = handler(provider.clone(), config);
+
+        let mut request = chat("Our deploy target is the staging cluster named aurora");
+        request.session = Some("alice".to_string());
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(request, sender).await;
+
+        let mut other_session = chat("Which cluster do we deploy to?");
+        other_session.session = Some("bob".to_string());
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(other_session, sender).await;
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler
+            .handle(chat("Which cluster do we deploy to?"), sender)
+            .await;
+
+        for request in &provider.requests()[1..] {
+            assert!(request
+                .messages
+                .iter()
+                .all(|message| !message.content.contains("aurora")));
+        }
+    }
+
+    #[tokio::test]
+    async fn test_recalled_chat_completes_when_chats_take_priority() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None,
+            "Deploys go to aurora",
+        )]));
+        let mut rag = RagConfig::default();
+        rag.conversation_recall.enabled = true;
+        let config = Config::default()
+            .with_rag_config(rag)
+            .with_server_config(ServerConfig {
+                prioritize_chats: true,
+                ..ServerConfig::default()
+            });
+        // Wired as `RequestHandler::new` does, so the chat's slot counts as
+        // an active chat for the embeddings it makes.
+        let mut handler = handler(provider.clone(), config);
+        let prioritized: Arc<dyn Provider> = Arc::new(
+            PriorityProvider::new(provider.clone(), &handler.config.server)
+                .with_activity(handler.chat_limiter.activity()),
+        );
+        handler.rag_manager = test_engine(prioritized.clone(), Arc::new(MemoryStore::new()));
+        handler.provider = prioritized;
+
+        let mut request = chat("Where do we deploy?");
+        request.session = Some("deploys".to_string());
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        tokio::time::timeout(Duration::from_secs(5), handler.handle(request, sender))
+            .await
+            .expect("chat finished");
+
+        let mut last = None;
+        while let Some(chunk) = receiver.recv().await {
+            last = Some(chunk);
+        }
+        let last = last.unwrap();
+        assert_eq!(last.chunk_type, ChunkType::Done);
+        assert_eq!(last.content, "Deploys go to aurora");
+        assert!(provider
+            .embedded_texts()
+            .contains(&"Deploys go to aurora".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_only_last_history_turns_are_sent() {
+        use crate::provider::testing::ScriptedProvider;
+        use crate::server::types::Message as HistoryMessage;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(None, "ok")]));
+        let config = Config::default()
+            .with_system_prompt("")
+            .with_max_history_turns(2);
+        let handler = handler(provider.clone(), config);
+
+        let mut request = chat("fourth question");
+        request.history = Some(
+            ["first", "second", "third"]
+                .iter()
+                .flat_map(|turn| {
+                    [("user", "question"), ("assistant", "answer")].map(|(role, text)| {
+                        HistoryMessage {
+                            role: role.to_string(),
+                            content: format!("{} {}", turn, text),
+                        }
+                    })
+                })
+                .collect(),
+        );
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(request, sender).await;
+
+        let sent: Vec<String> = provider.requests()[0]
+            .messages
+            .iter()
+            .filter(|message| message.role != "system")
+            .map(|message| message.content.clone())
+            .collect();
+        assert_eq!(
+            sent,
+            vec![
+                "second question",
+                "second answer",
+                "third question",
+                "third answer",
+                "fourth question"
+            ]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_system_prompt_suffix_ends_system_message() {
+        use crate::provider::testing::ScriptedProvider;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(None, "ok")]));
+        let mut config = Config::default().with_system_prompt("You review Rust code.");
+        config.system_prompt_suffix = "Answer in Markdown.".to_string();
+        let handler = handler(provider.clone(), config);
+
+        let (sender, _receiver) = mpsc::unbounded_channel();
+        handler.handle(chat("Is this safe?"), sender).await;
+
+        let system = &provider.requests()[0].messages[0];
+        assert_eq!(system.role, "system");
+        assert_eq!(
+            system.content,
+            "You review Rust code.\n\nAnswer in Markdown."
+        );
+    }
+
+    #[test]
+    fn test_parse_retag() {
+        assert_eq!(
+            parse_retag("notes/a b.md_chunk_0 team=search lang=en"),
+            Some((
+                "notes/a b.md_chunk_0".to_string(),
+                vec![
+                    ("team".to_string(), "search".to_string()),
+                    ("lang".to_string(), "en".to_string()),
+                ]
+            ))
+        );
+        assert_eq!(parse_retag("doc_0"), None);
+        assert_eq!(parse_retag("team=search"), None);
+    }
+
+    #[test]
+    fn test_parse_compare() {
+        let base = rag::RetrievalSettings {
+            top_k: 5,
+            min_score: Some(0.3),
+            candidate_multiplier: 3,
+            rerank: false,
+        };
+
+        let (first, second, query) = parse_compare(
+            "a.top_k=2 b.min_score=none how is config.yaml loaded?",
+            base,
+        )
+        .unwrap();
+        assert_eq!(first, base.with_top_k(2));
+        assert_eq!(second, base.with_min_score(None));
+        assert_eq!(query, "how is config.yaml loaded?");
+
+        assert!(parse_compare("b.top_k=lots query", base).is_err());
+        assert!(parse_compare("a.top_k=2", base).is_err());
+    }
+
+    #[test]
+    fn test_split_since() {
+        assert_eq!(
+            split_since("./src --since 24h"),
+            ("./src".to_string(), Some("24h".to_string()))
+        );
+        assert_eq!(
+            split_since("--since=7d ./docs"),
+            ("./docs".to_string(), Some("7d".to_string()))
+        );
+        assert_eq!(split_since("./src"), ("./src".to_string(), None));
+    }
+
+    #[test]
+    fn test_split_force() {
+        assert_eq!(split_force("./src --force"), ("./src".to_string(), true));
+        assert_eq!(split_force("./src"), ("./src".to_string(), false));
+    }
+
+    #[test]
+    fn test_format_tools_shows_status_and_permission() {
+        use nucleus_plugin::ToolStatus;
+
+        let tools = vec![
+            ToolInfo {
+                name: "read_file".to_string(),
+                description: "Read a file".to_string(),
+                required_permission: Permission::READ_ONLY,
+                status: ToolStatus::Enabled,
+            },
+            ToolInfo {
+                name: "exec".to_string(),
+                description: "Run a command".to_string(),
+                required_permission: Permission::ALL,
+                status: ToolStatus::Denied,
+            },
+        ];
+
+        let text = format_tools(&tools, Permission::READ_ONLY);
+        let lines: Vec<&str> = text.lines().collect();
+        assert_eq!(lines[0], "2 tools (granted: read)");
+        assert_eq!(lines[1], "read_file [enabled] needs read: Read a file");
+        assert_eq!(
+            lines[2],
+            "exec [denied] needs read+write+execute: Run a command"
+        );
+        assert_eq!(format_tools(&[], Permission::NONE), "No tools registered");
+    }
+
+    #[tokio::test]
+    async fn test_sources_rerank_reorders_last_query() {
+        use crate::provider::testing::ScriptedProvider;
+        use crate::server::types::Message as HistoryMessage;
+
+        let provider = Arc::new(ScriptedProvider::default());
+        let config = Config::default();
+        let handler = handler(provider.clone(), config);
+        // Closest by vector, but only mentions one of the query's words.
+        handler
+            .rag_manager
+            .add_knowledge("retry retry retry", "a.md")
+            .await
+            .unwrap();
+        handler
+            .rag_manager
+            .add_knowledge("retry after a timeout expires in the client", "b.md")
+            .await
+            .unwrap();
+
+        let mut request = chat("--rerank");
+        request.request_type = RequestType::Sources;
+        request.history = Some(vec![
+            HistoryMessage {
+                role: "user".to_string(),
+                content: "retry timeout".to_string(),
+            },
+            HistoryMessage {
+                role: "assistant".to_string(),
+                content: "It retries.".to_string(),
+            },
+        ]);
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(request, sender).await;
+        let reply = receiver.recv().await.unwrap();
+
+        assert_eq!(reply.chunk_type, ChunkType::Done);
+        assert!(reply.content.starts_with("Query: retry timeout"));
+        let ranks = |source: &str| {
+            let line = reply
+                .content
+                .lines()
+                .find(|line| line.contains(source))
+                .unwrap()
+                .to_string();
+            let (before, after) = line.split_once('|').unwrap();
+            (
+                before.split_whitespace().next().unwrap().to_string(),
+                after.split_whitespace().next().unwrap().to_string(),
+            )
+        };
+        assert_eq!(ranks("a.md"), ("#1".to_string(), "#2".to_string()));
+        assert_eq!(ranks("b.md"), ("#2".to_string(), "#1".to_string()));
+        assert!(provider.requests().is_empty());
+    }
+
+    /// Answers `answer from <model>` and records every request.
+    #[derive(Default)]
+    struct ModelTaggedProvider {
+        requests: std::sync::Mutex<Vec<ChatRequest>>,
+    }
+
+    #[async_trait]
+    impl Provider for ModelTaggedProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> crate::provider::Result<()> {
+            self.requests.lock().unwrap().push(request.clone());
+            let answer = format!("answer from {}", request.model);
+            callback(ChatResponse {
+                model: request.model.clone(),
+                content: answer.clone(),
+                done: false,
+                message: Message::assistant(None, &answer),
+            });
+            callback(ChatResponse {
+                model: request.model,
+                content: String::new(),
+                done: true,
+                message: Message::assistant(None, ""),
+            });
+            Ok(())
+        }
+
+        async fn embed(
+            &self,
+            text: &str,
+            _model: &EmbeddingModel,
+        ) -> crate::provider::Result<Vec<f32>> {
+            Ok(crate::provider::testing::fake_embedding(text))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_compare_models_sends_both_the_same_prompt() {
+        let provider = Arc::new(ModelTaggedProvider::default());
+        let config = Config::default();
+        let handler = handler(provider.clone(), config);
+        handler
+            .rag_manager
+            .add_knowledge("Channels in this codebase wrap tokio mpsc", "notes.md")
+            .await
+            .unwrap();
+
+        let mut request = chat("llama3 qwen3:8b What do channels wrap?");
+        request.request_type = RequestType::CompareModels;
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(request, sender).await;
+        let reply = receiver.recv().await.unwrap();
+
+        assert_eq!(reply.chunk_type, ChunkType::Done);
+        assert!(reply
+            .content
+            .starts_with("## llama3\n\nanswer from llama3\n\n~"));
+        assert!(reply
+            .content
+            .contains("## qwen3:8b\n\nanswer from qwen3:8b\n\n~"));
+        assert_eq!(reply.content.matches("answer tokens").count(), 2);
+
+        let requests = provider.requests.lock().unwrap();
+        assert_eq!(requests.len(), 2);
+        assert_eq!(requests[0].model, "llama3");
+        assert_eq!(requests[1].model, "qwen3:8b");
+        assert_eq!(
+            render_messages(&requests[0].messages),
+            render_messages(&requests[1].messages)
+        );
+        assert!(requests[0]
+            .messages
+            .last()
+            .unwrap()
+            .content
+            .contains("wrap tokio mpsc"));
+    }
+
+    #[test]
+    fn test_parse_compare_models() {
+        assert_eq!(
+            parse_compare_models("a b  how are  files chunked?"),
+            Some((
+                "a".to_string(),
+                "b".to_string(),
+                "how are files chunked?".to_string()
+            ))
+        );
+        assert_eq!(parse_compare_models("a b"), None);
+    }
+
+    /// Streams two tokens, then fails as if the connection dropped.
+    struct DroppedStreamProvider;
+
+    #[async_trait]
+    impl Provider for DroppedStreamProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> crate::provider::Result<()> {
+            for token in ["The index ", "is stored"] {
+                callback(ChatResponse {
+                    model: request.model.clone(),
+                    content: token.to_string(),
+                    done: false,
+                    message: Message::assistant(None, token),
+                });
+            }
+            Err(crate::provider::ProviderError::Other(
+                "connection reset".to_string(),
+            ))
+        }
+
+        async fn embed(
+            &self,
+            text: &str,
+            _model: &EmbeddingModel,
+        ) -> crate::provider::Result<Vec<f32>> {
+            Ok(crate::provider::testing::fake_embedding(text))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_disabled_rag_skips_retrieval_and_chat_still_works() {
+        use crate::config::RagConfig;
+        use crate::provider::testing::ScriptedProvider;
+
+        let provider = Arc::new(ScriptedProvider::new(vec![Message::assistant(
+            None,
+            "Plain answer",
+        )]));
+        let rag = RagConfig {
+            enabled: false,
+            ..RagConfig::default()
+        };
+        let handler = handler(provider.clone(), Config::default().with_rag_config(rag));
+        handler
+            .rag_manager
+            .add_knowledge("The deploy target is aurora", "deploy.md")
+            .await
+            .unwrap();
+        let embeds = provider.embed_calls();
+
+        let mut ask = chat("Where do we deploy?");
+        ask.request_type = RequestType::Ask;
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(ask, sender).await;
+        let mut last = None;
+        while let Some(chunk) = receiver.recv().await {
+            last = Some(chunk);
+        }
+        let last = last.unwrap();
+        assert_eq!(last.chunk_type, ChunkType::Done);
+        assert_eq!(last.content, "Plain answer");
+        assert!(!provider.requests()[0]
+            .messages
+            .iter()
+            .any(|message| message.content.contains("aurora")));
+
+        let mut index = chat("");
+        index.request_type = RequestType::Index;
+        index.pwd = Some(".".to_string());
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(index, sender).await;
+        assert_eq!(receiver.recv().await.unwrap().chunk_type, ChunkType::Error);
+
+        assert_eq!(provider.embed_calls(), embeds);
+    }
+
+    #[tokio::test]
+    async fn test_partial_response_returned_with_stream_error() {
+        for partial_on_error in [true, false] {
+            let provider = Arc::new(DroppedStreamProvider);
+            let config = Config::default().with_server_config(ServerConfig {
+                partial_on_error,
+                ..ServerConfig::default()
+            });
+            let handler = handler(provider, config);
+
+            let (sender, mut receiver) = mpsc::unbounded_channel();
+            handler.handle(chat("Where is the index?"), sender).await;
+            let mut last = None;
+            while let Some(chunk) = receiver.recv().await {
+                last = Some(chunk);
+            }
+
+            let last = last.unwrap();
+            assert_eq!(last.chunk_type, ChunkType::Error);
+            assert!(last.error.unwrap().contains("connection reset"));
+            let expected = if partial_on_error {
+                "The index is stored"
+            } else {
+                ""
+            };
+            assert_eq!(last.content, expected);
+        }
+    }
+
+    /// Sleeps a fixed time before each embedding and each answer.
+    struct DelayedProvider {
+        embed_delay: Duration,
+        chat_delay: Duration,
+    }
+
+    #[async_trait]
+    impl Provider for DelayedProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> crate::provider::Result<()> {
+            tokio::time::sleep(self.chat_delay).await;
+            let message = Message::assistant(None, "On port 8080");
+            callback(ChatResponse {
+                model: request.model,
+                content: message.content.clone(),
+                done: true,
+                message,
+            });
+            Ok(())
+        }
+
+        async fn embed(
+            &self,
+            text: &str,
+            _model: &EmbeddingModel,
+        ) -> crate::provider::Result<Vec<f32>> {
+            tokio::time::sleep(self.embed_delay).await;
+            Ok(crate::provider::testing::fake_embedding(text))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_bench_reports_injected_phase_delays() {
+        let provider = Arc::new(DelayedProvider {
+            embed_delay: Duration::from_millis(20),
+            chat_delay: Duration::from_millis(40),
+        });
+        let handler = handler(provider, Config::default());
+        handler
+            .rag_manager
+            .add_knowledge("The server listens on port 8080", "server.md")
+            .await
+            .unwrap();
+
+        let mut bench = chat("Which port? --runs 3");
+        bench.request_type = RequestType::Bench;
+        let (sender, mut receiver) = mpsc::unbounded_channel();
+        handler.handle(bench, sender).await;
+        let report = receiver.recv().await.unwrap();
+        assert_eq!(report.chunk_type, ChunkType::Done);
+
+        // `<phase> min <n>ms median <n>ms p95 <n>ms`, in milliseconds.
+        let stat = |phase: &str, stat: &str| -> f64 {
+            let line = report
+                .content
+                .lines()
+                .find(|l| l.starts_with(phase))
+                .unwrap();
+            let words: Vec<&str> = line.split_whitespace().collect();
+            let at = words.iter().position(|w| *w == stat).unwrap();
+            words[at + 1].trim_end_matches("ms").parse().unwrap()
+        };
+        // Delays only ever add time, so they bound each phase from below;
+        // upper bounds would depend on how busy the machine is.
+        assert!(report.content.starts_with("3 runs of \"Which port?\":"));
+        for phase in ["embedding", "retrieval", "generation", "total"] {
+            assert!(stat(phase, "min") <= stat(phase, "median"), "{}", phase);
+            assert!(stat(phase, "median") <= stat(phase, "p95"), "{}", phase);
+        }
+        assert!(stat("embedding", "min") >= 20.0);
+        assert!(stat("generation", "min") >= 40.0);
+        assert!(stat("total", "median") >= 60.0);
     }
 }
@@ -0,0 +1,106 @@
+use super::priority::{ActiveChat, ChatActivity};
+use crate::config::ServerConfig;
+use std::sync::Arc;
+use tokio::sync::{Semaphore, SemaphorePermit};
+
+/// Limits how many chat requests run at once.
+///
+/// A single local model serves every client, so unbounded concurrency only
+/// makes every response slower. Requests beyond the limit either wait for a
+/// slot or are rejected, depending on `server.reject_when_busy`.
+///
+/// Every held slot counts as a chat in progress in [`activity`](Self::activity).
+pub struct ChatLimiter {
+    semaphore: Option<Semaphore>,
+    max_concurrent: usize,
+    reject_when_busy: bool,
+    activity: Arc<ChatActivity>,
+}
+
+/// A held chat slot. The slot is released when this is dropped.
+pub struct ChatPermit<'a> {
+    _permit: Option<SemaphorePermit<'a>>,
+    _active: ActiveChat,
+}
+
+impl ChatLimiter {
+    pub fn new(config: &ServerConfig) -> Self {
+        let semaphore = match config.max_concurrent_chats {
+            0 => None,
+            n => Some(Semaphore::new(n)),
+        };
+
+        Self {
+            semaphore,
+            max_concurrent: config.max_concurrent_chats,
+            reject_when_busy: config.reject_when_busy,
+            activity: Arc::default(),
+        }
+    }
+
+    /// Waits for a chat slot, or returns `None` if the server is full and
+    /// configured to reject.
+    pub async fn acquire(&self) -> Option<ChatPermit<'_>> {
+        let Some(semaphore) = &self.semaphore else {
+            return Some(ChatPermit {
+                _permit: None,
+                _active: self.activity.begin(),
+            });
+        };
+
+        let permit = if self.reject_when_busy {
+            semaphore.try_acquire().ok()?
+        } else {
+            // The semaphore is never closed, so acquiring cannot fail.
+            semaphore.acquire().await.ok()?
+        };
+
+        Some(ChatPermit {
+            _permit: Some(permit),
+            _active: self.activity.begin(),
+        })
+    }
+
+    pub fn max_concurrent(&self) -> usize {
+        self.max_concurrent
+    }
+
+    /// The chats holding a slot, for a
+    /// [`PriorityProvider`](super::priority::PriorityProvider) to give way to.
+    pub fn activity(&self) -> Arc<ChatActivity> {
+        self.activity.clone()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn limiter(max_concurrent_chats: usize, reject_when_busy: bool) -> ChatLimiter {
+        ChatLimiter::new(&ServerConfig {
+            max_concurrent_chats,
+            reject_when_busy,
+            ..ServerConfig::default()
+        })
+    }
+
+    #[tokio::test]
+    async fn test_rejects_beyond_limit() {
+        let limiter = limiter(2, true);
+
+        let first = limiter.acquire().await;
+        let second = limiter.acquire().await;
+        assert!(first.is_some() && second.is_some());
+        assert!(limiter.acquire().await.is_none());
+
+        drop(first);
+        assert!(limiter.acquire().await.is_some());
+    }
+
+    #[tokio::test]
+    async fn test_zero_is_unlimited() {
+        let limiter = limiter(0, true);
+        let permits: Vec<_> = futures::future::join_all((0..16).map(|_| limiter.acquire())).await;
+        assert!(permits.iter().all(Option::is_some));
+    }
+}
@@ -3,9 +3,17 @@
 //! The server is organized into separate concerns:
 //! - `types`: Protocol types for requests and responses
 //! - `handler`: Business logic for processing requests
+//! - `limiter`: Concurrency limit for chat requests
+//! - `priority`: Concurrency limit for embedding, and chats ahead of it
+//! - `bench`: Latency statistics for the `bench` request
+//! - `cancel`: Ctrl-C cancels running requests, and shuts down when idle
 //! - `transport`: IPC communication layer (Unix sockets on Unix, Named Pipes on Windows)
 
+mod bench;
+mod cancel;
 mod handler;
+mod limiter;
+mod priority;
 mod transport;
 mod types;
 
@@ -20,7 +28,6 @@ use crate::{
 };
 use nucleus_plugin::PluginRegistry;
 use std::sync::Arc;
-use tokio::signal;
 use tokio::sync::mpsc;
 
 #[cfg(unix)]
@@ -33,6 +40,7 @@ const SOCKET_PATH: &str = r"\\.\pipe\llm-workspace";
 pub struct Server {
     handler: Arc<handler::RequestHandler>,
     transport: transport::IpcTransport,
+    in_flight: Arc<cancel::InFlight>,
 }
 
 impl Server {
@@ -50,28 +58,37 @@ impl Server {
         }
 
         let registry = Arc::new(registry);
-        let provider = create_provider(&config, registry).await?;
-        let handler = Arc::new(handler::RequestHandler::new(config, provider).await?);
+        let provider = create_provider(&config, Arc::clone(&registry)).await?;
+        let handler = Arc::new(handler::RequestHandler::new(config, provider, registry).await?);
         let transport = transport::IpcTransport::new(SOCKET_PATH);
 
-        Ok(Self { handler, transport })
+        Ok(Self {
+            handler,
+            transport,
+            in_flight: Arc::new(cancel::InFlight::new()),
+        })
     }
 
     /// Starts the server and listens for connections.
+    ///
+    /// Ctrl-C cancels the requests being handled; a Ctrl-C while no request
+    /// is running shuts the server down.
     pub async fn start(&self) -> Result<(), Box<dyn std::error::Error>> {
         let listener = self.transport.bind().await?;
 
         println!("AI Server listening on {}", SOCKET_PATH);
 
-        let shutdown = signal::ctrl_c();
+        let shutdown =
+            cancel::wait_for_shutdown(cancel::ctrl_c_interrupts(), Arc::clone(&self.in_flight));
         tokio::pin!(shutdown);
 
         loop {
             tokio::select! {
                 Ok((stream, _)) = listener.accept() => {
                     let handler = Arc::clone(&self.handler);
+                    let in_flight = Arc::clone(&self.in_flight);
                     tokio::spawn(async move {
-                        if let Err(e) = handle_connection(stream, handler).await {
+                        if let Err(e) = handle_connection(stream, handler, in_flight).await {
                             eprintln!("Connection error: {}", e);
                         }
                     });
@@ -92,19 +109,30 @@ impl Server {
 async fn handle_connection(
     mut stream: transport::IpcStream,
     handler: Arc<handler::RequestHandler>,
+    in_flight: Arc<cancel::InFlight>,
 ) -> Result<(), Box<dyn std::error::Error>> {
     let request = transport::read_request(&mut stream).await?;
 
     let (sender, receiver) = mpsc::unbounded_channel();
+    let notify = sender.clone();
+    let tracked = in_flight.track();
+    let token = tracked.token();
 
-    let handle_task = tokio::spawn(async move {
-        handler.handle(request, sender).await;
-    });
+    let handle_task =
+        tokio::spawn(
+            async move { cancel::cancellable(token, handler.handle(request, sender)).await },
+        );
 
     let write_task =
         tokio::spawn(async move { transport::write_chunks(&mut stream, receiver).await });
 
-    let _ = tokio::try_join!(handle_task, write_task)?;
+    if handle_task.await?.is_none() {
+        let _ = notify.send(StreamChunk::error("Request cancelled".to_string()));
+    }
+    drop(tracked);
+    drop(notify);
+
+    let _ = write_task.await?;
 
     Ok(())
 }
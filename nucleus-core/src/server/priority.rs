@@ -0,0 +1,288 @@
+use crate::config::ServerConfig;
+use crate::models::EmbeddingModel;
+use crate::provider::{ChatRequest, ChatResponse, Provider, Result};
+use async_trait::async_trait;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use tokio::sync::{Notify, Semaphore};
+
+/// Shares one model server between chats and embedding.
+///
+/// Indexing a large tree sends embedding calls back to back, and a local
+/// model server works through them in turn, so a chat arriving mid-index
+/// waits behind all of them. Embedding calls are limited to
+/// `server.max_concurrent_embeddings` at once, which bounds how many a chat
+/// can find ahead of it. With `server.prioritize_chats`, new embedding calls
+/// also wait while any chat is in progress; calls already sent finish first.
+///
+/// Query embeddings, which a chat waits on while it retrieves context, skip
+/// both: they go straight to the model server. A chat counts as in progress
+/// while it generates or embeds its query, and, once the provider is given
+/// the [`ChatActivity`] of the [`ChatLimiter`](super::limiter::ChatLimiter)
+/// that admits chats, for as long as it holds its slot, retrieval included.
+pub struct PriorityProvider {
+    inner: Arc<dyn Provider>,
+    embeddings: Option<Semaphore>,
+    prioritize_chats: bool,
+    activity: Arc<ChatActivity>,
+}
+
+/// Counts the chats in progress.
+#[derive(Default)]
+pub struct ChatActivity {
+    active: AtomicUsize,
+    done: Notify,
+}
+
+/// Counts a chat as in progress until dropped.
+pub struct ActiveChat(Arc<ChatActivity>);
+
+impl Drop for ActiveChat {
+    fn drop(&mut self) {
+        if self.0.active.fetch_sub(1, Ordering::SeqCst) == 1 {
+            self.0.done.notify_waiters();
+        }
+    }
+}
+
+impl ChatActivity {
+    /// Counts a chat as in progress until the returned guard is dropped.
+    pub fn begin(self: &Arc<Self>) -> ActiveChat {
+        self.active.fetch_add(1, Ordering::SeqCst);
+        ActiveChat(self.clone())
+    }
+
+    /// Waits until no chat is in progress.
+    async fn idle(&self) {
+        loop {
+            let done = self.done.notified();
+            if self.active.load(Ordering::SeqCst) == 0 {
+                return;
+            }
+            done.await;
+        }
+    }
+}
+
+impl PriorityProvider {
+    pub fn new(inner: Arc<dyn Provider>, config: &ServerConfig) -> Self {
+        let embeddings = match config.max_concurrent_embeddings {
+            0 => None,
+            n => Some(Semaphore::new(n)),
+        };
+
+        Self {
+            inner,
+            embeddings,
+            prioritize_chats: config.prioritize_chats,
+            activity: Arc::default(),
+        }
+    }
+
+    /// Counts chats through `activity`, which is shared with whatever admits
+    /// them, so a chat holds embedding back from start to finish.
+    pub fn with_activity(mut self, activity: Arc<ChatActivity>) -> Self {
+        self.activity = activity;
+        self
+    }
+
+    /// Runs `embed` once an embedding slot is free and, when chats take
+    /// priority, no chat is in progress.
+    async fn embedding<T>(&self, embed: impl std::future::Future<Output = T>) -> T {
+        // The semaphore is never closed, so acquiring cannot fail.
+        let _permit = match &self.embeddings {
+            Some(semaphore) => semaphore.acquire().await.ok(),
+            None => None,
+        };
+
+        if self.prioritize_chats {
+            self.activity.idle().await;
+        }
+
+        embed.await
+    }
+}
+
+#[async_trait]
+impl Provider for PriorityProvider {
+    async fn chat<'a>(
+        &'a self,
+        request: ChatRequest,
+        callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+    ) -> Result<()> {
+        let _active = self.activity.begin();
+        self.inner.chat(request, callback).await
+    }
+
+    async fn embed(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        self.embedding(self.inner.embed(text, model)).await
+    }
+
+    async fn embed_query(&self, text: &str, model: &EmbeddingModel) -> Result<Vec<f32>> {
+        let _active = self.activity.begin();
+        self.inner.embed_query(text, model).await
+    }
+
+    async fn embed_batch(&self, texts: &[&str], model: &EmbeddingModel) -> Result<Vec<Vec<f32>>> {
+        self.embedding(self.inner.embed_batch(texts, model)).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::provider::Message;
+    use std::time::{Duration, Instant};
+    use tokio::sync::Mutex;
+
+    const CALL: Duration = Duration::from_millis(40);
+
+    /// Serves one call at a time, in arrival order, like a model server with
+    /// a single worker.
+    #[derive(Default)]
+    struct SingleWorkerProvider {
+        worker: Mutex<()>,
+    }
+
+    #[async_trait]
+    impl Provider for SingleWorkerProvider {
+        async fn chat<'a>(
+            &'a self,
+            request: ChatRequest,
+            mut callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> Result<()> {
+            let _worker = self.worker.lock().await;
+            tokio::time::sleep(CALL).await;
+            callback(ChatResponse {
+                model: request.model,
+                content: "hi".to_string(),
+                done: true,
+                message: Message::assistant(None, "hi"),
+            });
+            Ok(())
+        }
+
+        async fn embed(&self, _text: &str, _model: &EmbeddingModel) -> Result<Vec<f32>> {
+            let _worker = self.worker.lock().await;
+            tokio::time::sleep(CALL).await;
+            Ok(vec![1.0])
+        }
+    }
+
+    /// Queues `count` embedding calls, then times a chat sent behind them.
+    async fn chat_latency_behind_embeddings(config: ServerConfig, count: usize) -> Duration {
+        let provider = Arc::new(PriorityProvider::new(
+            Arc::new(SingleWorkerProvider::default()),
+            &config,
+        ));
+        let embeddings: Vec<_> = (0..count)
+            .map(|_| {
+                let provider = provider.clone();
+                tokio::spawn(async move {
+                    provider
+                        .embed("chunk", &EmbeddingModel::default())
+                        .await
+                        .unwrap()
+                })
+            })
+            .collect();
+        tokio::time::sleep(CALL / 4).await;
+
+        let started = Instant::now();
+        provider
+            .chat(
+                ChatRequest::new("model", vec![Message::user(None, "hi")]),
+                Box::new(|_| {}),
+            )
+            .await
+            .unwrap();
+        let latency = started.elapsed();
+
+        for embedding in embeddings {
+            embedding.await.unwrap();
+        }
+        latency
+    }
+
+    #[tokio::test]
+    async fn test_chat_is_not_queued_behind_saturated_embeddings() {
+        let config = ServerConfig {
+            max_concurrent_embeddings: 1,
+            prioritize_chats: true,
+            ..ServerConfig::default()
+        };
+
+        // Twenty embeddings take 800ms; the chat waits for at most the one
+        // already running.
+        let latency = chat_latency_behind_embeddings(config, 20).await;
+        assert!(latency < CALL * 4, "chat took {:?}", latency);
+    }
+
+    #[tokio::test]
+    async fn test_rag_chat_is_not_queued_behind_saturated_embeddings() {
+        use crate::rag::testing::{test_engine, MemoryStore};
+        use crate::server::limiter::ChatLimiter;
+
+        let config = ServerConfig {
+            max_concurrent_embeddings: 1,
+            prioritize_chats: true,
+            ..ServerConfig::default()
+        };
+        let limiter = ChatLimiter::new(&config);
+        let provider = Arc::new(
+            PriorityProvider::new(Arc::new(SingleWorkerProvider::default()), &config)
+                .with_activity(limiter.activity()),
+        );
+        let engine = test_engine(provider.clone(), Arc::new(MemoryStore::new()));
+        engine
+            .add_knowledge("The server listens on port 8080", "server.md")
+            .await
+            .unwrap();
+
+        let embeddings: Vec<_> = (0..20)
+            .map(|_| {
+                let provider = provider.clone();
+                tokio::spawn(async move {
+                    provider
+                        .embed("chunk", &EmbeddingModel::default())
+                        .await
+                        .unwrap()
+                })
+            })
+            .collect();
+        tokio::time::sleep(CALL / 4).await;
+
+        // Retrieval and generation, as the handler runs a RAG chat.
+        let started = Instant::now();
+        let permit = limiter.acquire().await.unwrap();
+        let context = engine.search("Which port does it use?").await.unwrap();
+        provider
+            .chat(
+                ChatRequest::new("model", vec![Message::user(None, "Which port?")]),
+                Box::new(|_| {}),
+            )
+            .await
+            .unwrap();
+        drop(permit);
+        let latency = started.elapsed();
+
+        assert_eq!(context.len(), 1);
+        // The embedding already running, the query embedding and the answer.
+        assert!(latency < CALL * 4, "chat took {:?}", latency);
+        for embedding in embeddings {
+            embedding.await.unwrap();
+        }
+    }
+
+    #[tokio::test]
+    async fn test_unlimited_embeddings_queue_ahead_of_chats() {
+        let config = ServerConfig {
+            max_concurrent_embeddings: 0,
+            prioritize_chats: false,
+            ..ServerConfig::default()
+        };
+
+        let latency = chat_latency_behind_embeddings(config, 20).await;
+        assert!(latency >= CALL * 20, "chat took {:?}", latency);
+    }
+}
@@ -6,14 +6,97 @@ use serde::{Deserialize, Serialize};
 pub enum RequestType {
     /// Chat with AI (streaming response)
     Chat,
+    /// Chat with context retrieved from the knowledge base (streaming response)
+    Ask,
     /// Edit mode with AI assistance (streaming response)
     Edit,
     /// Add content to knowledge base
     Add,
     /// Index a directory for RAG
     Index,
+    /// Start indexing a directory in the background and return right away
+    #[serde(rename = "index-bg")]
+    IndexBackground,
+    /// Index the text files inside a .zip, .tar, .tar.gz or .tgz archive
+    #[serde(rename = "index-archive")]
+    IndexArchive,
+    /// Report the progress of background index jobs
+    #[serde(rename = "index-status")]
+    IndexStatus,
     /// Get knowledge base statistics
     Stats,
+    /// Show the effective server config, or with `--explain` where each
+    /// retrieval setting came from
+    Config,
+    /// Show the assembled chat prompt without generating a response
+    Explain,
+    /// Compute and cache embeddings for a directory without indexing it
+    #[serde(rename = "embed-warm")]
+    EmbedWarm,
+    /// Show the metadata of an indexed document
+    Meta,
+    /// Set metadata keys on an indexed document
+    Retag,
+    /// Re-embed the stored chunks of one source from their stored content
+    #[serde(rename = "reembed-source")]
+    ReembedSource,
+    /// Diff the content indexed for one source against the file on disk
+    #[serde(rename = "diff-source")]
+    DiffSource,
+    /// Add content to the in-memory knowledge kept until the server exits
+    #[serde(rename = "temp-add")]
+    TempAdd,
+    /// Discard all temporary knowledge
+    #[serde(rename = "temp-clear")]
+    TempClear,
+    /// Measure retrieval recall@k and MRR against a labeled query set
+    Eval,
+    /// Report document count, estimated vector size and on-disk size
+    Usage,
+    /// Run a query with two sets of retrieval settings and diff the results
+    Compare,
+    /// List the prompt templates in the templates directory
+    Templates,
+    /// Fill a prompt template and send it as a chat message (streaming response)
+    #[serde(rename = "use-template")]
+    UseTemplate,
+    /// Show how a file would be chunked, without indexing it
+    #[serde(rename = "chunk-preview")]
+    ChunkPreview,
+    /// Answer every question in a file with retrieved context, as a JSON array
+    Batch,
+    /// List the tools the model can call, with their permissions and status
+    Tools,
+    /// Return the chunks retrieved for a query with their scores, as a JSON array
+    Retrieve,
+    /// List the sources retrieved for a query, optionally reranked
+    Sources,
+    /// Compare the index with the files on disk, optionally fixing the drift
+    Verify,
+    /// Write the conversation in `history` to a Markdown file
+    #[serde(rename = "export-chat")]
+    ExportChat,
+    /// Pin a file so it accompanies every query, unpin it, or list pinned files
+    Pin,
+    /// Ask two models the same question with the same retrieved context
+    #[serde(rename = "compare-models")]
+    CompareModels,
+    /// Show the embedding vector of a piece of text
+    Embed,
+    /// Copy one collection's documents into another
+    Merge,
+    /// Report the best score each collection gets for a query
+    Which,
+    /// Save a labelled copy of the knowledge base, or list the saved ones
+    Snapshot,
+    /// Replace the knowledge base with a snapshot
+    Rollback,
+    /// Check an exported knowledge file against the embedding model without
+    /// importing it
+    #[serde(rename = "validate-export")]
+    ValidateExport,
+    /// Time a query's embedding, retrieval and generation over several runs
+    Bench,
 }
 
 /// Type of streaming response chunk.
@@ -56,10 +139,56 @@ pub struct Request {
 
     /// The main content/query for the request.
     ///
-    /// For chat/edit: the user's message
+    /// For chat/ask/edit: the user's message
     /// For add: the text to add to knowledge base
-    /// For index: the directory path to index
-    /// For stats: ignored
+    /// For temp-add: the text to add to temporary knowledge
+    /// For index: the directory path to index, optionally followed by
+    /// `--since <cutoff>` to skip files modified before the cutoff,
+    /// `--force` to index more than `rag.indexer.max_files` files or a
+    /// directory already indexed this session, and `--progress` to stream a
+    /// chunk as each file starts before the final summary
+    /// For index-bg: ignored; the directory is `pwd`. Chats and other
+    /// requests are served while it runs, and indexed files become
+    /// searchable as they are stored
+    /// For embed-warm: the directory whose chunks should be embedded
+    /// For explain: the message whose prompt should be shown
+    /// For meta: the document ID
+    /// For retag: the document ID followed by `key=value` pairs
+    /// For reembed-source: the source whose chunks should be re-embedded, as
+    /// it is stored
+    /// For diff-source: the source to compare with the file on disk, as it
+    /// is stored
+    /// For eval: path to a JSON file mapping queries to expected sources
+    /// For retrieve: the query to find chunks for
+    /// For sources: the query, optionally with `--rerank` to compare the order
+    /// with and without reranking; empty uses the last user message in `history`
+    /// For chunk-preview: path of the file to chunk
+    /// For batch: path of a file with one question per line
+    /// For use-template: the template name followed by its arguments
+    /// For compare: the query, optionally preceded by `a.<setting>=<value>`
+    /// and `b.<setting>=<value>` overrides of `top_k`, `min_score` or
+    /// `candidate_multiplier` for each side
+    /// For verify: optionally `--fix` to remove missing files and re-index
+    /// changed ones; the directory is `pwd`
+    /// For export-chat: path of the Markdown file to write `history` to
+    /// For pin: path of the file to pin, or `--remove <path>` to unpin it;
+    /// empty lists the pinned files
+    /// For compare-models: the two model names followed by the question
+    /// For embed: the text to embed as a query
+    /// For merge: the source and destination collections, optionally with
+    /// `--prefix` to copy documents whose ID is taken under a prefixed ID
+    /// instead of skipping them
+    /// For which: the query to score every collection of `rag.collections` on
+    /// For snapshot: the label to save the snapshot under; empty lists the
+    /// saved snapshots
+    /// For rollback: the label of the snapshot to restore
+    /// For validate-export: the path of the export file, relative to `pwd`
+    /// For bench: the query, optionally with `--runs <n>` for the number of
+    /// runs (5 by default)
+    /// For config: optionally `--explain` to list the retrieval settings with
+    /// their origin instead of printing the whole config
+    /// For index-archive: the path of the archive, relative to `pwd`
+    /// For stats, usage, templates, tools, index-status and temp-clear: ignored
     pub content: String,
 
     /// Optional working directory context.
@@ -68,11 +197,31 @@ pub struct Request {
     #[serde(skip_serializing_if = "Option::is_none")]
     pub pwd: Option<String>,
 
-    /// Optional conversation history for chat/edit requests.
+    /// Optional conversation history for chat/ask/edit requests.
     ///
     /// Allows maintaining context across multiple interactions.
     #[serde(skip_serializing_if = "Option::is_none")]
     pub history: Option<Vec<Message>>,
+
+    /// Optional cap on generated tokens for chat/ask/edit requests.
+    ///
+    /// Overrides `llm.max_tokens` from the server configuration.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_tokens: Option<usize>,
+
+    /// Whether to add retrieved knowledge-base context to chat/ask/edit and
+    /// explain requests.
+    ///
+    /// Defaults to on for ask and off for the others.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub rag: Option<bool>,
+
+    /// Optional ID of the conversation a chat request belongs to.
+    ///
+    /// With `rag.conversation_recall`, turns are remembered and recalled only
+    /// within the same session; chats without one are neither.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub session: Option<String>,
 }
 
 /// Streaming response chunk sent to client.
@@ -88,7 +237,8 @@ pub struct StreamChunk {
     ///
     /// For "chunk" type: partial response text
     /// For "done" type: complete response text
-    /// For "error" type: empty (error details in `error` field)
+    /// For "error" type: empty (error details in `error` field), or with
+    /// `server.partial_on_error` the text streamed before a chat failed
     pub content: String,
 
     /// Error message if chunk_type is "error".
@@ -120,4 +270,13 @@ impl StreamChunk {
             error: Some(error.into()),
         }
     }
+
+    /// An error that still carries the response text produced before it.
+    pub fn partial_error(content: impl Into<String>, error: impl Into<String>) -> Self {
+        Self {
+            chunk_type: ChunkType::Error,
+            content: content.into(),
+            error: Some(error.into()),
+        }
+    }
 }
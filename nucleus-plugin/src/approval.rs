@@ -0,0 +1,287 @@
+use crate::Permission;
+use serde_json::Value;
+use std::collections::HashSet;
+use std::io::{self, Write};
+use std::sync::{Arc, Mutex};
+
+/// Answer given when asked whether a tool call may run.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ApprovalResponse {
+    /// Run this call only.
+    Yes,
+    /// Skip this call.
+    No,
+    /// Run this call and every later call to the same tool.
+    AlwaysForTool,
+    /// Run this call and every later tool call for the rest of the session.
+    AlwaysForSession,
+}
+
+impl ApprovalResponse {
+    /// Parse a typed answer. Anything unrecognized is treated as [`ApprovalResponse::No`].
+    pub fn parse(answer: &str) -> Self {
+        match answer.trim().to_lowercase().as_str() {
+            "y" | "yes" => Self::Yes,
+            "t" | "tool" | "always" => Self::AlwaysForTool,
+            "s" | "session" => Self::AlwaysForSession,
+            _ => Self::No,
+        }
+    }
+}
+
+/// Asks the user whether a tool call may run.
+///
+/// [`ApprovalPolicy`] calls the prompter on a blocking thread, so it may wait
+/// on the user without stalling the async runtime.
+pub trait ApprovalPrompter: Send + Sync {
+    fn prompt(&self, tool_name: &str, input: &Value) -> ApprovalResponse;
+}
+
+/// Prompts on stdin/stdout. Intended for terminal front-ends.
+pub struct StdinPrompter;
+
+impl ApprovalPrompter for StdinPrompter {
+    fn prompt(&self, tool_name: &str, input: &Value) -> ApprovalResponse {
+        print!(
+            "Allow tool '{}' with {}? [y]es / [n]o / always for this [t]ool / always for this [s]ession: ",
+            tool_name, input
+        );
+        let _ = io::stdout().flush();
+
+        let mut answer = String::new();
+        if io::stdin().read_line(&mut answer).is_err() {
+            return ApprovalResponse::No;
+        }
+        ApprovalResponse::parse(&answer)
+    }
+}
+
+#[derive(Debug, Default)]
+struct RememberedDecisions {
+    tools: HashSet<String>,
+    session: bool,
+}
+
+/// Decides whether a tool call requested by the LLM may run.
+///
+/// The granted [`Permission`] is always the upper bound. In interactive mode the
+/// prompter is asked for every call that isn't already covered by an "always"
+/// answer; in non-interactive mode the permission flags alone decide.
+pub struct ApprovalPolicy {
+    granted: Permission,
+    prompter: Option<Arc<dyn ApprovalPrompter>>,
+    remembered: Mutex<RememberedDecisions>,
+}
+
+impl ApprovalPolicy {
+    /// Create a policy that asks `prompter` before running tools.
+    pub fn interactive(granted: Permission, prompter: impl ApprovalPrompter + 'static) -> Self {
+        Self {
+            granted,
+            prompter: Some(Arc::new(prompter)),
+            remembered: Mutex::new(RememberedDecisions::default()),
+        }
+    }
+
+    /// Create a policy that only consults the static permission flags.
+    pub fn non_interactive(granted: Permission) -> Self {
+        Self {
+            granted,
+            prompter: None,
+            remembered: Mutex::new(RememberedDecisions::default()),
+        }
+    }
+
+    /// Whether this policy prompts the user.
+    pub fn is_interactive(&self) -> bool {
+        self.prompter.is_some()
+    }
+
+    /// Check whether a call to `tool_name` may run, prompting if needed.
+    ///
+    /// A prompt that can't be completed counts as [`ApprovalResponse::No`].
+    pub async fn approve(&self, tool_name: &str, required: &Permission, input: &Value) -> bool {
+        if !self.granted.allows(required) {
+            return false;
+        }
+
+        let Some(prompter) = &self.prompter else {
+            return true;
+        };
+
+        {
+            let remembered = self.remembered.lock().unwrap();
+            if remembered.session || remembered.tools.contains(tool_name) {
+                return true;
+            }
+        }
+
+        let prompter = Arc::clone(prompter);
+        let (tool, input) = (tool_name.to_string(), input.clone());
+        let response = tokio::task::spawn_blocking(move || prompter.prompt(&tool, &input))
+            .await
+            .unwrap_or(ApprovalResponse::No);
+
+        match response {
+            ApprovalResponse::Yes => true,
+            ApprovalResponse::No => false,
+            ApprovalResponse::AlwaysForTool => {
+                self.remembered
+                    .lock()
+                    .unwrap()
+                    .tools
+                    .insert(tool_name.to_string());
+                true
+            }
+            ApprovalResponse::AlwaysForSession => {
+                self.remembered.lock().unwrap().session = true;
+                true
+            }
+        }
+    }
+
+    /// Forget all remembered "always" decisions.
+    pub fn reset(&self) {
+        *self.remembered.lock().unwrap() = RememberedDecisions::default();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    struct FixedPrompter {
+        response: ApprovalResponse,
+        calls: Arc<AtomicUsize>,
+    }
+
+    impl ApprovalPrompter for FixedPrompter {
+        fn prompt(&self, _tool_name: &str, _input: &Value) -> ApprovalResponse {
+            self.calls.fetch_add(1, Ordering::SeqCst);
+            self.response
+        }
+    }
+
+    fn policy(response: ApprovalResponse) -> (ApprovalPolicy, Arc<AtomicUsize>) {
+        let calls = Arc::new(AtomicUsize::new(0));
+        let prompter = FixedPrompter {
+            response,
+            calls: Arc::clone(&calls),
+        };
+        (
+            ApprovalPolicy::interactive(Permission::ALL, prompter),
+            calls,
+        )
+    }
+
+    #[tokio::test]
+    async fn test_yes_prompts_every_time() {
+        let (policy, calls) = policy(ApprovalResponse::Yes);
+        let input = serde_json::json!({});
+
+        assert!(
+            policy
+                .approve("read_file", &Permission::READ_ONLY, &input)
+                .await
+        );
+        assert!(
+            policy
+                .approve("read_file", &Permission::READ_ONLY, &input)
+                .await
+        );
+        assert_eq!(calls.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_no_denies() {
+        let (policy, calls) = policy(ApprovalResponse::No);
+
+        assert!(
+            !policy
+                .approve("exec", &Permission::ALL, &serde_json::json!({}))
+                .await
+        );
+        assert_eq!(calls.load(Ordering::SeqCst), 1);
+    }
+
+    #[tokio::test]
+    async fn test_always_for_tool_suppresses_prompts_for_that_tool() {
+        let (policy, calls) = policy(ApprovalResponse::AlwaysForTool);
+        let input = serde_json::json!({});
+
+        assert!(
+            policy
+                .approve("read_file", &Permission::READ_ONLY, &input)
+                .await
+        );
+        assert!(
+            policy
+                .approve("read_file", &Permission::READ_ONLY, &input)
+                .await
+        );
+        assert_eq!(calls.load(Ordering::SeqCst), 1);
+
+        assert!(
+            policy
+                .approve("write_file", &Permission::READ_WRITE, &input)
+                .await
+        );
+        assert_eq!(calls.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_always_for_session_suppresses_all_prompts() {
+        let (policy, calls) = policy(ApprovalResponse::AlwaysForSession);
+        let input = serde_json::json!({});
+
+        assert!(
+            policy
+                .approve("read_file", &Permission::READ_ONLY, &input)
+                .await
+        );
+        assert!(
+            policy
+                .approve("write_file", &Permission::READ_WRITE, &input)
+                .await
+        );
+        assert!(policy.approve("exec", &Permission::ALL, &input).await);
+        assert_eq!(calls.load(Ordering::SeqCst), 1);
+
+        policy.reset();
+        assert!(policy.approve("exec", &Permission::ALL, &input).await);
+        assert_eq!(calls.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_non_interactive_uses_permission_flags() {
+        let policy = ApprovalPolicy::non_interactive(Permission::READ_ONLY);
+        let input = serde_json::json!({});
+
+        assert!(!policy.is_interactive());
+        assert!(
+            policy
+                .approve("read_file", &Permission::READ_ONLY, &input)
+                .await
+        );
+        assert!(
+            !policy
+                .approve("write_file", &Permission::READ_WRITE, &input)
+                .await
+        );
+    }
+
+    #[test]
+    fn test_parse_response() {
+        assert_eq!(ApprovalResponse::parse("y\n"), ApprovalResponse::Yes);
+        assert_eq!(
+            ApprovalResponse::parse("Tool"),
+            ApprovalResponse::AlwaysForTool
+        );
+        assert_eq!(
+            ApprovalResponse::parse("s"),
+            ApprovalResponse::AlwaysForSession
+        );
+        assert_eq!(ApprovalResponse::parse("maybe"), ApprovalResponse::No);
+    }
+}
@@ -0,0 +1,217 @@
+//! Reuse of tool results within a single turn.
+
+use crate::PluginOutput;
+use serde_json::Value;
+use std::collections::HashMap;
+
+/// Results of cacheable tool calls, keyed by tool name and arguments.
+///
+/// Meant to live for one turn of the agent loop and be filled through
+/// [`PluginRegistry::execute_cached`](crate::PluginRegistry::execute_cached),
+/// which clears it whenever a mutating tool runs.
+#[derive(Debug, Default)]
+pub struct ToolCache {
+    entries: HashMap<(String, String), PluginOutput>,
+    hits: usize,
+}
+
+impl ToolCache {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// The cached output for this call, if any.
+    pub fn get(&mut self, name: &str, input: &Value) -> Option<PluginOutput> {
+        let output = self.entries.get(&key(name, input)).cloned();
+        if output.is_some() {
+            self.hits += 1;
+        }
+        output
+    }
+
+    pub fn insert(&mut self, name: &str, input: &Value, output: PluginOutput) {
+        self.entries.insert(key(name, input), output);
+    }
+
+    pub fn clear(&mut self) {
+        self.entries.clear();
+    }
+
+    pub fn len(&self) -> usize {
+        self.entries.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.entries.is_empty()
+    }
+
+    /// How many calls were served from the cache.
+    pub fn hits(&self) -> usize {
+        self.hits
+    }
+}
+
+fn key(name: &str, input: &Value) -> (String, String) {
+    (name.to_string(), canonical(input))
+}
+
+/// Serializes `value` with object keys sorted, so argument order doesn't
+/// change the key even when `serde_json` preserves insertion order.
+fn canonical(value: &Value) -> String {
+    match value {
+        Value::Object(map) => {
+            let mut fields: Vec<_> = map.iter().collect();
+            fields.sort_by(|a, b| a.0.cmp(b.0));
+            let fields: Vec<String> = fields
+                .into_iter()
+                .map(|(k, v)| format!("{}:{}", Value::from(k.as_str()), canonical(v)))
+                .collect();
+            format!("{{{}}}", fields.join(","))
+        }
+        Value::Array(items) => {
+            let items: Vec<String> = items.iter().map(canonical).collect();
+            format!("[{}]", items.join(","))
+        }
+        other => other.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{Permission, Plugin, PluginRegistry, Result};
+    use async_trait::async_trait;
+    use serde_json::json;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::{Arc, Mutex};
+
+    /// A file system with one file that counts reads.
+    #[derive(Default)]
+    struct Disk {
+        content: Mutex<String>,
+        reads: AtomicUsize,
+    }
+
+    struct Read(Arc<Disk>);
+    struct Write(Arc<Disk>);
+
+    #[async_trait]
+    impl Plugin for Read {
+        fn name(&self) -> &str {
+            "read_file"
+        }
+
+        fn description(&self) -> &str {
+            "Read the file"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        fn is_cacheable(&self) -> bool {
+            true
+        }
+
+        async fn execute(&self, _input: Value) -> Result<PluginOutput> {
+            self.0.reads.fetch_add(1, Ordering::SeqCst);
+            Ok(PluginOutput::new(self.0.content.lock().unwrap().clone()))
+        }
+    }
+
+    #[async_trait]
+    impl Plugin for Write {
+        fn name(&self) -> &str {
+            "write_file"
+        }
+
+        fn description(&self) -> &str {
+            "Write the file"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_WRITE
+        }
+
+        async fn execute(&self, input: Value) -> Result<PluginOutput> {
+            *self.0.content.lock().unwrap() = input["content"].as_str().unwrap().to_string();
+            Ok(PluginOutput::new("written"))
+        }
+    }
+
+    async fn registry(disk: &Arc<Disk>) -> PluginRegistry {
+        let registry = PluginRegistry::new(Permission::READ_WRITE);
+        registry.register(Read(disk.clone())).await;
+        registry.register(Write(disk.clone())).await;
+        registry
+    }
+
+    #[tokio::test]
+    async fn test_repeated_read_is_served_from_cache() {
+        let disk = Arc::new(Disk::default());
+        *disk.content.lock().unwrap() = "v1".to_string();
+        let registry = registry(&disk).await;
+        let mut cache = ToolCache::new();
+
+        let args = json!({ "path": "a.txt", "max_lines": 10 });
+        let reordered = json!({ "max_lines": 10, "path": "a.txt" });
+        let first = registry
+            .execute_cached(&mut cache, "read_file", args)
+            .await
+            .unwrap();
+        let second = registry
+            .execute_cached(&mut cache, "read_file", reordered)
+            .await
+            .unwrap();
+
+        assert_eq!(first.content, "v1");
+        assert_eq!(second.content, "v1");
+        assert_eq!(disk.reads.load(Ordering::SeqCst), 1);
+        assert_eq!(cache.hits(), 1);
+
+        registry
+            .execute_cached(&mut cache, "read_file", json!({ "path": "b.txt" }))
+            .await
+            .unwrap();
+        assert_eq!(disk.reads.load(Ordering::SeqCst), 2);
+    }
+
+    #[tokio::test]
+    async fn test_write_invalidates_cached_reads() {
+        let disk = Arc::new(Disk::default());
+        let registry = registry(&disk).await;
+        let mut cache = ToolCache::new();
+        let args = json!({ "path": "a.txt" });
+
+        registry
+            .execute_cached(&mut cache, "read_file", args.clone())
+            .await
+            .unwrap();
+        registry
+            .execute_cached(
+                &mut cache,
+                "write_file",
+                json!({ "path": "a.txt", "content": "v2" }),
+            )
+            .await
+            .unwrap();
+        assert!(cache.is_empty());
+
+        let reread = registry
+            .execute_cached(&mut cache, "read_file", args)
+            .await
+            .unwrap();
+
+        assert_eq!(reread.content, "v2");
+        assert_eq!(disk.reads.load(Ordering::SeqCst), 2);
+        assert_eq!(cache.hits(), 0);
+    }
+}
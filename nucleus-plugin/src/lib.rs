@@ -1,5 +1,11 @@
+mod approval;
+mod cache;
+mod loader;
 mod plugin;
 mod registry;
 
+pub use approval::{ApprovalPolicy, ApprovalPrompter, ApprovalResponse, StdinPrompter};
+pub use cache::ToolCache;
+pub use loader::PluginLoader;
 pub use plugin::{Permission, Plugin, PluginError, PluginOutput, Result};
-pub use registry::PluginRegistry;
+pub use registry::{PluginRegistry, ToolInfo, ToolStatus};
@@ -0,0 +1,144 @@
+use crate::{Plugin, PluginError, PluginRegistry, Result};
+use std::collections::HashMap;
+
+type PluginFactory = Box<dyn Fn() -> Box<dyn Plugin> + Send + Sync>;
+
+/// Named plugin factories that can be instantiated at startup.
+///
+/// External crates register a factory under a name, and the application loads
+/// whichever names are listed in its configuration. This lets users add their
+/// own tools without forking nucleus.
+///
+/// # Example
+///
+/// ```ignore
+/// let mut loader = PluginLoader::new();
+/// loader.register_factory("jira", || JiraPlugin::new());
+///
+/// let registry = PluginRegistry::new(Permission::READ_ONLY);
+/// loader.load(&config.plugins, &registry).await?;
+/// ```
+#[derive(Default)]
+pub struct PluginLoader {
+    factories: HashMap<String, PluginFactory>,
+}
+
+impl PluginLoader {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Register a factory under `name`, replacing any existing one.
+    pub fn register_factory<F, P>(&mut self, name: impl Into<String>, factory: F)
+    where
+        F: Fn() -> P + Send + Sync + 'static,
+        P: Plugin + 'static,
+    {
+        self.factories.insert(
+            name.into(),
+            Box::new(move || Box::new(factory()) as Box<dyn Plugin>),
+        );
+    }
+
+    /// Names of all registered factories.
+    pub fn names(&self) -> Vec<&str> {
+        self.factories.keys().map(|name| name.as_str()).collect()
+    }
+
+    /// Instantiate the named plugins and register them.
+    ///
+    /// Returns the names that were registered. Plugins denied by the registry's
+    /// permissions are skipped. An unknown name is an error.
+    pub async fn load(&self, names: &[String], registry: &PluginRegistry) -> Result<Vec<String>> {
+        let mut loaded = Vec::new();
+
+        for name in names {
+            let factory = self
+                .factories
+                .get(name)
+                .ok_or_else(|| PluginError::Other(format!("Unknown plugin: {}", name)))?;
+
+            if registry.register(factory()).await {
+                loaded.push(name.clone());
+            }
+        }
+
+        Ok(loaded)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{Permission, PluginOutput};
+    use async_trait::async_trait;
+    use serde_json::Value;
+
+    struct NamedPlugin {
+        name: &'static str,
+        permission: Permission,
+    }
+
+    #[async_trait]
+    impl Plugin for NamedPlugin {
+        fn name(&self) -> &str {
+            self.name
+        }
+
+        fn description(&self) -> &str {
+            "A loadable plugin"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            serde_json::json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            self.permission
+        }
+
+        async fn execute(&self, _input: Value) -> Result<PluginOutput> {
+            Ok(PluginOutput::new(self.name))
+        }
+    }
+
+    fn loader() -> PluginLoader {
+        let mut loader = PluginLoader::new();
+        loader.register_factory("reader", || NamedPlugin {
+            name: "reader",
+            permission: Permission::READ_ONLY,
+        });
+        loader.register_factory("runner", || NamedPlugin {
+            name: "runner",
+            permission: Permission::ALL,
+        });
+        loader
+    }
+
+    #[tokio::test]
+    async fn test_load_registers_named_plugins() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        let loaded = loader()
+            .load(&["reader".to_string(), "runner".to_string()], &registry)
+            .await
+            .unwrap();
+
+        assert_eq!(loaded, vec!["reader".to_string()]);
+        assert!(registry.get("reader").is_some());
+        assert!(registry.get("runner").is_none());
+
+        let output = registry
+            .execute("reader", serde_json::json!({}))
+            .await
+            .unwrap();
+        assert_eq!(output.content, "reader");
+    }
+
+    #[tokio::test]
+    async fn test_load_unknown_plugin_fails() {
+        let registry = PluginRegistry::new(Permission::ALL);
+        let result = loader().load(&["missing".to_string()], &registry).await;
+
+        assert!(result.is_err());
+    }
+}
@@ -14,6 +14,26 @@ pub enum PluginError {
     #[error("Permission denied: {0}")]
     PermissionDenied(String),
 
+    /// A file tool was asked to change a path outside the directories it may
+    /// write to.
+    #[error("{} is outside the write roots: {}", .path.display(), .roots.join(", "))]
+    OutsideWriteRoots {
+        path: std::path::PathBuf,
+        roots: Vec<String>,
+    },
+
+    /// A tool call argument was larger than the registry allows, so the tool
+    /// was not run.
+    #[error(
+        "Argument too large: '{argument}' of {tool} is {size} bytes, the limit is {limit} bytes"
+    )]
+    ArgumentTooLarge {
+        tool: String,
+        argument: String,
+        size: usize,
+        limit: usize,
+    },
+
     #[error("Plugin error: {0}")]
     Other(String),
 }
@@ -61,6 +81,26 @@ impl Permission {
     }
 }
 
+/// The granted flags joined with `+`, e.g. `read+write`, or `none`.
+impl fmt::Display for Permission {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let flags: Vec<&str> = [
+            (self.read, "read"),
+            (self.write, "write"),
+            (self.execute, "execute"),
+        ]
+        .into_iter()
+        .filter(|(granted, _)| *granted)
+        .map(|(_, name)| name)
+        .collect();
+        if flags.is_empty() {
+            write!(f, "none")
+        } else {
+            write!(f, "{}", flags.join("+"))
+        }
+    }
+}
+
 /// Output from plugin execution.
 #[derive(Debug, Clone)]
 pub struct PluginOutput {
@@ -110,9 +150,45 @@ pub trait Plugin: Send + Sync {
     /// Used to enforce security boundaries.
     fn required_permission(&self) -> Permission;
 
+    /// Whether repeating a call with the same input returns the same output
+    /// until something is written. Results of such plugins are reused within
+    /// a turn; see [`ToolCache`](crate::ToolCache).
+    fn is_cacheable(&self) -> bool {
+        false
+    }
+
     /// Execute the plugin with given input parameters.
     /// The input should match the parameter schema.
     ///
     /// **This is the actual function the LLM will use to call a tool**
     async fn execute(&self, input: Value) -> Result<PluginOutput>;
 }
+
+/// Lets boxed plugins, such as those built by a [`PluginLoader`](crate::PluginLoader)
+/// factory, be registered like any other plugin.
+#[async_trait]
+impl Plugin for Box<dyn Plugin> {
+    fn name(&self) -> &str {
+        (**self).name()
+    }
+
+    fn description(&self) -> &str {
+        (**self).description()
+    }
+
+    fn parameter_schema(&self) -> Value {
+        (**self).parameter_schema()
+    }
+
+    fn required_permission(&self) -> Permission {
+        (**self).required_permission()
+    }
+
+    fn is_cacheable(&self) -> bool {
+        (**self).is_cacheable()
+    }
+
+    async fn execute(&self, input: Value) -> Result<PluginOutput> {
+        (**self).execute(input).await
+    }
+}
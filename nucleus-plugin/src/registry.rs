@@ -1,9 +1,54 @@
-use crate::{Permission, Plugin, PluginError, PluginOutput};
+use crate::{Permission, Plugin, PluginError, PluginOutput, ToolCache};
 use serde_json::Value;
 use std::collections::HashMap;
-use std::sync::Arc;
+use std::fmt;
+use std::sync::{Arc, RwLock};
 use tokio::sync::Mutex;
 
+type SharedPlugin = Arc<Mutex<dyn Plugin + Send + Sync>>;
+
+/// Whether a listed tool can currently be called.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ToolStatus {
+    /// Registered and offered to the LLM.
+    Enabled,
+    /// Registered but switched off with [`PluginRegistry::disable`].
+    Disabled,
+    /// Rejected at registration because it needs permissions that weren't granted.
+    Denied,
+}
+
+impl fmt::Display for ToolStatus {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let status = match self {
+            Self::Enabled => "enabled",
+            Self::Disabled => "disabled",
+            Self::Denied => "denied",
+        };
+        write!(f, "{}", status)
+    }
+}
+
+/// A tool as listed by [`PluginRegistry::tools`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ToolInfo {
+    pub name: String,
+    pub description: String,
+    pub required_permission: Permission,
+    pub status: ToolStatus,
+}
+
+impl ToolInfo {
+    fn of(plugin: &dyn Plugin, status: ToolStatus) -> Self {
+        Self {
+            name: plugin.name().to_string(),
+            description: plugin.description().to_string(),
+            required_permission: plugin.required_permission(),
+            status,
+        }
+    }
+}
+
 /// Registry for managing plugins.
 ///
 /// The registry is responsible for:
@@ -11,67 +56,248 @@ use tokio::sync::Mutex;
 /// - Looking up plugins by name
 /// - Executing plugins
 /// - Providing plugin specifications to the LLM
+///
+/// All methods take `&self` and the registry is safe to share between tasks,
+/// so plugins can be registered or removed while it is in use.
 pub struct PluginRegistry {
-    plugins: HashMap<String, Arc<Mutex<dyn Plugin + Send + Sync>>>,
+    plugins: RwLock<HashMap<String, SharedPlugin>>,
+    /// Registered plugins that are switched off.
+    disabled: RwLock<HashMap<String, SharedPlugin>>,
+    /// Plugins refused by [`register`](Self::register), kept for listing.
+    denied: RwLock<HashMap<String, ToolInfo>>,
     granted_permissions: Permission,
+    /// Largest argument any tool accepts, in bytes.
+    max_argument_bytes: Option<usize>,
+    /// Per-tool limits that take precedence over `max_argument_bytes`.
+    tool_argument_limits: HashMap<String, usize>,
 }
 
 impl PluginRegistry {
     /// Create a new plugin registry with the given permissions.
     pub fn new(granted_permissions: Permission) -> Self {
         Self {
-            plugins: HashMap::new(),
+            plugins: RwLock::new(HashMap::new()),
+            disabled: RwLock::new(HashMap::new()),
+            denied: RwLock::new(HashMap::new()),
             granted_permissions,
+            max_argument_bytes: None,
+            tool_argument_limits: HashMap::new(),
         }
     }
 
+    /// Refuse to run a tool when any one of its arguments is larger than
+    /// `bytes`, such as a huge `content` for `write_file`. String arguments
+    /// are measured by their length, others by their JSON encoding.
+    pub fn with_max_argument_bytes(mut self, bytes: usize) -> Self {
+        self.max_argument_bytes = Some(bytes);
+        self
+    }
+
+    /// Limit the arguments of the tool called `name` to `bytes`, instead of
+    /// the limit set with [`with_max_argument_bytes`](Self::with_max_argument_bytes).
+    pub fn with_tool_argument_limit(mut self, name: impl Into<String>, bytes: usize) -> Self {
+        self.tool_argument_limits.insert(name.into(), bytes);
+        self
+    }
+
+    /// Checks the arguments of a call to `name` against the size limits.
+    ///
+    /// Returns [`PluginError::ArgumentTooLarge`] for the first argument over
+    /// the limit, which callers can hand back to the model as the result.
+    pub fn check_arguments(&self, name: &str, input: &Value) -> Result<(), PluginError> {
+        let Some(limit) = self
+            .tool_argument_limits
+            .get(name)
+            .copied()
+            .or(self.max_argument_bytes)
+        else {
+            return Ok(());
+        };
+
+        let arguments: Vec<(&str, &Value)> = match input {
+            Value::Object(map) => map
+                .iter()
+                .map(|(key, value)| (key.as_str(), value))
+                .collect(),
+            other => vec![("input", other)],
+        };
+        for (argument, value) in arguments {
+            let size = match value {
+                Value::String(text) => text.len(),
+                other => other.to_string().len(),
+            };
+            if size > limit {
+                return Err(PluginError::ArgumentTooLarge {
+                    tool: name.to_string(),
+                    argument: argument.to_string(),
+                    size,
+                    limit,
+                });
+            }
+        }
+        Ok(())
+    }
+
+    /// The permissions this registry was created with.
+    pub fn granted_permissions(&self) -> Permission {
+        self.granted_permissions
+    }
+
     /// Register a plugin if permissions allow.
     /// Returns true if the plugin was registered, false if denied by permissions.
-    pub async fn register<T: Plugin + 'static>(&mut self, plugin: T) -> bool {
-        let required = plugin.required_permission();
-        let plugin = Arc::new(Mutex::new(plugin));
-
-        if !self.granted_permissions.allows(&required) {
+    /// Denied plugins are remembered so [`tools`](Self::tools) can list them.
+    pub async fn register<T: Plugin + 'static>(&self, plugin: T) -> bool {
+        let plugin_name = plugin.name().to_string();
+        if !self
+            .granted_permissions
+            .allows(&plugin.required_permission())
+        {
+            let info = ToolInfo::of(&plugin, ToolStatus::Denied);
+            self.denied.write().unwrap().insert(plugin_name, info);
             return false;
         }
 
-        let plugin_name = {
-            let locked_plugin = plugin.lock().await;
-            locked_plugin.name().to_string()
+        self.denied.write().unwrap().remove(&plugin_name);
+        self.disabled.write().unwrap().remove(&plugin_name);
+        let plugin: SharedPlugin = Arc::new(Mutex::new(plugin));
+        self.plugins.write().unwrap().insert(plugin_name, plugin);
+        true
+    }
+
+    /// Remove a plugin by name, whether enabled or disabled.
+    /// Returns true if a plugin was removed.
+    pub fn unregister(&self, name: &str) -> bool {
+        let removed = self.plugins.write().unwrap().remove(name).is_some();
+        removed || self.disabled.write().unwrap().remove(name).is_some()
+    }
+
+    /// Switch a registered plugin off. It stays registered, but isn't offered
+    /// to the LLM or run until [`enable`](Self::enable)d again.
+    /// Returns true if an enabled plugin was disabled.
+    pub fn disable(&self, name: &str) -> bool {
+        let Some(plugin) = self.plugins.write().unwrap().remove(name) else {
+            return false;
         };
-        self.plugins.insert(plugin_name, plugin);
+        self.disabled
+            .write()
+            .unwrap()
+            .insert(name.to_string(), plugin);
+        true
+    }
+
+    /// Switch a disabled plugin back on.
+    /// Returns true if a disabled plugin was enabled.
+    pub fn enable(&self, name: &str) -> bool {
+        let Some(plugin) = self.disabled.write().unwrap().remove(name) else {
+            return false;
+        };
+        self.plugins
+            .write()
+            .unwrap()
+            .insert(name.to_string(), plugin);
         true
     }
 
     /// Get the number plugins that exist in the registry
     pub fn get_count(&self) -> usize {
-        self.plugins.iter().count()
+        self.plugins.read().unwrap().len()
     }
 
     /// Get a plugin by name.
-    pub fn get(&self, name: &str) -> Option<&Arc<Mutex<dyn Plugin + Send + Sync>>> {
-        self.plugins.get(name)
+    pub fn get(&self, name: &str) -> Option<SharedPlugin> {
+        self.plugins.read().unwrap().get(name).cloned()
     }
 
     /// Get all registered plugins.
-    pub fn all(&self) -> Vec<&Arc<Mutex<dyn Plugin + Send + Sync>>> {
-        self.plugins.values().collect()
+    pub fn all(&self) -> Vec<SharedPlugin> {
+        self.plugins.read().unwrap().values().cloned().collect()
+    }
+
+    /// Names of all registered plugins, sorted.
+    pub fn names(&self) -> Vec<String> {
+        let mut names: Vec<String> = self.plugins.read().unwrap().keys().cloned().collect();
+        names.sort();
+        names
+    }
+
+    /// Every known tool, sorted by name: enabled and disabled plugins, and
+    /// plugins refused for lack of permissions.
+    pub async fn tools(&self) -> Vec<ToolInfo> {
+        let registered: Vec<(SharedPlugin, ToolStatus)> = {
+            let plugins = self.plugins.read().unwrap();
+            let disabled = self.disabled.read().unwrap();
+            plugins
+                .values()
+                .map(|plugin| (plugin.clone(), ToolStatus::Enabled))
+                .chain(
+                    disabled
+                        .values()
+                        .map(|plugin| (plugin.clone(), ToolStatus::Disabled)),
+                )
+                .collect()
+        };
+
+        let mut tools = Vec::new();
+        for (plugin, status) in registered {
+            tools.push(ToolInfo::of(&*plugin.lock().await, status));
+        }
+        tools.extend(self.denied.read().unwrap().values().cloned());
+        tools.sort_by(|a, b| a.name.cmp(&b.name));
+        tools
     }
 
     /// Execute a plugin by name.
+    ///
+    /// Calls with an argument over the size limit fail with
+    /// [`PluginError::ArgumentTooLarge`] without running the plugin.
     pub async fn execute(&self, name: &str, input: Value) -> Result<PluginOutput, PluginError> {
         let plugin = self
             .get(name)
             .ok_or_else(|| PluginError::Other(format!("Unknown plugin: {}", name)))?;
+        self.check_arguments(name, &input)?;
 
         plugin.lock().await.execute(input).await
     }
 
+    /// Execute a plugin by name, reusing results from `cache`.
+    ///
+    /// Results of cacheable plugins are stored in and served from the cache.
+    /// Any other plugin that needs write or execute permission may change what
+    /// the cached calls would return, so running one clears the cache.
+    pub async fn execute_cached(
+        &self,
+        cache: &mut ToolCache,
+        name: &str,
+        input: Value,
+    ) -> Result<PluginOutput, PluginError> {
+        let plugin = self
+            .get(name)
+            .ok_or_else(|| PluginError::Other(format!("Unknown plugin: {}", name)))?;
+        self.check_arguments(name, &input)?;
+        let plugin = plugin.lock().await;
+
+        if !plugin.is_cacheable() {
+            let required = plugin.required_permission();
+            if required.write || required.execute {
+                cache.clear();
+            }
+            return plugin.execute(input).await;
+        }
+
+        if let Some(output) = cache.get(name, &input) {
+            return Ok(output);
+        }
+
+        let output = plugin.execute(input.clone()).await?;
+        cache.insert(name, &input, output.clone());
+        Ok(output)
+    }
+
     /// Get plugin specifications for the LLM.
     /// Returns a list of tool definitions in a format the LLM can understand.
     pub async fn plugin_specs(&self) -> Vec<Value> {
         let mut specs = Vec::new();
-        for plugin in self.plugins.values() {
+        for plugin in self.all() {
             let locked_plugin = plugin.lock().await;
             specs.push(serde_json::json!({
                 "name": locked_plugin.name(),
@@ -113,21 +339,228 @@ mod tests {
         }
     }
 
-    #[test]
-    fn test_registry_permissions() {
-        let mut registry = PluginRegistry::new(Permission::READ_ONLY);
-        // let plugin = TestPlugin;
+    #[tokio::test]
+    async fn test_registry_permissions() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        let plugin = TestPlugin;
 
-        // assert!(registry.register(plugin).await);
+        assert!(registry.register(plugin).await);
         assert!(registry.get("test").is_some());
     }
 
-    #[test]
-    fn test_registry_permission_denial() {
-        let mut registry = PluginRegistry::new(Permission::NONE);
-        // let plugin = TestPlugin;
+    #[tokio::test]
+    async fn test_registry_permission_denial() {
+        let registry = PluginRegistry::new(Permission::NONE);
+        let plugin = TestPlugin;
 
-        // assert!(!registry.register(plugin));
+        assert!(!registry.register(plugin).await);
         assert!(registry.get("test").is_none());
     }
+
+    struct WritePlugin;
+
+    #[async_trait]
+    impl Plugin for WritePlugin {
+        fn name(&self) -> &str {
+            "write"
+        }
+
+        fn description(&self) -> &str {
+            "Writes things"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            serde_json::json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_WRITE
+        }
+
+        async fn execute(&self, _input: Value) -> crate::Result<PluginOutput> {
+            Ok(PluginOutput::new("written"))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_tools_lists_disabled_and_denied() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        registry.register(TestPlugin).await;
+        registry.register(NumberedPlugin("other".to_string())).await;
+        assert!(!registry.register(WritePlugin).await);
+
+        assert!(registry.disable("other"));
+        assert!(registry.get("other").is_none());
+        assert!(registry
+            .execute("other", serde_json::json!({}))
+            .await
+            .is_err());
+
+        let tools = registry.tools().await;
+        let statuses: Vec<(&str, ToolStatus)> = tools
+            .iter()
+            .map(|tool| (tool.name.as_str(), tool.status))
+            .collect();
+        assert_eq!(
+            statuses,
+            vec![
+                ("other", ToolStatus::Disabled),
+                ("test", ToolStatus::Enabled),
+                ("write", ToolStatus::Denied),
+            ]
+        );
+        assert_eq!(tools[2].required_permission, Permission::READ_WRITE);
+        assert_eq!(tools[2].description, "Writes things");
+
+        assert!(registry.enable("other"));
+        assert_eq!(registry.tools().await[0].status, ToolStatus::Enabled);
+        assert_eq!(registry.plugin_specs().await.len(), 2);
+    }
+
+    /// Counts its runs, to tell whether a call reached it.
+    #[derive(Clone, Default)]
+    struct CountingPlugin {
+        runs: Arc<std::sync::atomic::AtomicUsize>,
+    }
+
+    #[async_trait]
+    impl Plugin for CountingPlugin {
+        fn name(&self) -> &str {
+            "write_file"
+        }
+
+        fn description(&self) -> &str {
+            "Counts its runs"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            serde_json::json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        async fn execute(&self, _input: Value) -> crate::Result<PluginOutput> {
+            self.runs.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
+            Ok(PluginOutput::new("written"))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_oversized_argument_is_not_executed() {
+        let plugin = CountingPlugin::default();
+        let registry = PluginRegistry::new(Permission::READ_ONLY).with_max_argument_bytes(16);
+        registry.register(plugin.clone()).await;
+
+        let oversized = serde_json::json!({ "path": "a.txt", "content": "x".repeat(17) });
+        let err = registry
+            .execute("write_file", oversized.clone())
+            .await
+            .unwrap_err();
+        assert!(matches!(
+            err,
+            PluginError::ArgumentTooLarge {
+                size: 17,
+                limit: 16,
+                ..
+            }
+        ));
+        assert!(err
+            .to_string()
+            .starts_with("Argument too large: 'content' of write_file"));
+        let mut cache = ToolCache::default();
+        assert!(registry
+            .execute_cached(&mut cache, "write_file", oversized)
+            .await
+            .is_err());
+        assert_eq!(plugin.runs.load(std::sync::atomic::Ordering::SeqCst), 0);
+
+        let small = serde_json::json!({ "path": "a.txt", "content": "x".repeat(16) });
+        registry.execute("write_file", small.clone()).await.unwrap();
+        assert_eq!(plugin.runs.load(std::sync::atomic::Ordering::SeqCst), 1);
+
+        // A per-tool limit replaces the registry-wide one.
+        let registry = PluginRegistry::new(Permission::READ_ONLY)
+            .with_max_argument_bytes(16)
+            .with_tool_argument_limit("write_file", 8);
+        assert!(registry.check_arguments("write_file", &small).is_err());
+        assert!(registry.check_arguments("search", &small).is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_unregister() {
+        let registry = PluginRegistry::new(Permission::READ_ONLY);
+        registry.register(TestPlugin).await;
+
+        assert!(registry.unregister("test"));
+        assert!(!registry.unregister("test"));
+        assert_eq!(registry.get_count(), 0);
+    }
+
+    struct NumberedPlugin(String);
+
+    #[async_trait]
+    impl Plugin for NumberedPlugin {
+        fn name(&self) -> &str {
+            &self.0
+        }
+
+        fn description(&self) -> &str {
+            "A numbered plugin"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            serde_json::json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::READ_ONLY
+        }
+
+        async fn execute(&self, _input: Value) -> crate::Result<PluginOutput> {
+            Ok(PluginOutput::new(self.0.clone()))
+        }
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn test_concurrent_registration_and_reads() {
+        let registry = Arc::new(PluginRegistry::new(Permission::READ_ONLY));
+
+        let tasks: Vec<_> = (0..32)
+            .map(|i| {
+                let registry = Arc::clone(&registry);
+                tokio::spawn(async move {
+                    registry
+                        .register(NumberedPlugin(format!("tool_{}", i)))
+                        .await;
+                    registry.plugin_specs().await;
+                    if i % 2 == 1 {
+                        assert!(registry.unregister(&format!("tool_{}", i)));
+                    }
+                    registry.get(&format!("tool_{}", i)).is_some()
+                })
+            })
+            .collect();
+
+        for (i, task) in tasks.into_iter().enumerate() {
+            assert_eq!(task.await.unwrap(), i % 2 == 0);
+        }
+
+        let expected: Vec<String> = {
+            let mut names: Vec<String> = (0..32)
+                .filter(|i| i % 2 == 0)
+                .map(|i| format!("tool_{}", i))
+                .collect();
+            names.sort();
+            names
+        };
+        assert_eq!(registry.names(), expected);
+
+        let output = registry
+            .execute("tool_4", serde_json::json!({}))
+            .await
+            .unwrap();
+        assert_eq!(output.content, "tool_4");
+    }
 }
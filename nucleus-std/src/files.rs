@@ -1,13 +1,45 @@
+use crate::paths::{check_write_root, literal, resolve, Resolved};
 use async_trait::async_trait;
 use nucleus_plugin::{Permission, Plugin, PluginError, PluginOutput, Result};
 use schemars::{schema_for, JsonSchema};
 use serde::Deserialize;
-use serde_json::Value;
-use std::path::{Path, PathBuf};
+use serde_json::{json, Value};
+use std::path::{Component, Path, PathBuf};
+use std::time::UNIX_EPOCH;
 
 /// Plugin for reading file contents.
-pub struct ReadFilePlugin;
-pub struct WriteFilePlugin;
+///
+/// Paths that don't exist are resolved by unique suffix match under the root
+/// (the working directory by default).
+pub struct ReadFilePlugin {
+    root: PathBuf,
+}
+
+/// Plugin for writing file contents.
+///
+/// Paths are taken as written, relative to the root (the working directory by
+/// default). Unlike [`ReadFilePlugin`] they are never matched by suffix, so a
+/// new file can't overwrite an existing one that happens to match.
+///
+/// With a staging directory set, files are written there instead, at the
+/// target's path relative to the root, so changes can be reviewed and diffed
+/// before they are applied.
+///
+/// With write roots set, writes outside every root are rejected, even when
+/// the path could be read.
+pub struct WriteFilePlugin {
+    root: PathBuf,
+    staging_dir: Option<PathBuf>,
+    write_roots: Vec<PathBuf>,
+}
+
+/// Plugin for listing the entries of a directory.
+///
+/// Relative paths are resolved against the root (the working directory by
+/// default).
+pub struct ListDirectoryPlugin {
+    root: PathBuf,
+}
 
 #[derive(Debug, Deserialize, JsonSchema)]
 struct ReadFileParams {
@@ -26,7 +58,15 @@ struct WriteFileParams {
 
 impl ReadFilePlugin {
     pub fn new() -> Self {
-        Self
+        Self {
+            root: PathBuf::from("."),
+        }
+    }
+
+    /// Sets the directory searched when a path doesn't exist as given.
+    pub fn with_root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = root.into();
+        self
     }
 
     pub async fn read(&self, path: &Path) -> Result<PluginOutput> {
@@ -39,8 +79,223 @@ impl ReadFilePlugin {
 
 impl WriteFilePlugin {
     pub fn new() -> Self {
-        Self
+        Self {
+            root: PathBuf::from("."),
+            staging_dir: None,
+            write_roots: Vec::new(),
+        }
+    }
+
+    /// Sets the directory relative paths are written under.
+    pub fn with_root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = root.into();
+        self
+    }
+
+    /// Redirects every write into `dir`, keeping the target's path relative
+    /// to the root. The real target is never touched.
+    pub fn with_staging_dir(mut self, dir: impl Into<PathBuf>) -> Self {
+        self.staging_dir = Some(dir.into());
+        self
+    }
+
+    /// Confines writes to `roots`, such as the directories that were indexed.
+    /// Without roots, any path can be written.
+    pub fn with_write_roots<P: Into<PathBuf>>(
+        mut self,
+        roots: impl IntoIterator<Item = P>,
+    ) -> Self {
+        self.write_roots = roots.into_iter().map(Into::into).collect();
+        self
+    }
+}
+
+/// Where a write to `target` lands under `staging_dir`: its path relative to
+/// `root`, or for targets outside the root, its full path without the leading
+/// `/`. `..` components are dropped so nothing escapes the staging directory.
+fn staged_path(staging_dir: &Path, root: &Path, target: &Path) -> PathBuf {
+    let relative = target.strip_prefix(root).unwrap_or(target);
+    let relative: PathBuf = relative
+        .components()
+        .filter(|component| matches!(component, Component::Normal(_)))
+        .collect();
+    staging_dir.join(relative)
+}
+
+impl ListDirectoryPlugin {
+    pub fn new() -> Self {
+        Self {
+            root: PathBuf::from("."),
+        }
+    }
+
+    /// Sets the directory relative paths are resolved against.
+    pub fn with_root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = root.into();
+        self
+    }
+}
+
+#[derive(Debug, Deserialize, JsonSchema)]
+struct ListDirectoryParams {
+    /// Absolute or relative path to the directory to list
+    #[serde(default = "current_dir")]
+    path: PathBuf,
+    /// Output format: `plain` (names only), `long` (type, size and
+    /// modification time) or `json`
+    #[serde(default)]
+    format: ListFormat,
+}
+
+fn current_dir() -> PathBuf {
+    PathBuf::from(".")
+}
+
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize, JsonSchema)]
+#[serde(rename_all = "lowercase")]
+enum ListFormat {
+    #[default]
+    Plain,
+    Long,
+    Json,
+}
+
+/// One directory entry, as listed by [`ListDirectoryPlugin`].
+#[derive(Debug, Clone, PartialEq, Eq, serde::Serialize)]
+struct Entry {
+    name: String,
+    #[serde(rename = "type")]
+    kind: &'static str,
+    size: u64,
+    /// Seconds since the Unix epoch
+    modified: Option<u64>,
+}
+
+impl Entry {
+    fn is_dir(&self) -> bool {
+        self.kind == "dir"
+    }
+}
+
+/// Reports filesystem permission errors as [`PluginError::PermissionDenied`]
+/// so callers can tell them apart from other failures.
+pub(crate) fn io_error(context: &str, error: std::io::Error) -> PluginError {
+    let message = format!("{}: {}", context, error);
+    if error.kind() == std::io::ErrorKind::PermissionDenied {
+        PluginError::PermissionDenied(message)
+    } else {
+        PluginError::ExecutionFailed(message)
+    }
+}
+
+async fn read_entries(dir: &Path) -> std::io::Result<Vec<Entry>> {
+    let mut entries = Vec::new();
+    let mut read_dir = tokio::fs::read_dir(dir).await?;
+
+    while let Some(entry) = read_dir.next_entry().await? {
+        let file_type = entry.file_type().await?;
+        let metadata = entry.metadata().await?;
+        let kind = if file_type.is_symlink() {
+            "symlink"
+        } else if file_type.is_dir() {
+            "dir"
+        } else {
+            "file"
+        };
+        entries.push(Entry {
+            name: entry.file_name().to_string_lossy().into_owned(),
+            kind,
+            size: metadata.len(),
+            modified: metadata
+                .modified()
+                .ok()
+                .and_then(|time| time.duration_since(UNIX_EPOCH).ok())
+                .map(|age| age.as_secs()),
+        });
     }
+
+    entries.sort_by(|a, b| a.name.cmp(&b.name));
+    Ok(entries)
+}
+
+fn format_entries(entries: &[Entry], format: ListFormat) -> String {
+    match format {
+        ListFormat::Plain => entries
+            .iter()
+            .map(|entry| {
+                if entry.is_dir() {
+                    format!("{}/", entry.name)
+                } else {
+                    entry.name.clone()
+                }
+            })
+            .collect::<Vec<_>>()
+            .join("\n"),
+        ListFormat::Long => entries
+            .iter()
+            .map(|entry| {
+                format!(
+                    "{:<7} {:>10}  {}  {}{}",
+                    entry.kind,
+                    entry.size,
+                    entry
+                        .modified
+                        .map(format_utc)
+                        .unwrap_or_else(|| "-".repeat(16)),
+                    entry.name,
+                    if entry.is_dir() { "/" } else { "" }
+                )
+            })
+            .collect::<Vec<_>>()
+            .join("\n"),
+        ListFormat::Json => serde_json::to_string_pretty(entries).unwrap_or_default(),
+    }
+}
+
+/// Formats Unix seconds as `YYYY-MM-DD HH:MM` in UTC.
+fn format_utc(seconds: u64) -> String {
+    let days = (seconds / 86_400) as i64;
+    let minutes = (seconds % 86_400) / 60;
+
+    // Civil date from days since 1970-01-01 (Howard Hinnant's algorithm).
+    let z = days + 719_468;
+    let era = z.div_euclid(146_097);
+    let day_of_era = z.rem_euclid(146_097);
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let mp = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = year_of_era + era * 400 + i64::from(month <= 2);
+
+    format!(
+        "{:04}-{:02}-{:02} {:02}:{:02}",
+        year,
+        month,
+        day,
+        minutes / 60,
+        minutes % 60
+    )
+}
+
+/// Prefixes output with a note when the path was fuzzily resolved, so the
+/// model learns the real path, and records the path in the metadata.
+fn resolved_output(requested: &Path, resolved: &Resolved, content: String) -> PluginOutput {
+    let content = match resolved {
+        Resolved::Fuzzy(path) => format!(
+            "Resolved '{}' to '{}'\n\n{}",
+            requested.display(),
+            path.display(),
+            content
+        ),
+        _ => content,
+    };
+
+    PluginOutput::new(content).with_metadata(json!({
+        "path": resolved.path().display().to_string(),
+        "resolved": matches!(resolved, Resolved::Fuzzy(_)),
+    }))
 }
 
 #[async_trait]
@@ -62,21 +317,35 @@ impl Plugin for ReadFilePlugin {
         Permission::READ_ONLY
     }
 
+    fn is_cacheable(&self) -> bool {
+        true
+    }
+
     async fn execute(&self, input: Value) -> Result<PluginOutput> {
         let params: ReadFileParams = serde_json::from_value(input)
             .map_err(|e| PluginError::InvalidInput(format!("Invalid parameters: {}", e)))?;
 
-        let path = PathBuf::from(&params.path);
+        let requested = PathBuf::from(&params.path);
+        let resolved = resolve(&self.root, &requested)?;
+        let path = match &resolved {
+            Resolved::Missing(_) => {
+                return Err(PluginError::ExecutionFailed(format!(
+                    "Failed to read file: no file matches '{}'",
+                    requested.display()
+                )))
+            }
+            resolved => resolved.path(),
+        };
 
         // Read file
-        let content = tokio::fs::read_to_string(&path)
+        let content = tokio::fs::read_to_string(path)
             .await
-            .map_err(|e| PluginError::ExecutionFailed(format!("Failed to read file: {}", e)))?;
+            .map_err(|e| io_error("Failed to read file", e))?;
 
         // Log the operation
         println!("Read file: {}", path.display());
 
-        Ok(PluginOutput::new(content))
+        Ok(resolved_output(&requested, &resolved, content))
     }
 }
 
@@ -103,19 +372,86 @@ impl Plugin for WriteFilePlugin {
         let params: WriteFileParams = serde_json::from_value(input)
             .map_err(|e| PluginError::InvalidInput(format!("Invalid parameters: {}", e)))?;
 
-        let path = PathBuf::from(&params.path);
-
-        tokio::fs::write(&path, &params.content)
+        let target = literal(&self.root, &params.path);
+        check_write_root(&target, &self.write_roots)?;
+        let mut metadata = json!({ "path": target.display().to_string() });
+
+        let Some(staging_dir) = &self.staging_dir else {
+            tokio::fs::write(&target, &params.content)
+                .await
+                .map_err(|e| io_error("Failed to write file", e))?;
+
+            println!("Wrote file: {}", target.display());
+
+            let summary = format!(
+                "Successfully wrote {} bytes to {}",
+                params.content.len(),
+                target.display()
+            );
+            return Ok(PluginOutput::new(summary).with_metadata(metadata));
+        };
+
+        let staged = staged_path(staging_dir, &self.root, &target);
+        if let Some(parent) = staged.parent() {
+            tokio::fs::create_dir_all(parent)
+                .await
+                .map_err(|e| io_error("Failed to create staging directory", e))?;
+        }
+        tokio::fs::write(&staged, &params.content)
             .await
-            .map_err(|e| PluginError::ExecutionFailed(format!("Failed to write file: {}", e)))?;
+            .map_err(|e| io_error("Failed to write staged file", e))?;
 
-        println!("Wrote file: {}", path.display());
+        println!("Staged file: {} -> {}", target.display(), staged.display());
 
-        Ok(PluginOutput::new(format!(
-            "Successfully wrote {} bytes to {}",
+        let summary = format!(
+            "Successfully wrote {} bytes to {} (staged for review; {} is unchanged)",
             params.content.len(),
-            path.display()
-        )))
+            staged.display(),
+            target.display()
+        );
+        metadata["staged"] = json!(staged.display().to_string());
+        Ok(PluginOutput::new(summary).with_metadata(metadata))
+    }
+}
+
+#[async_trait]
+impl Plugin for ListDirectoryPlugin {
+    fn name(&self) -> &str {
+        "list_directory"
+    }
+
+    fn description(&self) -> &str {
+        "List the files and directories in a directory"
+    }
+
+    fn parameter_schema(&self) -> Value {
+        let schema = schema_for!(ListDirectoryParams);
+        serde_json::to_value(schema).unwrap_or_default()
+    }
+
+    fn required_permission(&self) -> Permission {
+        Permission::READ_ONLY
+    }
+
+    fn is_cacheable(&self) -> bool {
+        true
+    }
+
+    async fn execute(&self, input: Value) -> Result<PluginOutput> {
+        let params: ListDirectoryParams = serde_json::from_value(input)
+            .map_err(|e| PluginError::InvalidInput(format!("Invalid parameters: {}", e)))?;
+
+        let dir = self.root.join(&params.path);
+        let entries = read_entries(&dir)
+            .await
+            .map_err(|e| io_error(&format!("Failed to list directory {}", dir.display()), e))?;
+
+        Ok(
+            PluginOutput::new(format_entries(&entries, params.format)).with_metadata(json!({
+                "path": dir.display().to_string(),
+                "entries": entries.len(),
+            })),
+        )
     }
 }
 
@@ -145,6 +481,21 @@ mod tests {
         std::fs::remove_file(test_file).ok();
     }
 
+    #[test]
+    fn test_permission_errors_are_permission_denied() {
+        let denied = io_error(
+            "Failed to write file",
+            std::io::Error::from(std::io::ErrorKind::PermissionDenied),
+        );
+        assert!(matches!(denied, PluginError::PermissionDenied(_)));
+
+        let missing = io_error(
+            "Failed to read file",
+            std::io::Error::from(std::io::ErrorKind::NotFound),
+        );
+        assert!(matches!(missing, PluginError::ExecutionFailed(_)));
+    }
+
     #[tokio::test]
     async fn test_read_nonexistent_file() {
         let plugin = ReadFilePlugin::new();
@@ -195,4 +546,191 @@ mod tests {
 
         std::fs::remove_file(test_file).ok();
     }
+
+    #[tokio::test]
+    async fn test_read_file_resolves_unique_suffix() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::create_dir_all(dir.path().join("src/bin")).unwrap();
+        std::fs::write(dir.path().join("src/bin/main.rs"), "fn main() {}").unwrap();
+
+        let plugin = ReadFilePlugin::new().with_root(dir.path());
+        let result = plugin
+            .execute(serde_json::json!({ "path": "main.rs" }))
+            .await
+            .unwrap();
+
+        assert!(result.content.ends_with("fn main() {}"));
+        assert!(result.content.contains("src/bin/main.rs"));
+        assert_eq!(result.metadata.unwrap()["resolved"], true);
+    }
+
+    #[tokio::test]
+    async fn test_write_file_never_resolves_by_suffix() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::create_dir_all(dir.path().join("src")).unwrap();
+        std::fs::write(dir.path().join("src/main.rs"), "fn main() {}").unwrap();
+
+        let plugin = WriteFilePlugin::new().with_root(dir.path());
+        plugin
+            .execute(serde_json::json!({ "path": "main.rs", "content": "x" }))
+            .await
+            .unwrap();
+
+        assert_eq!(
+            std::fs::read_to_string(dir.path().join("main.rs")).unwrap(),
+            "x"
+        );
+        assert_eq!(
+            std::fs::read_to_string(dir.path().join("src/main.rs")).unwrap(),
+            "fn main() {}"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_writes_confined_to_write_roots() {
+        let home = tempfile::tempdir().unwrap();
+        let project = home.path().join("project");
+        std::fs::create_dir_all(&project).unwrap();
+        std::fs::write(home.path().join("notes.md"), "mine").unwrap();
+
+        let plugin = WriteFilePlugin::new()
+            .with_root(home.path())
+            .with_write_roots([&project]);
+        plugin
+            .execute(json!({ "path": "project/lib.rs", "content": "pub fn run() {}" }))
+            .await
+            .unwrap();
+        assert_eq!(
+            std::fs::read_to_string(project.join("lib.rs")).unwrap(),
+            "pub fn run() {}"
+        );
+
+        for path in ["notes.md", "project/../notes.md"] {
+            let result = plugin
+                .execute(json!({ "path": path, "content": "overwritten" }))
+                .await;
+            assert!(matches!(result, Err(PluginError::OutsideWriteRoots { .. })));
+        }
+        assert_eq!(
+            std::fs::read_to_string(home.path().join("notes.md")).unwrap(),
+            "mine"
+        );
+
+        let reader = ReadFilePlugin::new().with_root(home.path());
+        let read = reader.execute(json!({ "path": "notes.md" })).await.unwrap();
+        assert_eq!(read.content, "mine");
+    }
+
+    #[tokio::test]
+    async fn test_staging_dir_keeps_relative_path() {
+        let root = tempfile::tempdir().unwrap();
+        let staging = tempfile::tempdir().unwrap();
+        std::fs::create_dir_all(root.path().join("src/bin")).unwrap();
+        std::fs::write(root.path().join("src/bin/main.rs"), "fn main() {}").unwrap();
+
+        let plugin = WriteFilePlugin::new()
+            .with_root(root.path())
+            .with_staging_dir(staging.path());
+        let result = plugin
+            .execute(json!({ "path": "src/bin/main.rs", "content": "fn main() { run() }" }))
+            .await
+            .unwrap();
+
+        let staged = staging.path().join("src/bin/main.rs");
+        assert_eq!(
+            std::fs::read_to_string(&staged).unwrap(),
+            "fn main() { run() }"
+        );
+        assert_eq!(
+            std::fs::read_to_string(root.path().join("src/bin/main.rs")).unwrap(),
+            "fn main() {}"
+        );
+        assert_eq!(
+            result.metadata.unwrap()["staged"],
+            staged.display().to_string()
+        );
+
+        plugin
+            .execute(json!({ "path": "docs/notes.md", "content": "new" }))
+            .await
+            .unwrap();
+        assert!(staging.path().join("docs/notes.md").exists());
+        assert!(!root.path().join("docs").exists());
+    }
+
+    #[test]
+    fn test_staged_path_stays_in_staging_dir() {
+        let staging = Path::new("/staging");
+        assert_eq!(
+            staged_path(staging, Path::new("/repo"), Path::new("/etc/hosts")),
+            PathBuf::from("/staging/etc/hosts")
+        );
+        assert_eq!(
+            staged_path(staging, Path::new("/repo"), Path::new("/repo/../secret")),
+            PathBuf::from("/staging/secret")
+        );
+    }
+
+    /// `notes.txt` (5 bytes, modified 2024-03-01 12:30 UTC) and `src/`.
+    fn list_fixture() -> tempfile::TempDir {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::create_dir(dir.path().join("src")).unwrap();
+        let notes = dir.path().join("notes.txt");
+        std::fs::write(&notes, "hello").unwrap();
+        std::fs::File::options()
+            .write(true)
+            .open(&notes)
+            .unwrap()
+            .set_modified(UNIX_EPOCH + std::time::Duration::from_secs(1_709_296_200))
+            .unwrap();
+        dir
+    }
+
+    async fn list(dir: &Path, format: Option<&str>) -> String {
+        let mut input = json!({ "path": "." });
+        if let Some(format) = format {
+            input["format"] = json!(format);
+        }
+        ListDirectoryPlugin::new()
+            .with_root(dir)
+            .execute(input)
+            .await
+            .unwrap()
+            .content
+    }
+
+    #[tokio::test]
+    async fn test_list_directory_plain_is_default() {
+        let dir = list_fixture();
+
+        assert_eq!(list(dir.path(), None).await, "notes.txt\nsrc/");
+        assert_eq!(list(dir.path(), Some("plain")).await, "notes.txt\nsrc/");
+    }
+
+    #[tokio::test]
+    async fn test_list_directory_long_and_json() {
+        let dir = list_fixture();
+
+        let long = list(dir.path(), Some("long")).await;
+        let lines: Vec<&str> = long.lines().collect();
+        assert_eq!(lines.len(), 2);
+        assert_eq!(lines[0], "file             5  2024-03-01 12:30  notes.txt");
+        assert!(lines[1].starts_with("dir "));
+        assert!(lines[1].ends_with("  src/"));
+
+        let parsed: Value = serde_json::from_str(&list(dir.path(), Some("json")).await).unwrap();
+        let entries = parsed.as_array().unwrap();
+        assert_eq!(entries.len(), 2);
+        assert_eq!(entries[0]["name"], "notes.txt");
+        assert_eq!(entries[0]["type"], "file");
+        assert_eq!(entries[0]["size"], 5);
+        assert_eq!(entries[0]["modified"], 1_709_296_200);
+        assert_eq!(entries[1]["type"], "dir");
+
+        let result = ListDirectoryPlugin::new()
+            .with_root(dir.path())
+            .execute(json!({ "format": "tree" }))
+            .await;
+        assert!(matches!(result, Err(PluginError::InvalidInput(_))));
+    }
 }
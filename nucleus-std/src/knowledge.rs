@@ -0,0 +1,139 @@
+use async_trait::async_trait;
+use nucleus_core::RagEngine;
+use nucleus_plugin::{Permission, Plugin, PluginError, PluginOutput, Result};
+use serde_json::{json, Value};
+use std::sync::Arc;
+
+/// Lists what the knowledge base holds, so the model can tell whether
+/// searching it is worth a call.
+pub struct ListKnowledgeSourcesPlugin {
+    engine: Arc<RagEngine>,
+}
+
+impl ListKnowledgeSourcesPlugin {
+    pub fn new(engine: Arc<RagEngine>) -> Self {
+        Self { engine }
+    }
+}
+
+#[async_trait]
+impl Plugin for ListKnowledgeSourcesPlugin {
+    fn name(&self) -> &str {
+        "list_knowledge_sources"
+    }
+
+    fn description(&self) -> &str {
+        "List the files and documents indexed in the knowledge base, with the number of chunks of each"
+    }
+
+    fn parameter_schema(&self) -> Value {
+        json!({
+            "type": "object",
+            "properties": {}
+        })
+    }
+
+    fn required_permission(&self) -> Permission {
+        Permission::READ_ONLY
+    }
+
+    async fn execute(&self, _input: Value) -> Result<PluginOutput> {
+        let counts = self.engine.source_chunk_counts().await.map_err(|e| {
+            PluginError::ExecutionFailed(format!("Failed to list knowledge sources: {}", e))
+        })?;
+
+        let sources: Vec<Value> = counts
+            .iter()
+            .map(|(source, chunks)| json!({ "source": source, "chunks": chunks }))
+            .collect();
+        Ok(PluginOutput::new(format_sources(&counts)).with_metadata(json!({ "sources": sources })))
+    }
+}
+
+fn format_sources(counts: &[(String, usize)]) -> String {
+    if counts.is_empty() {
+        return "The knowledge base is empty".to_string();
+    }
+    let mut lines = vec![format!("{} sources indexed:", counts.len())];
+    for (source, chunks) in counts {
+        let unit = if *chunks == 1 { "chunk" } else { "chunks" };
+        lines.push(format!("- {} ({} {})", source, chunks, unit));
+    }
+    lines.join("\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use nucleus_core::config::{RagConfig, StorageConfig, StorageMode};
+    use nucleus_core::models::EmbeddingModel;
+    use nucleus_core::provider::{ChatRequest, ChatResponse, Provider};
+    use nucleus_core::Config;
+
+    /// Embeds each text as a vector of its length, which is all listing
+    /// sources needs.
+    struct LengthProvider;
+
+    #[async_trait]
+    impl Provider for LengthProvider {
+        async fn chat<'a>(
+            &'a self,
+            _request: ChatRequest,
+            _callback: Box<dyn FnMut(ChatResponse) + Send + 'a>,
+        ) -> nucleus_core::provider::Result<()> {
+            Ok(())
+        }
+
+        async fn embed(
+            &self,
+            text: &str,
+            model: &EmbeddingModel,
+        ) -> nucleus_core::provider::Result<Vec<f32>> {
+            Ok(vec![1.0 + text.len() as f32; model.embedding_dim])
+        }
+    }
+
+    #[tokio::test]
+    async fn test_lists_distinct_sources_with_chunk_counts() {
+        let config = Config::default()
+            .with_rag_config(RagConfig::default())
+            .with_storage_config(StorageConfig {
+                storage_mode: StorageMode::Memory { max_documents: 0 },
+                ..StorageConfig::default()
+            });
+        let engine = Arc::new(
+            RagEngine::new(&config, Arc::new(LengthProvider))
+                .await
+                .unwrap(),
+        );
+        engine
+            .add_knowledge("Chunks are 512 bytes", "docs/chunking.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Overlap is 50 bytes", "docs/chunking.md")
+            .await
+            .unwrap();
+        engine
+            .add_knowledge("Config is read at startup", "docs/config.md")
+            .await
+            .unwrap();
+
+        let output = ListKnowledgeSourcesPlugin::new(engine)
+            .execute(json!({}))
+            .await
+            .unwrap();
+
+        assert_eq!(
+            output.content,
+            "2 sources indexed:\n- docs/chunking.md (2 chunks)\n- docs/config.md (1 chunk)"
+        );
+        assert_eq!(
+            output.metadata.unwrap()["sources"],
+            json!([
+                { "source": "docs/chunking.md", "chunks": 2 },
+                { "source": "docs/config.md", "chunks": 1 },
+            ])
+        );
+    }
+}
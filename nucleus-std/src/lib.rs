@@ -3,14 +3,25 @@
 //! The standard library is a collection of built-in plugins that are typical in most use-cases.
 //! Provides essential plugins that work out of the box:
 //! - File operations (read, write, list)
+//! - Symbol reading (one function or type from a code file)
 //! - Search (text and code search)
 //! - Execution (safe command execution)
+//! - Knowledge base listing (the indexed sources)
+//!
+//! [`registry_from_config`] registers them with the settings from a config,
+//! along with the plugins it names.
 
 mod commands;
 mod files;
+mod knowledge;
+mod paths;
 mod search;
+mod symbols;
+mod tools;
 
 pub use commands::ExecPlugin;
-pub use files::{ReadFilePlugin, WriteFilePlugin};
+pub use files::{ListDirectoryPlugin, ReadFilePlugin, WriteFilePlugin};
+pub use knowledge::ListKnowledgeSourcesPlugin;
 pub use search::SearchPlugin;
-// TODO: Implement ListDirectoryPlugin
+pub use symbols::ReadSymbolPlugin;
+pub use tools::registry_from_config;
@@ -0,0 +1,284 @@
+//! Path resolution for the file tools.
+//!
+//! Models often pass a bare filename or a slightly wrong path. When the exact
+//! path doesn't exist, the reading tools look for a unique file under the root
+//! whose path ends with the requested one. Writes always use the
+//! [`literal`] path, so they can't land on some other existing file.
+
+use nucleus_plugin::{PluginError, Result};
+use std::path::{Component, Path, PathBuf};
+use walkdir::WalkDir;
+
+/// Directories never searched during fuzzy resolution.
+const SKIPPED_DIRS: &[&str] = &[".git", "target", "node_modules"];
+
+/// Most candidates listed in an ambiguity error.
+const MAX_CANDIDATES: usize = 10;
+
+/// A path after resolution.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub(crate) enum Resolved {
+    /// The requested path exists as given.
+    Exact(PathBuf),
+    /// The requested path didn't exist; this is the single file that matched it.
+    Fuzzy(PathBuf),
+    /// Nothing matched. Writers may still create the file here.
+    Missing(PathBuf),
+}
+
+impl Resolved {
+    pub(crate) fn path(&self) -> &Path {
+        match self {
+            Self::Exact(path) | Self::Fuzzy(path) | Self::Missing(path) => path,
+        }
+    }
+}
+
+/// Resolves `requested` against `root`.
+///
+/// Existing paths are returned without touching the filesystem further.
+/// Otherwise files under `root` are matched by path suffix, component by
+/// component, so `main.rs` matches `src/main.rs` but not `domain.rs`.
+///
+/// # Errors
+///
+/// Returns [`PluginError::InvalidInput`] listing the candidates when more than
+/// one file matches.
+pub(crate) fn resolve(root: &Path, requested: &Path) -> Result<Resolved> {
+    let direct = literal(root, requested);
+
+    if direct.is_file() {
+        return Ok(Resolved::Exact(direct));
+    }
+
+    let suffix = relative_suffix(root, requested);
+    if suffix.as_os_str().is_empty() {
+        return Ok(Resolved::Missing(direct));
+    }
+
+    let mut candidates: Vec<PathBuf> = WalkDir::new(root)
+        .into_iter()
+        .filter_entry(|entry| {
+            !(entry.file_type().is_dir()
+                && SKIPPED_DIRS.contains(&entry.file_name().to_string_lossy().as_ref()))
+        })
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| entry.file_type().is_file())
+        .map(|entry| entry.into_path())
+        .filter(|path| path.ends_with(&suffix))
+        .collect();
+
+    match candidates.len() {
+        0 => Ok(Resolved::Missing(direct)),
+        1 => Ok(Resolved::Fuzzy(candidates.remove(0))),
+        count => {
+            candidates.sort();
+            let listed: Vec<String> = candidates
+                .iter()
+                .take(MAX_CANDIDATES)
+                .map(|path| path.display().to_string())
+                .collect();
+            let more = if count > MAX_CANDIDATES {
+                format!(" (and {} more)", count - MAX_CANDIDATES)
+            } else {
+                String::new()
+            };
+
+            Err(PluginError::InvalidInput(format!(
+                "Ambiguous path '{}' matches {} files: {}{}",
+                requested.display(),
+                count,
+                listed.join(", "),
+                more
+            )))
+        }
+    }
+}
+
+/// `requested` taken as written: as is when absolute, otherwise under `root`.
+pub(crate) fn literal(root: &Path, requested: &Path) -> PathBuf {
+    if requested.is_absolute() {
+        requested.to_path_buf()
+    } else {
+        root.join(requested)
+    }
+}
+
+/// Whether `path` is inside one of `roots`, comparing absolute paths with
+/// `.` and `..` resolved so `root/../elsewhere` doesn't count as inside, and
+/// symlinks resolved so a link inside a root to elsewhere doesn't either.
+pub(crate) fn is_within(path: &Path, roots: &[PathBuf]) -> bool {
+    let path = physical(path);
+    roots.iter().any(|root| path.starts_with(physical(root)))
+}
+
+/// Rejects a write to `target` outside every one of `roots` with
+/// [`PluginError::OutsideWriteRoots`]. No roots allow any target.
+///
+/// Every tool that changes files checks its targets with this.
+pub(crate) fn check_write_root(target: &Path, roots: &[PathBuf]) -> Result<()> {
+    if roots.is_empty() || is_within(target, roots) {
+        return Ok(());
+    }
+
+    Err(PluginError::OutsideWriteRoots {
+        path: target.to_path_buf(),
+        roots: roots
+            .iter()
+            .map(|root| root.display().to_string())
+            .collect(),
+    })
+}
+
+/// [`normalize`]s `path`, then resolves symlinks in the longest part of it
+/// that exists. The rest is kept as is, since a write may create it.
+fn physical(path: &Path) -> PathBuf {
+    let normalized = normalize(path);
+    let mut existing = normalized.as_path();
+    let mut missing = Vec::new();
+    loop {
+        if let Ok(canonical) = existing.canonicalize() {
+            return missing
+                .iter()
+                .rev()
+                .fold(canonical, |path, part| path.join(part));
+        }
+        match (existing.parent(), existing.file_name()) {
+            (Some(parent), Some(name)) => {
+                missing.push(name.to_os_string());
+                existing = parent;
+            }
+            _ => return normalized,
+        }
+    }
+}
+
+/// Makes `path` absolute and resolves `.` and `..` without touching the
+/// filesystem, since the path may not exist yet.
+fn normalize(path: &Path) -> PathBuf {
+    let absolute = std::path::absolute(path).unwrap_or_else(|_| path.to_path_buf());
+    let mut normalized = PathBuf::new();
+    for component in absolute.components() {
+        match component {
+            Component::CurDir => {}
+            Component::ParentDir => {
+                normalized.pop();
+            }
+            component => normalized.push(component),
+        }
+    }
+    normalized
+}
+
+/// The part of `requested` that can be matched as a suffix.
+///
+/// Absolute paths under `root` are made relative; `.`, `..` and root
+/// components are dropped since they can't be matched against a suffix.
+fn relative_suffix(root: &Path, requested: &Path) -> PathBuf {
+    let relative = requested.strip_prefix(root).unwrap_or(requested);
+    relative
+        .components()
+        .filter_map(|component| match component {
+            Component::Normal(part) => Some(part),
+            _ => None,
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    fn touch(root: &Path, relative: &str) -> PathBuf {
+        let path = root.join(relative);
+        std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+        std::fs::write(&path, relative).unwrap();
+        path
+    }
+
+    #[test]
+    fn test_exact_path_is_fast_pathed() {
+        let dir = tempdir().unwrap();
+        let path = touch(dir.path(), "src/main.rs");
+
+        assert_eq!(
+            resolve(dir.path(), Path::new("src/main.rs")).unwrap(),
+            Resolved::Exact(path)
+        );
+    }
+
+    #[test]
+    fn test_unique_suffix_match() {
+        let dir = tempdir().unwrap();
+        let path = touch(dir.path(), "crates/core/src/main.rs");
+        touch(dir.path(), "crates/core/src/domain.rs");
+
+        assert_eq!(
+            resolve(dir.path(), Path::new("main.rs")).unwrap(),
+            Resolved::Fuzzy(path.clone())
+        );
+        assert_eq!(
+            resolve(dir.path(), Path::new("./core/src/main.rs")).unwrap(),
+            Resolved::Fuzzy(path)
+        );
+    }
+
+    #[test]
+    fn test_ambiguous_match_lists_candidates() {
+        let dir = tempdir().unwrap();
+        touch(dir.path(), "a/main.rs");
+        touch(dir.path(), "b/main.rs");
+
+        let err = resolve(dir.path(), Path::new("main.rs")).unwrap_err();
+        let message = err.to_string();
+
+        assert!(matches!(err, PluginError::InvalidInput(_)));
+        assert!(message.contains("a/main.rs"));
+        assert!(message.contains("b/main.rs"));
+    }
+
+    #[test]
+    fn test_within_roots_resolves_parent_components() {
+        let roots = vec![PathBuf::from("/home/me/project")];
+
+        assert!(is_within(Path::new("/home/me/project/src/main.rs"), &roots));
+        assert!(is_within(Path::new("/home/me/project/./a/../b.rs"), &roots));
+        assert!(!is_within(
+            Path::new("/home/me/project/../notes.md"),
+            &roots
+        ));
+        assert!(!is_within(Path::new("/home/me/project-old/a.rs"), &roots));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_symlink_out_of_root_is_not_within() {
+        let home = tempdir().unwrap();
+        let project = home.path().join("project");
+        let elsewhere = home.path().join("elsewhere");
+        std::fs::create_dir_all(&project).unwrap();
+        std::fs::create_dir_all(&elsewhere).unwrap();
+        std::os::unix::fs::symlink(&elsewhere, project.join("link")).unwrap();
+        let roots = vec![project.clone()];
+
+        assert!(is_within(&project.join("src/new.rs"), &roots));
+        assert!(!is_within(&project.join("link/new.rs"), &roots));
+        assert!(matches!(
+            check_write_root(&project.join("link/new.rs"), &roots),
+            Err(PluginError::OutsideWriteRoots { .. })
+        ));
+        assert!(check_write_root(&elsewhere.join("new.rs"), &[]).is_ok());
+    }
+
+    #[test]
+    fn test_no_match_is_missing() {
+        let dir = tempdir().unwrap();
+        touch(dir.path(), "src/lib.rs");
+
+        assert_eq!(
+            resolve(dir.path(), Path::new("main.rs")).unwrap(),
+            Resolved::Missing(dir.path().join("main.rs"))
+        );
+    }
+}
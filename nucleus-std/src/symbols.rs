@@ -0,0 +1,469 @@
+//! Reading a single declaration out of a source file.
+//!
+//! Declarations are found line by line with a per-language pattern and end at
+//! their closing brace (Rust, Go) or where the indentation drops back (Python),
+//! so the model can read one function or type without pulling in the whole
+//! file. Doc comments, attributes and decorators directly above a declaration
+//! are included.
+
+use crate::files::io_error;
+use crate::paths::{resolve, Resolved};
+use async_trait::async_trait;
+use nucleus_plugin::{Permission, Plugin, PluginError, PluginOutput, Result};
+use regex::Regex;
+use schemars::{schema_for, JsonSchema};
+use serde::Deserialize;
+use serde_json::{json, Value};
+use std::path::{Path, PathBuf};
+
+/// Plugin for reading one function, type or method from a code file.
+///
+/// Paths are resolved like [`ReadFilePlugin`](crate::ReadFilePlugin).
+pub struct ReadSymbolPlugin {
+    root: PathBuf,
+}
+
+#[derive(Debug, Deserialize, JsonSchema)]
+struct ReadSymbolParams {
+    /// Absolute or relative path to the source file
+    path: String,
+    /// Name of the function, type or method. Qualify methods with their type
+    /// as `Type::method` (Rust) or `Type.method` (Go, Python) when the name
+    /// alone is ambiguous
+    symbol: String,
+}
+
+impl ReadSymbolPlugin {
+    pub fn new() -> Self {
+        Self {
+            root: PathBuf::from("."),
+        }
+    }
+
+    /// Sets the directory searched when a path doesn't exist as given.
+    pub fn with_root(mut self, root: impl Into<PathBuf>) -> Self {
+        self.root = root.into();
+        self
+    }
+}
+
+/// Languages whose declarations can be located.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Language {
+    Rust,
+    Go,
+    Python,
+}
+
+/// Lines of a declaration, 0-based and inclusive.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+struct Span {
+    start: usize,
+    end: usize,
+}
+
+impl Language {
+    fn from_path(path: &Path) -> Option<Self> {
+        match path.extension()?.to_str()? {
+            "rs" => Some(Self::Rust),
+            "go" => Some(Self::Go),
+            "py" => Some(Self::Python),
+            _ => None,
+        }
+    }
+
+    /// Matches the first line of a declaration of `name`. For Go, `owner`
+    /// is the receiver type of a method.
+    fn declaration(self, name: &str, owner: Option<&str>) -> Regex {
+        let name = regex::escape(name);
+        let pattern = match (self, owner) {
+            (Self::Rust, _) => format!(
+                r#"^\s*(?:pub(?:\([^)]*\))?\s+)?(?:(?:async|const|unsafe|default|extern(?:\s+"[^"]*")?)\s+)*(?:(?:fn|struct|enum|trait|type|mod|union)\s+{name}\b|macro_rules!\s*{name}\b|(?:const|static)\s+(?:mut\s+)?{name}\s*:)"#
+            ),
+            (Self::Go, None) => {
+                format!(
+                    r"^(?:func\s+(?:\([^)]*\)\s*)?{name}\s*[\[(]|(?:type|var|const)\s+{name}\b)"
+                )
+            }
+            (Self::Go, Some(owner)) => {
+                let owner = regex::escape(owner);
+                format!(r"^func\s+\([^)]*\b{owner}\b[^)]*\)\s*{name}\s*[\[(]")
+            }
+            (Self::Python, _) => {
+                format!(r"^\s*(?:(?:async\s+)?def\s+{name}\s*\(|class\s+{name}\b)")
+            }
+        };
+        Regex::new(&pattern).expect("symbol pattern")
+    }
+
+    /// Matches the first line of a block whose members belong to `owner`,
+    /// for languages that declare methods inside one.
+    fn container(self, owner: &str) -> Option<Regex> {
+        let owner = regex::escape(owner);
+        let pattern = match self {
+            Self::Rust => format!(
+                r"^\s*(?:unsafe\s+)?(?:impl\b[^{{]*\b{owner}\b|(?:pub(?:\([^)]*\))?\s+)?trait\s+{owner}\b)"
+            ),
+            Self::Go => return None,
+            Self::Python => format!(r"^\s*class\s+{owner}\b"),
+        };
+        Some(Regex::new(&pattern).expect("container pattern"))
+    }
+
+    /// Line prefixes attached to the declaration below them.
+    fn preamble(self) -> &'static [&'static str] {
+        match self {
+            Self::Rust => &["///", "#["],
+            Self::Go => &["//"],
+            Self::Python => &["@"],
+        }
+    }
+
+    /// Finds the declaration of `symbol`, optionally qualified with its type.
+    fn find(self, lines: &[&str], symbol: &str) -> Option<Span> {
+        let separator = if self == Self::Rust { "::" } else { "." };
+        let (owner, name) = match symbol.rsplit_once(separator) {
+            Some((owner, name)) => (Some(owner), name),
+            None => (None, symbol),
+        };
+
+        let span = match owner.and_then(|owner| self.container(owner)) {
+            Some(container) => {
+                let declaration = self.declaration(name, None);
+                (0..lines.len())
+                    .filter(|&i| container.is_match(lines[i]))
+                    .find_map(|i| {
+                        let block = self.span(lines, i);
+                        (block.start + 1..=block.end)
+                            .find(|&j| declaration.is_match(lines[j]))
+                            .map(|j| self.span(lines, j))
+                    })
+            }
+            None => {
+                let declaration = self.declaration(name, owner);
+                (0..lines.len())
+                    .find(|&i| declaration.is_match(lines[i]))
+                    .map(|i| self.span(lines, i))
+            }
+        }?;
+
+        let preamble = self.preamble();
+        let mut start = span.start;
+        while start > 0 {
+            let above = lines[start - 1].trim_start();
+            if !preamble.iter().any(|prefix| above.starts_with(prefix)) {
+                break;
+            }
+            start -= 1;
+        }
+        Some(Span { start, ..span })
+    }
+
+    /// The declaration starting on line `start`.
+    fn span(self, lines: &[&str], start: usize) -> Span {
+        let end = match self {
+            Self::Rust => brace_end(lines, start, true),
+            Self::Go => brace_end(lines, start, false),
+            Self::Python => indent_end(lines, start),
+        };
+        Span { start, end }
+    }
+}
+
+/// Last line of a brace-delimited declaration.
+///
+/// Declarations without a body end at a `;` when `semicolon_ends` is set
+/// (Rust's `struct Unit;`), and otherwise at the end of their line once all
+/// parentheses are closed (Go's `type ID int`). Braces in strings, character
+/// literals and comments are ignored.
+fn brace_end(lines: &[&str], start: usize, semicolon_ends: bool) -> usize {
+    let mut braces = 0usize;
+    let mut parens = 0usize;
+    let mut opened = false;
+    let mut in_comment = false;
+
+    for (i, line) in lines.iter().enumerate().skip(start) {
+        let chars: Vec<char> = line.chars().collect();
+        let mut quote: Option<char> = None;
+        let mut j = 0;
+
+        while j < chars.len() {
+            let c = chars[j];
+            let next = chars.get(j + 1).copied();
+            j += 1;
+
+            if in_comment {
+                if c == '*' && next == Some('/') {
+                    in_comment = false;
+                    j += 1;
+                }
+                continue;
+            }
+            if let Some(q) = quote {
+                if c == '\\' {
+                    j += 1;
+                } else if c == q {
+                    quote = None;
+                }
+                continue;
+            }
+
+            match c {
+                '/' if next == Some('/') => break,
+                '/' if next == Some('*') => {
+                    in_comment = true;
+                    j += 1;
+                }
+                '"' | '`' => quote = Some(c),
+                // A character literal, as opposed to a Rust lifetime.
+                '\'' if next == Some('\\') => {
+                    while j < chars.len() && !(chars[j] == '\'' && chars[j - 1] != '\\') {
+                        j += 1;
+                    }
+                    j += 1;
+                }
+                '\'' if chars.get(j + 1) == Some(&'\'') => j += 2,
+                '{' => {
+                    braces += 1;
+                    opened = true;
+                }
+                '}' => {
+                    braces = braces.saturating_sub(1);
+                    if opened && braces == 0 {
+                        return i;
+                    }
+                }
+                '(' | '[' => parens += 1,
+                ')' | ']' => parens = parens.saturating_sub(1),
+                ';' if semicolon_ends && !opened && parens == 0 => return i,
+                _ => {}
+            }
+        }
+
+        if !semicolon_ends && !opened && parens == 0 {
+            return i;
+        }
+    }
+
+    lines.len() - 1
+}
+
+/// Last line of an indented block: the last non-blank line before one that
+/// is indented no deeper than the block's first line.
+fn indent_end(lines: &[&str], start: usize) -> usize {
+    let indent = |line: &str| line.len() - line.trim_start().len();
+    let base = indent(lines[start]);
+    let mut end = start;
+
+    for (i, line) in lines.iter().enumerate().skip(start + 1) {
+        if line.trim().is_empty() {
+            continue;
+        }
+        if indent(line) <= base {
+            break;
+        }
+        end = i;
+    }
+
+    end
+}
+
+#[async_trait]
+impl Plugin for ReadSymbolPlugin {
+    fn name(&self) -> &str {
+        "read_symbol"
+    }
+
+    fn description(&self) -> &str {
+        "Read a single function, type or method from a Rust, Go or Python file"
+    }
+
+    fn parameter_schema(&self) -> Value {
+        let schema = schema_for!(ReadSymbolParams);
+        serde_json::to_value(schema).unwrap_or_default()
+    }
+
+    fn required_permission(&self) -> Permission {
+        Permission::READ_ONLY
+    }
+
+    fn is_cacheable(&self) -> bool {
+        true
+    }
+
+    async fn execute(&self, input: Value) -> Result<PluginOutput> {
+        let params: ReadSymbolParams = serde_json::from_value(input)
+            .map_err(|e| PluginError::InvalidInput(format!("Invalid parameters: {}", e)))?;
+
+        let requested = PathBuf::from(&params.path);
+        let resolved = resolve(&self.root, &requested)?;
+        let path = match &resolved {
+            Resolved::Missing(_) => {
+                return Err(PluginError::ExecutionFailed(format!(
+                    "Failed to read symbol: no file matches '{}'",
+                    requested.display()
+                )))
+            }
+            resolved => resolved.path(),
+        };
+
+        let language = Language::from_path(path).ok_or_else(|| {
+            PluginError::InvalidInput(format!(
+                "Can't read symbols from {}: only .rs, .go and .py files are supported",
+                path.display()
+            ))
+        })?;
+
+        let content = tokio::fs::read_to_string(path)
+            .await
+            .map_err(|e| io_error("Failed to read file", e))?;
+        let lines: Vec<&str> = content.lines().collect();
+
+        let span = language.find(&lines, &params.symbol).ok_or_else(|| {
+            PluginError::ExecutionFailed(format!(
+                "No symbol '{}' in {}",
+                params.symbol,
+                path.display()
+            ))
+        })?;
+
+        Ok(
+            PluginOutput::new(lines[span.start..=span.end].join("\n")).with_metadata(json!({
+                "path": path.display().to_string(),
+                "symbol": params.symbol,
+                "start_line": span.start + 1,
+                "end_line": span.end + 1,
+            })),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const GO_FIXTURE: &str = r#"package server
+
+import "fmt"
+
+// Server answers requests.
+type Server struct {
+	addr string
+}
+
+type ID int
+
+// Start listens on the configured address.
+func (s *Server) Start() error {
+	if s.addr == "" {
+		return fmt.Errorf("no address {")
+	}
+	return nil
+}
+
+func NewServer(addr string) *Server {
+	return &Server{addr: addr}
+}
+"#;
+
+    const RUST_FIXTURE: &str = r#"pub struct Marker;
+
+impl Config {
+    /// Builds the default config.
+    pub fn new() -> Self {
+        let open = '{';
+        Self { open }
+    }
+}
+
+impl Client {
+    pub fn new() -> Self {
+        Self
+    }
+}
+"#;
+
+    async fn read_symbol(file: &str, content: &str, symbol: &str) -> Result<PluginOutput> {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(dir.path().join(file), content).unwrap();
+        ReadSymbolPlugin::new()
+            .with_root(dir.path())
+            .execute(json!({ "path": file, "symbol": symbol }))
+            .await
+    }
+
+    #[tokio::test]
+    async fn test_go_function_method_and_type() {
+        let output = read_symbol("server.go", GO_FIXTURE, "Start").await.unwrap();
+        assert_eq!(
+            output.content,
+            "// Start listens on the configured address.\n\
+             func (s *Server) Start() error {\n\
+             \tif s.addr == \"\" {\n\
+             \t\treturn fmt.Errorf(\"no address {\")\n\
+             \t}\n\
+             \treturn nil\n\
+             }"
+        );
+        let metadata = output.metadata.unwrap();
+        assert_eq!(metadata["start_line"], 12);
+        assert_eq!(metadata["end_line"], 18);
+
+        let output = read_symbol("server.go", GO_FIXTURE, "Server.Start")
+            .await
+            .unwrap();
+        assert!(output.content.starts_with("// Start listens"));
+
+        let output = read_symbol("server.go", GO_FIXTURE, "Server")
+            .await
+            .unwrap();
+        assert_eq!(
+            output.content,
+            "// Server answers requests.\ntype Server struct {\n\taddr string\n}"
+        );
+
+        let output = read_symbol("server.go", GO_FIXTURE, "ID").await.unwrap();
+        assert_eq!(output.content, "type ID int");
+    }
+
+    #[tokio::test]
+    async fn test_rust_method_qualified_by_impl() {
+        let output = read_symbol("lib.rs", RUST_FIXTURE, "Client::new")
+            .await
+            .unwrap();
+        assert_eq!(
+            output.content,
+            "    pub fn new() -> Self {\n        Self\n    }"
+        );
+
+        let output = read_symbol("lib.rs", RUST_FIXTURE, "new").await.unwrap();
+        assert_eq!(
+            output.content,
+            "    /// Builds the default config.\n    pub fn new() -> Self {\n        let open = '{';\n        Self { open }\n    }"
+        );
+
+        let output = read_symbol("lib.rs", RUST_FIXTURE, "Marker").await.unwrap();
+        assert_eq!(output.content, "pub struct Marker;");
+    }
+
+    #[tokio::test]
+    async fn test_python_method_ends_at_dedent() {
+        let source = "class Cache:\n    @staticmethod\n    def size():\n        return 1\n\n    def clear(self):\n        pass\n";
+        let output = read_symbol("cache.py", source, "Cache.size").await.unwrap();
+        assert_eq!(
+            output.content,
+            "    @staticmethod\n    def size():\n        return 1"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_unknown_symbol_and_unsupported_language() {
+        let result = read_symbol("server.go", GO_FIXTURE, "Stop").await;
+        assert!(
+            matches!(result, Err(PluginError::ExecutionFailed(message)) if message.contains("No symbol 'Stop'"))
+        );
+
+        let result = read_symbol("notes.txt", "fn main() {}", "main").await;
+        assert!(matches!(result, Err(PluginError::InvalidInput(_))));
+    }
+}
@@ -0,0 +1,218 @@
+use crate::{
+    ExecPlugin, ListDirectoryPlugin, ListKnowledgeSourcesPlugin, ReadFilePlugin, ReadSymbolPlugin,
+    SearchPlugin, WriteFilePlugin,
+};
+use nucleus_core::{Config, RagEngine};
+use nucleus_plugin::{PluginLoader, PluginRegistry, Result};
+use std::sync::Arc;
+
+/// Builds a registry holding the standard tools, set up from `config`.
+///
+/// The registry grants what `config.permission` allows, so tools needing
+/// more are listed as denied. File writes are confined to
+/// `permission.write_roots` and staged in `permission.write_staging_dir` when
+/// it is set, and tool call arguments are limited by
+/// `permission.max_argument_bytes` and `permission.tool_argument_limits`.
+/// With a knowledge base `engine`, its sources can be listed too.
+///
+/// The plugins named in `config.plugins` are then loaded from `loader`; an
+/// unknown name is an error. Tools in `permission.disabled_tools` stay
+/// registered but are disabled.
+pub async fn registry_from_config(
+    config: &Config,
+    loader: &PluginLoader,
+    engine: Option<Arc<RagEngine>>,
+) -> Result<PluginRegistry> {
+    let permission = &config.permission;
+    let mut registry = PluginRegistry::new(permission.granted());
+    if let Some(bytes) = permission.max_argument_bytes {
+        registry = registry.with_max_argument_bytes(bytes);
+    }
+    for (name, bytes) in &permission.tool_argument_limits {
+        registry = registry.with_tool_argument_limit(name, *bytes);
+    }
+
+    let mut write_file = WriteFilePlugin::new().with_write_roots(&permission.write_roots);
+    if let Some(dir) = &permission.write_staging_dir {
+        write_file = write_file.with_staging_dir(dir);
+    }
+
+    registry.register(ReadFilePlugin::new()).await;
+    registry.register(write_file).await;
+    registry.register(ListDirectoryPlugin::new()).await;
+    registry.register(ReadSymbolPlugin::new()).await;
+    registry.register(SearchPlugin::new()).await;
+    registry.register(ExecPlugin::new()).await;
+    if let Some(engine) = engine {
+        registry
+            .register(ListKnowledgeSourcesPlugin::new(engine))
+            .await;
+    }
+
+    loader.load(&config.plugins, &registry).await?;
+    for name in &permission.disabled_tools {
+        registry.disable(name);
+    }
+
+    Ok(registry)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use async_trait::async_trait;
+    use nucleus_plugin::{Permission, Plugin, PluginError, PluginOutput, ToolStatus};
+    use serde_json::{json, Value};
+
+    struct JiraPlugin;
+
+    #[async_trait]
+    impl Plugin for JiraPlugin {
+        fn name(&self) -> &str {
+            "jira"
+        }
+
+        fn description(&self) -> &str {
+            "Look up a ticket"
+        }
+
+        fn parameter_schema(&self) -> Value {
+            json!({})
+        }
+
+        fn required_permission(&self) -> Permission {
+            Permission::NONE
+        }
+
+        async fn execute(&self, _input: Value) -> nucleus_plugin::Result<PluginOutput> {
+            Ok(PluginOutput::new("NUC-1"))
+        }
+    }
+
+    fn loader() -> PluginLoader {
+        let mut loader = PluginLoader::new();
+        loader.register_factory("jira", || JiraPlugin);
+        loader
+    }
+
+    #[tokio::test]
+    async fn test_registry_applies_configured_permission() {
+        let project = tempfile::tempdir().unwrap();
+        let elsewhere = tempfile::tempdir().unwrap();
+        let mut config = Config::default();
+        config.permission.command = false;
+        config.permission.write_roots = vec![project.path().display().to_string()];
+
+        let registry = registry_from_config(&config, &loader(), None)
+            .await
+            .unwrap();
+
+        let exec = registry.tools().await;
+        let exec = exec.iter().find(|tool| tool.name == "exec").unwrap();
+        assert_eq!(exec.status, ToolStatus::Denied);
+
+        let inside = project.path().join("lib.rs");
+        registry
+            .execute("write_file", json!({ "path": inside, "content": "ok" }))
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read_to_string(&inside).unwrap(), "ok");
+
+        let outside = elsewhere.path().join("lib.rs");
+        let result = registry
+            .execute("write_file", json!({ "path": outside, "content": "no" }))
+            .await;
+        assert!(matches!(result, Err(PluginError::OutsideWriteRoots { .. })));
+        assert!(!outside.exists());
+    }
+
+    #[tokio::test]
+    async fn test_registry_stages_writes_in_configured_dir() {
+        let project = tempfile::tempdir().unwrap();
+        let staging = tempfile::tempdir().unwrap();
+        let mut config = serde_json::to_value(Config::default()).unwrap();
+        config["permission"]["write_staging_dir"] = json!(staging.path());
+        let path = project.path().join("config.yaml");
+        std::fs::write(&path, config.to_string()).unwrap();
+        let config = Config::load(&path).unwrap();
+
+        let registry = registry_from_config(&config, &loader(), None)
+            .await
+            .unwrap();
+
+        let target = project.path().join("lib.rs");
+        let output = registry
+            .execute("write_file", json!({ "path": target, "content": "ok" }))
+            .await
+            .unwrap();
+        let staged = output.metadata.unwrap()["staged"]
+            .as_str()
+            .unwrap()
+            .to_string();
+        assert!(staged.starts_with(&staging.path().display().to_string()));
+        assert_eq!(std::fs::read_to_string(staged).unwrap(), "ok");
+        assert!(!target.exists());
+    }
+
+    #[tokio::test]
+    async fn test_registry_applies_configured_argument_limits() {
+        let mut config = Config::default();
+        config.permission.max_argument_bytes = Some(16);
+        config
+            .permission
+            .tool_argument_limits
+            .insert("write_file".to_string(), 8);
+
+        let registry = registry_from_config(&config, &loader(), None)
+            .await
+            .unwrap();
+
+        let args = json!({ "path": "x".repeat(12) });
+        assert!(matches!(
+            registry.check_arguments("write_file", &args),
+            Err(PluginError::ArgumentTooLarge { limit: 8, .. })
+        ));
+        assert!(registry.check_arguments("read_file", &args).is_ok());
+        let args = json!({ "path": "x".repeat(17) });
+        assert!(registry.check_arguments("read_file", &args).is_err());
+    }
+
+    #[tokio::test]
+    async fn test_registry_disables_configured_tools() {
+        let mut config = Config::default().with_plugins(vec!["jira".into()]);
+        config.permission.disabled_tools = vec!["exec".to_string(), "jira".to_string()];
+
+        let registry = registry_from_config(&config, &loader(), None)
+            .await
+            .unwrap();
+
+        let tools = registry.tools().await;
+        for name in ["exec", "jira"] {
+            let tool = tools.iter().find(|tool| tool.name == name).unwrap();
+            assert_eq!(tool.status, ToolStatus::Disabled);
+        }
+        assert!(registry.execute("jira", json!({})).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_registry_loads_configured_plugins() {
+        let config = Config::default().with_plugins(vec!["jira".into()]);
+
+        let registry = registry_from_config(&config, &loader(), None)
+            .await
+            .unwrap();
+
+        let output = registry.execute("jira", json!({})).await.unwrap();
+        assert_eq!(output.content, "NUC-1");
+        assert!(registry.get("read_file").is_some());
+    }
+
+    #[tokio::test]
+    async fn test_registry_rejects_unknown_plugin() {
+        let config = Config::default().with_plugins(vec!["missing".into()]);
+
+        let result = registry_from_config(&config, &PluginLoader::new(), None).await;
+
+        assert!(result.is_err());
+    }
+}